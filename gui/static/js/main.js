@@ -891,7 +891,8 @@ $(function() {
                 return d.Type;
             }).each(function(d) {
                 var bbox = this.getBBox();
-                d.width = (d.TypeInfo.InRoutes.length * ROUTE + d.TypeInfo.InRoutes.length * ROUTE_SPACE)
+                var routes = Math.max(d.TypeInfo.InRoutes.length, d.TypeInfo.OutRoutes.length);
+                d.width = (routes * ROUTE + routes * ROUTE_SPACE)
                 d.width = (d.width > bbox.width ? d.width : bbox.width + 30);
                 d.height = (d.height > bbox.height ? d.height : bbox.height + 5);
             }).attr('dy', function(d) {
@@ -1157,11 +1158,12 @@ $(function() {
     // generates paths fo all links
     function updateLinks() {
         link.attr('d', function(d) {
+            var fromRoute = Math.max(d.from.TypeInfo.OutRoutes.indexOf(d.FromRoute), 0);
             return lineStyle([{
-                x: d.from.Position.X + HALF_ROUTE,
+                x: d.from.Position.X + (fromRoute * ROUTE_SPACE) + HALF_ROUTE,
                 y: (d.from.Position.Y + d.from.height * 2) - HALF_ROUTE
             }, {
-                x: d.from.Position.X + HALF_ROUTE,
+                x: d.from.Position.X + (fromRoute * ROUTE_SPACE) + HALF_ROUTE,
                 y: (d.from.Position.Y + d.from.height * 2) + ROUTE_SPACE
             }, {
                 x: d.to.Position.X + (d.to.TypeInfo.InRoutes.indexOf(d.ToRoute) * ROUTE_SPACE) + HALF_ROUTE,
@@ -1195,16 +1197,19 @@ $(function() {
 
         var connReq = {
             'FromId': null,
+            'FromRoute': null,
             'ToId': null,
             'ToRoute': null
         };
 
         if (newConn.startType == 'out') {
             connReq.FromId = newConn.start.Id;
+            connReq.FromRoute = newConn.startRoute;
             connReq.ToId = block.Id;
             connReq.ToRoute = route;
         } else {
             connReq.FromId = block.Id;
+            connReq.FromRoute = route;
             connReq.ToId = newConn.start.Id;
             connReq.ToRoute = newConn.startRoute;
         }
@@ -1223,10 +1228,10 @@ $(function() {
         newConnection.attr('d', function() {
             return lineStyle(newConn.startType == 'out' ?
                 [{
-                    x: newConn.start.Position.X + HALF_ROUTE,
+                    x: newConn.start.Position.X + (newConn.start.TypeInfo.OutRoutes.indexOf(newConn.startRoute) * ROUTE_SPACE) + HALF_ROUTE,
                     y: (newConn.start.Position.Y + newConn.start.height * 2) - HALF_ROUTE
                 }, {
-                    x: newConn.start.Position.X + HALF_ROUTE,
+                    x: newConn.start.Position.X + (newConn.start.TypeInfo.OutRoutes.indexOf(newConn.startRoute) * ROUTE_SPACE) + HALF_ROUTE,
                     y: (newConn.start.Position.Y + newConn.start.height * 2) + ROUTE_SPACE
                 }, {
                     x: mouse.x,
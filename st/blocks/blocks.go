@@ -21,8 +21,9 @@ func (c MsgChan) MarshalJSON() ([]byte, error) {
 }
 
 type AddChanMsg struct {
-	Route   string
-	Channel chan *Msg
+	Route     string
+	Channel   chan *Msg
+	FromRoute string // the out route to listen to, "out" if empty
 }
 
 type QueryMsg struct {
@@ -65,6 +66,8 @@ type Block struct {
 	queryRoutes      map[string]chan MsgChan
 	queryParamRoutes map[string]chan Query
 	broadcast        MsgChan
+	routed           chan *Msg
+	outRoutes        []string
 	quit             MsgChan
 	doesBroadcast    bool
 	BlockChans
@@ -87,6 +90,7 @@ type BlockInterface interface {
 	Build(BlockChans)
 	Quit() MsgChan
 	Broadcast() MsgChan
+	OutRoutes(...string) chan *Msg
 	InRoute(string) MsgChan
 	QueryRoute(string) chan MsgChan
 	QueryParamRoute(string) chan Query
@@ -115,6 +119,8 @@ func (b *Block) Build(c BlockChans) {
 
 	// broadcast channel
 	b.broadcast = make(MsgChan, 10) // necessary to stop locking...
+	b.routed = make(chan *Msg, 10)
+	b.outRoutes = []string{}
 
 	// quit chan
 	b.quit = make(MsgChan)
@@ -150,6 +156,14 @@ func (b *Block) Broadcast() MsgChan {
 	return b.broadcast
 }
 
+// OutRoutes declares out routes besides the broadcast out route. Messages
+// sent on the returned channel only go to connections from the route named in
+// their Route.
+func (b *Block) OutRoutes(routeNames ...string) chan *Msg {
+	b.outRoutes = append(b.outRoutes, routeNames...)
+	return b.routed
+}
+
 func (b *Block) Quit() MsgChan {
 	return b.quit
 }
@@ -179,6 +193,7 @@ func (b *Block) GetDef() *BlockDef {
 	if b.doesBroadcast {
 		outRoutes = []string{"out"}
 	}
+	outRoutes = append(outRoutes, b.outRoutes...)
 
 	return &BlockDef{
 		Type:             b.Kind,
@@ -205,6 +220,7 @@ func (b *Block) CleanUp() {
 	defer close(b.ErrChan)
 	defer close(b.QuitChan)
 	defer close(b.broadcast)
+	defer close(b.routed)
 	defer close(b.IdChan)
 
 	go func(id string) {
@@ -242,6 +258,7 @@ func BlockRoutine(bi BlockInterface) {
 	dropTicker.Stop()
 
 	outChans := make(map[string]chan *Msg)
+	fromRoutes := make(map[string]string)
 	b := bi.GetBlock()
 	bi.Setup()
 	go bi.Run()
@@ -341,15 +358,33 @@ func BlockRoutine(bi BlockInterface) {
 			b.SetId(id)
 		case msg := <-b.AddChan:
 			outChans[msg.Route] = msg.Channel
+			fromRoutes[msg.Route] = msg.FromRoute
+			if msg.FromRoute == "" {
+				fromRoutes[msg.Route] = "out"
+			}
 		case msg := <-b.DelChan:
 			delete(outChans, msg.Route)
+			delete(fromRoutes, msg.Route)
 		case msg := <-b.broadcast:
-			for _, v := range outChans {
+			for k, v := range outChans {
+				if fromRoutes[k] != "out" {
+					continue
+				}
 				v <- &Msg{
 					Msg:   msg,
 					Route: "",
 				}
 			}
+		case msg := <-b.routed:
+			for k, v := range outChans {
+				if fromRoutes[k] != msg.Route {
+					continue
+				}
+				v <- &Msg{
+					Msg:   msg.Msg,
+					Route: "",
+				}
+			}
 		case <-b.QuitChan:
 			b.quit <- true
 			b.CleanUp()
@@ -0,0 +1,498 @@
+package library
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// scales the median absolute deviation so that it estimates the standard
+// deviation of normally distributed data
+const madScale = 1.4826
+
+// specify those channels we're going to use to communicate with streamtools
+type Anomaly struct {
+	blocks.Block
+	queryrule  chan blocks.MsgChan
+	querystate chan blocks.MsgChan
+	inrule     blocks.MsgChan
+	in         blocks.MsgChan
+	out        blocks.MsgChan
+	quit       blocks.MsgChan
+}
+
+// anomalyState holds everything we know about the values seen for one key.
+type anomalyState struct {
+	n int
+
+	// mad: the values seen over the window
+	pq *PriorityQueue
+
+	// ewma: exponentially weighted mean and variance
+	mean     float64
+	variance float64
+
+	// holtwinters: level, trend and one seasonal term per step of the season,
+	// along with the smoothed variance of the forecast error
+	level    float64
+	trend    float64
+	seasonal []float64
+	residual float64
+	warmup   []float64
+}
+
+// anomalyScore describes where a value sits relative to what we expected.
+type anomalyScore struct {
+	ok       bool
+	score    float64
+	expected float64
+	spread   float64
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewAnomaly() blocks.BlockInterface {
+	return &Anomaly{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Anomaly) Setup() {
+	b.Kind = "Stats"
+	b.Desc = "emits messages whose value at Path is anomalous, scored with an EWMA, median absolute deviation or Holt-Winters model"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querystate = b.QueryRoute("state")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// groupKey turns the value found at a KeyPath into a string we can group
+// messages on.
+func groupKey(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+	return "", errors.New("key must be a string, number or bool")
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// scoreMAD scores a value against the median and median absolute deviation of
+// the values currently in the window.
+func (s *anomalyState) scoreMAD(val float64) anomalyScore {
+	values := make([]float64, 0, len(*s.pq))
+	for _, pqMsg := range *s.pq {
+		if v, ok := pqMsg.val.(float64); ok {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return anomalyScore{}
+	}
+	m := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - m)
+	}
+	spread := madScale * median(deviations)
+	if spread == 0 {
+		return anomalyScore{expected: m}
+	}
+	return anomalyScore{
+		ok:       true,
+		score:    (val - m) / spread,
+		expected: m,
+		spread:   spread,
+	}
+}
+
+// updateMAD adds a value to the window.
+func (s *anomalyState) updateMAD(val float64) {
+	heap.Push(s.pq, &PQMessage{
+		val: val,
+		t:   time.Now(),
+	})
+}
+
+// scoreEWMA scores a value against the exponentially weighted mean and
+// variance.
+func (s *anomalyState) scoreEWMA(val float64) anomalyScore {
+	if s.n == 0 || s.variance == 0 {
+		return anomalyScore{expected: s.mean}
+	}
+	spread := math.Sqrt(s.variance)
+	return anomalyScore{
+		ok:       true,
+		score:    (val - s.mean) / spread,
+		expected: s.mean,
+		spread:   spread,
+	}
+}
+
+func (s *anomalyState) updateEWMA(val, alpha float64) {
+	if s.n == 0 {
+		s.mean = val
+		s.variance = 0
+		return
+	}
+	diff := val - s.mean
+	incr := alpha * diff
+	s.mean += incr
+	s.variance = (1 - alpha) * (s.variance + diff*incr)
+}
+
+// scoreHoltWinters scores a value against the one step ahead forecast of an
+// additive Holt-Winters model.
+func (s *anomalyState) scoreHoltWinters(val float64) anomalyScore {
+	if s.seasonal == nil {
+		return anomalyScore{}
+	}
+	expected := s.level + s.trend + s.seasonal[s.n%len(s.seasonal)]
+	if s.residual == 0 {
+		return anomalyScore{expected: expected}
+	}
+	spread := math.Sqrt(s.residual)
+	return anomalyScore{
+		ok:       true,
+		score:    (val - expected) / spread,
+		expected: expected,
+		spread:   spread,
+	}
+}
+
+func (s *anomalyState) updateHoltWinters(val, alpha, beta, gamma float64, season int) {
+	// we need a full season of values before we can initialise the model
+	if s.seasonal == nil {
+		s.warmup = append(s.warmup, val)
+		if len(s.warmup) < season {
+			return
+		}
+		var sum float64
+		for _, v := range s.warmup {
+			sum += v
+		}
+		s.level = sum / float64(season)
+		s.trend = 0
+		s.seasonal = make([]float64, season)
+		for i, v := range s.warmup {
+			s.seasonal[i] = v - s.level
+		}
+		s.warmup = nil
+		return
+	}
+
+	i := s.n % season
+	e := val - (s.level + s.trend + s.seasonal[i])
+	lastLevel := s.level
+	s.level = alpha*(val-s.seasonal[i]) + (1-alpha)*(s.level+s.trend)
+	s.trend = beta*(s.level-lastLevel) + (1-beta)*s.trend
+	s.seasonal[i] = gamma*(val-s.level) + (1-gamma)*s.seasonal[i]
+	s.residual = alpha*e*e + (1-alpha)*s.residual
+}
+
+// score scores a value using the given method without updating the model.
+func (s *anomalyState) score(method string, val float64) anomalyScore {
+	switch method {
+	case "mad":
+		return s.scoreMAD(val)
+	case "holtwinters":
+		return s.scoreHoltWinters(val)
+	}
+	return s.scoreEWMA(val)
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Anomaly) Run() {
+	var path, keyPath, windowString string
+	var tree, keyTree *jee.TokenTree
+
+	method := "ewma"
+	threshold := 3.0
+	alpha := 0.3
+	beta := 0.1
+	gamma := 0.1
+	season := 24
+	minSamples := 10
+	window := time.Duration(0)
+	waitTimer := time.NewTimer(100 * time.Millisecond)
+
+	states := map[string]*anomalyState{}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			// set a parameter of the block
+			rule, ok := ruleI.(map[string]interface{})
+			if !ok {
+				b.Error(errors.New("could not assert rule to map"))
+				continue
+			}
+			tmpPath, err := util.ParseString(rule, "Path")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTree, err := util.BuildTokenTree(tmpPath)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			tmpKeyPath := ""
+			var tmpKeyTree *jee.TokenTree
+			if util.KeyExists(rule, "KeyPath") {
+				tmpKeyPath, err = util.ParseString(rule, "KeyPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpKeyPath != "" {
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			tmpMethod, err := util.ParseString(rule, "Method")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMethod != "ewma" && tmpMethod != "mad" && tmpMethod != "holtwinters" {
+				b.Error(errors.New("Method must be one of ewma, mad or holtwinters"))
+				continue
+			}
+
+			tmpWindowString, err := util.ParseString(rule, "Window")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpWindow, err := time.ParseDuration(tmpWindowString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMethod == "mad" && tmpWindow <= 0 {
+				b.Error(errors.New("Window must be positive when using mad"))
+				continue
+			}
+
+			tmpThreshold, err := util.ParseFloat(rule, "Threshold")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpThreshold <= 0 {
+				b.Error(errors.New("Threshold must be positive"))
+				continue
+			}
+
+			tmpMinSamples, err := util.ParseInt(rule, "MinSamples")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			tmpAlpha, tmpBeta, tmpGamma, tmpSeason := alpha, beta, gamma, season
+			if util.KeyExists(rule, "Alpha") {
+				tmpAlpha, err = util.ParseFloat(rule, "Alpha")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if util.KeyExists(rule, "Beta") {
+				tmpBeta, err = util.ParseFloat(rule, "Beta")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if util.KeyExists(rule, "Gamma") {
+				tmpGamma, err = util.ParseFloat(rule, "Gamma")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if util.KeyExists(rule, "Season") {
+				tmpSeason, err = util.ParseInt(rule, "Season")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpAlpha <= 0 || tmpAlpha > 1 || tmpBeta < 0 || tmpBeta > 1 || tmpGamma < 0 || tmpGamma > 1 {
+				b.Error(errors.New("Alpha, Beta and Gamma must be between 0 and 1"))
+				continue
+			}
+			if tmpMethod == "holtwinters" && tmpSeason < 1 {
+				b.Error(errors.New("Season must be at least 1 when using holtwinters"))
+				continue
+			}
+
+			// a new model means our old state no longer applies
+			if tmpMethod != method || tmpKeyPath != keyPath || tmpSeason != season {
+				states = map[string]*anomalyState{}
+			}
+
+			path, tree = tmpPath, tmpTree
+			keyPath, keyTree = tmpKeyPath, tmpKeyTree
+			method = tmpMethod
+			windowString, window = tmpWindowString, tmpWindow
+			threshold = tmpThreshold
+			minSamples = tmpMinSamples
+			alpha, beta, gamma, season = tmpAlpha, tmpBeta, tmpGamma, tmpSeason
+
+		case <-b.quit:
+			// quit the block
+			return
+		case msg := <-b.in:
+			// deal with inbound data
+			if tree == nil {
+				break
+			}
+			v, err := jee.Eval(tree, msg)
+			if err != nil {
+				b.Error(err)
+				break
+			}
+			val, ok := v.(float64)
+			if !ok {
+				b.Error(errors.New("trying to score a non-float for anomalies"))
+				break
+			}
+
+			key := ""
+			if keyTree != nil {
+				k, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				key, err = groupKey(k)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+
+			state, ok := states[key]
+			if !ok {
+				state = &anomalyState{
+					pq: &PriorityQueue{},
+				}
+				heap.Init(state.pq)
+				states[key] = state
+			}
+
+			s := state.score(method, val)
+			switch method {
+			case "ewma":
+				state.updateEWMA(val, alpha)
+			case "mad":
+				state.updateMAD(val)
+			case "holtwinters":
+				state.updateHoltWinters(val, alpha, beta, gamma, season)
+			}
+			state.n++
+
+			if !s.ok || state.n <= minSamples || math.Abs(s.score) <= threshold {
+				break
+			}
+
+			b.out <- map[string]interface{}{
+				"Key":      key,
+				"Value":    val,
+				"Score":    s.score,
+				"Expected": s.expected,
+				"Lower":    s.expected - threshold*s.spread,
+				"Upper":    s.expected + threshold*s.spread,
+				"Msg":      msg,
+			}
+		case c := <-b.querystate:
+			out := map[string]interface{}{}
+			for key, state := range states {
+				s := state.score(method, 0)
+				out[key] = map[string]interface{}{
+					"Count":    float64(state.n),
+					"Expected": s.expected,
+					"Lower":    s.expected - threshold*s.spread,
+					"Upper":    s.expected + threshold*s.spread,
+				}
+			}
+			c <- map[string]interface{}{
+				"State": out,
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Path":       path,
+				"KeyPath":    keyPath,
+				"Method":     method,
+				"Window":     windowString,
+				"Threshold":  threshold,
+				"MinSamples": float64(minSamples),
+				"Alpha":      alpha,
+				"Beta":       beta,
+				"Gamma":      gamma,
+				"Season":     float64(season),
+			}
+		case <-waitTimer.C:
+		}
+
+		// only the mad method keeps a window of values around
+		if method != "mad" {
+			waitTimer.Reset(500 * time.Millisecond)
+			continue
+		}
+		// wake up again when the soonest value across all keys leaves the
+		// window, or in a little while if there's nothing queued
+		wait := time.Duration(500) * time.Millisecond
+		for key, state := range states {
+			for {
+				pqMsg, diff := state.pq.PeekAndShift(time.Now(), window)
+				if pqMsg == nil {
+					// either the queue is empty, or it's not time to emit
+					if diff != 0 && diff < wait {
+						wait = diff
+					}
+					break
+				}
+			}
+			if state.pq.Len() == 0 {
+				delete(states, key)
+			}
+		}
+		waitTimer.Reset(wait)
+	}
+}
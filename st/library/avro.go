@@ -0,0 +1,808 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// avroMagic starts every Avro object container file.
+const avroMagic = "Obj\x01"
+
+// avroSchema is a parsed Avro schema.
+type avroSchema struct {
+	Type     string
+	Name     string
+	Fields   []avroField
+	Items    *avroSchema
+	Values   *avroSchema
+	Branches []*avroSchema
+	Symbols  []string
+	Size     int
+}
+
+type avroField struct {
+	Name       string
+	Type       *avroSchema
+	Default    interface{}
+	HasDefault bool
+}
+
+var avroNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// parseAvroSchema builds a schema from its JSON form.
+func parseAvroSchema(schemaI interface{}) (*avroSchema, error) {
+	return parseAvroType(schemaI, "", make(map[string]*avroSchema))
+}
+
+func parseAvroType(t interface{}, namespace string, named map[string]*avroSchema) (*avroSchema, error) {
+	switch v := t.(type) {
+	case string:
+		switch v {
+		case "null", "boolean", "int", "long", "float", "double", "bytes", "string":
+			return &avroSchema{Type: v}, nil
+		}
+		if s, ok := named[v]; ok {
+			return s, nil
+		}
+		if s, ok := named[namespace+"."+v]; ok {
+			return s, nil
+		}
+		return nil, errors.New("unknown Avro type " + v)
+
+	case []interface{}:
+		s := &avroSchema{Type: "union"}
+		for _, branchI := range v {
+			branch, err := parseAvroType(branchI, namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			if branch.Type == "union" {
+				return nil, errors.New("Avro unions can't contain unions")
+			}
+			s.Branches = append(s.Branches, branch)
+		}
+		return s, nil
+
+	case map[string]interface{}:
+		typeString, ok := v["type"].(string)
+		if !ok {
+			return parseAvroType(v["type"], namespace, named)
+		}
+		switch typeString {
+		case "record", "error", "enum", "fixed":
+			name, ok := v["name"].(string)
+			if !ok || name == "" {
+				return nil, errors.New("Avro " + typeString + "s must have a name")
+			}
+			if ns, ok := v["namespace"].(string); ok {
+				namespace = ns
+			}
+			if !strings.Contains(name, ".") && namespace != "" {
+				name = namespace + "." + name
+			}
+			if i := strings.LastIndex(name, "."); i != -1 {
+				namespace = name[:i]
+			}
+			s := &avroSchema{Type: typeString, Name: name}
+			if typeString == "error" {
+				s.Type = "record"
+			}
+			named[name] = s
+
+			switch s.Type {
+			case "record":
+				fieldsI, ok := v["fields"].([]interface{})
+				if !ok {
+					return nil, errors.New("Avro records must have a list of fields")
+				}
+				for _, fieldI := range fieldsI {
+					f, ok := fieldI.(map[string]interface{})
+					if !ok {
+						return nil, errors.New("Avro fields must be objects")
+					}
+					fieldName, ok := f["name"].(string)
+					if !ok {
+						return nil, errors.New("Avro fields must have a name")
+					}
+					fieldType, err := parseAvroType(f["type"], namespace, named)
+					if err != nil {
+						return nil, err
+					}
+					field := avroField{Name: fieldName, Type: fieldType}
+					field.Default, field.HasDefault = f["default"]
+					s.Fields = append(s.Fields, field)
+				}
+			case "enum":
+				symbolsI, ok := v["symbols"].([]interface{})
+				if !ok {
+					return nil, errors.New("Avro enums must have a list of symbols")
+				}
+				for _, symbolI := range symbolsI {
+					symbol, ok := symbolI.(string)
+					if !ok {
+						return nil, errors.New("Avro enum symbols must be strings")
+					}
+					s.Symbols = append(s.Symbols, symbol)
+				}
+			case "fixed":
+				size, ok := v["size"].(float64)
+				if !ok || size < 0 {
+					return nil, errors.New("Avro fixed types must have a size")
+				}
+				s.Size = int(size)
+			}
+			return s, nil
+
+		case "array":
+			items, err := parseAvroType(v["items"], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			return &avroSchema{Type: "array", Items: items}, nil
+
+		case "map":
+			values, err := parseAvroType(v["values"], namespace, named)
+			if err != nil {
+				return nil, err
+			}
+			return &avroSchema{Type: "map", Values: values}, nil
+		}
+		// primitives can be written as objects, often to add a logicalType
+		return parseAvroType(typeString, namespace, named)
+	}
+	return nil, errors.New("Avro schemas must be a string, an array or an object")
+}
+
+// numberValue reads any of the number types messages might hold.
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// matches reports whether v can be written as s, which is how we pick the
+// branch of a union to write.
+func (s *avroSchema) matches(v interface{}) bool {
+	if n, ok := numberValue(v); ok {
+		switch s.Type {
+		case "int", "long":
+			return n == math.Trunc(n)
+		case "float", "double":
+			return true
+		}
+		return false
+	}
+	switch value := v.(type) {
+	case nil:
+		return s.Type == "null"
+	case bool:
+		return s.Type == "boolean"
+	case string:
+		switch s.Type {
+		case "string", "bytes":
+			return true
+		case "fixed":
+			return len(value) == s.Size
+		case "enum":
+			for _, symbol := range s.Symbols {
+				if symbol == value {
+					return true
+				}
+			}
+		}
+	case []byte:
+		return s.Type == "bytes" || (s.Type == "fixed" && len(value) == s.Size)
+	case []interface{}:
+		return s.Type == "array"
+	case map[string]interface{}:
+		return s.Type == "record" || s.Type == "map"
+	}
+	return false
+}
+
+func writeAvroLong(buf *bytes.Buffer, n int64) {
+	var b [binary.MaxVarintLen64]byte
+	// Avro longs are zig-zag varints, which is what PutVarint writes
+	buf.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+func writeAvroBytes(buf *bytes.Buffer, b []byte) {
+	writeAvroLong(buf, int64(len(b)))
+	buf.Write(b)
+}
+
+// encode writes v to buf using Avro's binary encoding.
+func (s *avroSchema) encode(buf *bytes.Buffer, v interface{}) error {
+	switch s.Type {
+	case "null":
+		if v != nil {
+			return errors.New("expected null")
+		}
+	case "boolean":
+		b, ok := v.(bool)
+		if !ok {
+			return errors.New("expected a boolean")
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case "int", "long":
+		n, ok := numberValue(v)
+		if !ok {
+			return errors.New("expected a number")
+		}
+		writeAvroLong(buf, int64(n))
+	case "float":
+		n, ok := numberValue(v)
+		if !ok {
+			return errors.New("expected a number")
+		}
+		binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(n)))
+	case "double":
+		n, ok := numberValue(v)
+		if !ok {
+			return errors.New("expected a number")
+		}
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(n))
+	case "bytes", "string", "fixed":
+		var b []byte
+		switch value := v.(type) {
+		case string:
+			b = []byte(value)
+		case []byte:
+			b = value
+		default:
+			return errors.New("expected a string")
+		}
+		if s.Type == "fixed" {
+			if len(b) != s.Size {
+				return errors.New("wrong length for fixed type " + s.Name)
+			}
+			buf.Write(b)
+			break
+		}
+		writeAvroBytes(buf, b)
+	case "enum":
+		symbol, ok := v.(string)
+		if !ok {
+			return errors.New("expected a string")
+		}
+		for i, sym := range s.Symbols {
+			if sym == symbol {
+				writeAvroLong(buf, int64(i))
+				return nil
+			}
+		}
+		return errors.New(symbol + " is not a symbol of " + s.Name)
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return errors.New("expected an array")
+		}
+		if len(items) > 0 {
+			writeAvroLong(buf, int64(len(items)))
+			for _, item := range items {
+				if err := s.Items.encode(buf, item); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buf, 0)
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("expected an object")
+		}
+		if len(m) > 0 {
+			writeAvroLong(buf, int64(len(m)))
+			for k, value := range m {
+				writeAvroBytes(buf, []byte(k))
+				if err := s.Values.encode(buf, value); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buf, 0)
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New("expected an object")
+		}
+		for _, field := range s.Fields {
+			value, ok := m[field.Name]
+			if !ok && field.HasDefault {
+				value = field.Default
+			}
+			if err := field.Type.encode(buf, value); err != nil {
+				return errors.New(field.Name + ": " + err.Error())
+			}
+		}
+	case "union":
+		for i, branch := range s.Branches {
+			if branch.matches(v) {
+				writeAvroLong(buf, int64(i))
+				return branch.encode(buf, v)
+			}
+		}
+		return errors.New("value doesn't match any type in the union")
+	}
+	return nil
+}
+
+// avroByteReader is what we decode from.
+type avroByteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readAvroBytes reads a length followed by that many bytes. Lengths inside a
+// block are checked against what's left of it, so that a corrupt file can't
+// have us allocate more than it holds.
+func readAvroBytes(r avroByteReader) ([]byte, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("negative length in Avro data")
+	}
+	if block, ok := r.(*bytes.Reader); ok && n > int64(block.Len()) {
+		return nil, errors.New("length in Avro data is longer than its block")
+	}
+	return readLength(r, n)
+}
+
+// readLength reads n bytes, growing the buffer as they arrive rather than
+// allocating n up front, as n comes from the file and may be nonsense.
+func readLength(r io.Reader, n int64) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, r, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// decode reads a value written in Avro's binary encoding. Numbers become
+// float64s and bytes become strings, as they would coming from JSON.
+func (s *avroSchema) decode(r avroByteReader) (interface{}, error) {
+	switch s.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.ReadByte()
+		return b != 0, err
+	case "int", "long":
+		n, err := binary.ReadVarint(r)
+		return float64(n), err
+	case "float":
+		var bits uint32
+		err := binary.Read(r, binary.LittleEndian, &bits)
+		return float64(math.Float32frombits(bits)), err
+	case "double":
+		var bits uint64
+		err := binary.Read(r, binary.LittleEndian, &bits)
+		return math.Float64frombits(bits), err
+	case "bytes", "string":
+		b, err := readAvroBytes(r)
+		return string(b), err
+	case "fixed":
+		b := make([]byte, s.Size)
+		_, err := io.ReadFull(r, b)
+		return string(b), err
+	case "enum":
+		i, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.Symbols) {
+			return nil, errors.New("bad enum index in Avro data")
+		}
+		return s.Symbols[i], nil
+	case "array", "map":
+		var items []interface{}
+		m := make(map[string]interface{})
+		for {
+			count, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			if count == 0 {
+				break
+			}
+			if count < 0 {
+				// negative counts are followed by the block's size in bytes
+				count = -count
+				if _, err := binary.ReadVarint(r); err != nil {
+					return nil, err
+				}
+			}
+			for i := int64(0); i < count; i++ {
+				if s.Type == "array" {
+					item, err := s.Items.decode(r)
+					if err != nil {
+						return nil, err
+					}
+					items = append(items, item)
+					continue
+				}
+				k, err := readAvroBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				m[string(k)], err = s.Values.decode(r)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if s.Type == "map" {
+			return m, nil
+		}
+		if items == nil {
+			items = []interface{}{}
+		}
+		return items, nil
+	case "record":
+		m := make(map[string]interface{})
+		for _, field := range s.Fields {
+			value, err := field.Type.decode(r)
+			if err != nil {
+				return nil, err
+			}
+			m[field.Name] = value
+		}
+		return m, nil
+	case "union":
+		i, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || int(i) >= len(s.Branches) {
+			return nil, errors.New("bad union index in Avro data")
+		}
+		return s.Branches[i].decode(r)
+	}
+	return nil, errors.New("unknown Avro type " + s.Type)
+}
+
+// avroInference accumulates the types seen at one place in a set of
+// messages, from which we can write a schema that fits them all.
+type avroInference struct {
+	null    bool
+	boolean bool
+	long    bool
+	double  bool
+	str     bool
+	items   *avroInference
+	fields  map[string]*avroInference
+	objects int
+	// how many of the enclosing objects had this field
+	present int
+}
+
+func (a *avroInference) add(v interface{}) error {
+	if n, ok := numberValue(v); ok {
+		if n == math.Trunc(n) {
+			a.long = true
+		} else {
+			a.double = true
+		}
+		return nil
+	}
+	switch value := v.(type) {
+	case nil:
+		a.null = true
+	case bool:
+		a.boolean = true
+	case string:
+		a.str = true
+	case []interface{}:
+		if a.items == nil {
+			a.items = &avroInference{}
+		}
+		for _, item := range value {
+			if err := a.items.add(item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		if a.fields == nil {
+			a.fields = make(map[string]*avroInference)
+		}
+		a.objects++
+		for k, fieldValue := range value {
+			if !avroNameRegexp.MatchString(k) {
+				return errors.New("can't infer an Avro schema for the field " + k + ", Avro names must be letters, numbers and underscores")
+			}
+			f, ok := a.fields[k]
+			if !ok {
+				f = &avroInference{}
+				a.fields[k] = f
+			}
+			f.present++
+			if err := f.add(fieldValue); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("can't infer an Avro schema for this message")
+	}
+	return nil
+}
+
+// schema writes out the JSON form of the inferred schema. Records are named
+// after where they are in the message.
+func (a *avroInference) schema(name string, nullable bool) interface{} {
+	var branches []interface{}
+	if a.null || nullable {
+		// null goes first so that it can be the default
+		branches = append(branches, "null")
+	}
+	if a.boolean {
+		branches = append(branches, "boolean")
+	}
+	if a.double {
+		branches = append(branches, "double")
+	} else if a.long {
+		branches = append(branches, "long")
+	}
+	if a.str {
+		branches = append(branches, "string")
+	}
+	if a.items != nil {
+		branches = append(branches, map[string]interface{}{
+			"type":  "array",
+			"items": a.items.schema(name+"_item", false),
+		})
+	}
+	if a.fields != nil {
+		keys := make([]string, 0, len(a.fields))
+		for k := range a.fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]interface{}, len(keys))
+		for i, k := range keys {
+			f := a.fields[k]
+			// fields missing from some messages can be null
+			optional := f.present < a.objects
+			field := map[string]interface{}{
+				"name": k,
+				"type": f.schema(name+"_"+k, optional),
+			}
+			if optional || f.null {
+				field["default"] = nil
+			}
+			fields[i] = field
+		}
+		branches = append(branches, map[string]interface{}{
+			"type":   "record",
+			"name":   name,
+			"fields": fields,
+		})
+	}
+	switch len(branches) {
+	case 0:
+		return "null"
+	case 1:
+		return branches[0]
+	}
+	return branches
+}
+
+// inferAvroSchema writes a schema that fits every one of msgs.
+func inferAvroSchema(msgs []interface{}) ([]byte, *avroSchema, error) {
+	inference := &avroInference{}
+	for _, msg := range msgs {
+		if err := inference.add(msg); err != nil {
+			return nil, nil, err
+		}
+	}
+	schemaJSON, err := json.Marshal(inference.schema("Message", false))
+	if err != nil {
+		return nil, nil, err
+	}
+	var schemaI interface{}
+	json.Unmarshal(schemaJSON, &schemaI)
+	schema, err := parseAvroSchema(schemaI)
+	return schemaJSON, schema, err
+}
+
+// avroContainerWriter writes an Avro object container file, buffering
+// records into blocks.
+type avroContainerWriter struct {
+	w      io.Writer
+	schema *avroSchema
+	codec  string
+	sync   []byte
+	block  bytes.Buffer
+	count  int
+}
+
+func newAvroContainerWriter(w io.Writer, schemaJSON []byte, schema *avroSchema, codec string) (*avroContainerWriter, error) {
+	if codec != "null" && codec != "deflate" {
+		return nil, errors.New("Avro codec must be null or deflate")
+	}
+	a := &avroContainerWriter{
+		w:      w,
+		schema: schema,
+		codec:  codec,
+		sync:   make([]byte, 16),
+	}
+	if _, err := rand.Read(a.sync); err != nil {
+		return nil, err
+	}
+
+	var header bytes.Buffer
+	header.WriteString(avroMagic)
+	// the file's metadata is a map of bytes
+	writeAvroLong(&header, 2)
+	writeAvroBytes(&header, []byte("avro.schema"))
+	writeAvroBytes(&header, schemaJSON)
+	writeAvroBytes(&header, []byte("avro.codec"))
+	writeAvroBytes(&header, []byte(codec))
+	writeAvroLong(&header, 0)
+	header.Write(a.sync)
+	_, err := w.Write(header.Bytes())
+	return a, err
+}
+
+// Append adds a record to the current block.
+func (a *avroContainerWriter) Append(v interface{}) error {
+	var record bytes.Buffer
+	if err := a.schema.encode(&record, v); err != nil {
+		return err
+	}
+	a.block.Write(record.Bytes())
+	a.count++
+	return nil
+}
+
+// Flush writes out the current block.
+func (a *avroContainerWriter) Flush() error {
+	if a.count == 0 {
+		return nil
+	}
+	data := a.block.Bytes()
+	if a.codec == "deflate" {
+		var compressed bytes.Buffer
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		fw.Write(data)
+		fw.Close()
+		data = compressed.Bytes()
+	}
+	var block bytes.Buffer
+	writeAvroLong(&block, int64(a.count))
+	writeAvroBytes(&block, data)
+	block.Write(a.sync)
+	a.block.Reset()
+	a.count = 0
+	_, err := a.w.Write(block.Bytes())
+	return err
+}
+
+// avroContainerReader reads records from an Avro object container file.
+type avroContainerReader struct {
+	r          *bufio.Reader
+	schema     *avroSchema
+	schemaJSON []byte
+	codec      string
+	sync       []byte
+	block      *bytes.Reader
+	remaining  int64
+}
+
+func newAvroContainerReader(r io.Reader) (*avroContainerReader, error) {
+	a := &avroContainerReader{
+		r:     bufio.NewReader(r),
+		codec: "null",
+		sync:  make([]byte, 16),
+	}
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(a.r, magic); err != nil || string(magic) != avroMagic {
+		return nil, errors.New("not an Avro object container file")
+	}
+	for {
+		count, err := binary.ReadVarint(a.r)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			break
+		}
+		if count < 0 {
+			count = -count
+			if _, err := binary.ReadVarint(a.r); err != nil {
+				return nil, err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			k, err := readAvroBytes(a.r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readAvroBytes(a.r)
+			if err != nil {
+				return nil, err
+			}
+			switch string(k) {
+			case "avro.schema":
+				a.schemaJSON = v
+			case "avro.codec":
+				a.codec = string(v)
+			}
+		}
+	}
+	if _, err := io.ReadFull(a.r, a.sync); err != nil {
+		return nil, err
+	}
+	if a.codec != "null" && a.codec != "deflate" {
+		return nil, errors.New("unsupported Avro codec " + a.codec)
+	}
+	var schemaI interface{}
+	if err := json.Unmarshal(a.schemaJSON, &schemaI); err != nil {
+		return nil, err
+	}
+	schema, err := parseAvroSchema(schemaI)
+	if err != nil {
+		return nil, err
+	}
+	a.schema = schema
+	return a, nil
+}
+
+// Next returns the next record, or io.EOF at the end of the file.
+func (a *avroContainerReader) Next() (interface{}, error) {
+	for a.remaining == 0 {
+		count, err := binary.ReadVarint(a.r)
+		if err != nil {
+			return nil, err
+		}
+		data, err := readAvroBytes(a.r)
+		if err != nil {
+			return nil, err
+		}
+		sync := make([]byte, len(a.sync))
+		if _, err := io.ReadFull(a.r, sync); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(sync, a.sync) {
+			return nil, errors.New("bad sync marker in Avro file")
+		}
+		if a.codec == "deflate" {
+			data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		a.block = bytes.NewReader(data)
+		a.remaining = count
+	}
+	a.remaining--
+	return a.schema.decode(a.block)
+}
@@ -0,0 +1,176 @@
+package library
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Decode struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// messageCodec converts between messages and a binary encoding of them.
+type messageCodec interface {
+	Decode([]byte) (interface{}, error)
+	Encode(interface{}) ([]byte, error)
+}
+
+// codecRule holds the rule shared by the decode and encode blocks.
+type codecRule struct {
+	format      string
+	path        string
+	encoding    string
+	descriptors string
+	message     string
+	tree        *jee.TokenTree
+	codec       messageCodec
+}
+
+// parseCodecRule reads a decode or encode rule. Path and Encoding are
+// optional, with the defaults given.
+func parseCodecRule(ruleI interface{}, defaultPath, defaultEncoding string) (*codecRule, error) {
+	format, err := util.ParseString(ruleI, "Format")
+	if err != nil {
+		return nil, err
+	}
+	r := &codecRule{
+		format:   format,
+		path:     defaultPath,
+		encoding: defaultEncoding,
+	}
+	if util.KeyExists(ruleI, "Path") {
+		r.path, err = util.ParseString(ruleI, "Path")
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.tree, err = util.BuildTokenTree(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if util.KeyExists(ruleI, "Encoding") {
+		r.encoding, err = util.ParseString(ruleI, "Encoding")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.encoding != "raw" && r.encoding != "base64" {
+		return nil, errors.New("Encoding must be either raw or base64")
+	}
+
+	switch format {
+	case "msgpack":
+		r.codec = msgpackCodec{}
+	case "protobuf":
+		r.descriptors, err = util.ParseRequiredString(ruleI, "Descriptors")
+		if err != nil {
+			return nil, err
+		}
+		r.message, err = util.ParseRequiredString(ruleI, "Message")
+		if err != nil {
+			return nil, err
+		}
+		r.codec, err = newProtoCodec(r.descriptors, r.message)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Format must be either msgpack or protobuf")
+	}
+	return r, nil
+}
+
+// ruleMsg is the rule as the rule query route returns it.
+func (r *codecRule) ruleMsg() map[string]interface{} {
+	return map[string]interface{}{
+		"Format":      r.format,
+		"Path":        r.path,
+		"Encoding":    r.encoding,
+		"Descriptors": r.descriptors,
+		"Message":     r.message,
+	}
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewDecode() blocks.BlockInterface {
+	return &Decode{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Decode) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "decodes MessagePack or protobuf found in incoming messages, emitting the result"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Decode) Run() {
+	rule := &codecRule{
+		path:     ".data",
+		encoding: "raw",
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseCodecRule(ruleI, ".data", "raw")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			rule = tmpRule
+		case <-b.quit:
+			// quit the block
+			return
+		case msg := <-b.in:
+			if rule.codec == nil {
+				continue
+			}
+			dataI, err := jee.Eval(rule.tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			var data []byte
+			switch value := dataI.(type) {
+			case []byte:
+				data = value
+			case string:
+				data = []byte(value)
+			default:
+				b.Error(errors.New("data to decode must be a string"))
+				continue
+			}
+			if rule.encoding == "base64" {
+				data, err = base64.StdEncoding.DecodeString(string(data))
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			decoded, err := rule.codec.Decode(data)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			b.out <- decoded
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- rule.ruleMsg()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package library
+
+import (
+	"encoding/base64"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Encode struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewEncode() blocks.BlockInterface {
+	return &Encode{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Encode) Setup() {
+	b.Kind = "Parsers"
+	b.Desc = "encodes incoming messages as MessagePack or protobuf, emitting the result as data"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Encode) Run() {
+	rule := &codecRule{
+		path:     ".",
+		encoding: "base64",
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseCodecRule(ruleI, ".", "base64")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			rule = tmpRule
+		case <-b.quit:
+			// quit the block
+			return
+		case msg := <-b.in:
+			if rule.codec == nil {
+				continue
+			}
+			v, err := jee.Eval(rule.tree, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			encoded, err := rule.codec.Encode(v)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			data := string(encoded)
+			if rule.encoding == "base64" {
+				data = base64.StdEncoding.EncodeToString(encoded)
+			}
+			b.out <- map[string]interface{}{
+				"data": data,
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- rule.ruleMsg()
+		}
+	}
+}
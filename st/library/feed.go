@@ -0,0 +1,292 @@
+package library
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// feedTimeLayouts are the date formats seen in RSS, Atom and JSON Feed, most
+// common first.
+var feedTimeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 02 Jan 2006 15:04 -0700",
+	"Mon, 02 Jan 2006 15:04 MST",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// normalizeFeedTime returns the date as RFC3339 in UTC, or as it was if it
+// can't be parsed.
+func normalizeFeedTime(s string) string {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
+// feed is a feed and its items, each normalized to the same set of keys
+// whatever the format they came in.
+type feed struct {
+	Title string
+	Link  string
+	Items []map[string]interface{}
+}
+
+func newFeedItem(id, title, link, summary, content, author, published, updated string, categories []string) map[string]interface{} {
+	if id == "" {
+		id = link
+	}
+	if id == "" {
+		id = title + published
+	}
+	c := make([]interface{}, len(categories))
+	for i, category := range categories {
+		c[i] = category
+	}
+	return map[string]interface{}{
+		"ID":         id,
+		"Title":      title,
+		"Link":       link,
+		"Summary":    summary,
+		"Content":    content,
+		"Author":     author,
+		"Published":  normalizeFeedTime(published),
+		"Updated":    normalizeFeedTime(updated),
+		"Categories": c,
+	}
+}
+
+// parseFeed reads an RSS 2.0, RSS 1.0, Atom or JSON Feed document.
+func parseFeed(data []byte) (*feed, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		return parseJSONFeed(trimmed)
+	}
+	doc, err := parseXMLDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	root := doc.children[0]
+	switch root.name {
+	case "rss":
+		channel := feedChild(root, "channel")
+		if channel == nil {
+			return nil, errors.New("RSS feed has no channel")
+		}
+		return parseRSS(channel, feedChildren(channel, "item")), nil
+	case "RDF":
+		// RSS 1.0 puts its items alongside the channel rather than in it
+		channel := feedChild(root, "channel")
+		if channel == nil {
+			return nil, errors.New("RSS feed has no channel")
+		}
+		return parseRSS(channel, feedChildren(root, "item")), nil
+	case "feed":
+		return parseAtom(root), nil
+	}
+	return nil, errors.New("unknown feed format " + root.name)
+}
+
+// feedChildren returns the children of n with the given local name. A name
+// with a prefix, such as dc:creator, must match the prefix too.
+func feedChildren(n *xmlNode, name string) []*xmlNode {
+	prefix := ""
+	if colon := strings.Index(name, ":"); colon >= 0 {
+		prefix, name = name[:colon], name[colon+1:]
+	}
+	var children []*xmlNode
+	for _, child := range n.children {
+		if child.name == name && (prefix == "" || child.prefix == prefix) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// feedChild returns the first child of n with the given name. An unprefixed
+// name prefers a child without a prefix, so that an RSS channel's link isn't
+// mistaken for an atom:link that comes before it.
+func feedChild(n *xmlNode, name string) *xmlNode {
+	children := feedChildren(n, name)
+	if len(children) == 0 {
+		return nil
+	}
+	if !strings.Contains(name, ":") {
+		for _, child := range children {
+			if child.prefix == "" {
+				return child
+			}
+		}
+	}
+	return children[0]
+}
+
+// feedText returns the text of the first of the named children that exists.
+func feedText(n *xmlNode, names ...string) string {
+	for _, name := range names {
+		if child := feedChild(n, name); child != nil {
+			return child.text
+		}
+	}
+	return ""
+}
+
+func feedAttr(n *xmlNode, name string) string {
+	for _, attr := range n.attrs {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func parseRSS(channel *xmlNode, items []*xmlNode) *feed {
+	f := &feed{
+		Title: feedText(channel, "title"),
+		Link:  feedText(channel, "link"),
+	}
+	for _, item := range items {
+		var categories []string
+		for _, category := range feedChildren(item, "category") {
+			categories = append(categories, category.text)
+		}
+		for _, subject := range feedChildren(item, "dc:subject") {
+			categories = append(categories, subject.text)
+		}
+		id := feedText(item, "guid")
+		if id == "" {
+			id = feedAttr(item, "about")
+		}
+		f.Items = append(f.Items, newFeedItem(
+			id,
+			feedText(item, "title"),
+			feedText(item, "link"),
+			feedText(item, "description"),
+			feedText(item, "content:encoded"),
+			feedText(item, "dc:creator", "author"),
+			feedText(item, "pubDate", "dc:date"),
+			feedText(item, "updated"),
+			categories,
+		))
+	}
+	return f
+}
+
+// atomLink picks the alternate link, which is the default when rel is missing.
+func atomLink(n *xmlNode) string {
+	for _, link := range feedChildren(n, "link") {
+		if rel := feedAttr(link, "rel"); rel == "" || rel == "alternate" {
+			return feedAttr(link, "href")
+		}
+	}
+	return ""
+}
+
+func parseAtom(root *xmlNode) *feed {
+	f := &feed{
+		Title: feedText(root, "title"),
+		Link:  atomLink(root),
+	}
+	for _, entry := range feedChildren(root, "entry") {
+		var categories []string
+		for _, category := range feedChildren(entry, "category") {
+			categories = append(categories, feedAttr(category, "term"))
+		}
+		author := ""
+		if a := feedChild(entry, "author"); a != nil {
+			author = feedText(a, "name")
+		}
+		published := feedText(entry, "published", "issued")
+		updated := feedText(entry, "updated", "modified")
+		if published == "" {
+			published = updated
+		}
+		f.Items = append(f.Items, newFeedItem(
+			feedText(entry, "id"),
+			feedText(entry, "title"),
+			atomLink(entry),
+			feedText(entry, "summary"),
+			feedText(entry, "content"),
+			author,
+			published,
+			updated,
+			categories,
+		))
+	}
+	return f
+}
+
+func parseJSONFeed(data []byte) (*feed, error) {
+	var doc struct {
+		Title       string `json:"title"`
+		HomePageURL string `json:"home_page_url"`
+		Items       []struct {
+			ID            interface{} `json:"id"`
+			URL           string      `json:"url"`
+			Title         string      `json:"title"`
+			Summary       string      `json:"summary"`
+			ContentHTML   string      `json:"content_html"`
+			ContentText   string      `json:"content_text"`
+			DatePublished string      `json:"date_published"`
+			DateModified  string      `json:"date_modified"`
+			Tags          []string    `json:"tags"`
+			Author        *struct {
+				Name string `json:"name"`
+			} `json:"author"`
+			Authors []struct {
+				Name string `json:"name"`
+			} `json:"authors"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	f := &feed{
+		Title: doc.Title,
+		Link:  doc.HomePageURL,
+	}
+	for _, item := range doc.Items {
+		// ids should be strings, but some feeds use numbers
+		id := ""
+		switch v := item.ID.(type) {
+		case string:
+			id = v
+		case float64:
+			id = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		content := item.ContentHTML
+		if content == "" {
+			content = item.ContentText
+		}
+		author := ""
+		if len(item.Authors) > 0 {
+			author = item.Authors[0].Name
+		} else if item.Author != nil {
+			author = item.Author.Name
+		}
+		f.Items = append(f.Items, newFeedItem(
+			id,
+			item.Title,
+			item.URL,
+			item.Summary,
+			content,
+			author,
+			item.DatePublished,
+			item.DateModified,
+			item.Tags,
+		))
+	}
+	return f, nil
+}
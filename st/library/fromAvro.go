@@ -0,0 +1,126 @@
+package library
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromAvro struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	queryschema chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromAvro() blocks.BlockInterface {
+	return &FromAvro{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromAvro) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "reads an Avro object container file, emitting a message for each record"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.queryschema = b.QueryRoute("schema")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// readRecords sends every record in the file to records, closing the file
+// once it's done.
+func (b *FromAvro) readRecords(file *os.File, reader *avroContainerReader, records chan interface{}, quit chan bool) {
+	defer file.Close()
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		select {
+		case records <- record:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromAvro) Run() {
+	var filename string
+	var schemaJSON []byte
+	var records chan interface{}
+	var stop chan bool
+
+	stopReading := func() {
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+		records = nil
+	}
+
+	for {
+		select {
+		case msgI := <-b.inrule:
+			// set a parameter of the block
+			tmpFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			stopReading()
+			filename = tmpFilename
+			schemaJSON = nil
+
+			file, err := os.Open(filename)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			reader, err := newAvroContainerReader(file)
+			if err != nil {
+				file.Close()
+				b.Error(err)
+				continue
+			}
+			schemaJSON = reader.schemaJSON
+
+			records = make(chan interface{})
+			stop = make(chan bool)
+			go b.readRecords(file, reader, records, stop)
+
+		case record := <-records:
+			b.out <- record
+
+		case c := <-b.queryschema:
+			var schemaI interface{}
+			json.Unmarshal(schemaJSON, &schemaI)
+			c <- map[string]interface{}{
+				"Schema": schemaI,
+			}
+
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Filename": filename,
+			}
+
+		case <-b.quit:
+			// quit the block
+			stopReading()
+			return
+		}
+	}
+}
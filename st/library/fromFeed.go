@@ -0,0 +1,222 @@
+package library
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromFeed struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromFeed() blocks.BlockInterface {
+	return &FromFeed{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromFeed) Setup() {
+	b.Kind = "Network I/O"
+	b.Desc = "polls an RSS, Atom or JSON Feed, emitting each item the first time it appears"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromFeed) Run() {
+	var feedURL string
+	interval := time.Duration(5) * time.Minute
+	maxSeen := 1000
+	timeout := time.Duration(30) * time.Second
+
+	// validators from the last response, sent back so that an unchanged
+	// feed costs a 304 rather than a download
+	var etag, lastModified string
+
+	// the ids of emitted items, oldest first, so the set can be bounded
+	seen := make(map[string]bool)
+	var seenOrder []string
+
+	transport := http.Transport{
+		Dial: dialTimeout,
+	}
+	client := &http.Client{
+		Transport: &transport,
+		Timeout:   timeout,
+	}
+
+	ticker := time.NewTicker(interval)
+	ticker.Stop()
+
+	forget := func() {
+		for len(seenOrder) > maxSeen {
+			delete(seen, seenOrder[0])
+			seenOrder = seenOrder[1:]
+		}
+	}
+
+	poll := func() error {
+		req, err := http.NewRequest("GET", feedURL, nil)
+		if err != nil {
+			return err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		if lastModified != "" {
+			req.Header.Set("If-Modified-Since", lastModified)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return errors.New("feed request failed with status " + strconv.Itoa(resp.StatusCode))
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		f, err := parseFeed(body)
+		if err != nil {
+			return err
+		}
+
+		// feeds list their newest items first, so emit from the bottom up
+		for i := len(f.Items) - 1; i >= 0; i-- {
+			item := f.Items[i]
+			id := item["ID"].(string)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			seenOrder = append(seenOrder, id)
+			forget()
+
+			item["Feed"] = map[string]interface{}{
+				"Title": f.Title,
+				"Link":  f.Link,
+				"URL":   feedURL,
+			}
+			b.out <- item
+		}
+
+		// only now is the feed known to have been read, so a response that
+		// failed is fetched in full next time
+		etag = resp.Header.Get("ETag")
+		lastModified = resp.Header.Get("Last-Modified")
+		return nil
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := poll(); err != nil {
+				b.Error(err)
+			}
+		case ruleI := <-b.inrule:
+			// set a parameter of the block
+			tmpURL, err := util.ParseRequiredString(ruleI, "URL")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpIntervalString := interval.String()
+			if util.KeyExists(ruleI, "Interval") {
+				tmpIntervalString, err = util.ParseString(ruleI, "Interval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpInterval, err := time.ParseDuration(tmpIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpInterval <= 0 {
+				b.Error(errors.New("Interval must be positive"))
+				continue
+			}
+			tmpMaxSeen := maxSeen
+			if util.KeyExists(ruleI, "MaxSeen") {
+				tmpMaxSeen, err = util.ParseInt(ruleI, "MaxSeen")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMaxSeen <= 0 {
+				b.Error(errors.New("MaxSeen must be positive"))
+				continue
+			}
+			tmpTimeoutString := timeout.String()
+			if util.KeyExists(ruleI, "Timeout") {
+				tmpTimeoutString, err = util.ParseString(ruleI, "Timeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeout, err := time.ParseDuration(tmpTimeoutString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpTimeout <= 0 {
+				b.Error(errors.New("Timeout must be positive"))
+				continue
+			}
+
+			// a different feed starts from scratch
+			if tmpURL != feedURL {
+				etag = ""
+				lastModified = ""
+				seen = make(map[string]bool)
+				seenOrder = nil
+			}
+			feedURL = tmpURL
+			interval = tmpInterval
+			maxSeen = tmpMaxSeen
+			timeout = tmpTimeout
+			client.Timeout = timeout
+			forget()
+
+			ticker.Stop()
+			ticker = time.NewTicker(interval)
+			if err := poll(); err != nil {
+				b.Error(err)
+			}
+		case <-b.quit:
+			// quit the block
+			ticker.Stop()
+			return
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"URL":      feedURL,
+				"Interval": interval.String(),
+				"MaxSeen":  float64(maxSeen),
+				"Timeout":  timeout.String(),
+			}
+		}
+	}
+}
@@ -2,9 +2,13 @@ package library
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
@@ -21,6 +25,275 @@ type FromFile struct {
 	quit      blocks.MsgChan
 }
 
+// followedFile is a file being read line by line, like tail -F does.
+type followedFile struct {
+	name       string
+	file       *os.File
+	info       os.FileInfo
+	reader     *bufio.Reader
+	offset     int64
+	partial    []byte
+	compressed bool
+}
+
+// openFollowedFile opens a file for reading, starting either at its
+// beginning or at its end. Gzipped files are decompressed and always read
+// from the beginning.
+func openFollowedFile(name string, fromStart bool) (*followedFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	f := &followedFile{
+		name:   name,
+		file:   file,
+		info:   info,
+		reader: bufio.NewReader(file),
+	}
+
+	magic, _ := f.reader.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(f.reader)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.reader = bufio.NewReader(gz)
+		f.compressed = true
+		return f, nil
+	}
+
+	if !fromStart {
+		f.offset, err = file.Seek(0, os.SEEK_END)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f.reader.Reset(file)
+	}
+	return f, nil
+}
+
+// readLines emits every complete line up to the end of the file. A trailing
+// line without a newline is held on to until the rest of it is written,
+// unless final is set.
+func (f *followedFile) readLines(final bool, emit func([]byte) bool) (bool, error) {
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		f.offset += int64(len(line))
+		if err != nil && err != io.EOF {
+			return true, err
+		}
+		f.partial = append(f.partial, line...)
+		if err == io.EOF && !final {
+			return true, nil
+		}
+		if len(f.partial) > 0 {
+			if !emit(f.partial) {
+				return false, nil
+			}
+			f.partial = nil
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+	}
+}
+
+// changed reports whether the file has been rotated away from its name, or
+// truncated, since we last looked. Like tail -F, a file that has been moved
+// and not yet replaced is left alone until it reappears.
+func (f *followedFile) changed() (rotated bool, truncated bool) {
+	info, err := os.Stat(f.name)
+	if err != nil {
+		return false, false
+	}
+	if !os.SameFile(f.info, info) {
+		return true, false
+	}
+	return false, info.Size() < f.offset
+}
+
+// reopen starts reading whatever file now has our name from its beginning.
+func (f *followedFile) reopen() error {
+	file, err := os.Open(f.name)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file.Close()
+	f.file = file
+	f.info = info
+	f.reader.Reset(file)
+	f.offset = 0
+	f.partial = nil
+	return nil
+}
+
+// rewind starts reading a truncated file from its beginning again.
+func (f *followedFile) rewind() error {
+	if _, err := f.file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	f.reader.Reset(f.file)
+	f.offset = 0
+	f.partial = nil
+	return nil
+}
+
+// globFiles lists the files matching pattern. A directory matches every file
+// in it.
+func globFiles(pattern string) ([]string, error) {
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		pattern = filepath.Join(pattern, "*")
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range matches {
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// parseLine emits JSON lines as they are. Anything else is stored unparsed
+// as "data".
+func parseLine(line []byte) interface{} {
+	var outMsg interface{}
+	err := json.Unmarshal(line, &outMsg)
+	if err != nil {
+		outMsg = map[string]interface{}{
+			"data": string(line),
+		}
+	}
+	return outMsg
+}
+
+// readFiles reads every file matching pattern to its end, sending each line
+// on lines. When following, it carries on reading lines as they're written.
+// When watching, it picks up new files that match pattern.
+func (b *FromFile) readFiles(pattern string, follow, watch, fromStart bool, interval time.Duration, lines chan []byte, quit chan bool) {
+	var files []*followedFile
+	open := make(map[string]bool)
+	done := make(map[string]bool)
+
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+
+	emit := func(line []byte) bool {
+		// strip the newline, and any carriage return before it
+		if n := len(line); n > 0 && line[n-1] == '\n' {
+			line = line[:n-1]
+			if n := len(line); n > 0 && line[n-1] == '\r' {
+				line = line[:n-1]
+			}
+		}
+		select {
+		case lines <- line:
+			return true
+		case <-quit:
+			return false
+		}
+	}
+
+	first := true
+	for {
+		names, err := globFiles(pattern)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		for _, name := range names {
+			if open[name] || done[name] {
+				continue
+			}
+			// when following, files that were there before we started are
+			// read from their end, like tail -F
+			f, err := openFollowedFile(name, fromStart || !follow || !first)
+			if err != nil {
+				b.Error(err)
+				done[name] = true
+				continue
+			}
+			files = append(files, f)
+			open[name] = true
+		}
+		if first && len(files) == 0 && !watch && !follow {
+			b.Error(errors.New("no files match " + pattern))
+		}
+		first = false
+
+		remaining := files[:0]
+		for _, f := range files {
+			final := !follow || f.compressed
+			ok, err := f.readLines(final, emit)
+			if !ok {
+				return
+			}
+			if err != nil {
+				b.Error(err)
+				final = true
+			}
+			if final {
+				f.file.Close()
+				delete(open, f.name)
+				done[f.name] = true
+				continue
+			}
+
+			rotated, truncated := f.changed()
+			if rotated {
+				// finish off the old file before moving on to its replacement
+				ok, err := f.readLines(true, emit)
+				if !ok {
+					return
+				}
+				if err != nil {
+					b.Error(err)
+				}
+				if err := f.reopen(); err != nil {
+					b.Error(err)
+				}
+			}
+			if truncated {
+				if err := f.rewind(); err != nil {
+					b.Error(err)
+				}
+			}
+			remaining = append(remaining, f)
+		}
+		files = remaining
+
+		if !follow && !watch {
+			return
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-quit:
+			return
+		}
+	}
+}
+
 // we need to build a simple factory so that streamtools can make new blocks of this kind
 func NewFromFile() blocks.BlockInterface {
 	return &FromFile{}
@@ -29,7 +302,7 @@ func NewFromFile() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *FromFile) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "reads in a file specified by the block's rule, emitting a message for each line"
+	b.Desc = "reads in a file specified by the block's rule, emitting a message for each line, either when polled, all at once, or following the file as it's written to"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.inpoll = b.InRoute("poll")
@@ -42,18 +315,124 @@ func (b *FromFile) Setup() {
 func (b *FromFile) Run() {
 	var file *os.File
 	var filename string
-	var err error
 	var reader *bufio.Reader
 
+	mode := "poll"
+	watch := false
+	fromStart := false
+	rate := 0.0
+	pollIntervalString := "1s"
+
+	// lines read by readFiles, and the channel that stops it
+	var lines chan []byte
+	var stop chan bool
+	// recv is nil while we wait for the rate limit to let the next line through
+	var recv chan []byte
+	rateTicker := time.NewTicker(time.Duration(1) * time.Second)
+	rateTicker.Stop()
+
+	stopReading := func() {
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+		lines, recv = nil, nil
+		if file != nil {
+			file.Close()
+			file = nil
+		}
+		reader = nil
+	}
+
 	for {
 		select {
 		case msgI := <-b.inrule:
 			// set a parameter of the block
-			filename, err = util.ParseString(msgI, "Filename")
+			tmpFilename, err := util.ParseString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// everything but the filename is optional so that older rules still work
+			tmpMode := "poll"
+			if util.KeyExists(msgI, "Mode") {
+				tmpMode, err = util.ParseString(msgI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMode != "poll" && tmpMode != "read" && tmpMode != "follow" {
+				b.Error(errors.New("Mode must be one of poll, read or follow"))
+				continue
+			}
+			tmpWatch := false
+			if util.KeyExists(msgI, "Watch") {
+				tmpWatch, err = util.ParseBool(msgI, "Watch")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFromStart := false
+			if util.KeyExists(msgI, "FromStart") {
+				tmpFromStart, err = util.ParseBool(msgI, "FromStart")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpRate := 0.0
+			if util.KeyExists(msgI, "Rate") {
+				tmpRate, err = util.ParseFloat(msgI, "Rate")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpRate < 0 {
+				b.Error(errors.New("Rate can't be negative"))
+				continue
+			}
+			tmpPollIntervalString := "1s"
+			if util.KeyExists(msgI, "PollInterval") {
+				tmpPollIntervalString, err = util.ParseString(msgI, "PollInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			pollInterval, err := time.ParseDuration(tmpPollIntervalString)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
+			if pollInterval <= 0 {
+				b.Error(errors.New("PollInterval must be positive"))
+				continue
+			}
+
+			stopReading()
+			filename = tmpFilename
+			mode = tmpMode
+			watch = tmpWatch
+			fromStart = tmpFromStart
+			rate = tmpRate
+			pollIntervalString = tmpPollIntervalString
+
+			rateTicker.Stop()
+			if rate > 0 {
+				rateTicker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+			}
+
+			if mode != "poll" {
+				lines = make(chan []byte)
+				recv = lines
+				stop = make(chan bool)
+				go b.readFiles(filename, mode == "follow", watch, fromStart, pollInterval, lines, stop)
+				continue
+			}
 
 			file, err = os.Open(filename)
 			if err != nil {
@@ -62,41 +441,53 @@ func (b *FromFile) Run() {
 			}
 
 			reader = bufio.NewReader(file)
+			magic, _ := reader.Peek(2)
+			if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+				gz, err := gzip.NewReader(reader)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				reader = bufio.NewReader(gz)
+			}
 
 		case c := <-b.queryrule:
 			c <- map[string]interface{}{
-				"Filename": filename,
+				"Filename":     filename,
+				"Mode":         mode,
+				"Watch":        watch,
+				"FromStart":    fromStart,
+				"Rate":         rate,
+				"PollInterval": pollIntervalString,
+			}
+
+		case line := <-recv:
+			if rate > 0 {
+				recv = nil
 			}
+			b.out <- parseLine(line)
+
+		case <-rateTicker.C:
+			recv = lines
 
 		case <-b.inpoll:
-			if reader == nil && filename == "" {
-				b.Error("you must configure a filename before polling this block.")
+			if reader == nil {
+				b.Error("you must configure a filename in poll mode before polling this block.")
 				break
 			}
 
-			var outMsg interface{}
-
 			line, err := reader.ReadBytes('\n')
 			if err != nil && err != io.EOF {
 				b.Error(err)
 				continue
 			}
 
-			err = json.Unmarshal(line, &outMsg)
-			// if the json parsing fails, store data unparsed as "data"
-			if err != nil {
-				outMsg = map[string]interface{}{
-					"data": string(line),
-				}
-			}
-
-			b.out <- outMsg
+			b.out <- parseLine(line)
 
 		case <-b.quit:
 			// quit the block
-			if file != nil {
-				file.Close()
-			}
+			rateTicker.Stop()
+			stopReading()
 			return
 		}
 	}
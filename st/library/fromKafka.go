@@ -0,0 +1,264 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromKafka struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// a bit of boilerplate for streamtools
+func NewFromKafka() blocks.BlockInterface {
+	return &FromKafka{}
+}
+
+func (b *FromKafka) Setup() {
+	b.Kind = "Queue I/O"
+	b.Desc = "reads from Kafka topics as part of a consumer group, as specified in this block's rule"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// kafkaHandler hands the messages of each partition this block is given to
+// the Run loop, marking each one to be committed once it's been emitted.
+type kafkaHandler struct {
+	toOut blocks.MsgChan
+}
+
+func (h kafkaHandler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h kafkaHandler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h kafkaHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			var msg interface{}
+			err := json.Unmarshal(message.Value, &msg)
+			if err != nil {
+				msg = map[string]interface{}{
+					"data": string(message.Value),
+				}
+			}
+			select {
+			case h.toOut <- msg:
+				session.MarkMessage(message, "")
+			case <-session.Context().Done():
+				return nil
+			}
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// kafkaReader runs a consumer group until it's stopped, rejoining the group
+// whenever Kafka rebalances it.
+type kafkaReader struct {
+	group  sarama.ConsumerGroup
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+func newKafkaReader(brokers, topics []string, groupID string, conf *sarama.Config, toOut blocks.MsgChan, toError chan error) (*kafkaReader, error) {
+	group, err := sarama.NewConsumerGroup(brokers, groupID, conf)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &kafkaReader{
+		group:  group,
+		cancel: cancel,
+		done:   make(chan bool),
+	}
+	handler := kafkaHandler{toOut}
+
+	go func() {
+		for err := range group.Errors() {
+			select {
+			case toError <- err:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	go func() {
+		defer close(r.done)
+		for {
+			err := group.Consume(ctx, topics, handler)
+			if err == sarama.ErrClosedConsumerGroup || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				select {
+				case toError <- err:
+				case <-ctx.Done():
+					return
+				}
+				// don't spin while the brokers are unavailable
+				select {
+				case <-time.After(time.Duration(1) * time.Second):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return r, nil
+}
+
+// stop leaves the group, committing the offsets of everything emitted.
+func (r *kafkaReader) stop() error {
+	r.cancel()
+	<-r.done
+	return r.group.Close()
+}
+
+// connects to Kafka and emits each message of the topics into streamtools.
+func (b *FromKafka) Run() {
+	var reader *kafkaReader
+	var err error
+	brokers := []string{"localhost:9092"}
+	topics := []string{}
+	group := "streamtools"
+	startOffset := "newest"
+	commitInterval := time.Duration(1) * time.Second
+
+	toOut := make(blocks.MsgChan)
+	toError := make(chan error)
+
+	for {
+		select {
+		case msg := <-toOut:
+			b.out <- msg
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpTopics, err := util.ParseArrayString(ruleI, "Topics")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if len(tmpTopics) == 0 {
+				b.Error(errors.New("Topics must name at least one topic"))
+				continue
+			}
+			tmpBrokers := []string{"localhost:9092"}
+			if util.KeyExists(ruleI, "Brokers") {
+				tmpBrokers, err = util.ParseArrayString(ruleI, "Brokers")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpGroup := "streamtools"
+			if util.KeyExists(ruleI, "Group") {
+				tmpGroup, err = util.ParseRequiredString(ruleI, "Group")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpStartOffset := "newest"
+			if util.KeyExists(ruleI, "StartOffset") {
+				tmpStartOffset, err = util.ParseString(ruleI, "StartOffset")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCommitIntervalString := "1s"
+			if util.KeyExists(ruleI, "CommitInterval") {
+				tmpCommitIntervalString, err = util.ParseString(ruleI, "CommitInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCommitInterval, err := time.ParseDuration(tmpCommitIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpCommitInterval <= 0 {
+				b.Error(errors.New("CommitInterval must be positive"))
+				continue
+			}
+
+			conf := sarama.NewConfig()
+			conf.ClientID = "streamtools"
+			conf.Version = sarama.V0_10_2_0
+			conf.Consumer.Return.Errors = true
+			conf.Consumer.Offsets.AutoCommit.Enable = true
+			conf.Consumer.Offsets.AutoCommit.Interval = tmpCommitInterval
+			// the start offset only matters the first time a group reads a
+			// topic; after that it carries on from its committed offsets
+			switch tmpStartOffset {
+			case "newest":
+				conf.Consumer.Offsets.Initial = sarama.OffsetNewest
+			case "oldest":
+				conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+			default:
+				b.Error(errors.New("StartOffset must be either newest or oldest"))
+				continue
+			}
+
+			brokers = tmpBrokers
+			topics = tmpTopics
+			group = tmpGroup
+			startOffset = tmpStartOffset
+			commitInterval = tmpCommitInterval
+
+			if reader != nil {
+				err = reader.stop()
+				if err != nil {
+					b.Error(err)
+				}
+				reader = nil
+			}
+
+			reader, err = newKafkaReader(brokers, topics, group, conf, toOut, toError)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+		case <-b.quit:
+			if reader != nil {
+				err = reader.stop()
+				if err != nil {
+					b.Error(err)
+				}
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Brokers":        brokers,
+				"Topics":         topics,
+				"Group":          group,
+				"StartOffset":    startOffset,
+				"CommitInterval": commitInterval.String(),
+			}
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/eclipse/paho.mqtt.golang" // mqtt
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromMQTT struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// a bit of boilerplate for streamtools
+func NewFromMQTT() blocks.BlockInterface {
+	return &FromMQTT{}
+}
+
+func (b *FromMQTT) Setup() {
+	b.Kind = "Queue I/O"
+	b.Desc = "subscribes to topics on an MQTT broker, emitting each message it receives"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// mqttBuffer is how many received messages can wait for the Run loop.
+const mqttBuffer = 1000
+
+// mqttSubscriber hands the messages of a client's subscriptions to the Run
+// loop until it's stopped.
+type mqttSubscriber struct {
+	client       mqtt.Client
+	topics       map[string]byte
+	includeTopic bool
+	toOut        blocks.MsgChan
+	toError      chan error
+	stop         chan bool
+}
+
+func (s *mqttSubscriber) handle(client mqtt.Client, message mqtt.Message) {
+	var msg interface{}
+	err := json.Unmarshal(message.Payload(), &msg)
+	if err != nil {
+		msg = map[string]interface{}{
+			"data": string(message.Payload()),
+		}
+	}
+	if s.includeTopic {
+		msg = map[string]interface{}{
+			"Topic":    message.Topic(),
+			"Retained": message.Retained(),
+			"Msg":      msg,
+		}
+	}
+	select {
+	case s.toOut <- msg:
+	case <-s.stop:
+	}
+}
+
+func (s *mqttSubscriber) sendError(err error) {
+	select {
+	case s.toError <- err:
+	case <-s.stop:
+	}
+}
+
+// subscribe is called every time the client connects, as a broker doesn't
+// remember the subscriptions of a clean session.
+func (s *mqttSubscriber) subscribe(client mqtt.Client) {
+	token := client.SubscribeMultiple(s.topics, s.handle)
+	token.Wait()
+	if token.Error() != nil {
+		s.sendError(token.Error())
+	}
+}
+
+func (s *mqttSubscriber) connectionLost(client mqtt.Client, err error) {
+	s.sendError(errors.New("lost connection to MQTT broker, reconnecting: " + err.Error()))
+}
+
+func (s *mqttSubscriber) close() {
+	close(s.stop)
+	s.client.Disconnect(250)
+}
+
+// connects to an MQTT broker and emits each message of the topics into streamtools.
+func (b *FromMQTT) Run() {
+	var subscriber *mqttSubscriber
+	rule := &mqttRule{
+		broker:       "tcp://localhost:1883",
+		cleanSession: true,
+	}
+	topics := []string{}
+	includeTopic := false
+
+	// paho hands over messages one at a time, and while a handler waits
+	// for the Run loop it can't keep the connection alive, so there's
+	// room for a burst. Only once that's full does the broker have to wait.
+	toOut := make(blocks.MsgChan, mqttBuffer)
+	toError := make(chan error)
+
+	for {
+		select {
+		case msg := <-toOut:
+			b.out <- msg
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseMQTTRule(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTopics, err := util.ParseArrayString(ruleI, "Topics")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if len(tmpTopics) == 0 {
+				b.Error(errors.New("Topics must have at least one topic"))
+				continue
+			}
+			tmpIncludeTopic := false
+			if util.KeyExists(ruleI, "IncludeTopic") {
+				tmpIncludeTopic, err = util.ParseBool(ruleI, "IncludeTopic")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			rule = tmpRule
+			topics = tmpTopics
+			includeTopic = tmpIncludeTopic
+
+			if subscriber != nil {
+				subscriber.close()
+			}
+			subscriber = &mqttSubscriber{
+				topics:       make(map[string]byte),
+				includeTopic: includeTopic,
+				toOut:        toOut,
+				toError:      toError,
+				stop:         make(chan bool),
+			}
+			for _, topic := range topics {
+				subscriber.topics[topic] = byte(rule.qos)
+			}
+			subscriber.client = rule.connect(subscriber.subscribe, subscriber.connectionLost)
+		case <-b.quit:
+			if subscriber != nil {
+				subscriber.close()
+			}
+			return
+		case c := <-b.queryrule:
+			ruleMsg := rule.ruleMsg()
+			ruleMsg["Topics"] = topics
+			ruleMsg["IncludeTopic"] = includeTopic
+			c <- ruleMsg
+		}
+	}
+}
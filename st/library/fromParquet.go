@@ -0,0 +1,129 @@
+package library
+
+import (
+	"io"
+	"os"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromParquet struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	queryschema chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromParquet() blocks.BlockInterface {
+	return &FromParquet{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromParquet) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "reads a Parquet file, emitting a message for each row"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.queryschema = b.QueryRoute("schema")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// readRows sends every row in the file to rows, closing the file once it's
+// done.
+func (b *FromParquet) readRows(file *os.File, reader *parquetReader, rows chan interface{}, quit chan bool) {
+	defer file.Close()
+	for {
+		row, err := reader.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		select {
+		case rows <- row:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromParquet) Run() {
+	var filename string
+	var schema []interface{}
+	var rows chan interface{}
+	var stop chan bool
+
+	stopReading := func() {
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+		rows = nil
+	}
+
+	for {
+		select {
+		case msgI := <-b.inrule:
+			// set a parameter of the block
+			tmpFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			stopReading()
+			filename = tmpFilename
+			schema = nil
+
+			file, err := os.Open(filename)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				b.Error(err)
+				continue
+			}
+			reader, err := newParquetReader(file, info.Size())
+			if err != nil {
+				file.Close()
+				b.Error(err)
+				continue
+			}
+			schema = reader.schema()
+
+			rows = make(chan interface{})
+			stop = make(chan bool)
+			go b.readRows(file, reader, rows, stop)
+
+		case row := <-rows:
+			b.out <- row
+
+		case c := <-b.queryschema:
+			c <- map[string]interface{}{
+				"Columns": schema,
+			}
+
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Filename": filename,
+			}
+
+		case <-b.quit:
+			// quit the block
+			stopReading()
+			return
+		}
+	}
+}
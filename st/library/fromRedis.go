@@ -0,0 +1,547 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromRedis struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// a bit of boilerplate for streamtools
+func NewFromRedis() blocks.BlockInterface {
+	return &FromRedis{}
+}
+
+func (b *FromRedis) Setup() {
+	b.Kind = "Queue I/O"
+	b.Desc = "reads from redis, subscribing to channels, consuming a stream as part of a consumer group or popping from lists"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// decodeRedisMessage parses a payload as JSON, falling back to the raw string
+// under data like the other queue blocks.
+func decodeRedisMessage(data []byte) interface{} {
+	var msg interface{}
+	err := json.Unmarshal(data, &msg)
+	if err != nil {
+		msg = map[string]interface{}{
+			"data": string(data),
+		}
+	}
+	return msg
+}
+
+// redisReader reads from redis in its own goroutine, as all of the ways of
+// reading block, handing messages and errors back to the block's Run loop.
+type redisReader struct {
+	server   string
+	password string
+	mode     string
+	channels []string
+	keys     []string
+	stream   string
+	group    string
+	consumer string
+	count    int
+	timeout  time.Duration
+
+	toOut   blocks.MsgChan
+	toError chan error
+	stop    chan bool
+	conns   chan redis.Conn
+}
+
+// start connects and reads until the reader is stopped, reconnecting after
+// a second if the connection goes away.
+func (r *redisReader) start() {
+	r.stop = make(chan bool)
+	r.conns = make(chan redis.Conn, 1)
+	go func() {
+		for {
+			err := r.read()
+			if r.stopped() {
+				return
+			}
+			if err != nil && !r.sendError(err) {
+				return
+			}
+			select {
+			case <-r.stop:
+				return
+			case <-time.After(time.Duration(1) * time.Second):
+			}
+		}
+	}()
+}
+
+// close stops the reader, closing its connection to interrupt whatever it's
+// waiting on.
+func (r *redisReader) close() {
+	close(r.stop)
+	select {
+	case conn := <-r.conns:
+		conn.Close()
+	default:
+	}
+}
+
+func (r *redisReader) send(msg interface{}) bool {
+	select {
+	case r.toOut <- msg:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+func (r *redisReader) sendError(err error) bool {
+	select {
+	case r.toError <- err:
+		return true
+	case <-r.stop:
+		return false
+	}
+}
+
+// connect opens a connection of the reader's own, which close knows
+// nothing about.
+func (r *redisReader) connect() (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", r.server)
+	if err != nil {
+		return nil, err
+	}
+	if r.password != "" {
+		if _, err := conn.Do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (r *redisReader) dial() (redis.Conn, error) {
+	conn, err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+	// leave the connection where close can find it
+	select {
+	case <-r.conns:
+	default:
+	}
+	r.conns <- conn
+	if r.stopped() {
+		conn.Close()
+		return nil, errors.New("stopped")
+	}
+	return conn, nil
+}
+
+func (r *redisReader) stopped() bool {
+	select {
+	case <-r.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *redisReader) read() error {
+	conn, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	switch r.mode {
+	case "subscribe", "psubscribe":
+		return r.subscribe(conn)
+	case "stream":
+		return r.readStream(conn)
+	case "list":
+		return r.popList(conn)
+	}
+	return errors.New("unknown mode " + r.mode)
+}
+
+func (r *redisReader) subscribe(conn redis.Conn) error {
+	psc := redis.PubSubConn{Conn: conn}
+	channels := make([]interface{}, len(r.channels))
+	for i, channel := range r.channels {
+		channels[i] = channel
+	}
+	var err error
+	if r.mode == "psubscribe" {
+		err = psc.PSubscribe(channels...)
+	} else {
+		err = psc.Subscribe(channels...)
+	}
+	if err != nil {
+		return err
+	}
+	for {
+		switch reply := psc.Receive().(type) {
+		case redis.Message:
+			if !r.send(decodeRedisMessage(reply.Data)) {
+				return nil
+			}
+		case redis.PMessage:
+			if !r.send(decodeRedisMessage(reply.Data)) {
+				return nil
+			}
+		case error:
+			return reply
+		}
+	}
+}
+
+func (r *redisReader) popList(conn redis.Conn) error {
+	args := make([]interface{}, 0, len(r.keys)+1)
+	for _, key := range r.keys {
+		args = append(args, key)
+	}
+	args = append(args, int(r.timeout/time.Second))
+	for !r.stopped() {
+		// a nil reply means we timed out waiting
+		reply, err := redis.Values(conn.Do("BLPOP", args...))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(reply) != 2 {
+			return fmt.Errorf("unexpected BLPOP reply %v", reply)
+		}
+		data, err := redis.Bytes(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		if !r.send(decodeRedisMessage(data)) {
+			return r.pushBack(reply[0], data)
+		}
+	}
+	return nil
+}
+
+// pushBack puts an item that was popped as the reader stopped back on the
+// front of its list, so the next reader gets it instead of it being lost.
+// The reader's connection may already have been closed, so it uses a new
+// one.
+func (r *redisReader) pushBack(key interface{}, data []byte) error {
+	conn, err := r.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("LPUSH", key, data)
+	return err
+}
+
+// streamEntry is one entry of a stream, with its fields decoded where they
+// hold JSON.
+type streamEntry struct {
+	id     string
+	fields map[string]interface{}
+}
+
+// parseStreamReply picks the entries out of an XREADGROUP reply, which looks
+// like [[stream, [[id, [field, value, ...]], ...]]].
+func parseStreamReply(reply interface{}) ([]*streamEntry, error) {
+	streams, err := redis.Values(reply, nil)
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*streamEntry
+	for _, streamI := range streams {
+		stream, err := redis.Values(streamI, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(stream) != 2 {
+			return nil, errors.New("unexpected stream reply")
+		}
+		items, err := redis.Values(stream[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, itemI := range items {
+			item, err := redis.Values(itemI, nil)
+			if err != nil {
+				return nil, err
+			}
+			if len(item) != 2 {
+				return nil, errors.New("unexpected stream entry")
+			}
+			id, err := redis.String(item[0], nil)
+			if err != nil {
+				return nil, err
+			}
+			// entries that have been deleted since being delivered have no fields
+			pairs, err := redis.Strings(item[1], nil)
+			if err != nil && err != redis.ErrNil {
+				return nil, err
+			}
+			fields := make(map[string]interface{})
+			for i := 0; i+1 < len(pairs); i += 2 {
+				var value interface{}
+				if json.Unmarshal([]byte(pairs[i+1]), &value) != nil {
+					value = pairs[i+1]
+				}
+				fields[pairs[i]] = value
+			}
+			entries = append(entries, &streamEntry{id: id, fields: fields})
+		}
+	}
+	return entries, nil
+}
+
+func (r *redisReader) readStream(conn redis.Conn) error {
+	_, err := conn.Do("XGROUP", "CREATE", r.stream, r.group, "$", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	// start with anything delivered to us before that we never acknowledged,
+	// then move on to new entries
+	next := "0"
+	for !r.stopped() {
+		reply, err := conn.Do("XREADGROUP", "GROUP", r.group, r.consumer,
+			"COUNT", r.count, "BLOCK", int(r.timeout/time.Millisecond),
+			"STREAMS", r.stream, next)
+		if err != nil {
+			return err
+		}
+		entries, err := parseStreamReply(reply)
+		if err != nil {
+			return err
+		}
+		if next == "0" && len(entries) == 0 {
+			next = ">"
+			continue
+		}
+		for _, entry := range entries {
+			if !r.send(entry.fields) {
+				return nil
+			}
+			_, err := conn.Do("XACK", r.stream, r.group, entry.id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// connects to redis and emits each message it reads into streamtools.
+func (b *FromRedis) Run() {
+	var reader *redisReader
+	var err error
+	server := "localhost:6379"
+	var password string
+	mode := "subscribe"
+	channels := []string{}
+	keys := []string{}
+	var stream, group, consumer string
+	count := 10
+	timeout := time.Duration(1) * time.Second
+
+	toOut := make(blocks.MsgChan)
+	toError := make(chan error)
+
+	for {
+		select {
+		case msg := <-toOut:
+			b.out <- msg
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpServer := "localhost:6379"
+			if util.KeyExists(ruleI, "Server") {
+				tmpServer, err = util.ParseString(ruleI, "Server")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpPassword := ""
+			if util.KeyExists(ruleI, "Password") {
+				tmpPassword, err = util.ParseString(ruleI, "Password")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpMode := "subscribe"
+			if util.KeyExists(ruleI, "Mode") {
+				tmpMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpChannels := []string{}
+			if util.KeyExists(ruleI, "Channels") {
+				tmpChannels, err = util.ParseArrayString(ruleI, "Channels")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpKeys := []string{}
+			if util.KeyExists(ruleI, "Keys") {
+				tmpKeys, err = util.ParseArrayString(ruleI, "Keys")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpStream := ""
+			if util.KeyExists(ruleI, "Stream") {
+				tmpStream, err = util.ParseString(ruleI, "Stream")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpGroup := "streamtools"
+			if util.KeyExists(ruleI, "Group") {
+				tmpGroup, err = util.ParseString(ruleI, "Group")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			// each block gets its own consumer name unless told otherwise
+			tmpConsumer := b.Id
+			if tmpConsumer == "" {
+				tmpConsumer = "streamtools"
+			}
+			if util.KeyExists(ruleI, "Consumer") {
+				tmpConsumer, err = util.ParseString(ruleI, "Consumer")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCount := 10
+			if util.KeyExists(ruleI, "Count") {
+				tmpCount, err = util.ParseInt(ruleI, "Count")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeoutString := "1s"
+			if util.KeyExists(ruleI, "Timeout") {
+				tmpTimeoutString, err = util.ParseString(ruleI, "Timeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeout, err := time.ParseDuration(tmpTimeoutString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			switch tmpMode {
+			case "subscribe", "psubscribe":
+				if len(tmpChannels) == 0 {
+					b.Error(errors.New(tmpMode + " needs at least one of Channels"))
+					continue
+				}
+			case "stream":
+				if tmpStream == "" || tmpGroup == "" || tmpConsumer == "" {
+					b.Error(errors.New("stream needs a Stream, Group and Consumer"))
+					continue
+				}
+				if tmpCount < 1 {
+					b.Error(errors.New("Count must be at least 1"))
+					continue
+				}
+			case "list":
+				if len(tmpKeys) == 0 {
+					b.Error(errors.New("list needs at least one of Keys"))
+					continue
+				}
+			default:
+				b.Error(errors.New("Mode must be one of subscribe, psubscribe, stream or list"))
+				continue
+			}
+			// BLPOP only waits in whole seconds
+			if tmpTimeout < time.Second {
+				b.Error(errors.New("Timeout must be at least 1s"))
+				continue
+			}
+
+			server = tmpServer
+			password = tmpPassword
+			mode = tmpMode
+			channels = tmpChannels
+			keys = tmpKeys
+			stream = tmpStream
+			group = tmpGroup
+			consumer = tmpConsumer
+			count = tmpCount
+			timeout = tmpTimeout
+
+			if reader != nil {
+				reader.close()
+			}
+			reader = &redisReader{
+				server:   server,
+				password: password,
+				mode:     mode,
+				channels: channels,
+				keys:     keys,
+				stream:   stream,
+				group:    group,
+				consumer: consumer,
+				count:    count,
+				timeout:  timeout,
+				toOut:    toOut,
+				toError:  toError,
+			}
+			reader.start()
+		case <-b.quit:
+			if reader != nil {
+				reader.close()
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Server":   server,
+				"Password": password,
+				"Mode":     mode,
+				"Channels": channels,
+				"Keys":     keys,
+				"Stream":   stream,
+				"Group":    group,
+				"Consumer": consumer,
+				"Count":    float64(count),
+				"Timeout":  timeout.String(),
+			}
+		}
+	}
+}
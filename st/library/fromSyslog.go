@@ -0,0 +1,135 @@
+package library
+
+import (
+	"errors"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromSyslog struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromSyslog() blocks.BlockInterface {
+	return &FromSyslog{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromSyslog) Setup() {
+	b.Kind = "Network I/O"
+	b.Desc = "receives syslog messages over UDP or TCP, emitting each with its priority, timestamp, hostname, app and structured data picked out"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// decodeSyslogMessage parses a syslog message, adding the address it came
+// from, which for RFC 3164 messages is often the only way to tell.
+func decodeSyslogMessage(frame []byte, conn *socketConn) interface{} {
+	msg := parseSyslog(frame, time.Now())
+	msg["RemoteAddr"] = conn.remoteAddr
+	return msg
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromSyslog) Run() {
+	// either a *socketServer or a *packetServer
+	var server interface {
+		close()
+	}
+	var address string
+	protocol := "udp"
+	maxSize := 65536
+
+	toOut := make(blocks.MsgChan)
+	toError := make(chan error)
+
+	for {
+		select {
+		case msg := <-toOut:
+			b.out <- msg
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpAddress, err := util.ParseRequiredString(ruleI, "Address")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpProtocol := "udp"
+			if util.KeyExists(ruleI, "Protocol") {
+				tmpProtocol, err = util.ParseString(ruleI, "Protocol")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpProtocol != "udp" && tmpProtocol != "tcp" {
+				b.Error(errors.New("Protocol must be either udp or tcp"))
+				continue
+			}
+			tmpMaxSize := 65536
+			if util.KeyExists(ruleI, "MaxSize") {
+				tmpMaxSize, err = util.ParseInt(ruleI, "MaxSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMaxSize < 1 {
+				b.Error(errors.New("MaxSize must be at least 1"))
+				continue
+			}
+
+			if server != nil {
+				server.close()
+				server = nil
+			}
+
+			address = tmpAddress
+			protocol = tmpProtocol
+			maxSize = tmpMaxSize
+
+			if protocol == "udp" {
+				size := maxSize
+				if size > MAX_UDP_MESSAGE_SIZE {
+					size = MAX_UDP_MESSAGE_SIZE
+				}
+				var s *packetServer
+				s, err = listenPacket(udpSettings{connectionString: address, maxSize: size}, decodeSyslogMessage, toOut, toError)
+				if err == nil {
+					server = s
+				}
+			} else {
+				var s *socketServer
+				s, err = listenSocket("tcp", address, "octet", maxSize, decodeSyslogMessage, toOut, toError)
+				if err == nil {
+					server = s
+				}
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		case <-b.quit:
+			if server != nil {
+				server.close()
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Address":  address,
+				"Protocol": protocol,
+				"MaxSize":  float64(maxSize),
+			}
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type FromTCP struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+	network   string
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewFromTCP() blocks.BlockInterface {
+	return &FromTCP{network: "tcp"}
+}
+
+// fromUnix is the same block listening on a Unix domain socket
+func NewFromUnix() blocks.BlockInterface {
+	return &FromTCP{network: "unix"}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *FromTCP) Setup() {
+	b.Kind = "Network I/O"
+	if b.network == "unix" {
+		b.Desc = "listens on a Unix domain socket, emitting each message clients send into streamtools"
+	} else {
+		b.Desc = "listens for TCP connections, emitting each message clients send into streamtools"
+	}
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// decodeSocketMessage parses messages as JSON, falling back to the raw string
+// under data, and wraps them up with where they came from if asked to.
+func decodeSocketMessage(includeConnection bool) socketDecoder {
+	return func(frame []byte, conn *socketConn) interface{} {
+		var msg interface{}
+		err := json.Unmarshal(frame, &msg)
+		if err != nil {
+			msg = map[string]interface{}{
+				"data": string(frame),
+			}
+		}
+		if !includeConnection {
+			return msg
+		}
+		return map[string]interface{}{
+			"Connection": map[string]interface{}{
+				"ID":         conn.id,
+				"LocalAddr":  conn.localAddr,
+				"RemoteAddr": conn.remoteAddr,
+			},
+			"Msg": msg,
+		}
+	}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *FromTCP) Run() {
+	var server *socketServer
+	var address string
+	framing := "newline"
+	maxSize := 65536
+	includeConnection := false
+
+	toOut := make(blocks.MsgChan)
+	toError := make(chan error)
+
+	for {
+		select {
+		case msg := <-toOut:
+			b.out <- msg
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpAddress, err := util.ParseRequiredString(ruleI, "Address")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpFraming := "newline"
+			if util.KeyExists(ruleI, "Framing") {
+				tmpFraming, err = util.ParseString(ruleI, "Framing")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			err = checkFraming(tmpFraming)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpMaxSize := 65536
+			if util.KeyExists(ruleI, "MaxSize") {
+				tmpMaxSize, err = util.ParseInt(ruleI, "MaxSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMaxSize < 1 {
+				b.Error(errors.New("MaxSize must be at least 1"))
+				continue
+			}
+			tmpIncludeConnection := false
+			if util.KeyExists(ruleI, "IncludeConnection") {
+				tmpIncludeConnection, err = util.ParseBool(ruleI, "IncludeConnection")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			if server != nil {
+				server.close()
+				server = nil
+			}
+
+			address = tmpAddress
+			framing = tmpFraming
+			maxSize = tmpMaxSize
+			includeConnection = tmpIncludeConnection
+
+			server, err = listenSocket(b.network, address, framing, maxSize, decodeSocketMessage(includeConnection), toOut, toError)
+			if err != nil {
+				b.Error(err)
+			}
+		case <-b.quit:
+			if server != nil {
+				server.close()
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Address":           address,
+				"Framing":           framing,
+				"MaxSize":           float64(maxSize),
+				"IncludeConnection": includeConnection,
+			}
+		}
+	}
+}
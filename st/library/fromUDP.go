@@ -1,97 +1,19 @@
 package library
 
 import (
-	"encoding/json"
-	"net"
-	"sync"
+	"errors"
 
 	"github.com/nytlabs/streamtools/st/blocks"
 	"github.com/nytlabs/streamtools/st/util"
 )
 
-const (
-	MAX_UDP_MESSAGE_SIZE = 1024
-)
-
-type listenerUDP struct {
-	block   blocks.BlockInterface
-	out     chan []byte
-	udpConn net.PacketConn
-	wait    sync.WaitGroup
-	closed  bool
-}
-
-func NewListenerUDP(block blocks.BlockInterface, connectionString string, out chan []byte) (*listenerUDP, error) {
-	l := &listenerUDP{
-		block: block,
-		out:   out,
-	}
-
-	// Try to open a new UDP connection, returning any error.
-	if conn, err := net.ListenPacket("udp", connectionString); err != nil {
-		return l, err
-	} else {
-		l.udpConn = conn
-	}
-
-	// Start the listener.
-	l.wait.Add(1)
-	go l.listen()
-
-	return l, nil
-}
-
-func (l *listenerUDP) Close() {
-
-	// Signal the listener loop to exit and close the UDP connection.
-	l.closed = true
-	l.udpConn.Close()
-
-	// Wait for the listener loop to exit.
-	l.wait.Wait()
-}
-
-func (l *listenerUDP) listen() {
-
-	// Defer notification that the listener is done.
-	defer l.wait.Done()
-
-	// Create a byte buffer
-	buffer := make([]byte, MAX_UDP_MESSAGE_SIZE)
-
-	// Loop continuously.
-	for !l.closed {
-
-		// Try to read from the connection, and log the error if there is one.
-		if bytes, _, err := l.udpConn.ReadFrom(buffer); err != nil {
-
-			// Log the error.
-			l.block.Error(err)
-		} else {
-
-			// Copy the message from the buffer.
-			message := make([]byte, bytes)
-			copy(message, buffer)
-
-			// Dump the message onto the listener chanel.
-			l.out <- message
-		}
-	}
-}
-
 // specify those channels we're going to use to communicate with streamtools
 type FromUDP struct {
 	blocks.Block
-	queryrule        chan blocks.MsgChan
-	inrule           blocks.MsgChan
-	inpoll           blocks.MsgChan
-	in               blocks.MsgChan
-	out              blocks.MsgChan
-	quit             blocks.MsgChan
-	connectionString string
-	listener         *listenerUDP
-	listenerLock     sync.RWMutex
-	listenerChan     chan []byte
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
 }
 
 // we need to build a simple factory so that streamtools can make new blocks of this kind
@@ -108,13 +30,21 @@ func (u *FromUDP) Setup() {
 	u.queryrule = u.QueryRoute("rule")
 	u.quit = u.Quit()
 	u.out = u.Broadcast()
-	u.listenerChan = make(chan []byte)
 }
 
 // Run is the block's main loop. Here we listen on the different channels we
 // set up.
 func (u *FromUDP) Run() {
-	var ConnectionString string
+	var server *packetServer
+	settings := udpSettings{
+		maxSize: MAX_UDP_MESSAGE_SIZE,
+	}
+
+	// the server reads datagrams in its own goroutine and hands them back
+	// here. Anything that isn't JSON is passed on as it is, so it can be
+	// decoded downstream.
+	toOut := make(blocks.MsgChan)
+	toError := make(chan error)
 
 	for {
 		select {
@@ -122,74 +52,94 @@ func (u *FromUDP) Run() {
 		// Handle a rule change.
 		case msgI := <-u.inrule:
 
+			var tmpSettings udpSettings
+
 			// Check for a new connection string.
 			if cs, err := util.ParseString(msgI, "ConnectionString"); err != nil {
 				u.Error(err)
 				break
 			} else {
-				ConnectionString = cs
+				tmpSettings.connectionString = cs
 			}
 
-			// Get the listener lock for writing.
-			u.listenerLock.Lock()
-
-			// Check if the connection string has been modified.
-			if u.connectionString != ConnectionString {
-
-				// Save the new connection string.
-				u.connectionString = ConnectionString
-
-				// Close any existing connection.
-				if u.listener != nil {
-					u.listener.Close()
-					u.listener = nil
+			// Check for a new maximum message size, keeping the largest
+			// possible if there isn't one.
+			tmpSettings.maxSize = MAX_UDP_MESSAGE_SIZE
+			if util.KeyExists(msgI, "MaxSize") {
+				if size, err := util.ParseInt(msgI, "MaxSize"); err != nil {
+					u.Error(err)
+					break
+				} else {
+					tmpSettings.maxSize = size
 				}
+			}
+			if tmpSettings.maxSize < 1 || tmpSettings.maxSize > MAX_UDP_MESSAGE_SIZE {
+				u.Error(errors.New("MaxSize must be between 1 and 65507"))
+				break
+			}
 
-				// Try to get a new connection.
-				if l, err := NewListenerUDP(u, ConnectionString, u.listenerChan); err != nil {
+			// Check for a multicast group to join, and the interface to join
+			// it on.
+			if util.KeyExists(msgI, "MulticastGroup") {
+				if group, err := util.ParseString(msgI, "MulticastGroup"); err != nil {
+					u.Error(err)
+					break
+				} else {
+					tmpSettings.multicastGroup = group
+				}
+			}
+			if util.KeyExists(msgI, "Interface") {
+				if iface, err := util.ParseString(msgI, "Interface"); err != nil {
 					u.Error(err)
+					break
 				} else {
-					u.listener = l
+					tmpSettings.iface = iface
 				}
 			}
 
-			// Release the listener lock.
-			u.listenerLock.Unlock()
+			// Only listen again if the settings have been modified, or the
+			// server gave up on its socket.
+			if server != nil && !server.failed() && settings == tmpSettings {
+				break
+			}
+			settings = tmpSettings
 
-		// Recieving a message from the listener. This is the same as from SQS
-		// etc.
-		case msg := <-u.listenerChan:
-			var outMsg interface{}
-			if err := json.Unmarshal(msg, &outMsg); err != nil {
+			// Close any existing connection.
+			if server != nil {
+				server.close()
+				server = nil
+			}
+
+			// Try to get a new connection.
+			if s, err := listenPacket(settings, decodeSocketMessage(false), toOut, toError); err != nil {
 				u.Error(err)
 			} else {
-				u.out <- outMsg
+				server = s
 			}
 
-		// Respond to a rule query.
-		case MsgChan := <-u.queryrule:
+		// Recieving a message from the server. This is the same as from SQS
+		// etc.
+		case msg := <-toOut:
+			u.out <- msg
 
-			// Get the listener lock for reading.
-			u.listenerLock.RLock()
+		case err := <-toError:
+			u.Error(err)
 
+		// Respond to a rule query.
+		case MsgChan := <-u.queryrule:
 			MsgChan <- map[string]interface{}{
-				"ConnectionString": u.connectionString,
+				"ConnectionString": settings.connectionString,
+				"MaxSize":          float64(settings.maxSize),
+				"MulticastGroup":   settings.multicastGroup,
+				"Interface":        settings.iface,
 			}
 
-			// Release the listener lock.
-			u.listenerLock.RUnlock()
-
 		// Shutdown everything.
 		case <-u.quit:
 
-			// Get the listener lock for writing and defer its closing.
-			u.listenerLock.Lock()
-			defer u.listenerLock.Unlock()
-
-			// Clean up the listener if it exists.
-			if u.listener != nil {
-				u.listener.Close()
-				u.listener = nil
+			// Clean up the server if it exists.
+			if server != nil {
+				server.close()
 			}
 
 			// quit the block
@@ -14,11 +14,12 @@ import (
 // specify those channels we're going to use to communicate with streamtools
 type GetHTTP struct {
 	blocks.Block
-	queryrule chan blocks.MsgChan
-	inrule    blocks.MsgChan
-	in        blocks.MsgChan
-	out       blocks.MsgChan
-	quit      blocks.MsgChan
+	queryrule   chan blocks.MsgChan
+	querystatus chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
 }
 
 // we need to build a simple factory so that streamtools can make new blocks of this kind
@@ -33,39 +34,118 @@ func (b *GetHTTP) Setup() {
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
+	b.querystatus = b.QueryRoute("status")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
 }
 
+// get fetches a URL, returning the body as JSON if it can be parsed, or
+// unparsed as "data" if not.
+func (b *GetHTTP) get(client *http.Client, urlString string) interface{} {
+	resp, err := client.Get(urlString)
+	if err != nil {
+		b.Error(err)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		b.Error(err)
+		return nil
+	}
+	var outMsg interface{}
+	// try treating the body as json first...
+	err = json.Unmarshal(body, &outMsg)
+
+	// if the json parsing fails, store data unparsed as "data"
+	if err != nil {
+		outMsg = map[string]interface{}{
+			"data": string(body),
+		}
+	}
+	return outMsg
+}
+
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *GetHTTP) Run() {
 	client := &http.Client{}
 	var tree *jee.TokenTree
 	var path string
-	var err error
+	pool := newRequestPool()
 	for {
+		// stop taking messages while the queue is full
+		in := b.in
+		if pool.full() {
+			in = nil
+		}
+
 		select {
 		case ruleI := <-b.inrule:
 			// set a parameter of the block
-			path, err = util.ParseString(ruleI, "Path")
+			tmpPath, err := util.ParseString(ruleI, "Path")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			token, err := jee.Lexer(path)
+			token, err := jee.Lexer(tmpPath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			tree, err = jee.Parser(token)
+			tmpTree, err := jee.Parser(token)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
+
+			// the remaining options are optional so that older rules still work
+			tmpConcurrency := pool.size
+			if util.KeyExists(ruleI, "Concurrency") {
+				tmpConcurrency, err = util.ParseInt(ruleI, "Concurrency")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpConcurrency < 1 {
+					b.Error(errors.New("Concurrency must be at least 1"))
+					continue
+				}
+			}
+			tmpMaxQueued := pool.maxQueued
+			if util.KeyExists(ruleI, "MaxQueued") {
+				tmpMaxQueued, err = util.ParseInt(ruleI, "MaxQueued")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpMaxQueued < 1 {
+					b.Error(errors.New("MaxQueued must be at least 1"))
+					continue
+				}
+			}
+			tmpOrdered := pool.ordered
+			if util.KeyExists(ruleI, "Ordered") {
+				tmpOrdered, err = util.ParseBool(ruleI, "Ordered")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			path = tmpPath
+			tree = tmpTree
+			pool.size = tmpConcurrency
+			pool.maxQueued = tmpMaxQueued
+			for _, outMsg := range pool.setOrdered(tmpOrdered) {
+				b.out <- outMsg
+			}
+			pool.dispatch()
 		case <-b.quit:
 			// quit the block
+			pool.close()
 			return
-		case msg := <-b.in:
+		case msg := <-in:
 			// deal with inbound data
 			if tree == nil {
 				continue
@@ -81,35 +161,23 @@ func (b *GetHTTP) Run() {
 				continue
 			}
 
-			resp, err := client.Get(urlString)
-			if err != nil {
-				b.Error(err)
-				continue
+			pool.add(func() interface{} {
+				return b.get(client, urlString)
+			})
+		case j := <-pool.done:
+			for _, outMsg := range pool.finish(j) {
+				b.out <- outMsg
 			}
-			defer resp.Body.Close()
-
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				b.Error(err)
-				continue
-			}
-			var outMsg interface{}
-			// try treating the body as json first...
-			err = json.Unmarshal(body, &outMsg)
-
-			// if the json parsing fails, store data unparsed as "data"
-			if err != nil {
-				outMsg = map[string]interface{}{
-					"data": string(body),
-				}
-			}
-			b.out <- outMsg
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				"Path": path,
+				"Path":        path,
+				"Concurrency": float64(pool.size),
+				"MaxQueued":   float64(pool.maxQueued),
+				"Ordered":     pool.ordered,
 			}
-
+		case MsgChan := <-b.querystatus:
+			MsgChan <- pool.status()
 		}
 	}
 }
@@ -3,6 +3,7 @@ package library
 import (
 	"container/heap"
 	"errors"
+	"math"
 	"strconv"
 	"time"
 
@@ -16,6 +17,8 @@ type Histogram struct {
 	blocks.Block
 	queryrule chan blocks.MsgChan
 	historule chan blocks.MsgChan
+	quantile  chan blocks.Query
+	cdf       chan blocks.Query
 	inrule    blocks.MsgChan
 	inpoll    blocks.MsgChan
 	in        blocks.MsgChan
@@ -50,14 +53,95 @@ func buildHistogram(histogram map[string]*PriorityQueue) interface{} {
 	return data
 }
 
+// the window of a numeric histogram is covered by this many digests, so that
+// old values can be dropped a slice at a time.
+const histogramSlices = 10
+
+// mergeDigests combines the digests covering the window into one.
+func mergeDigests(pq *PriorityQueue, compression float64) *tDigest {
+	merged := newTDigest(compression)
+	for _, pqMsg := range *pq {
+		merged.Merge(pqMsg.val.(*tDigest))
+	}
+	return merged
+}
+
+// buildNumericHistogram counts the values that fall between each of the
+// bucket boundaries, along with the requested quantiles.
+func buildNumericHistogram(digest *tDigest, boundaries, quantiles []float64) interface{} {
+	edges := append([]float64{math.Inf(-1)}, boundaries...)
+	edges = append(edges, math.Inf(1))
+
+	buckets := make([]interface{}, 0, len(edges)-1)
+	previous := 0.0
+	for i := 1; i < len(edges); i++ {
+		cdf := 1.0
+		if !math.IsInf(edges[i], 1) {
+			cdf, _ = digest.CDF(edges[i])
+		}
+		var label string
+		switch {
+		case math.IsInf(edges[i-1], -1) && math.IsInf(edges[i], 1):
+			label = "all"
+		case math.IsInf(edges[i-1], -1):
+			label = "<=" + strconv.FormatFloat(edges[i], 'g', -1, 64)
+		case math.IsInf(edges[i], 1):
+			label = ">" + strconv.FormatFloat(edges[i-1], 'g', -1, 64)
+		default:
+			label = strconv.FormatFloat(edges[i-1], 'g', -1, 64) + "-" + strconv.FormatFloat(edges[i], 'g', -1, 64)
+		}
+		buckets = append(buckets, map[string]interface{}{
+			"Count": (cdf - previous) * digest.Count(),
+			"Label": label,
+		})
+		previous = cdf
+	}
+
+	return map[string]interface{}{
+		"Histogram": buckets,
+		"Quantiles": buildQuantiles(digest, quantiles),
+		"Count":     digest.Count(),
+	}
+}
+
+func buildQuantiles(digest *tDigest, quantiles []float64) []interface{} {
+	out := make([]interface{}, 0, len(quantiles))
+	for _, q := range quantiles {
+		v, err := digest.Quantile(q)
+		if err != nil {
+			continue
+		}
+		out = append(out, map[string]interface{}{
+			"Quantile": q,
+			"Value":    v,
+		})
+	}
+	return out
+}
+
+// parseQueryFloats reads every value of a query parameter as a number.
+func parseQueryFloats(params []string) ([]float64, error) {
+	out := make([]float64, len(params))
+	for i, p := range params {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = f
+	}
+	return out, nil
+}
+
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *Histogram) Setup() {
 	b.Kind = "Stats"
-	b.Desc = "builds a non-stationary histogram of inbound messages for a specified path"
+	b.Desc = "builds a non-stationary histogram of inbound messages for a specified path, optionally summarising numeric values with quantiles"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
 	b.historule = b.QueryRoute("histogram")
+	b.quantile = b.QueryParamRoute("quantile")
+	b.cdf = b.QueryParamRoute("cdf")
 	b.inpoll = b.InRoute("poll")
 	b.quit = b.Quit()
 	b.out = b.Broadcast()
@@ -70,7 +154,17 @@ func (b *Histogram) Run() {
 	waitTimer := time.NewTimer(100 * time.Millisecond)
 	window := time.Duration(0)
 
+	mode := "discrete"
+	compression := 100.0
+	boundaries := []float64{}
+	quantiles := []float64{0.5, 0.9, 0.99}
+
 	histogram := map[string]*PriorityQueue{}
+	digests := &PriorityQueue{}
+	heap.Init(digests)
+	var current *tDigest
+	var currentStart time.Time
+
 	emptyByte := make([]byte, 0)
 MainLoop:
 	for {
@@ -92,6 +186,64 @@ MainLoop:
 				break
 			}
 
+			// numeric mode is optional so that older rules still work
+			tmpMode := "discrete"
+			if util.KeyExists(ruleI, "Mode") {
+				tmpMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if tmpMode != "discrete" && tmpMode != "numeric" {
+				b.Error(errors.New("Mode must be either discrete or numeric"))
+				break
+			}
+			tmpCompression := compression
+			if util.KeyExists(ruleI, "Compression") {
+				tmpCompression, err = util.ParseFloat(ruleI, "Compression")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				if tmpCompression < 1 {
+					b.Error(errors.New("Compression must be at least 1"))
+					break
+				}
+			}
+			tmpBoundaries := boundaries
+			if util.KeyExists(ruleI, "Buckets") {
+				tmpBoundaries, err = util.ParseArrayFloat(ruleI, "Buckets")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				for i := 1; i < len(tmpBoundaries); i++ {
+					if tmpBoundaries[i] <= tmpBoundaries[i-1] {
+						b.Error(errors.New("Buckets must be in increasing order"))
+						continue MainLoop
+					}
+				}
+			}
+			tmpQuantiles := quantiles
+			if util.KeyExists(ruleI, "Quantiles") {
+				tmpQuantiles, err = util.ParseArrayFloat(ruleI, "Quantiles")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if tmpMode != mode {
+				histogram = map[string]*PriorityQueue{}
+				digests = &PriorityQueue{}
+				heap.Init(digests)
+				current = nil
+			}
+			mode = tmpMode
+			compression = tmpCompression
+			boundaries = tmpBoundaries
+			quantiles = tmpQuantiles
+
 		case <-b.quit:
 			// quit the block
 			return
@@ -105,6 +257,27 @@ MainLoop:
 				break
 			}
 
+			if mode == "numeric" {
+				val, ok := v.(float64)
+				if !ok {
+					b.Error(errors.New("numeric histograms need a number at Path"))
+					continue
+				}
+				// start a new digest once the current one covers its share
+				// of the window
+				now := time.Now()
+				if current == nil || now.Sub(currentStart) >= window/histogramSlices {
+					current = newTDigest(compression)
+					currentStart = now
+					heap.Push(digests, &PQMessage{
+						val: current,
+						t:   now,
+					})
+				}
+				current.Add(val)
+				break
+			}
+
 			var valueString string
 
 			switch v := v.(type) {
@@ -141,18 +314,75 @@ MainLoop:
 
 		case <-b.inpoll:
 			// deal with a poll request
+			if mode == "numeric" {
+				b.out <- buildNumericHistogram(mergeDigests(digests, compression), boundaries, quantiles)
+				break
+			}
 			data := buildHistogram(histogram)
 			b.out <- data
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			out := map[string]interface{}{
-				"Window": window.String(),
-				"Path":   path,
+				"Window":      window.String(),
+				"Path":        path,
+				"Mode":        mode,
+				"Compression": compression,
+				"Buckets":     boundaries,
+				"Quantiles":   quantiles,
 			}
 			MsgChan <- out
 		case MsgChan := <-b.historule:
+			if mode == "numeric" {
+				MsgChan <- buildNumericHistogram(mergeDigests(digests, compression), boundaries, quantiles)
+				break
+			}
 			data := buildHistogram(histogram)
 			MsgChan <- data
+		case q := <-b.quantile:
+			// ?q=0.5&q=0.99
+			qs, err := parseQueryFloats(q.Params["q"])
+			if err != nil {
+				b.Error(err)
+			}
+			q.RespChan <- map[string]interface{}{
+				"Quantiles": buildQuantiles(mergeDigests(digests, compression), qs),
+			}
+		case q := <-b.cdf:
+			// ?x=100&x=250
+			xs, err := parseQueryFloats(q.Params["x"])
+			if err != nil {
+				b.Error(err)
+			}
+			digest := mergeDigests(digests, compression)
+			out := make([]interface{}, 0, len(xs))
+			for _, x := range xs {
+				p, err := digest.CDF(x)
+				if err != nil {
+					continue
+				}
+				out = append(out, map[string]interface{}{
+					"Value": x,
+					"CDF":   p,
+				})
+			}
+			q.RespChan <- map[string]interface{}{
+				"CDF": out,
+			}
+		}
+		for {
+			pqMsg, diff := digests.PeekAndShift(time.Now(), window)
+			if pqMsg == nil {
+				if mode == "numeric" {
+					if diff == 0 {
+						diff = time.Duration(500) * time.Millisecond
+					}
+					waitTimer.Reset(diff)
+				}
+				break
+			}
+			if pqMsg.(*PQMessage).val == current {
+				current = nil
+			}
 		}
 		for _, pq := range histogram {
 			for {
@@ -7,23 +7,34 @@ import (
 )
 
 var Blocks = map[string]func() blocks.BlockInterface{
+	"anomaly":            NewAnomaly,
 	"bang":               NewBang,
 	"cache":              NewCache,
 	"categorical":        NewCategorical,
 	"count":              NewCount,
+	"decode":             NewDecode,
 	"dedupe":             NewDeDupe,
 	"fft":                NewFFT,
 	"filter":             NewFilter,
 	"fromamqp":           NewFromAMQP,
+	"fromavro":           NewFromAvro,
 	"fromemail":          NewFromEmail,
+	"fromfeed":           NewFromFeed,
 	"fromfile":           NewFromFile,
 	"fromHTTPGetRequest": NewFromHTTPGetRequest,
 	"fromhttpstream":     NewFromHTTPStream,
+	"fromkafka":          NewFromKafka,
+	"frommqtt":           NewFromMQTT,
 	"fromnsq":            NewFromNSQ,
+	"fromparquet":        NewFromParquet,
+	"fromredis":          NewFromRedis,
 	"frompost":           NewFromPost,
 	"fromsqs":            NewFromSQS,
+	"fromsyslog":         NewFromSyslog,
+	"fromtcp":            NewFromTCP,
 	"fromwebsocket":      NewFromWebsocket,
 	"fromudp":            NewFromUDP,
+	"fromunix":           NewFromUnix,
 	"gaussian":           NewGaussian,
 	"gethttp":            NewGetHTTP,
 	"histogram":          NewHistogram,
@@ -41,14 +52,20 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"parsecsv":           NewParseCSV,
 	"parsexml":           NewParseXML,
 	"poisson":            NewPoisson,
+	"pollhttp":           NewPollHTTP,
 	"javascript":         NewJavascript,
 	"queue":              NewQueue,
 	"redis":              NewRedis,
+	"sample":             NewSample,
 	"set":                NewSet,
+	"sqlquery":           NewSQLQuery,
 	"sync":               NewSync,
+	"switch":             NewSwitch,
 	"ticker":             NewTicker,
+	"throttle":           NewThrottle,
 	"timeseries":         NewTimeseries,
 	"toamqp":             NewToAMQP,
+	"toavro":             NewToAvro,
 	"tobeanstalkd":       NewToBeanstalkd,
 	"toelasticsearch":    NewToElasticsearch,
 	"toemail":            NewToEmail,
@@ -57,11 +74,18 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"toHTTPGetRequest":   NewToHTTPGetRequest,
 	"tolog":              NewToLog,
 	"tomongodb":          NewToMongoDB,
+	"tokafka":            NewToKafka,
+	"tomqtt":             NewToMQTT,
 	"tonsq":              NewToNSQ,
 	"tonsqmulti":         NewToNSQMulti,
+	"toparquet":          NewToParquet,
+	"tosql":              NewToSQL,
+	"totcp":              NewToTCP,
+	"tounix":             NewToUnix,
 	"unpack":             NewUnpack,
 	"webRequest":         NewWebRequest,
 	"zipf":               NewZipf,
+	"encode":             NewEncode,
 	"exponential":        NewExponential,
 }
 
@@ -8,23 +8,34 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"analogPin":          NewAnalogPin,
 	"digitalpin":         NewDigitalPin,
 	"todigitalpin":       NewToDigitalPin,
+	"anomaly":            NewAnomaly,
 	"bang":               NewBang,
 	"cache":              NewCache,
 	"categorical":        NewCategorical,
 	"count":              NewCount,
+	"decode":             NewDecode,
 	"dedupe":             NewDeDupe,
 	"fft":                NewFFT,
 	"filter":             NewFilter,
 	"fromamqp":           NewFromAMQP,
+	"fromavro":           NewFromAvro,
 	"fromemail":          NewFromEmail,
+	"fromfeed":           NewFromFeed,
 	"fromfile":           NewFromFile,
 	"fromHTTPGetRequest": NewFromHTTPGetRequest,
 	"fromhttpstream":     NewFromHTTPStream,
+	"fromkafka":          NewFromKafka,
+	"frommqtt":           NewFromMQTT,
 	"fromnsq":            NewFromNSQ,
+	"fromparquet":        NewFromParquet,
+	"fromredis":          NewFromRedis,
 	"frompost":           NewFromPost,
 	"fromsqs":            NewFromSQS,
+	"fromsyslog":         NewFromSyslog,
+	"fromtcp":            NewFromTCP,
 	"fromwebsocket":      NewFromWebsocket,
 	"fromudp":            NewFromUDP,
+	"fromunix":           NewFromUnix,
 	"gaussian":           NewGaussian,
 	"gethttp":            NewGetHTTP,
 	"histogram":          NewHistogram,
@@ -42,14 +53,20 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"parsecsv":           NewParseCSV,
 	"parsexml":           NewParseXML,
 	"poisson":            NewPoisson,
+	"pollhttp":           NewPollHTTP,
 	"javascript":         NewJavascript,
 	"queue":              NewQueue,
 	"redis":              NewRedis,
+	"sample":             NewSample,
 	"set":                NewSet,
+	"sqlquery":           NewSQLQuery,
 	"sync":               NewSync,
+	"switch":             NewSwitch,
 	"ticker":             NewTicker,
+	"throttle":           NewThrottle,
 	"timeseries":         NewTimeseries,
 	"toamqp":             NewToAMQP,
+	"toavro":             NewToAvro,
 	"tobeanstalkd":       NewToBeanstalkd,
 	"toelasticsearch":    NewToElasticsearch,
 	"toemail":            NewToEmail,
@@ -58,11 +75,18 @@ var Blocks = map[string]func() blocks.BlockInterface{
 	"toHTTPGetRequest":   NewToHTTPGetRequest,
 	"tolog":              NewToLog,
 	"tomongodb":          NewToMongoDB,
+	"tokafka":            NewToKafka,
+	"tomqtt":             NewToMQTT,
 	"tonsq":              NewToNSQ,
 	"tonsqmulti":         NewToNSQMulti,
+	"toparquet":          NewToParquet,
+	"tosql":              NewToSQL,
+	"totcp":              NewToTCP,
+	"tounix":             NewToUnix,
 	"unpack":             NewUnpack,
 	"webRequest":         NewWebRequest,
 	"zipf":               NewZipf,
+	"encode":             NewEncode,
 	"exponential":        NewExponential,
 }
 
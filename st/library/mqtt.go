@@ -0,0 +1,106 @@
+package library
+
+import (
+	"errors"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang" // mqtt
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// mqttRule holds the rule shared by the fromMQTT and toMQTT blocks.
+type mqttRule struct {
+	broker       string
+	clientID     string
+	username     string
+	password     string
+	qos          int
+	cleanSession bool
+}
+
+// parseMQTTRule reads the connection part of an MQTT rule. Everything is
+// optional, connecting to a local broker with QoS 0 by default.
+func parseMQTTRule(ruleI interface{}) (*mqttRule, error) {
+	var err error
+	r := &mqttRule{
+		broker:       "tcp://localhost:1883",
+		cleanSession: true,
+	}
+	if util.KeyExists(ruleI, "Broker") {
+		r.broker, err = util.ParseRequiredString(ruleI, "Broker")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if util.KeyExists(ruleI, "ClientID") {
+		r.clientID, err = util.ParseString(ruleI, "ClientID")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if util.KeyExists(ruleI, "Username") {
+		r.username, err = util.ParseString(ruleI, "Username")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if util.KeyExists(ruleI, "Password") {
+		r.password, err = util.ParseString(ruleI, "Password")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if util.KeyExists(ruleI, "QoS") {
+		r.qos, err = util.ParseInt(ruleI, "QoS")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.qos < 0 || r.qos > 2 {
+		return nil, errors.New("QoS must be 0, 1 or 2")
+	}
+	if util.KeyExists(ruleI, "CleanSession") {
+		r.cleanSession, err = util.ParseBool(ruleI, "CleanSession")
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the broker can only keep a session for a client it can recognise
+	if !r.cleanSession && r.clientID == "" {
+		return nil, errors.New("a ClientID is needed to keep the session")
+	}
+	return r, nil
+}
+
+// ruleMsg is the rule as the rule query route returns it.
+func (r *mqttRule) ruleMsg() map[string]interface{} {
+	return map[string]interface{}{
+		"Broker":       r.broker,
+		"ClientID":     r.clientID,
+		"Username":     r.username,
+		"Password":     r.password,
+		"QoS":          float64(r.qos),
+		"CleanSession": r.cleanSession,
+	}
+}
+
+// connect starts connecting to the broker. The client keeps trying until it
+// connects, and reconnects whenever the connection is lost, calling
+// onConnect each time it's connected.
+func (r *mqttRule) connect(onConnect mqtt.OnConnectHandler, onLost mqtt.ConnectionLostHandler) mqtt.Client {
+	opts := mqtt.NewClientOptions().
+		AddBroker(r.broker).
+		SetClientID(r.clientID).
+		SetUsername(r.username).
+		SetPassword(r.password).
+		SetCleanSession(r.cleanSession).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(time.Duration(1) * time.Second).
+		SetMaxReconnectInterval(time.Duration(1) * time.Minute).
+		SetOnConnectHandler(onConnect).
+		SetConnectionLostHandler(onLost)
+	client := mqtt.NewClient(opts)
+	client.Connect()
+	return client
+}
@@ -0,0 +1,294 @@
+package library
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// msgpackCodec converts between MessagePack and messages.
+type msgpackCodec struct{}
+
+func (m msgpackCodec) Decode(data []byte) (interface{}, error) {
+	r := bytes.NewReader(data)
+	v, err := decodeMsgpack(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, errors.New("trailing data after MessagePack value")
+	}
+	return v, nil
+}
+
+func (m msgpackCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := encodeMsgpack(&buf, v)
+	return buf.Bytes(), err
+}
+
+func readMsgpackUint(r *bytes.Reader, size int) (uint64, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func readMsgpackBytes(r *bytes.Reader, n uint64) ([]byte, error) {
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+// decodeMsgpack reads one value. Numbers become float64s, and strings and
+// binary both become strings, as they would coming from JSON.
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return float64(c), nil
+	case c >= 0xe0:
+		return float64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return decodeMsgpackMap(r, uint64(c&0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return decodeMsgpackArray(r, uint64(c&0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := readMsgpackBytes(r, uint64(c&0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		// bin and str
+		size := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		n, err := readMsgpackUint(r, size)
+		if err != nil {
+			return nil, err
+		}
+		b, err := readMsgpackBytes(r, n)
+		return string(b), err
+	case 0xc7, 0xc8, 0xc9, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		// extension types are passed on as their type and data
+		var n uint64
+		switch c {
+		case 0xc7, 0xc8, 0xc9:
+			n, err = readMsgpackUint(r, map[byte]int{0xc7: 1, 0xc8: 2, 0xc9: 4}[c])
+			if err != nil {
+				return nil, err
+			}
+		default:
+			n = 1 << (c - 0xd4)
+		}
+		t, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b, err := readMsgpackBytes(r, n)
+		return map[string]interface{}{
+			"ExtType": float64(int8(t)),
+			"Data":    string(b),
+		}, err
+	case 0xca:
+		n, err := readMsgpackUint(r, 4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := readMsgpackUint(r, 8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := readMsgpackUint(r, 1<<(c-0xcc))
+		return float64(n), err
+	case 0xd0:
+		n, err := readMsgpackUint(r, 1)
+		return float64(int8(n)), err
+	case 0xd1:
+		n, err := readMsgpackUint(r, 2)
+		return float64(int16(n)), err
+	case 0xd2:
+		n, err := readMsgpackUint(r, 4)
+		return float64(int32(n)), err
+	case 0xd3:
+		n, err := readMsgpackUint(r, 8)
+		return float64(int64(n)), err
+	case 0xdc, 0xdd:
+		n, err := readMsgpackUint(r, map[byte]int{0xdc: 2, 0xdd: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(r, n)
+	case 0xde, 0xdf:
+		n, err := readMsgpackUint(r, map[byte]int{0xde: 2, 0xdf: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(r, n)
+	}
+	return nil, errors.New("unknown MessagePack type 0x" + strconv.FormatUint(uint64(c), 16))
+}
+
+func decodeMsgpackArray(r *bytes.Reader, n uint64) (interface{}, error) {
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	items := make([]interface{}, n)
+	for i := range items {
+		var err error
+		items[i], err = decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+func decodeMsgpackMap(r *bytes.Reader, n uint64) (interface{}, error) {
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	m := make(map[string]interface{})
+	for i := uint64(0); i < n; i++ {
+		k, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		var key string
+		switch value := k.(type) {
+		case string:
+			key = value
+		case float64:
+			key = strconv.FormatFloat(value, 'f', -1, 64)
+		case bool:
+			key = strconv.FormatBool(value)
+		default:
+			return nil, errors.New("MessagePack map keys must be strings, numbers or booleans")
+		}
+		m[key], err = decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func writeMsgpackHeader(buf *bytes.Buffer, fix byte, fixMax uint64, codes [3]byte, n uint64) {
+	switch {
+	case n <= fixMax && fix != 0:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint8 && codes[0] != 0:
+		buf.WriteByte(codes[0])
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(codes[1])
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(codes[2])
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// encodeMsgpack writes v using the smallest MessagePack type that holds it.
+// Whole numbers are written as integers.
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch value := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if value {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		return encodeMsgpack(buf, float64(value))
+	case int64:
+		return encodeMsgpack(buf, float64(value))
+	case float32:
+		return encodeMsgpack(buf, float64(value))
+	case float64:
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(value))
+			break
+		}
+		n := int64(value)
+		switch {
+		case n >= 0 && n <= 0x7f:
+			buf.WriteByte(byte(n))
+		case n < 0 && n >= -32:
+			buf.WriteByte(byte(int8(n)))
+		case n >= 0 && n <= math.MaxUint8:
+			buf.Write([]byte{0xcc, byte(n)})
+		case n >= 0 && n <= math.MaxUint16:
+			buf.WriteByte(0xcd)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		case n >= 0 && n <= math.MaxUint32:
+			buf.WriteByte(0xce)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		case n >= 0:
+			buf.WriteByte(0xcf)
+			binary.Write(buf, binary.BigEndian, uint64(n))
+		case n >= math.MinInt8:
+			buf.Write([]byte{0xd0, byte(int8(n))})
+		case n >= math.MinInt16:
+			buf.WriteByte(0xd1)
+			binary.Write(buf, binary.BigEndian, int16(n))
+		case n >= math.MinInt32:
+			buf.WriteByte(0xd2)
+			binary.Write(buf, binary.BigEndian, int32(n))
+		default:
+			buf.WriteByte(0xd3)
+			binary.Write(buf, binary.BigEndian, n)
+		}
+	case string:
+		writeMsgpackHeader(buf, 0xa0, 31, [3]byte{0xd9, 0xda, 0xdb}, uint64(len(value)))
+		buf.WriteString(value)
+	case []byte:
+		writeMsgpackHeader(buf, 0, 0, [3]byte{0xc4, 0xc5, 0xc6}, uint64(len(value)))
+		buf.Write(value)
+	case []interface{}:
+		writeMsgpackHeader(buf, 0x90, 15, [3]byte{0, 0xdc, 0xdd}, uint64(len(value)))
+		for _, item := range value {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, 0x80, 15, [3]byte{0, 0xde, 0xdf}, uint64(len(value)))
+		// sort the keys so the same message always encodes the same way
+		keys := make([]string, 0, len(value))
+		for k := range value {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, value[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("can't encode this value as MessagePack")
+	}
+	return nil
+}
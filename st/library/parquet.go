@@ -0,0 +1,1169 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"time"
+
+	"code.google.com/p/snappy-go/snappy"
+)
+
+// parquetMagic starts and ends every Parquet file.
+const parquetMagic = "PAR1"
+
+// Parquet's physical types.
+const (
+	parquetBoolean           = 0
+	parquetInt32             = 1
+	parquetInt64             = 2
+	parquetInt96             = 3
+	parquetFloat             = 4
+	parquetDouble            = 5
+	parquetByteArray         = 6
+	parquetFixedLenByteArray = 7
+)
+
+var parquetTypeNames = []string{"BOOLEAN", "INT32", "INT64", "INT96", "FLOAT", "DOUBLE", "BYTE_ARRAY", "FIXED_LEN_BYTE_ARRAY"}
+
+// the converted types that change how we read a column
+const (
+	parquetNoConversion = -1
+	parquetUTF8         = 0
+	parquetEnum         = 4
+	parquetJSON         = 19
+)
+
+// encodings
+const (
+	parquetPlain           = 0
+	parquetPlainDictionary = 2
+	parquetRLE             = 3
+	parquetRLEDictionary   = 8
+)
+
+// page types
+const (
+	parquetDataPage       = 0
+	parquetDictionaryPage = 2
+	parquetDataPageV2     = 3
+)
+
+// parquetCodecs are the compression codecs we can write, and their numbers
+// in the file.
+var parquetCodecs = map[string]int32{
+	"none":   0,
+	"snappy": 1,
+	"gzip":   2,
+}
+
+// parquetMaxPageValues bounds the values we'll decode from one page, which is
+// far more than any writer puts in a page.
+const parquetMaxPageValues = 1 << 24
+
+// Parquet's metadata is written with Thrift's compact protocol. We read it
+// into maps of field id to value, with integers as int64s, binary as []byte,
+// lists as []interface{} and structs as thriftStructs.
+type thriftStruct map[int16]interface{}
+
+// Thrift compact protocol types
+const (
+	thriftTrue       = 1
+	thriftFalse      = 2
+	thriftByte       = 3
+	thriftI16        = 4
+	thriftI32        = 5
+	thriftI64        = 6
+	thriftDouble     = 7
+	thriftBinary     = 8
+	thriftList       = 9
+	thriftSet        = 10
+	thriftMap        = 11
+	thriftStructType = 12
+)
+
+type thriftReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readThriftStruct(r thriftReader, depth int) (thriftStruct, error) {
+	if depth > 32 {
+		return nil, errors.New("Parquet metadata is nested too deeply")
+	}
+	s := thriftStruct{}
+	var id int16
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == 0 {
+			return s, nil
+		}
+		t := b & 0x0f
+		if delta := int16(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			n, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, err
+			}
+			id = int16(n)
+		}
+		// booleans are written in the field's type
+		switch t {
+		case thriftTrue:
+			s[id] = true
+		case thriftFalse:
+			s[id] = false
+		default:
+			s[id], err = readThriftValue(r, t, depth)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func readThriftValue(r thriftReader, t byte, depth int) (interface{}, error) {
+	switch t {
+	case thriftTrue, thriftFalse:
+		// in lists, booleans are a byte each
+		b, err := r.ReadByte()
+		return b == thriftTrue, err
+	case thriftByte:
+		b, err := r.ReadByte()
+		return int64(int8(b)), err
+	case thriftI16, thriftI32, thriftI64:
+		return binary.ReadVarint(r)
+	case thriftDouble:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), nil
+	case thriftBinary:
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt32 {
+			return nil, errors.New("string in Parquet metadata is too long")
+		}
+		return readLength(r, int64(n))
+	case thriftList, thriftSet:
+		h, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(h >> 4)
+		if size == 15 {
+			size, err = binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		// every element takes at least a byte, so a bad size runs out of
+		// file rather than memory
+		var list []interface{}
+		for i := uint64(0); i < size; i++ {
+			v, err := readThriftValue(r, h&0x0f, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case thriftMap:
+		// nothing we read uses maps, so they're skipped
+		size, err := binary.ReadUvarint(r)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+		h, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint64(0); i < size; i++ {
+			if _, err := readThriftValue(r, h>>4, depth+1); err != nil {
+				return nil, err
+			}
+			if _, err := readThriftValue(r, h&0x0f, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	case thriftStructType:
+		return readThriftStruct(r, depth+1)
+	}
+	return nil, errors.New("unknown type in Parquet metadata")
+}
+
+func (s thriftStruct) has(id int16) bool {
+	_, ok := s[id]
+	return ok
+}
+
+func (s thriftStruct) int(id int16) int64 {
+	n, _ := s[id].(int64)
+	return n
+}
+
+func (s thriftStruct) bool(id int16) bool {
+	b, _ := s[id].(bool)
+	return b
+}
+
+func (s thriftStruct) str(id int16) string {
+	b, _ := s[id].([]byte)
+	return string(b)
+}
+
+func (s thriftStruct) list(id int16) []interface{} {
+	l, _ := s[id].([]interface{})
+	return l
+}
+
+func (s thriftStruct) child(id int16) thriftStruct {
+	c, _ := s[id].(thriftStruct)
+	return c
+}
+
+// thriftField is a field of a struct we're writing. Values can be bool,
+// int32, int64, string, []thriftField for a struct, or a list of int32s,
+// strings or structs.
+type thriftField struct {
+	id    int16
+	value interface{}
+}
+
+type thriftWriter struct {
+	bytes.Buffer
+}
+
+// writeStruct writes fields, which must be in order of their ids.
+func (w *thriftWriter) writeStruct(fields []thriftField) {
+	var last int16
+	for _, f := range fields {
+		var t byte
+		switch v := f.value.(type) {
+		case bool:
+			t = thriftFalse
+			if v {
+				t = thriftTrue
+			}
+		case int32:
+			t = thriftI32
+		case int64:
+			t = thriftI64
+		case string:
+			t = thriftBinary
+		case []thriftField:
+			t = thriftStructType
+		default:
+			t = thriftList
+		}
+		if delta := f.id - last; delta > 0 && delta <= 15 {
+			w.WriteByte(byte(delta<<4) | t)
+		} else {
+			w.WriteByte(t)
+			w.writeVarint(int64(f.id))
+		}
+		last = f.id
+		if t != thriftTrue && t != thriftFalse {
+			w.writeValue(f.value)
+		}
+	}
+	w.WriteByte(0)
+}
+
+func (w *thriftWriter) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case int32:
+		w.writeVarint(int64(v))
+	case int64:
+		w.writeVarint(v)
+	case string:
+		w.writeUvarint(uint64(len(v)))
+		w.WriteString(v)
+	case []thriftField:
+		w.writeStruct(v)
+	case []int32:
+		w.writeListHeader(len(v), thriftI32)
+		for _, n := range v {
+			w.writeVarint(int64(n))
+		}
+	case []string:
+		w.writeListHeader(len(v), thriftBinary)
+		for _, s := range v {
+			w.writeValue(s)
+		}
+	case [][]thriftField:
+		w.writeListHeader(len(v), thriftStructType)
+		for _, s := range v {
+			w.writeStruct(s)
+		}
+	}
+}
+
+func (w *thriftWriter) writeListHeader(n int, t byte) {
+	if n < 15 {
+		w.WriteByte(byte(n<<4) | t)
+		return
+	}
+	w.WriteByte(0xf0 | t)
+	w.writeUvarint(uint64(n))
+}
+
+func (w *thriftWriter) writeVarint(n int64) {
+	var b [binary.MaxVarintLen64]byte
+	// Thrift's compact integers are zig-zag varints, like Avro's
+	w.Write(b[:binary.PutVarint(b[:], n)])
+}
+
+func (w *thriftWriter) writeUvarint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+// encodeRLE writes definition levels with Parquet's RLE/bit-packing hybrid
+// encoding. We only ever write runs, which suits levels that are mostly the
+// same.
+func encodeRLE(levels []int, bitWidth int) []byte {
+	var buf bytes.Buffer
+	var b [binary.MaxVarintLen64]byte
+	width := (bitWidth + 7) / 8
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		buf.Write(b[:binary.PutUvarint(b[:], uint64(j-i)<<1)])
+		for k := 0; k < width; k++ {
+			buf.WriteByte(byte(levels[i] >> uint(8*k)))
+		}
+		i = j
+	}
+	return buf.Bytes()
+}
+
+// decodeRLE reads n values written with the RLE/bit-packing hybrid encoding.
+func decodeRLE(r *bytes.Reader, bitWidth int, n int) ([]int, error) {
+	if bitWidth > 32 {
+		return nil, errors.New("bad bit width in Parquet data")
+	}
+	var values []int
+	width := (bitWidth + 7) / 8
+	for len(values) < n {
+		header, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if header&1 == 0 {
+			// a run of the same value
+			v := 0
+			for k := 0; k < width; k++ {
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				v |= int(b) << uint(8*k)
+			}
+			for count := header >> 1; count > 0 && len(values) < n; count-- {
+				values = append(values, v)
+			}
+			continue
+		}
+		// groups of eight values packed from the least significant bit
+		groups := header >> 1
+		if groups*uint64(bitWidth) > uint64(r.Len()) {
+			return nil, errors.New("bit-packed run is longer than its Parquet page")
+		}
+		packed := make([]byte, int(groups)*bitWidth)
+		if _, err := io.ReadFull(r, packed); err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(groups)*8 && len(values) < n; i++ {
+			v := 0
+			for bit := 0; bit < bitWidth; bit++ {
+				pos := i*bitWidth + bit
+				if packed[pos/8]&(1<<uint(pos%8)) != 0 {
+					v |= 1 << uint(bit)
+				}
+			}
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+func parquetCompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "snappy":
+		return snappy.Encode(nil, data)
+	case "gzip":
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		if err := gz.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return data, nil
+}
+
+// parquetDecompress uncompresses a page, which should come to size bytes.
+func parquetDecompress(codec int64, data []byte, size int64) ([]byte, error) {
+	switch codec {
+	case 0:
+		return data, nil
+	case 1:
+		// check the length snappy starts with before it allocates that much
+		n, _ := binary.Uvarint(data)
+		if int64(n) != size {
+			return nil, errors.New("Parquet page is the wrong size")
+		}
+		return snappy.Decode(nil, data)
+	case 2:
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		page, err := ioutil.ReadAll(io.LimitReader(gz, size+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(page)) != size {
+			return nil, errors.New("Parquet page is the wrong size")
+		}
+		return page, nil
+	}
+	return nil, errors.New("unsupported Parquet compression codec " + strconv.FormatInt(codec, 10))
+}
+
+// parquetColumn is a column of a flat Parquet file, one without nested
+// groups or repeated fields.
+type parquetColumn struct {
+	name      string
+	typ       int32
+	length    int32
+	converted int32
+	optional  bool
+}
+
+// parquetColumns lays out a record schema as Parquet columns. Fields that are
+// records, arrays, maps or unions of more than one type are written as JSON.
+func parquetColumns(schema *avroSchema) ([]parquetColumn, error) {
+	if schema.Type != "record" {
+		return nil, errors.New("Parquet schemas must be a record")
+	}
+	columns := make([]parquetColumn, len(schema.Fields))
+	for i, f := range schema.Fields {
+		c := parquetColumn{name: f.Name, converted: parquetNoConversion}
+		t := f.Type
+		if t.Type == "union" {
+			var branches []*avroSchema
+			for _, branch := range t.Branches {
+				if branch.Type == "null" {
+					c.optional = true
+					continue
+				}
+				branches = append(branches, branch)
+			}
+			if len(branches) == 1 {
+				t = branches[0]
+			}
+		}
+		switch t.Type {
+		case "boolean":
+			c.typ = parquetBoolean
+		case "int":
+			c.typ = parquetInt32
+		case "long":
+			c.typ = parquetInt64
+		case "float":
+			c.typ = parquetFloat
+		case "double":
+			c.typ = parquetDouble
+		case "string":
+			c.typ = parquetByteArray
+			c.converted = parquetUTF8
+		case "enum":
+			c.typ = parquetByteArray
+			c.converted = parquetEnum
+		case "bytes":
+			c.typ = parquetByteArray
+		case "fixed":
+			c.typ = parquetFixedLenByteArray
+			c.length = int32(t.Size)
+		case "null":
+			c.typ = parquetByteArray
+			c.converted = parquetJSON
+			c.optional = true
+		default:
+			c.typ = parquetByteArray
+			c.converted = parquetJSON
+		}
+		columns[i] = c
+	}
+	return columns, nil
+}
+
+// encodePlain writes v with the plain encoding, except for booleans, which
+// are written a byte each and packed into bits when the page is written.
+func (c *parquetColumn) encodePlain(buf *bytes.Buffer, v interface{}) error {
+	if c.converted == parquetJSON {
+		j, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(len(j)))
+		buf.Write(j)
+		return nil
+	}
+	if c.typ == parquetBoolean {
+		b, ok := v.(bool)
+		if !ok {
+			return errors.New(c.name + " must be a boolean")
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return nil
+	}
+	if n, ok := numberValue(v); ok {
+		switch c.typ {
+		case parquetInt32:
+			if n != math.Trunc(n) || n < math.MinInt32 || n > math.MaxInt32 {
+				return errors.New(c.name + " must be a 32 bit integer")
+			}
+			return binary.Write(buf, binary.LittleEndian, int32(n))
+		case parquetInt64:
+			if n != math.Trunc(n) {
+				return errors.New(c.name + " must be an integer")
+			}
+			return binary.Write(buf, binary.LittleEndian, int64(n))
+		case parquetFloat:
+			return binary.Write(buf, binary.LittleEndian, float32(n))
+		case parquetDouble:
+			return binary.Write(buf, binary.LittleEndian, n)
+		}
+		return errors.New(c.name + " can't be a number")
+	}
+	var b []byte
+	switch value := v.(type) {
+	case string:
+		b = []byte(value)
+	case []byte:
+		b = value
+	default:
+		return errors.New(c.name + " must be a " + parquetTypeNames[c.typ])
+	}
+	switch c.typ {
+	case parquetByteArray:
+		binary.Write(buf, binary.LittleEndian, uint32(len(b)))
+	case parquetFixedLenByteArray:
+		if len(b) != int(c.length) {
+			return errors.New(c.name + " must be " + strconv.Itoa(int(c.length)) + " bytes long")
+		}
+	default:
+		return errors.New(c.name + " must be a " + parquetTypeNames[c.typ])
+	}
+	buf.Write(b)
+	return nil
+}
+
+// decodePlain reads n values written with the plain encoding.
+func (c *parquetColumn) decodePlain(r *bytes.Reader, n int) ([]interface{}, error) {
+	var values []interface{}
+	var b byte
+	var err error
+	for i := 0; i < n; i++ {
+		switch c.typ {
+		case parquetBoolean:
+			if i%8 == 0 {
+				b, err = r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+			}
+			values = append(values, b&(1<<uint(i%8)) != 0)
+		case parquetInt32:
+			var v int32
+			err = binary.Read(r, binary.LittleEndian, &v)
+			values = append(values, float64(v))
+		case parquetInt64:
+			var v int64
+			err = binary.Read(r, binary.LittleEndian, &v)
+			values = append(values, float64(v))
+		case parquetInt96:
+			var v []byte
+			v, err = readLength(r, 12)
+			if err == nil {
+				values = append(values, parquetInt96Time(v))
+			}
+		case parquetFloat:
+			var v float32
+			err = binary.Read(r, binary.LittleEndian, &v)
+			values = append(values, float64(v))
+		case parquetDouble:
+			var v float64
+			err = binary.Read(r, binary.LittleEndian, &v)
+			values = append(values, v)
+		case parquetByteArray, parquetFixedLenByteArray:
+			length := int64(c.length)
+			if c.typ == parquetByteArray {
+				var l uint32
+				if err = binary.Read(r, binary.LittleEndian, &l); err != nil {
+					return nil, err
+				}
+				length = int64(l)
+			}
+			if length > int64(r.Len()) {
+				return nil, errors.New("value is longer than its Parquet page")
+			}
+			var v []byte
+			v, err = readLength(r, length)
+			if err != nil {
+				return nil, err
+			}
+			var value interface{}
+			value, err = c.byteValue(v)
+			values = append(values, value)
+		default:
+			return nil, errors.New("unknown Parquet type " + strconv.Itoa(int(c.typ)))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// byteValue turns a byte array into a string, or, for JSON columns, into
+// whatever the JSON holds.
+func (c *parquetColumn) byteValue(b []byte) (interface{}, error) {
+	if c.converted == parquetJSON {
+		var v interface{}
+		err := json.Unmarshal(b, &v)
+		return v, err
+	}
+	return string(b), nil
+}
+
+// parquetInt96Time reads the nanoseconds and Julian day that older writers
+// use for timestamps.
+func parquetInt96Time(b []byte) string {
+	nanos := int64(binary.LittleEndian.Uint64(b[:8]))
+	days := int64(binary.LittleEndian.Uint32(b[8:]))
+	// the Julian day of the Unix epoch
+	return time.Unix((days-2440588)*86400, nanos).UTC().Format(time.RFC3339Nano)
+}
+
+// parquetWriter writes rows to a Parquet file, buffering them into row
+// groups. The file isn't readable until it's closed and the footer that
+// describes it is written.
+type parquetWriter struct {
+	w         io.Writer
+	offset    int64
+	columns   []parquetColumn
+	codec     string
+	values    []bytes.Buffer
+	levels    [][]int
+	count     int
+	rows      int64
+	rowGroups [][]thriftField
+}
+
+func newParquetWriter(w io.Writer, columns []parquetColumn, codec string) (*parquetWriter, error) {
+	if _, ok := parquetCodecs[codec]; !ok {
+		return nil, errors.New("Parquet codec must be none, snappy or gzip")
+	}
+	p := &parquetWriter{
+		w:       w,
+		columns: columns,
+		codec:   codec,
+		values:  make([]bytes.Buffer, len(columns)),
+		levels:  make([][]int, len(columns)),
+	}
+	n, err := io.WriteString(w, parquetMagic)
+	p.offset += int64(n)
+	return p, err
+}
+
+// Append adds a row to the current row group. Fields missing from the row
+// are null.
+func (p *parquetWriter) Append(v interface{}) error {
+	record, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("Parquet rows must be objects")
+	}
+	// encode the whole row before adding any of it, so that a bad row
+	// doesn't leave the columns different lengths
+	encoded := make([]*bytes.Buffer, len(p.columns))
+	for i := range p.columns {
+		c := &p.columns[i]
+		value := record[c.name]
+		if value == nil {
+			if !c.optional {
+				return errors.New(c.name + " can't be null")
+			}
+			continue
+		}
+		encoded[i] = &bytes.Buffer{}
+		if err := c.encodePlain(encoded[i], value); err != nil {
+			return err
+		}
+	}
+	for i := range p.columns {
+		if encoded[i] == nil {
+			p.levels[i] = append(p.levels[i], 0)
+			continue
+		}
+		p.levels[i] = append(p.levels[i], 1)
+		p.values[i].Write(encoded[i].Bytes())
+	}
+	p.count++
+	return nil
+}
+
+// Flush writes the current row group, with a single page for each column.
+func (p *parquetWriter) Flush() error {
+	if p.count == 0 {
+		return nil
+	}
+	var chunks [][]thriftField
+	var total int64
+	for i, c := range p.columns {
+		var page bytes.Buffer
+		if c.optional {
+			levels := encodeRLE(p.levels[i], 1)
+			binary.Write(&page, binary.LittleEndian, uint32(len(levels)))
+			page.Write(levels)
+		}
+		values := p.values[i].Bytes()
+		if c.typ == parquetBoolean {
+			packed := make([]byte, (len(values)+7)/8)
+			for j, b := range values {
+				packed[j/8] |= b << uint(j%8)
+			}
+			values = packed
+		}
+		page.Write(values)
+		data, err := parquetCompress(p.codec, page.Bytes())
+		if err != nil {
+			return err
+		}
+
+		var header thriftWriter
+		header.writeStruct([]thriftField{
+			{1, int32(parquetDataPage)},
+			{2, int32(page.Len())},
+			{3, int32(len(data))},
+			{5, []thriftField{
+				{1, int32(p.count)},
+				{2, int32(parquetPlain)},
+				{3, int32(parquetRLE)},
+				{4, int32(parquetRLE)},
+			}},
+		})
+		offset := p.offset
+		if _, err := p.w.Write(header.Bytes()); err != nil {
+			return err
+		}
+		if _, err := p.w.Write(data); err != nil {
+			return err
+		}
+		p.offset += int64(header.Len() + len(data))
+
+		uncompressed := int64(header.Len() + page.Len())
+		total += uncompressed
+		chunks = append(chunks, []thriftField{
+			{2, offset},
+			{3, []thriftField{
+				{1, c.typ},
+				{2, []int32{parquetPlain, parquetRLE}},
+				{3, []string{c.name}},
+				{4, parquetCodecs[p.codec]},
+				{5, int64(p.count)},
+				{6, uncompressed},
+				{7, int64(header.Len() + len(data))},
+				{9, offset},
+			}},
+		})
+		p.values[i].Reset()
+		p.levels[i] = p.levels[i][:0]
+	}
+	p.rowGroups = append(p.rowGroups, []thriftField{
+		{1, chunks},
+		{2, total},
+		{3, int64(p.count)},
+	})
+	p.rows += int64(p.count)
+	p.count = 0
+	return nil
+}
+
+// Close writes the last row group and the footer.
+func (p *parquetWriter) Close() error {
+	if err := p.Flush(); err != nil {
+		return err
+	}
+	schema := [][]thriftField{{
+		{4, "schema"},
+		{5, int32(len(p.columns))},
+	}}
+	for _, c := range p.columns {
+		repetition := int32(0)
+		if c.optional {
+			repetition = 1
+		}
+		element := []thriftField{{1, c.typ}}
+		if c.typ == parquetFixedLenByteArray {
+			element = append(element, thriftField{2, c.length})
+		}
+		element = append(element, thriftField{3, repetition}, thriftField{4, c.name})
+		if c.converted != parquetNoConversion {
+			element = append(element, thriftField{6, c.converted})
+		}
+		schema = append(schema, element)
+	}
+	var footer thriftWriter
+	footer.writeStruct([]thriftField{
+		{1, int32(1)},
+		{2, schema},
+		{3, p.rows},
+		{4, p.rowGroups},
+		{6, "streamtools"},
+	})
+	binary.Write(&footer.Buffer, binary.LittleEndian, uint32(footer.Len()))
+	footer.WriteString(parquetMagic)
+	_, err := p.w.Write(footer.Bytes())
+	return err
+}
+
+// parquetReader reads rows from a flat Parquet file a row group at a time.
+type parquetReader struct {
+	r         io.ReaderAt
+	columns   []parquetColumn
+	rowGroups []thriftStruct
+	group     int
+	values    [][]interface{}
+	row       int
+	rows      int
+}
+
+func newParquetReader(r io.ReaderAt, size int64) (*parquetReader, error) {
+	if size < int64(2*len(parquetMagic)+4) {
+		return nil, errors.New("not a Parquet file")
+	}
+	head := make([]byte, len(parquetMagic))
+	tail := make([]byte, 4+len(parquetMagic))
+	if _, err := r.ReadAt(head, 0); err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	if string(head) != parquetMagic || string(tail[4:]) != parquetMagic {
+		return nil, errors.New("not a Parquet file")
+	}
+	length := int64(binary.LittleEndian.Uint32(tail))
+	if length > size-int64(len(head)+len(tail)) {
+		return nil, errors.New("Parquet footer is longer than the file")
+	}
+	meta, err := readThriftStruct(bufio.NewReader(io.NewSectionReader(r, size-int64(len(tail))-length, length)), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parquetReader{r: r}
+	schema := meta.list(2)
+	if len(schema) == 0 {
+		return nil, errors.New("Parquet file has no schema")
+	}
+	for _, elementI := range schema[1:] {
+		element, ok := elementI.(thriftStruct)
+		if !ok {
+			return nil, errors.New("bad Parquet schema")
+		}
+		name := element.str(4)
+		if element.int(5) > 0 || element.int(3) == 2 {
+			return nil, errors.New("only flat Parquet files can be read, and " + name + " is nested or repeated")
+		}
+		c := parquetColumn{
+			name:      name,
+			typ:       int32(element.int(1)),
+			length:    int32(element.int(2)),
+			converted: parquetNoConversion,
+			optional:  element.int(3) == 1,
+		}
+		if element.has(6) {
+			c.converted = int32(element.int(6))
+		}
+		// newer writers may only give a logical type
+		if logical := element.child(10); logical != nil {
+			switch {
+			case logical.has(1):
+				c.converted = parquetUTF8
+			case logical.has(4):
+				c.converted = parquetEnum
+			case logical.has(12):
+				c.converted = parquetJSON
+			}
+		}
+		if c.typ < parquetBoolean || c.typ > parquetFixedLenByteArray {
+			return nil, errors.New("unknown Parquet type for " + name)
+		}
+		p.columns = append(p.columns, c)
+	}
+	if root, ok := schema[0].(thriftStruct); !ok || root.int(5) != int64(len(p.columns)) {
+		return nil, errors.New("only flat Parquet files can be read")
+	}
+	for _, rowGroupI := range meta.list(4) {
+		rowGroup, ok := rowGroupI.(thriftStruct)
+		if !ok {
+			return nil, errors.New("bad Parquet row group")
+		}
+		p.rowGroups = append(p.rowGroups, rowGroup)
+	}
+	return p, nil
+}
+
+// schema describes the file's columns.
+func (p *parquetReader) schema() []interface{} {
+	columns := make([]interface{}, len(p.columns))
+	for i, c := range p.columns {
+		columns[i] = map[string]interface{}{
+			"Name":     c.name,
+			"Type":     parquetTypeNames[c.typ],
+			"Optional": c.optional,
+		}
+	}
+	return columns
+}
+
+// Next returns the next row, or io.EOF at the end of the file.
+func (p *parquetReader) Next() (interface{}, error) {
+	for p.row == p.rows {
+		if p.group == len(p.rowGroups) {
+			return nil, io.EOF
+		}
+		if err := p.readRowGroup(p.rowGroups[p.group]); err != nil {
+			return nil, err
+		}
+		p.group++
+	}
+	record := make(map[string]interface{}, len(p.columns))
+	for i, c := range p.columns {
+		record[c.name] = p.values[i][p.row]
+	}
+	p.row++
+	return record, nil
+}
+
+func (p *parquetReader) readRowGroup(rowGroup thriftStruct) error {
+	chunks := rowGroup.list(1)
+	rows := rowGroup.int(3)
+	if len(chunks) != len(p.columns) {
+		return errors.New("Parquet row group has the wrong number of columns")
+	}
+	p.values = make([][]interface{}, len(p.columns))
+	for i, chunkI := range chunks {
+		chunk, _ := chunkI.(thriftStruct)
+		meta := chunk.child(3)
+		if meta == nil {
+			return errors.New("Parquet columns kept in other files can't be read")
+		}
+		values, err := p.readColumnChunk(&p.columns[i], meta)
+		if err != nil {
+			return err
+		}
+		if int64(len(values)) != rows {
+			return errors.New("Parquet column " + p.columns[i].name + " has the wrong number of values")
+		}
+		p.values[i] = values
+	}
+	p.row = 0
+	p.rows = int(rows)
+	return nil
+}
+
+// readColumnChunk reads every value of a column in a row group.
+func (p *parquetReader) readColumnChunk(c *parquetColumn, meta thriftStruct) ([]interface{}, error) {
+	codec := meta.int(4)
+	count := meta.int(5)
+	start := meta.int(9)
+	if dictionary := meta.int(11); dictionary > 0 && dictionary < start {
+		start = dictionary
+	}
+	r := bufio.NewReader(io.NewSectionReader(p.r, start, meta.int(7)))
+
+	var dictionary []interface{}
+	var values []interface{}
+	for int64(len(values)) < count {
+		header, err := readThriftStruct(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		size := header.int(2)
+		if size < 0 || header.int(3) < 0 {
+			return nil, errors.New("bad Parquet page header")
+		}
+		data, err := readLength(r, header.int(3))
+		if err != nil {
+			return nil, err
+		}
+
+		var page []byte
+		var levels *bytes.Reader
+		var pageHeader thriftStruct
+		var encoding int64
+		switch header.int(1) {
+		case parquetDictionaryPage:
+			page, err = parquetDecompress(codec, data, size)
+			if err != nil {
+				return nil, err
+			}
+			n := int(header.child(7).int(1))
+			if n < 0 || n > parquetMaxPageValues {
+				return nil, errors.New("bad Parquet dictionary page")
+			}
+			dictionary, err = c.decodePlain(bytes.NewReader(page), n)
+			if err != nil {
+				return nil, err
+			}
+			// a chunk whose values are all null still has a dictionary,
+			// it's just empty
+			if dictionary == nil {
+				dictionary = []interface{}{}
+			}
+			continue
+		case parquetDataPage:
+			pageHeader = header.child(5)
+			encoding = pageHeader.int(2)
+			page, err = parquetDecompress(codec, data, size)
+			if err != nil {
+				return nil, err
+			}
+			if c.optional {
+				if len(page) < 4 {
+					return nil, errors.New("bad Parquet data page")
+				}
+				length := int64(binary.LittleEndian.Uint32(page))
+				if length > int64(len(page)-4) {
+					return nil, errors.New("bad Parquet data page")
+				}
+				levels = bytes.NewReader(page[4 : 4+length])
+				page = page[4+length:]
+			}
+		case parquetDataPageV2:
+			pageHeader = header.child(8)
+			encoding = pageHeader.int(4)
+			if pageHeader.int(6) != 0 {
+				return nil, errors.New("only flat Parquet files can be read")
+			}
+			length := pageHeader.int(5)
+			if length < 0 || length > int64(len(data)) {
+				return nil, errors.New("bad Parquet data page")
+			}
+			levels = bytes.NewReader(data[:length])
+			page = data[length:]
+			if !pageHeader.has(7) || pageHeader.bool(7) {
+				page, err = parquetDecompress(codec, page, size-length)
+				if err != nil {
+					return nil, err
+				}
+			}
+		default:
+			// index pages, and whatever else comes along, aren't needed
+			continue
+		}
+
+		n := int(pageHeader.int(1))
+		if n < 0 || n > parquetMaxPageValues {
+			return nil, errors.New("bad Parquet data page")
+		}
+		pageValues, err := c.decodePage(bytes.NewReader(page), int(encoding), levels, dictionary, n)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, pageValues...)
+	}
+	return values, nil
+}
+
+// decodePage reads the n values of a data page, with nulls wherever the
+// definition levels say there's no value.
+func (c *parquetColumn) decodePage(r *bytes.Reader, encoding int, levels *bytes.Reader, dictionary []interface{}, n int) ([]interface{}, error) {
+	present := n
+	var defs []int
+	if c.optional {
+		if levels == nil {
+			return nil, errors.New("bad Parquet data page")
+		}
+		var err error
+		defs, err = decodeRLE(levels, 1, n)
+		if err != nil {
+			return nil, err
+		}
+		present = 0
+		for _, d := range defs {
+			present += d
+		}
+	}
+
+	var nonNull []interface{}
+	switch encoding {
+	case parquetPlain:
+		var err error
+		nonNull, err = c.decodePlain(r, present)
+		if err != nil {
+			return nil, err
+		}
+	case parquetPlainDictionary, parquetRLEDictionary:
+		if dictionary == nil {
+			return nil, errors.New("Parquet dictionary page is missing")
+		}
+		bitWidth, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		indices, err := decodeRLE(r, int(bitWidth), present)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range indices {
+			if i >= len(dictionary) {
+				return nil, errors.New("Parquet dictionary index out of range")
+			}
+			nonNull = append(nonNull, dictionary[i])
+		}
+	default:
+		return nil, errors.New("unsupported Parquet encoding " + strconv.Itoa(encoding))
+	}
+
+	if defs == nil {
+		return nonNull, nil
+	}
+	values := make([]interface{}, n)
+	j := 0
+	for i, d := range defs {
+		if d == 1 {
+			values[i] = nonNull[j]
+			j++
+		}
+	}
+	return values, nil
+}
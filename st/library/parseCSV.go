@@ -2,9 +2,13 @@ package library
 
 import (
 	"encoding/csv"
+	"errors"
 	"io"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/nytlabs/gojee"
 	// jee
@@ -23,6 +27,165 @@ type ParseCSV struct {
 	quit      blocks.MsgChan
 }
 
+// csvRecordReader is satisfied by csv.Reader, and by quotedCSVReader for
+// when we need a quote character other than '"'.
+type csvRecordReader interface {
+	Read() ([]string, error)
+}
+
+// quotedCSVReader reads CSV records using any quote character. Like the
+// csv.Reader the block uses by default, it trims leading space, allows a
+// variable number of fields per record and skips empty and comment lines.
+type quotedCSVReader struct {
+	data    []rune
+	pos     int
+	comma   rune
+	quote   rune
+	comment rune
+}
+
+func (r *quotedCSVReader) Read() ([]string, error) {
+	// skip empty lines and comments
+	for r.pos < len(r.data) {
+		c := r.data[r.pos]
+		if c == '\n' || c == '\r' {
+			r.pos++
+			continue
+		}
+		if r.comment != 0 && c == r.comment {
+			for r.pos < len(r.data) && r.data[r.pos] != '\n' {
+				r.pos++
+			}
+			continue
+		}
+		break
+	}
+	if r.pos >= len(r.data) {
+		return nil, io.EOF
+	}
+
+	var record []string
+	for {
+		for r.pos < len(r.data) && r.data[r.pos] != r.comma && r.data[r.pos] != '\n' && unicode.IsSpace(r.data[r.pos]) {
+			r.pos++
+		}
+
+		var field []rune
+		if r.pos < len(r.data) && r.data[r.pos] == r.quote {
+			r.pos++
+			for {
+				if r.pos >= len(r.data) {
+					return record, errors.New("extraneous or missing quote in quoted field")
+				}
+				c := r.data[r.pos]
+				r.pos++
+				if c != r.quote {
+					field = append(field, c)
+					continue
+				}
+				// a doubled quote is a literal quote
+				if r.pos < len(r.data) && r.data[r.pos] == r.quote {
+					field = append(field, c)
+					r.pos++
+					continue
+				}
+				break
+			}
+		}
+		for r.pos < len(r.data) && r.data[r.pos] != r.comma && r.data[r.pos] != '\n' {
+			if r.data[r.pos] != '\r' {
+				field = append(field, r.data[r.pos])
+			}
+			r.pos++
+		}
+		record = append(record, string(field))
+
+		if r.pos >= len(r.data) || r.data[r.pos] == '\n' {
+			r.pos++
+			return record, nil
+		}
+		// skip the delimiter
+		r.pos++
+	}
+}
+
+// newCSVReader builds a record reader for data using the given delimiter,
+// quote and comment characters. A zero comment means comments aren't allowed.
+func newCSVReader(data string, comma, quote, comment rune) csvRecordReader {
+	if quote != '"' {
+		return &quotedCSVReader{
+			data:    []rune(data),
+			comma:   comma,
+			quote:   quote,
+			comment: comment,
+		}
+	}
+	csvReader := csv.NewReader(strings.NewReader(data))
+	csvReader.TrimLeadingSpace = true
+	// allow records to have variable numbers of fields
+	csvReader.FieldsPerRecord = -1
+	csvReader.Comma = comma
+	csvReader.Comment = comment
+	return csvReader
+}
+
+// parseRune reads a rule value that must be at most a single character.
+func parseRune(ruleI interface{}, key string) (rune, error) {
+	s, err := util.ParseString(ruleI, key)
+	if err != nil {
+		return 0, err
+	}
+	if s == "" {
+		return 0, nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, errors.New(key + " must be a single character")
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return r, nil
+}
+
+// parseTypes reads the map of column names to the types they're coerced to.
+func parseTypes(ruleI interface{}) (map[string]string, error) {
+	rule := ruleI.(map[string]interface{})
+	typesI, ok := rule["Types"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Types must be a map of column names to types")
+	}
+	types := make(map[string]string)
+	for column, t := range typesI {
+		typeString, ok := t.(string)
+		if !ok {
+			return nil, errors.New("Types must be a map of column names to types")
+		}
+		switch typeString {
+		case "string", "number", "bool", "timestamp":
+		default:
+			return nil, errors.New("column types must be one of string, number, bool or timestamp")
+		}
+		types[column] = typeString
+	}
+	return types, nil
+}
+
+// coerceField converts a field to the type given for its column.
+func coerceField(field, fieldType, timeFormat string) (interface{}, error) {
+	switch fieldType {
+	case "number":
+		return strconv.ParseFloat(strings.TrimSpace(field), 64)
+	case "bool":
+		return strconv.ParseBool(strings.TrimSpace(field))
+	case "timestamp":
+		// timestamps become milliseconds since the epoch, as used by the sync block
+		t, err := time.Parse(timeFormat, strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		return float64(t.UnixNano() / int64(time.Millisecond)), nil
+	}
+	return field, nil
+}
+
 // we need to build a simple factory so that streamtools can make new blocks of this kind
 func NewParseCSV() blocks.BlockInterface {
 	return &ParseCSV{}
@@ -44,35 +207,165 @@ func (b *ParseCSV) Setup() {
 func (b *ParseCSV) Run() {
 	var tree *jee.TokenTree
 	var path string
-	var err error
 	var headers []string
-	var csvReader *csv.Reader
+	var csvReader csvRecordReader
+
+	// headers found in the first row of the current input
+	var rowHeaders []string
+
+	mode := "poll"
+	headerRow := false
+	summary := false
+	delimiter := ","
+	quote := "\""
+	comment := ""
+	comma, quoteRune, commentRune := ',', '"', rune(0)
+	types := map[string]string{}
+	timeFormat := time.RFC3339
+
+	buildRow := func(record []string) (map[string]interface{}, int) {
+		h := headers
+		if headerRow {
+			h = rowHeaders
+		}
+		errs := 0
+		row := make(map[string]interface{})
+		for fieldIndex, field := range record {
+			var header string
+			if fieldIndex >= len(h) {
+				header = strconv.Itoa(fieldIndex)
+			} else {
+				header = h[fieldIndex]
+			}
+			value, err := coerceField(field, types[header], timeFormat)
+			if err != nil {
+				b.Error(err)
+				errs++
+				row[header] = field
+				continue
+			}
+			row[header] = value
+		}
+		return row, errs
+	}
 
 	for {
 		select {
 		case ruleI := <-b.inrule:
 			// set a parameter of the block
-			path, err = util.ParseString(ruleI, "Path")
+			tmpPath, err := util.ParseString(ruleI, "Path")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			token, err := jee.Lexer(path)
+			tmpTree, err := util.BuildTokenTree(tmpPath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			tree, err = jee.Parser(token)
+
+			tmpHeaders, err := util.ParseArrayString(ruleI, "Headers")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			headers, err = util.ParseArrayString(ruleI, "Headers")
-			if err != nil {
-				b.Error(err)
-				continue
+			// the remaining options are optional so that older rules still
+			// work, keeping their current values when they're left out
+			tmpMode := mode
+			if util.KeyExists(ruleI, "Mode") {
+				tmpMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpMode != "poll" && tmpMode != "stream" {
+					b.Error(errors.New("Mode must be either poll or stream"))
+					continue
+				}
+			}
+			tmpHeaderRow := headerRow
+			if util.KeyExists(ruleI, "HeaderRow") {
+				tmpHeaderRow, err = util.ParseBool(ruleI, "HeaderRow")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpSummary := summary
+			if util.KeyExists(ruleI, "Summary") {
+				tmpSummary, err = util.ParseBool(ruleI, "Summary")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpComma := comma
+			if util.KeyExists(ruleI, "Delimiter") {
+				tmpComma, err = parseRune(ruleI, "Delimiter")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpComma == 0 {
+					b.Error(errors.New("Delimiter can't be empty"))
+					continue
+				}
+			}
+			tmpQuoteRune := quoteRune
+			if util.KeyExists(ruleI, "Quote") {
+				tmpQuoteRune, err = parseRune(ruleI, "Quote")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpQuoteRune == 0 {
+					b.Error(errors.New("Quote can't be empty"))
+					continue
+				}
+			}
+			tmpCommentRune := commentRune
+			if util.KeyExists(ruleI, "Comment") {
+				tmpCommentRune, err = parseRune(ruleI, "Comment")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTypes := types
+			if util.KeyExists(ruleI, "Types") {
+				tmpTypes, err = parseTypes(ruleI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeFormat := timeFormat
+			if util.KeyExists(ruleI, "TimeFormat") {
+				tmpTimeFormat, err = util.ParseRequiredString(ruleI, "TimeFormat")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			path = tmpPath
+			tree = tmpTree
+			headers = tmpHeaders
+			mode = tmpMode
+			headerRow = tmpHeaderRow
+			summary = tmpSummary
+			comma = tmpComma
+			delimiter = string(comma)
+			quoteRune = tmpQuoteRune
+			quote = string(quoteRune)
+			commentRune = tmpCommentRune
+			comment = ""
+			if commentRune != 0 {
+				comment = string(commentRune)
 			}
+			types = tmpTypes
+			timeFormat = tmpTimeFormat
 		case <-b.quit:
 			// quit the block
 			return
@@ -101,10 +394,58 @@ func (b *ParseCSV) Run() {
 				continue
 			}
 
-			csvReader = csv.NewReader(strings.NewReader(data))
-			csvReader.TrimLeadingSpace = true
-			// allow records to have variable numbers of fields
-			csvReader.FieldsPerRecord = -1
+			csvReader = newCSVReader(data, comma, quoteRune, commentRune)
+
+			rows, errs := 0, 0
+			rowHeaders = nil
+			if headerRow {
+				rowHeaders, err = csvReader.Read()
+				if err != nil && err != io.EOF {
+					b.Error(err)
+					errs++
+				}
+			}
+
+			if mode != "stream" {
+				continue
+			}
+
+			// emit every row now rather than waiting to be polled
+			for {
+				record, err := csvReader.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					b.Error(err)
+					errs++
+					// the stdlib reader can carry on past a bad record,
+					// ours can't
+					if _, ok := csvReader.(*csv.Reader); !ok {
+						break
+					}
+					continue
+				}
+				row, rowErrs := buildRow(record)
+				errs += rowErrs
+				rows++
+				b.out <- row
+			}
+			csvReader = nil
+
+			if summary {
+				h := headers
+				if headerRow {
+					h = rowHeaders
+				}
+				b.out <- map[string]interface{}{
+					"Summary": map[string]interface{}{
+						"Rows":    float64(rows),
+						"Errors":  float64(errs),
+						"Headers": h,
+					},
+				}
+			}
 
 		case <-b.inpoll:
 			if csvReader == nil {
@@ -116,23 +457,27 @@ func (b *ParseCSV) Run() {
 				b.Error(err)
 				continue
 			}
-			row := make(map[string]interface{})
-			for fieldIndex, field := range record {
-				if fieldIndex >= len(headers) {
-					row[strconv.Itoa(fieldIndex)] = field
-				} else {
-					header := headers[fieldIndex]
-					row[header] = field
-				}
-			}
+			row, _ := buildRow(record)
 
 			b.out <- row
 
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
+			typesOut := make(map[string]interface{})
+			for column, t := range types {
+				typesOut[column] = t
+			}
 			MsgChan <- map[string]interface{}{
-				"Path":    path,
-				"Headers": headers,
+				"Path":       path,
+				"Headers":    headers,
+				"Mode":       mode,
+				"HeaderRow":  headerRow,
+				"Summary":    summary,
+				"Delimiter":  delimiter,
+				"Quote":      quote,
+				"Comment":    comment,
+				"Types":      typesOut,
+				"TimeFormat": timeFormat,
 			}
 		}
 	}
@@ -1,10 +1,9 @@
 package library
 
 import (
-	"encoding/json"
+	"errors"
 
-	"github.com/nytlabs/gojee" // jee
-	"github.com/nytlabs/mxj"
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 )
@@ -39,28 +38,100 @@ func (b *ParseXML) Setup() {
 func (b *ParseXML) Run() {
 	var tree *jee.TokenTree
 	var path string
-	var err error
 	var xmlData []byte
 
+	options := &xmlOptions{
+		attributes: "merge",
+		attrPrefix: "-",
+		forceArray: make(map[string]bool),
+	}
+	forceArray := []string{}
+	var xpath string
+	var steps []xpathStep
+
 	for {
 		select {
 		case ruleI := <-b.inrule:
 			// set a parameter of the block
-			path, err = util.ParseString(ruleI, "Path")
+			tmpPath, err := util.ParseString(ruleI, "Path")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			token, err := jee.Lexer(path)
+			tmpTree, err := util.BuildTokenTree(tmpPath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			tree, err = jee.Parser(token)
-			if err != nil {
-				b.Error(err)
+
+			// the remaining options are optional so that older rules still work
+			tmpAttributes := "merge"
+			if util.KeyExists(ruleI, "Attributes") {
+				tmpAttributes, err = util.ParseString(ruleI, "Attributes")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpAttributes != "merge" && tmpAttributes != "prefix" && tmpAttributes != "nested" {
+				b.Error(errors.New("Attributes must be one of merge, prefix or nested"))
 				continue
 			}
+			tmpAttrPrefix := "-"
+			if util.KeyExists(ruleI, "AttrPrefix") {
+				tmpAttrPrefix, err = util.ParseString(ruleI, "AttrPrefix")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpNamespaces := false
+			if util.KeyExists(ruleI, "Namespaces") {
+				tmpNamespaces, err = util.ParseBool(ruleI, "Namespaces")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpForceArray := []string{}
+			if util.KeyExists(ruleI, "ForceArray") {
+				tmpForceArray, err = util.ParseArrayString(ruleI, "ForceArray")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpXPath := ""
+			if util.KeyExists(ruleI, "XPath") {
+				tmpXPath, err = util.ParseString(ruleI, "XPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpSteps []xpathStep
+			if tmpXPath != "" {
+				tmpSteps, err = parseXPath(tmpXPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			path = tmpPath
+			tree = tmpTree
+			forceArray = tmpForceArray
+			xpath = tmpXPath
+			steps = tmpSteps
+			options = &xmlOptions{
+				attributes: tmpAttributes,
+				attrPrefix: tmpAttrPrefix,
+				namespaces: tmpNamespaces,
+				forceArray: make(map[string]bool),
+			}
+			for _, name := range forceArray {
+				options.forceArray[name] = true
+			}
 		case <-b.quit:
 			// quit the block
 			return
@@ -87,34 +158,31 @@ func (b *ParseXML) Run() {
 				continue
 			}
 
-			// parse xml -> map[string]interface{} with mxj
-			// http://godoc.org/github.com/clbanning/mxj#NewMapXml
-			mapVal, err := mxj.NewMapXml(xmlData)
+			doc, err := parseXMLDocument(xmlData)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			// TODO: replace this json.Marshal / Unmarshal dance with Nik's recursive map copy from the map block
-			outMsg, err := json.Marshal(mapVal)
-			if err != nil {
-				b.Error(err)
+			if steps == nil {
+				b.out <- options.message(doc.children[0])
 				continue
 			}
 
-			var newMsg interface{}
-			err = json.Unmarshal(outMsg, &newMsg)
-			if err != nil {
-				b.Error(err)
-				continue
+			// split the document, emitting each matched element on its own
+			for _, n := range evalXPath(doc, steps) {
+				b.out <- options.message(n)
 			}
 
-			b.out <- newMsg
-
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				"Path": path,
+				"Path":       path,
+				"Attributes": options.attributes,
+				"AttrPrefix": options.attrPrefix,
+				"Namespaces": options.namespaces,
+				"ForceArray": forceArray,
+				"XPath":      xpath,
 			}
 
 		}
@@ -0,0 +1,560 @@
+package library
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type PollHTTP struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewPollHTTP() blocks.BlockInterface {
+	return &PollHTTP{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *PollHTTP) Setup() {
+	b.Kind = "Network I/O"
+	b.Desc = "polls a URL on an interval, following pagination and emitting each item it returns"
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// linkNext finds the rel="next" URL in a Link header.
+func linkNext(header string) string {
+	for _, link := range strings.Split(header, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.Replace(strings.TrimSpace(param), " ", "", -1)
+			if param == `rel="next"` || param == "rel=next" {
+				return target[1 : len(target)-1]
+			}
+		}
+	}
+	return ""
+}
+
+// retryAfter reads a Retry-After header, which is either a number of
+// seconds or a date.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+// pollHTTPRequest is everything a poll needs, copied from the rule so that
+// the poll can run outside the block's Run loop.
+type pollHTTPRequest struct {
+	ctx          context.Context
+	client       *http.Client
+	url          string
+	headers      map[string]string
+	itemsTree    *jee.TokenTree
+	pagination   string
+	cursorTree   *jee.TokenTree
+	cursorParam  string
+	maxPages     int
+	etag         string
+	lastModified string
+
+	out  blocks.MsgChan
+	done chan pollHTTPResult
+}
+
+// pollHTTPResult is how a poll went. The validators are the ones to send with
+// the next poll, which are only new once every page has been fetched.
+type pollHTTPResult struct {
+	slowDown     bool
+	wait         time.Duration
+	err          error
+	etag         string
+	lastModified string
+}
+
+// nextPage works out where the page after this one is, or returns an empty
+// string if this is the last.
+func (p *pollHTTPRequest) nextPage(current *url.URL, resp *http.Response, body interface{}) (string, error) {
+	var next string
+	switch p.pagination {
+	case "link":
+		next = linkNext(resp.Header.Get("Link"))
+	case "cursor":
+		cursorI, err := jee.Eval(p.cursorTree, body)
+		if err != nil {
+			return "", err
+		}
+		switch cursor := cursorI.(type) {
+		case nil:
+			return "", nil
+		case string:
+			next = cursor
+		case float64:
+			next = strconv.FormatFloat(cursor, 'f', -1, 64)
+		default:
+			return "", errors.New("cursor must be a string or a number")
+		}
+		// a cursor that isn't a URL is sent back as a query parameter
+		if next != "" && !strings.Contains(next, "://") && !strings.HasPrefix(next, "/") && !strings.HasPrefix(next, "?") {
+			u, err := url.Parse(p.url)
+			if err != nil {
+				return "", err
+			}
+			q := u.Query()
+			q.Set(p.cursorParam, next)
+			u.RawQuery = q.Encode()
+			return u.String(), nil
+		}
+	}
+	if next == "" {
+		return "", nil
+	}
+	u, err := current.Parse(next)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// emit hands an item to the block, giving up if the poll is cancelled.
+func (p *pollHTTPRequest) emit(item interface{}) bool {
+	select {
+	case p.out <- item:
+		return true
+	case <-p.ctx.Done():
+		return false
+	}
+}
+
+// run fetches every page, emitting their items, and reports how it went on
+// done, unless the poll is cancelled first.
+func (p *pollHTTPRequest) run() {
+	result := p.poll()
+	select {
+	case p.done <- result:
+	case <-p.ctx.Done():
+	}
+}
+
+func (p *pollHTTPRequest) poll() pollHTTPResult {
+	// until every page has been fetched the old validators still stand
+	failed := func(slowDown bool, wait time.Duration, err error) pollHTTPResult {
+		return pollHTTPResult{
+			slowDown:     slowDown,
+			wait:         wait,
+			err:          err,
+			etag:         p.etag,
+			lastModified: p.lastModified,
+		}
+	}
+	var etag, lastModified string
+	pageURL := p.url
+	for page := 0; page < p.maxPages && pageURL != ""; page++ {
+		req, err := http.NewRequest("GET", pageURL, nil)
+		if err != nil {
+			return failed(false, 0, err)
+		}
+		req = req.WithContext(p.ctx)
+		for key, value := range p.headers {
+			if key == "Host" {
+				req.Host = value
+			} else {
+				req.Header.Set(key, value)
+			}
+		}
+		if page == 0 && p.etag != "" {
+			req.Header.Set("If-None-Match", p.etag)
+		}
+		if page == 0 && p.lastModified != "" {
+			req.Header.Set("If-Modified-Since", p.lastModified)
+		}
+
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return failed(true, 0, err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return failed(true, 0, err)
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusNotModified:
+			return failed(false, 0, nil)
+		case resp.StatusCode == 429 || resp.StatusCode >= 500:
+			return failed(true, retryAfter(resp.Header.Get("Retry-After")), errors.New(pageURL+" returned "+resp.Status))
+		case resp.StatusCode < 200 || resp.StatusCode >= 300:
+			return failed(false, 0, errors.New(pageURL+" returned "+resp.Status))
+		}
+		if page == 0 {
+			etag = resp.Header.Get("ETag")
+			lastModified = resp.Header.Get("Last-Modified")
+		}
+
+		var bodyI interface{}
+		err = json.Unmarshal(body, &bodyI)
+		// if the json parsing fails, store data unparsed as "data"
+		if err != nil {
+			bodyI = map[string]interface{}{
+				"data": string(body),
+			}
+		}
+
+		if p.itemsTree == nil {
+			if !p.emit(bodyI) {
+				return failed(false, 0, nil)
+			}
+		} else {
+			itemsI, err := jee.Eval(p.itemsTree, bodyI)
+			if err != nil {
+				return failed(false, 0, err)
+			}
+			items, ok := itemsI.([]interface{})
+			if !ok && itemsI != nil {
+				return failed(false, 0, errors.New("ItemsPath must point to an array"))
+			}
+			for _, item := range items {
+				if !p.emit(item) {
+					return failed(false, 0, nil)
+				}
+			}
+		}
+
+		pageURL, err = p.nextPage(req.URL, resp, bodyI)
+		if err != nil {
+			return failed(false, 0, err)
+		}
+	}
+	return pollHTTPResult{etag: etag, lastModified: lastModified}
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *PollHTTP) Run() {
+	var pollURL string
+	interval := time.Duration(1) * time.Minute
+	maxBackoff := time.Duration(10) * time.Minute
+	timeout := time.Duration(30) * time.Second
+	headerRule := map[string]interface{}{}
+	headers := map[string]string{}
+	var itemsPath string
+	var itemsTree *jee.TokenTree
+	pagination := "none"
+	var cursorPath string
+	var cursorTree *jee.TokenTree
+	cursorParam := "cursor"
+	maxPages := 10
+
+	// validators from the first page of the last complete response
+	var etag, lastModified string
+	// consecutive polls that were throttled or failed, for backing off
+	failures := 0
+
+	transport := http.Transport{
+		Dial: dialTimeout,
+	}
+	client := &http.Client{
+		Transport: &transport,
+		Timeout:   timeout,
+	}
+
+	timer := time.NewTimer(interval)
+	timer.Stop()
+
+	// polls run in their own goroutine, so a slow server doesn't hold up
+	// rules and queries. These are nil while there isn't one running.
+	var pollOut blocks.MsgChan
+	var pollDone chan pollHTTPResult
+	var cancelPoll context.CancelFunc
+
+	startPoll := func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		p := &pollHTTPRequest{
+			ctx:          ctx,
+			client:       client,
+			url:          pollURL,
+			headers:      headers,
+			itemsTree:    itemsTree,
+			pagination:   pagination,
+			cursorTree:   cursorTree,
+			cursorParam:  cursorParam,
+			maxPages:     maxPages,
+			etag:         etag,
+			lastModified: lastModified,
+			out:          make(blocks.MsgChan),
+			done:         make(chan pollHTTPResult),
+		}
+		pollOut = p.out
+		pollDone = p.done
+		cancelPoll = cancel
+		go p.run()
+	}
+	stopPoll := func() {
+		if cancelPoll != nil {
+			cancelPoll()
+		}
+		pollOut = nil
+		pollDone = nil
+		cancelPoll = nil
+	}
+
+	// schedule sets the timer for the next poll, backing off exponentially
+	// while the server is struggling.
+	schedule := func(result pollHTTPResult) {
+		if result.err != nil {
+			b.Error(result.err)
+		}
+		delay := interval
+		if result.slowDown {
+			failures++
+			for i := 0; i < failures && delay < maxBackoff; i++ {
+				delay *= 2
+			}
+			if delay > maxBackoff {
+				delay = maxBackoff
+			}
+			if result.wait > delay {
+				delay = result.wait
+			}
+		} else {
+			failures = 0
+		}
+		timer.Stop()
+		timer = time.NewTimer(delay)
+	}
+
+	for {
+		select {
+		case <-timer.C:
+			startPoll()
+		case item := <-pollOut:
+			b.out <- item
+		case result := <-pollDone:
+			stopPoll()
+			etag = result.etag
+			lastModified = result.lastModified
+			schedule(result)
+		case ruleI := <-b.inrule:
+			// set a parameter of the block
+			tmpURL, err := util.ParseRequiredString(ruleI, "URL")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if _, err := url.Parse(tmpURL); err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpIntervalString := interval.String()
+			if util.KeyExists(ruleI, "Interval") {
+				tmpIntervalString, err = util.ParseString(ruleI, "Interval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpInterval, err := time.ParseDuration(tmpIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpInterval <= 0 {
+				b.Error(errors.New("Interval must be positive"))
+				continue
+			}
+			tmpMaxBackoffString := maxBackoff.String()
+			if util.KeyExists(ruleI, "MaxBackoff") {
+				tmpMaxBackoffString, err = util.ParseString(ruleI, "MaxBackoff")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpMaxBackoff, err := time.ParseDuration(tmpMaxBackoffString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTimeoutString := timeout.String()
+			if util.KeyExists(ruleI, "Timeout") {
+				tmpTimeoutString, err = util.ParseString(ruleI, "Timeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeout, err := time.ParseDuration(tmpTimeoutString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpTimeout <= 0 {
+				b.Error(errors.New("Timeout must be positive"))
+				continue
+			}
+
+			tmpHeaderRule := map[string]interface{}{}
+			if util.KeyExists(ruleI, "Headers") {
+				var ok bool
+				tmpHeaderRule, ok = ruleI.(map[string]interface{})["Headers"].(map[string]interface{})
+				if !ok {
+					b.Error(errors.New("Headers must be an object"))
+					continue
+				}
+			}
+			tmpHeaders, err := parseHeaders(tmpHeaderRule)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			tmpItemsPath := ""
+			if util.KeyExists(ruleI, "ItemsPath") {
+				tmpItemsPath, err = util.ParseString(ruleI, "ItemsPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpItemsTree *jee.TokenTree
+			if tmpItemsPath != "" {
+				tmpItemsTree, err = util.BuildTokenTree(tmpItemsPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			tmpPagination := "none"
+			if util.KeyExists(ruleI, "Pagination") {
+				tmpPagination, err = util.ParseString(ruleI, "Pagination")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpPagination != "none" && tmpPagination != "link" && tmpPagination != "cursor" {
+				b.Error(errors.New("Pagination must be one of none, link or cursor"))
+				continue
+			}
+			tmpCursorPath := ""
+			if util.KeyExists(ruleI, "CursorPath") {
+				tmpCursorPath, err = util.ParseString(ruleI, "CursorPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpCursorTree *jee.TokenTree
+			if tmpPagination == "cursor" {
+				if tmpCursorPath == "" {
+					b.Error(errors.New("cursor pagination needs a CursorPath"))
+					continue
+				}
+				tmpCursorTree, err = util.BuildTokenTree(tmpCursorPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCursorParam := "cursor"
+			if util.KeyExists(ruleI, "CursorParam") {
+				tmpCursorParam, err = util.ParseString(ruleI, "CursorParam")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpMaxPages := 10
+			if util.KeyExists(ruleI, "MaxPages") {
+				tmpMaxPages, err = util.ParseInt(ruleI, "MaxPages")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMaxPages <= 0 {
+				b.Error(errors.New("MaxPages must be positive"))
+				continue
+			}
+
+			// a different URL has nothing to do with what we've seen before
+			if tmpURL != pollURL {
+				etag = ""
+				lastModified = ""
+			}
+			pollURL = tmpURL
+			interval = tmpInterval
+			maxBackoff = tmpMaxBackoff
+			timeout = tmpTimeout
+			client = &http.Client{
+				Transport: &transport,
+				Timeout:   timeout,
+			}
+			headerRule = tmpHeaderRule
+			headers = tmpHeaders
+			itemsPath = tmpItemsPath
+			itemsTree = tmpItemsTree
+			pagination = tmpPagination
+			cursorPath = tmpCursorPath
+			cursorTree = tmpCursorTree
+			cursorParam = tmpCursorParam
+			maxPages = tmpMaxPages
+			failures = 0
+
+			// anything still being fetched was asked for by the old rule
+			stopPoll()
+			timer.Stop()
+			startPoll()
+		case <-b.quit:
+			// quit the block
+			stopPoll()
+			timer.Stop()
+			return
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"URL":         pollURL,
+				"Interval":    interval.String(),
+				"Headers":     headerRule,
+				"ItemsPath":   itemsPath,
+				"Pagination":  pagination,
+				"CursorPath":  cursorPath,
+				"CursorParam": cursorParam,
+				"MaxPages":    float64(maxPages),
+				"MaxBackoff":  maxBackoff.String(),
+				"Timeout":     timeout.String(),
+			}
+		}
+	}
+}
@@ -0,0 +1,804 @@
+package library
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// field types from descriptor.proto
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoMessage  = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+
+	protoRepeated = 3
+)
+
+// protoMessageType describes a message, as read from a descriptor set.
+type protoMessageType struct {
+	name     string
+	fields   []*protoField
+	byNumber map[uint64]*protoField
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	number   uint64
+	label    uint64
+	typ      uint64
+	typeName string
+	packed   bool
+	message  *protoMessageType
+	enum     *protoEnumType
+}
+
+type protoEnumType struct {
+	byNumber map[int32]string
+	byName   map[string]int32
+}
+
+// protoCodec converts between one message type and messages.
+type protoCodec struct {
+	message *protoMessageType
+}
+
+func (p protoCodec) Decode(data []byte) (interface{}, error) {
+	return p.message.decode(data)
+}
+
+func (p protoCodec) Encode(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("only objects can be encoded as protobuf messages")
+	}
+	var buf bytes.Buffer
+	err := p.message.encode(&buf, m)
+	return buf.Bytes(), err
+}
+
+// protoReader reads the protobuf wire format.
+type protoReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *protoReader) done() bool {
+	return r.pos >= len(r.data)
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 {
+		return 0, errors.New("bad varint in protobuf data")
+	}
+	r.pos += size
+	return n, nil
+}
+
+func (r *protoReader) fixed(size int) (uint64, error) {
+	if r.pos+size > len(r.data) {
+		return 0, errors.New("unexpected end of protobuf data")
+	}
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(r.data[r.pos+i])
+	}
+	r.pos += size
+	return n, nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		return nil, errors.New("unexpected end of protobuf data")
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *protoReader) tag() (uint64, uint64, error) {
+	key, err := r.varint()
+	return key >> 3, key & 7, err
+}
+
+func (r *protoReader) skip(wireType uint64) error {
+	var err error
+	switch wireType {
+	case 0:
+		_, err = r.varint()
+	case 1:
+		_, err = r.fixed(8)
+	case 2:
+		_, err = r.bytes()
+	case 5:
+		_, err = r.fixed(4)
+	default:
+		err = errors.New("protobuf groups aren't supported")
+	}
+	return err
+}
+
+// parseDescriptorSet reads a FileDescriptorSet, as written by
+// protoc --descriptor_set_out, returning its messages by full name.
+func parseDescriptorSet(data []byte) (map[string]*protoMessageType, error) {
+	messages := make(map[string]*protoMessageType)
+	enums := make(map[string]*protoEnumType)
+
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return nil, err
+		}
+		if num != 1 || wireType != 2 {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		file, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		if err := parseFileDescriptor(file, messages, enums); err != nil {
+			return nil, err
+		}
+	}
+
+	// now that we've seen every type we can link fields to them
+	for _, message := range messages {
+		for _, field := range message.fields {
+			switch field.typ {
+			case protoMessage:
+				field.message = messages[field.typeName]
+				if field.message == nil {
+					return nil, errors.New("unknown message type " + field.typeName)
+				}
+			case protoEnum:
+				field.enum = enums[field.typeName]
+				if field.enum == nil {
+					return nil, errors.New("unknown enum type " + field.typeName)
+				}
+			}
+		}
+	}
+	return messages, nil
+}
+
+func parseFileDescriptor(data []byte, messages map[string]*protoMessageType, enums map[string]*protoEnumType) error {
+	var pkg string
+	var messageData, enumData [][]byte
+	proto3 := false
+
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return err
+		}
+		if wireType != 2 {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 2:
+			pkg = string(b)
+		case 4:
+			messageData = append(messageData, b)
+		case 5:
+			enumData = append(enumData, b)
+		case 12:
+			proto3 = string(b) == "proto3"
+		}
+	}
+
+	scope := ""
+	if pkg != "" {
+		scope = "." + pkg
+	}
+	for _, b := range enumData {
+		if err := parseEnumDescriptor(b, scope, enums); err != nil {
+			return err
+		}
+	}
+	for _, b := range messageData {
+		if err := parseMessageDescriptor(b, scope, proto3, messages, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMessageDescriptor(data []byte, scope string, proto3 bool, messages map[string]*protoMessageType, enums map[string]*protoEnumType) error {
+	message := &protoMessageType{byNumber: make(map[uint64]*protoField)}
+	var nested, nestedEnums [][]byte
+
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return err
+		}
+		if wireType != 2 {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			message.name = scope + "." + string(b)
+		case 2:
+			field, err := parseFieldDescriptor(b, proto3)
+			if err != nil {
+				return err
+			}
+			message.fields = append(message.fields, field)
+			message.byNumber[field.number] = field
+		case 3:
+			nested = append(nested, b)
+		case 4:
+			nestedEnums = append(nestedEnums, b)
+		case 7:
+			// MessageOptions, where map_entry is field 7
+			options := &protoReader{data: b}
+			for !options.done() {
+				optNum, optWireType, err := options.tag()
+				if err != nil {
+					return err
+				}
+				if optNum == 7 && optWireType == 0 {
+					v, err := options.varint()
+					if err != nil {
+						return err
+					}
+					message.mapEntry = v != 0
+					continue
+				}
+				if err := options.skip(optWireType); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	sort.Sort(protoFieldsByNumber(message.fields))
+	messages[message.name] = message
+	for _, b := range nestedEnums {
+		if err := parseEnumDescriptor(b, message.name, enums); err != nil {
+			return err
+		}
+	}
+	for _, b := range nested {
+		if err := parseMessageDescriptor(b, message.name, proto3, messages, enums); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type protoFieldsByNumber []*protoField
+
+func (p protoFieldsByNumber) Len() int           { return len(p) }
+func (p protoFieldsByNumber) Less(i, j int) bool { return p[i].number < p[j].number }
+func (p protoFieldsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func parseFieldDescriptor(data []byte, proto3 bool) (*protoField, error) {
+	field := &protoField{}
+	packedSet := false
+
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case wireType == 0:
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			switch num {
+			case 3:
+				field.number = v
+			case 4:
+				field.label = v
+			case 5:
+				field.typ = v
+			}
+		case wireType == 2:
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			switch num {
+			case 1:
+				field.name = string(b)
+			case 6:
+				field.typeName = string(b)
+			case 8:
+				// FieldOptions, where packed is field 2
+				options := &protoReader{data: b}
+				for !options.done() {
+					optNum, optWireType, err := options.tag()
+					if err != nil {
+						return nil, err
+					}
+					if optNum == 2 && optWireType == 0 {
+						v, err := options.varint()
+						if err != nil {
+							return nil, err
+						}
+						field.packed, packedSet = v != 0, true
+						continue
+					}
+					if err := options.skip(optWireType); err != nil {
+						return nil, err
+					}
+				}
+			}
+		default:
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if field.typ == protoGroup {
+		return nil, errors.New("protobuf groups aren't supported")
+	}
+	// repeated numbers are packed by default in proto3
+	if proto3 && !packedSet && field.label == protoRepeated && field.packable() {
+		field.packed = true
+	}
+	return field, nil
+}
+
+func parseEnumDescriptor(data []byte, scope string, enums map[string]*protoEnumType) error {
+	enum := &protoEnumType{
+		byNumber: make(map[int32]string),
+		byName:   make(map[string]int32),
+	}
+	var name string
+
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return err
+		}
+		if wireType != 2 {
+			if err := r.skip(wireType); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		switch num {
+		case 1:
+			name = string(b)
+		case 2:
+			var valueName string
+			var valueNumber int32
+			value := &protoReader{data: b}
+			for !value.done() {
+				valueNum, valueWireType, err := value.tag()
+				if err != nil {
+					return err
+				}
+				switch {
+				case valueNum == 1 && valueWireType == 2:
+					nameBytes, err := value.bytes()
+					if err != nil {
+						return err
+					}
+					valueName = string(nameBytes)
+				case valueNum == 2 && valueWireType == 0:
+					n, err := value.varint()
+					if err != nil {
+						return err
+					}
+					valueNumber = int32(n)
+				default:
+					if err := value.skip(valueWireType); err != nil {
+						return err
+					}
+				}
+			}
+			enum.byName[valueName] = valueNumber
+			if _, ok := enum.byNumber[valueNumber]; !ok {
+				enum.byNumber[valueNumber] = valueName
+			}
+		}
+	}
+	enums[scope+"."+name] = enum
+	return nil
+}
+
+// packable reports whether a repeated field of this type can be packed.
+func (f *protoField) packable() bool {
+	switch f.typ {
+	case protoString, protoBytes, protoMessage, protoGroup:
+		return false
+	}
+	return true
+}
+
+// wireType is how values of this field are written.
+func (f *protoField) wireType() uint64 {
+	switch f.typ {
+	case protoDouble, protoFixed64, protoSfixed64:
+		return 1
+	case protoFloat, protoFixed32, protoSfixed32:
+		return 5
+	case protoString, protoBytes, protoMessage:
+		return 2
+	}
+	return 0
+}
+
+// decodeValue reads a single value of the field.
+func (f *protoField) decodeValue(r *protoReader) (interface{}, error) {
+	switch f.wireType() {
+	case 1:
+		n, err := r.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case protoDouble:
+			return math.Float64frombits(n), nil
+		case protoSfixed64:
+			return float64(int64(n)), nil
+		}
+		return float64(n), nil
+	case 5:
+		n, err := r.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case protoFloat:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case protoSfixed32:
+			return float64(int32(n)), nil
+		}
+		return float64(uint32(n)), nil
+	case 2:
+		b, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch f.typ {
+		case protoString:
+			return string(b), nil
+		case protoBytes:
+			return base64.StdEncoding.EncodeToString(b), nil
+		}
+		return f.message.decode(b)
+	}
+
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	switch f.typ {
+	case protoInt32:
+		return float64(int32(n)), nil
+	case protoInt64:
+		return float64(int64(n)), nil
+	case protoUint32:
+		return float64(uint32(n)), nil
+	case protoBool:
+		return n != 0, nil
+	case protoSint32, protoSint64:
+		return float64(int64(n>>1) ^ -int64(n&1)), nil
+	case protoEnum:
+		if name, ok := f.enum.byNumber[int32(n)]; ok {
+			return name, nil
+		}
+		return float64(int32(n)), nil
+	}
+	return float64(n), nil
+}
+
+// decode reads a message. Fields that aren't set are left out, bytes are
+// base64 encoded and enums are emitted by name.
+func (m *protoMessageType) decode(data []byte) (map[string]interface{}, error) {
+	out := make(map[string]interface{})
+	r := &protoReader{data: data}
+	for !r.done() {
+		num, wireType, err := r.tag()
+		if err != nil {
+			return nil, err
+		}
+		f, ok := m.byNumber[num]
+		if !ok {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var values []interface{}
+		if wireType == 2 && f.wireType() != 2 {
+			// a packed run of numbers
+			b, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			packed := &protoReader{data: b}
+			for !packed.done() {
+				v, err := f.decodeValue(packed)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, v)
+			}
+		} else {
+			if wireType != f.wireType() {
+				return nil, errors.New("wrong wire type for protobuf field " + f.name)
+			}
+			v, err := f.decodeValue(r)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+
+		switch {
+		case f.message != nil && f.message.mapEntry:
+			entries, _ := out[f.name].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				out[f.name] = entries
+			}
+			for _, v := range values {
+				entry := v.(map[string]interface{})
+				k, err := formatColumn(entry["key"])
+				if err != nil {
+					return nil, err
+				}
+				entries[k] = entry["value"]
+			}
+		case f.label == protoRepeated:
+			existing, _ := out[f.name].([]interface{})
+			out[f.name] = append(existing, values...)
+		default:
+			// the last value wins, as it does for protobuf
+			out[f.name] = values[len(values)-1]
+		}
+	}
+	return out, nil
+}
+
+// encodeValue writes a single value of the field, without its tag.
+func (f *protoField) encodeValue(buf *bytes.Buffer, v interface{}) error {
+	switch f.typ {
+	case protoString:
+		s, ok := v.(string)
+		if !ok {
+			return errors.New(f.name + " must be a string")
+		}
+		writeProtoVarint(buf, uint64(len(s)))
+		buf.WriteString(s)
+		return nil
+	case protoBytes:
+		var b []byte
+		switch value := v.(type) {
+		case []byte:
+			b = value
+		case string:
+			var err error
+			b, err = base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return errors.New(f.name + " must be base64 encoded")
+			}
+		default:
+			return errors.New(f.name + " must be a base64 encoded string")
+		}
+		writeProtoVarint(buf, uint64(len(b)))
+		buf.Write(b)
+		return nil
+	case protoMessage:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.New(f.name + " must be an object")
+		}
+		var message bytes.Buffer
+		if err := f.message.encode(&message, m); err != nil {
+			return err
+		}
+		writeProtoVarint(buf, uint64(message.Len()))
+		buf.Write(message.Bytes())
+		return nil
+	case protoBool:
+		b, ok := v.(bool)
+		if !ok {
+			return errors.New(f.name + " must be a boolean")
+		}
+		if b {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		return nil
+	case protoEnum:
+		if name, ok := v.(string); ok {
+			n, ok := f.enum.byName[name]
+			if !ok {
+				return errors.New(name + " isn't a value of " + f.name)
+			}
+			writeProtoVarint(buf, uint64(int64(n)))
+			return nil
+		}
+	}
+
+	n, ok := numberValue(v)
+	if !ok {
+		return errors.New(f.name + " must be a number")
+	}
+	switch f.typ {
+	case protoDouble:
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(n))
+	case protoFloat:
+		binary.Write(buf, binary.LittleEndian, math.Float32bits(float32(n)))
+	case protoFixed64, protoSfixed64:
+		binary.Write(buf, binary.LittleEndian, uint64(int64(n)))
+	case protoFixed32, protoSfixed32:
+		binary.Write(buf, binary.LittleEndian, uint32(int32(n)))
+	case protoSint32, protoSint64:
+		i := int64(n)
+		writeProtoVarint(buf, uint64(i<<1)^uint64(i>>63))
+	case protoUint64:
+		writeProtoVarint(buf, uint64(n))
+	default:
+		// negative int32s and int64s are sign extended to ten bytes
+		writeProtoVarint(buf, uint64(int64(n)))
+	}
+	return nil
+}
+
+func writeProtoVarint(buf *bytes.Buffer, n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func writeProtoTag(buf *bytes.Buffer, number, wireType uint64) {
+	writeProtoVarint(buf, number<<3|wireType)
+}
+
+// encode writes a message's fields in order of their numbers.
+func (m *protoMessageType) encode(buf *bytes.Buffer, msg map[string]interface{}) error {
+	for _, f := range m.fields {
+		v, ok := msg[f.name]
+		if !ok || v == nil {
+			continue
+		}
+
+		if f.message != nil && f.message.mapEntry {
+			entries, ok := v.(map[string]interface{})
+			if !ok {
+				return errors.New(f.name + " must be an object")
+			}
+			keys := make([]string, 0, len(entries))
+			for k := range entries {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			keyField := f.message.byNumber[1]
+			for _, k := range keys {
+				var key interface{} = k
+				if keyField != nil && keyField.typ != protoString {
+					// map keys that aren't strings are numbers or booleans
+					if keyField.typ == protoBool {
+						key = k == "true"
+					} else {
+						n, err := strconv.ParseFloat(k, 64)
+						if err != nil {
+							return errors.New("keys of " + f.name + " must be numbers")
+						}
+						key = n
+					}
+				}
+				writeProtoTag(buf, f.number, 2)
+				if err := f.encodeValue(buf, map[string]interface{}{"key": key, "value": entries[k]}); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if f.label != protoRepeated {
+			writeProtoTag(buf, f.number, f.wireType())
+			if err := f.encodeValue(buf, v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		items, ok := v.([]interface{})
+		if !ok {
+			return errors.New(f.name + " must be an array")
+		}
+		if f.packed && len(items) > 0 {
+			var packed bytes.Buffer
+			for _, item := range items {
+				if err := f.encodeValue(&packed, item); err != nil {
+					return err
+				}
+			}
+			writeProtoTag(buf, f.number, 2)
+			writeProtoVarint(buf, uint64(packed.Len()))
+			buf.Write(packed.Bytes())
+			continue
+		}
+		for _, item := range items {
+			writeProtoTag(buf, f.number, f.wireType())
+			if err := f.encodeValue(buf, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newProtoCodec reads a base64 encoded descriptor set and finds the named
+// message type in it.
+func newProtoCodec(descriptors, messageName string) (protoCodec, error) {
+	data, err := base64.StdEncoding.DecodeString(descriptors)
+	if err != nil {
+		return protoCodec{}, errors.New("Descriptors must be a base64 encoded FileDescriptorSet")
+	}
+	messages, err := parseDescriptorSet(data)
+	if err != nil {
+		return protoCodec{}, err
+	}
+	if !strings.HasPrefix(messageName, ".") {
+		messageName = "." + messageName
+	}
+	message, ok := messages[messageName]
+	if !ok {
+		return protoCodec{}, errors.New("no message called " + messageName[1:] + " in Descriptors")
+	}
+	return protoCodec{message: message}, nil
+}
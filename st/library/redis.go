@@ -1,7 +1,9 @@
 package library
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -51,6 +53,12 @@ func newPool(server, password string) *redis.Pool {
 
 func formatReply(reply interface{}) (interface{}, error) {
 	switch reply := reply.(type) {
+	case nil:
+		// missing keys
+		return nil, nil
+	case string:
+		// status replies like OK
+		return reply, nil
 	case int64:
 		return float64(reply), nil
 	case []byte:
@@ -68,10 +76,74 @@ func formatReply(reply interface{}) (interface{}, error) {
 			result[i] = p
 		}
 		return result, nil
+	case redis.Error:
+		return nil, reply
 	}
 	return nil, fmt.Errorf("some other error happened")
 }
 
+// redisCommand is a command and the paths to its arguments.
+type redisCommand struct {
+	command       string
+	arguments     []string
+	argumentTrees []*jee.TokenTree
+}
+
+func newRedisCommand(command string, arguments []string) (*redisCommand, error) {
+	c := &redisCommand{
+		command:       command,
+		arguments:     arguments,
+		argumentTrees: make([]*jee.TokenTree, len(arguments)),
+	}
+	for i, path := range arguments {
+		tree, err := util.BuildTokenTree(path)
+		if err != nil {
+			return nil, err
+		}
+		c.argumentTrees[i] = tree
+	}
+	return c, nil
+}
+
+func (c *redisCommand) args(msg interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(c.argumentTrees))
+	for i, tree := range c.argumentTrees {
+		argument, err := jee.Eval(tree, msg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = argument
+	}
+	return args, nil
+}
+
+// setPath puts value into a copy of msg at a path like .user.visits,
+// making any objects along the way that don't exist yet.
+func setPath(msg interface{}, path string, value interface{}) (interface{}, error) {
+	keys := strings.Split(strings.TrimPrefix(path, "."), ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New(path + " isn't a path of keys like .user.visits")
+		}
+	}
+	m, ok := msg.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("can only add the reply to an object")
+	}
+	root := recCopy(m)
+	current := root
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[key] = next
+		}
+		current = next
+	}
+	current[keys[len(keys)-1]] = value
+	return root, nil
+}
+
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *Redis) Setup() {
 	b.Kind = "Data Stores"
@@ -89,9 +161,107 @@ func (b *Redis) Run() {
 	var password string
 	var command string
 	var arguments = make([]string, 0, 10)
-	var argumentTrees []*jee.TokenTree
+	var commandsRule = []interface{}{}
+	var commands []*redisCommand
 	var err error
 	var pool *redis.Pool
+	var pending []interface{}
+
+	batchSize := 1
+	flushInterval := time.Duration(1) * time.Second
+	var replyPath string
+
+	ticker := time.NewTicker(flushInterval)
+
+	// flush pipelines the commands for every pending message, sending them
+	// all before reading any of the replies, then hands each message's
+	// replies to emit. A message with a failed command is dropped.
+	flush := func(emit func(interface{}, interface{})) {
+		if len(pending) == 0 || pool == nil {
+			return
+		}
+		msgs := pending
+		pending = nil
+
+		conn := pool.Get()
+		defer conn.Close()
+
+		sent := make([]bool, len(msgs))
+		for i, msg := range msgs {
+			var commandArgs [][]interface{}
+			for _, c := range commands {
+				args, err := c.args(msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				commandArgs = append(commandArgs, args)
+			}
+			if len(commandArgs) != len(commands) {
+				continue
+			}
+			for j, c := range commands {
+				// commands like 'KEYS *' or 'SET NUMBERS 1'
+				err := conn.Send(c.command, commandArgs[j]...)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+			}
+			sent[i] = true
+		}
+		err := conn.Flush()
+		if err != nil {
+			b.Error(err)
+			return
+		}
+
+		for i, msg := range msgs {
+			if !sent[i] {
+				continue
+			}
+			replies := make([]interface{}, len(commands))
+			failed := false
+			for j := range commands {
+				reply, err := conn.Receive()
+				if _, ok := err.(redis.Error); !ok && err != nil {
+					// the connection is gone, so there's nothing more to read
+					b.Error(err)
+					return
+				}
+				if err == nil {
+					replies[j], err = formatReply(reply)
+				}
+				if err != nil {
+					b.Error(err)
+					failed = true
+				}
+			}
+			if failed {
+				continue
+			}
+			// a single command's reply is given as it is
+			var reply interface{} = replies
+			if len(replies) == 1 {
+				reply = replies[0]
+			}
+			emit(msg, reply)
+		}
+	}
+	emitReply := func(msg interface{}, reply interface{}) {
+		if replyPath == "" {
+			b.out <- map[string]interface{}{
+				"response": reply,
+			}
+			return
+		}
+		out, err := setPath(msg, replyPath, reply)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		b.out <- out
+	}
 
 	for {
 		select {
@@ -106,81 +276,168 @@ func (b *Redis) Run() {
 				b.Error(err)
 				continue
 			}
-			command, err = util.ParseString(ruleI, "Command")
+
+			// the remaining options are optional so that older rules still work
+			tmpCommandsRule := []interface{}{}
+			var tmpCommands []*redisCommand
+			if util.KeyExists(ruleI, "Commands") {
+				rules, ok := ruleI.(map[string]interface{})["Commands"].([]interface{})
+				if !ok {
+					b.Error(errors.New("Commands must be an array of objects with a Command and Arguments"))
+					continue
+				}
+				for _, commandRuleI := range rules {
+					if _, ok := commandRuleI.(map[string]interface{}); !ok {
+						err = errors.New("Commands must be an array of objects with a Command and Arguments")
+						break
+					}
+					var c string
+					c, err = util.ParseRequiredString(commandRuleI, "Command")
+					if err != nil {
+						break
+					}
+					args := []string{}
+					if util.KeyExists(commandRuleI, "Arguments") {
+						args, err = util.ParseArrayString(commandRuleI, "Arguments")
+						if err != nil {
+							break
+						}
+					}
+					var rc *redisCommand
+					rc, err = newRedisCommand(c, args)
+					if err != nil {
+						break
+					}
+					tmpCommands = append(tmpCommands, rc)
+					tmpCommandsRule = append(tmpCommandsRule, map[string]interface{}{
+						"Command":   c,
+						"Arguments": args,
+					})
+				}
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			// Command is only needed when there aren't any Commands
+			tmpCommand := ""
+			if util.KeyExists(ruleI, "Command") || len(tmpCommands) == 0 {
+				tmpCommand, err = util.ParseString(ruleI, "Command")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpArguments := make([]string, 0, 10)
+			if util.KeyExists(ruleI, "Arguments") {
+				tmpArguments, err = util.ParseArrayString(ruleI, "Arguments")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if len(tmpCommands) == 0 {
+				rc, err := newRedisCommand(tmpCommand, tmpArguments)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				tmpCommands = []*redisCommand{rc}
+			}
+			tmpBatchSize := 1
+			if util.KeyExists(ruleI, "BatchSize") {
+				tmpBatchSize, err = util.ParseInt(ruleI, "BatchSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpBatchSize < 1 {
+				b.Error(errors.New("BatchSize must be at least 1"))
+				continue
+			}
+			tmpFlushIntervalString := "1s"
+			if util.KeyExists(ruleI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(ruleI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-
-			if util.KeyExists(ruleI, "Arguments") {
-				arguments, err = util.ParseArrayString(ruleI, "Arguments")
+			if tmpFlushInterval <= 0 {
+				b.Error(errors.New("FlushInterval must be positive"))
+				continue
+			}
+			tmpReplyPath := ""
+			if util.KeyExists(ruleI, "ReplyPath") {
+				tmpReplyPath, err = util.ParseString(ruleI, "ReplyPath")
 				if err != nil {
 					b.Error(err)
 					continue
 				}
 			}
-
-			if len(arguments) > 0 {
-				argumentTrees = make([]*jee.TokenTree, len(arguments))
-				for i, path := range arguments {
-					token, err := jee.Lexer(path)
-					if err != nil {
-						b.Error(err)
-						continue
-					}
-					tree, err := jee.Parser(token)
-					if err != nil {
-						b.Error(err)
-						continue
-					}
-					argumentTrees[i] = tree
+			if tmpReplyPath != "" {
+				_, err = setPath(map[string]interface{}{}, tmpReplyPath, nil)
+				if err != nil {
+					b.Error(err)
+					continue
 				}
 			}
+
+			// run anything waiting with the old commands
+			flush(emitReply)
+
+			command = tmpCommand
+			arguments = tmpArguments
+			commandsRule = tmpCommandsRule
+			commands = tmpCommands
+			batchSize = tmpBatchSize
+			flushInterval = tmpFlushInterval
+			replyPath = tmpReplyPath
+			ticker.Stop()
+			ticker = time.NewTicker(flushInterval)
+
+			if pool != nil {
+				pool.Close()
+			}
 			pool = newPool(server, password)
 
 		case responseChan := <-b.queryrule:
 			// deal with a query request
 			responseChan <- map[string]interface{}{
-				"Server":    server,
-				"Password":  password,
-				"Command":   command,
-				"Arguments": arguments,
+				"Server":        server,
+				"Password":      password,
+				"Command":       command,
+				"Arguments":     arguments,
+				"Commands":      commandsRule,
+				"BatchSize":     float64(batchSize),
+				"FlushInterval": flushInterval.String(),
+				"ReplyPath":     replyPath,
 			}
 		case <-b.quit:
-			// quit the block
+			// run what's left, but there's nowhere to send the replies
+			ticker.Stop()
+			flush(func(msg interface{}, reply interface{}) {})
+			if pool != nil {
+				pool.Close()
+			}
 			return
+		case <-ticker.C:
+			flush(emitReply)
 		case msg := <-b.in:
 			if pool == nil {
 				b.Error("not connected to redis")
 				break
 			}
-
-			conn := pool.Get()
-
-			args := make([]interface{}, len(argumentTrees))
-			for i, tree := range argumentTrees {
-				argument, err := jee.Eval(tree, msg)
-				if err != nil {
-					b.Error(err)
-					break
-				}
-				args[i] = argument
-			}
-
-			// commands like 'KEYS *' or 'SET NUMBERS 1'
-			reply, err := conn.Do(command, args...)
-			if err != nil {
-				b.Error(err)
-				break
-			}
-
-			conn.Close()
-
-			nicerReply, err := formatReply(reply)
-			out := map[string]interface{}{
-				"response": nicerReply,
+			pending = append(pending, msg)
+			if len(pending) >= batchSize {
+				flush(emitReply)
 			}
-			b.out <- out
 		}
 	}
 }
@@ -0,0 +1,122 @@
+package library
+
+// requestPool runs slow work, like HTTP requests, on up to size goroutines
+// so that one slow call doesn't hold up the rest. Results come back to the
+// block's Run loop on done, where finish hands them over either in the order
+// the work was added or as soon as each is ready. Blocks stop reading their
+// inbound messages while the pool is full, so that a slow service pushes back
+// on the blocks upstream rather than growing the queue without limit.
+type requestPool struct {
+	size      int
+	maxQueued int
+	ordered   bool
+	queue     []*poolJob
+	inFlight  int
+	next      int
+	nextOut   int
+	finished  map[int]*poolJob
+	done      chan *poolJob
+	stop      chan bool
+}
+
+// poolJob is one piece of work. A nil result means there's nothing to emit,
+// usually because the work failed and has already reported its error.
+type poolJob struct {
+	seq    int
+	work   func() interface{}
+	result interface{}
+}
+
+func newRequestPool() *requestPool {
+	return &requestPool{
+		size:      1,
+		maxQueued: 100,
+		ordered:   true,
+		finished:  make(map[int]*poolJob),
+		done:      make(chan *poolJob),
+		stop:      make(chan bool),
+	}
+}
+
+// add queues work, starting it straight away if there's a free goroutine.
+func (p *requestPool) add(work func() interface{}) {
+	p.queue = append(p.queue, &poolJob{seq: p.next, work: work})
+	p.next++
+	p.dispatch()
+}
+
+// full is true when no more work should be added until some has finished.
+func (p *requestPool) full() bool {
+	return len(p.queue) >= p.maxQueued
+}
+
+func (p *requestPool) dispatch() {
+	for p.inFlight < p.size && len(p.queue) > 0 {
+		j := p.queue[0]
+		p.queue = p.queue[1:]
+		p.inFlight++
+		go func() {
+			j.result = j.work()
+			select {
+			case p.done <- j:
+			case <-p.stop:
+			}
+		}()
+	}
+}
+
+// finish takes a job from done and returns the results that are now ready
+// to emit. Every job passes through finished, even when unordered, so that
+// switching to ordered knows where to carry on from.
+func (p *requestPool) finish(j *poolJob) []interface{} {
+	p.inFlight--
+	p.dispatch()
+
+	var ready []interface{}
+	if !p.ordered && j.result != nil {
+		ready = append(ready, j.result)
+		j.result = nil
+	}
+	p.finished[j.seq] = j
+	for {
+		next, ok := p.finished[p.nextOut]
+		if !ok {
+			break
+		}
+		delete(p.finished, p.nextOut)
+		p.nextOut++
+		if next.result != nil {
+			ready = append(ready, next.result)
+		}
+	}
+	return ready
+}
+
+// setOrdered switches between emitting in order and as completed. Switching
+// to as completed returns anything held back waiting for an earlier result.
+func (p *requestPool) setOrdered(ordered bool) []interface{} {
+	p.ordered = ordered
+	var ready []interface{}
+	if ordered {
+		return ready
+	}
+	for seq := p.nextOut; seq < p.next; seq++ {
+		if j, ok := p.finished[seq]; ok && j.result != nil {
+			ready = append(ready, j.result)
+			j.result = nil
+		}
+	}
+	return ready
+}
+
+// close stops any running work from waiting to hand back its result.
+func (p *requestPool) close() {
+	close(p.stop)
+}
+
+func (p *requestPool) status() map[string]interface{} {
+	return map[string]interface{}{
+		"InFlight": float64(p.inFlight),
+		"Queued":   float64(len(p.queue)),
+	}
+}
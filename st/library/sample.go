@@ -0,0 +1,205 @@
+package library
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Sample struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	querysample chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	inpoll      blocks.MsgChan
+	in          blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewSample() blocks.BlockInterface {
+	return &Sample{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Sample) Setup() {
+	b.Kind = "Core"
+	b.Desc = "emits a random sample of messages, either by probability, consistently by key, or as a reservoir"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.inpoll = b.InRoute("poll")
+	b.queryrule = b.QueryRoute("rule")
+	b.querysample = b.QueryRoute("sample")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// hashFraction maps a key onto [0, 1) so that the same key always gets the
+// same fraction.
+func hashFraction(key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// keep the top 53 bits so the result fits exactly in a float64
+	return float64(h.Sum64()>>11) / (1 << 53)
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Sample) Run() {
+	var keyPath string
+	var keyTree *jee.TokenTree
+
+	mode := "bernoulli"
+	windowString := "0"
+	probability := 0.1
+	size := 100
+	window := time.Duration(0)
+
+	// reservoir sampling
+	var reservoir []interface{}
+	var seen float64
+	windowTicker := time.NewTicker(time.Duration(1) * time.Second)
+	windowTicker.Stop()
+
+	emitReservoir := func() map[string]interface{} {
+		sample := make([]interface{}, len(reservoir))
+		copy(sample, reservoir)
+		return map[string]interface{}{
+			"Sample": sample,
+			"Seen":   seen,
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpMode, err := util.ParseString(ruleI, "Mode")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMode != "bernoulli" && tmpMode != "hash" && tmpMode != "reservoir" {
+				b.Error(errors.New("Mode must be one of bernoulli, hash or reservoir"))
+				continue
+			}
+			tmpProbability, err := util.ParseFloat(ruleI, "Probability")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpProbability < 0 || tmpProbability > 1 {
+				b.Error(errors.New("Probability must be between 0 and 1"))
+				continue
+			}
+			tmpKeyPath, err := util.ParseString(ruleI, "KeyPath")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			var tmpKeyTree *jee.TokenTree
+			if tmpKeyPath != "" {
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMode == "hash" && tmpKeyTree == nil {
+				b.Error(errors.New("hash sampling needs a KeyPath"))
+				continue
+			}
+			tmpSize, err := util.ParseInt(ruleI, "Size")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMode == "reservoir" && tmpSize < 1 {
+				b.Error(errors.New("Size must be at least 1"))
+				continue
+			}
+			tmpWindowString, err := util.ParseString(ruleI, "Window")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpWindow, err := time.ParseDuration(tmpWindowString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			mode = tmpMode
+			probability = tmpProbability
+			keyPath, keyTree = tmpKeyPath, tmpKeyTree
+			size = tmpSize
+			windowString, window = tmpWindowString, tmpWindow
+
+			reservoir = nil
+			seen = 0
+			windowTicker.Stop()
+			if mode == "reservoir" && window > 0 {
+				windowTicker = time.NewTicker(window)
+			}
+
+		case <-b.quit:
+			// quit the block
+			windowTicker.Stop()
+			return
+		case msg := <-b.in:
+			switch mode {
+			case "bernoulli":
+				if rand.Float64() < probability {
+					b.out <- msg
+				}
+			case "hash":
+				k, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				key, err := groupKey(k)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				if hashFraction(key) < probability {
+					b.out <- msg
+				}
+			case "reservoir":
+				// Vitter's algorithm R: every message seen so far has the
+				// same chance of being in the reservoir
+				seen++
+				if len(reservoir) < size {
+					reservoir = append(reservoir, msg)
+					break
+				}
+				if i := rand.Int63n(int64(seen)); i < int64(size) {
+					reservoir[i] = msg
+				}
+			}
+		case <-windowTicker.C:
+			b.out <- emitReservoir()
+			reservoir = nil
+			seen = 0
+		case <-b.inpoll:
+			b.out <- emitReservoir()
+		case c := <-b.querysample:
+			c <- emitReservoir()
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Mode":        mode,
+				"Probability": probability,
+				"KeyPath":     keyPath,
+				"Size":        float64(size),
+				"Window":      windowString,
+			}
+		}
+	}
+}
@@ -0,0 +1,505 @@
+package library
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+)
+
+// socketFramings are the ways the TCP and Unix socket blocks split a stream
+// of bytes into messages. newline ends each message with a newline, length
+// starts each with its length as a 4 byte big-endian number.
+var socketFramings = map[string]bool{
+	"newline": true,
+	"length":  true,
+}
+
+func checkFraming(framing string) error {
+	if !socketFramings[framing] {
+		return errors.New("Framing must be either newline or length")
+	}
+	return nil
+}
+
+var errFrameTooLong = errors.New("message is longer than MaxSize")
+
+// readFrame reads the next message from r, which should have a buffer of at
+// least maxSize bytes. A newline framed message that's too long is skipped,
+// but there's no way back from a bad length so the connection should be
+// dropped.
+//
+// Syslog uses octet framing, where each message starts with its length as
+// decimal digits and a space. As senders may also use newlines instead, any
+// message that doesn't start with a digit is read up to a newline.
+func readFrame(r *bufio.Reader, framing string, maxSize int) ([]byte, error) {
+	if framing == "octet" {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] >= '0' && b[0] <= '9' {
+			n := 0
+			for {
+				c, err := r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if c == ' ' {
+					break
+				}
+				if c < '0' || c > '9' || n > maxSize {
+					return nil, errors.New("bad message length")
+				}
+				n = n*10 + int(c-'0')
+			}
+			if n > maxSize {
+				return nil, errFrameTooLong
+			}
+			frame := make([]byte, n)
+			_, err = io.ReadFull(r, frame)
+			return frame, err
+		}
+		framing = "newline"
+	}
+
+	if framing == "length" {
+		var header [4]byte
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			return nil, err
+		}
+		n := binary.BigEndian.Uint32(header[:])
+		if n > uint32(maxSize) {
+			return nil, errFrameTooLong
+		}
+		frame := make([]byte, n)
+		_, err = io.ReadFull(r, frame)
+		return frame, err
+	}
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// throw the rest of the line away
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			return nil, errFrameTooLong
+		}
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > 0 {
+			// ReadSlice's buffer is reused by the next read
+			frame := make([]byte, len(line))
+			copy(frame, line)
+			// a last line without a newline still counts
+			return frame, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeFrame writes a message to w.
+func writeFrame(w io.Writer, framing string, data []byte) error {
+	var frame []byte
+	if framing == "length" {
+		frame = make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(frame, uint32(len(data)))
+		frame = append(frame, data...)
+	} else {
+		frame = make([]byte, 0, len(data)+1)
+		frame = append(frame, data...)
+		frame = append(frame, '\n')
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// socketConn describes where a message came from.
+type socketConn struct {
+	id         string
+	localAddr  string
+	remoteAddr string
+}
+
+// socketDecoder turns a message read from a socket into the message emitted
+// into streamtools.
+type socketDecoder func(frame []byte, conn *socketConn) interface{}
+
+// serverOutput is how the socket and packet servers hand messages and
+// errors back to the block's Run loop, giving up once they're told to stop.
+type serverOutput struct {
+	toOut   blocks.MsgChan
+	toError chan error
+	stop    chan bool
+}
+
+func (o *serverOutput) stopped() bool {
+	select {
+	case <-o.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *serverOutput) send(msg interface{}) bool {
+	select {
+	case o.toOut <- msg:
+		return true
+	case <-o.stop:
+		return false
+	}
+}
+
+func (o *serverOutput) sendError(err error) bool {
+	select {
+	case o.toError <- err:
+		return true
+	case <-o.stop:
+		return false
+	}
+}
+
+// temporaryError says whether an error from reading a socket passes, such as
+// running out of file descriptors, so that it's worth waiting and trying again.
+func temporaryError(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// socketServer accepts connections on a TCP or Unix socket, reading messages
+// from each in its own goroutine and handing them back to the block's Run
+// loop.
+type socketServer struct {
+	serverOutput
+	network string
+	framing string
+	maxSize int
+	decode  socketDecoder
+
+	listener net.Listener
+	wait     sync.WaitGroup
+
+	lock  sync.Mutex
+	conns map[net.Conn]bool
+}
+
+func listenSocket(network, address, framing string, maxSize int, decode socketDecoder, toOut blocks.MsgChan, toError chan error) (*socketServer, error) {
+	if network == "unix" {
+		// a socket file left behind by a streamtools that didn't shut down
+		// cleanly stops us listening, but one that's in use is left alone
+		fi, err := os.Stat(address)
+		if err == nil && fi.Mode()&os.ModeSocket != 0 {
+			conn, err := net.Dial("unix", address)
+			if err == nil {
+				conn.Close()
+			} else {
+				os.Remove(address)
+			}
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	s := &socketServer{
+		serverOutput: serverOutput{
+			toOut:   toOut,
+			toError: toError,
+			stop:    make(chan bool),
+		},
+		network:  network,
+		framing:  framing,
+		maxSize:  maxSize,
+		decode:   decode,
+		listener: listener,
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wait.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// close stops listening, drops every connection and waits for their
+// goroutines to finish.
+func (s *socketServer) close() {
+	close(s.stop)
+	s.listener.Close()
+	s.lock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.wait.Wait()
+}
+
+func (s *socketServer) accept() {
+	defer s.wait.Done()
+	id := 0
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.stopped() {
+				return
+			}
+			if !s.sendError(err) {
+				return
+			}
+			if temporaryError(err) {
+				time.Sleep(time.Duration(100) * time.Millisecond)
+				continue
+			}
+			return
+		}
+		s.lock.Lock()
+		if s.stopped() {
+			s.lock.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.lock.Unlock()
+
+		id++
+		s.wait.Add(1)
+		go s.serve(conn, id)
+	}
+}
+
+// serve reads messages from one connection until it's closed.
+func (s *socketServer) serve(conn net.Conn, id int) {
+	defer s.wait.Done()
+	defer func() {
+		s.lock.Lock()
+		delete(s.conns, conn)
+		s.lock.Unlock()
+		conn.Close()
+	}()
+
+	c := &socketConn{
+		id:        s.network + ":" + strconv.Itoa(id),
+		localAddr: conn.LocalAddr().String(),
+	}
+	if addr := conn.RemoteAddr(); addr != nil {
+		c.remoteAddr = addr.String()
+	}
+	// Unix socket clients usually don't have a name, which Go shows as @
+	if c.remoteAddr == "@" {
+		c.remoteAddr = ""
+	}
+
+	r := bufio.NewReaderSize(conn, s.maxSize)
+	for {
+		frame, err := readFrame(r, s.framing, s.maxSize)
+		if err == errFrameTooLong && s.framing == "newline" {
+			if !s.sendError(err) {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !s.stopped() {
+				s.sendError(err)
+			}
+			return
+		}
+		if !s.send(s.decode(frame, c)) {
+			return
+		}
+	}
+}
+
+// the largest payload a UDP datagram can carry
+const MAX_UDP_MESSAGE_SIZE = 65507
+
+// udpSettings is everything about how to listen for UDP datagrams.
+type udpSettings struct {
+	connectionString string
+	maxSize          int
+	multicastGroup   string
+	iface            string
+}
+
+// listenUDP listens on the connection string, joining the multicast group if
+// there is one. The group's port is taken from the connection string.
+func listenUDP(settings udpSettings) (net.PacketConn, error) {
+	if settings.multicastGroup == "" {
+		return net.ListenPacket("udp", settings.connectionString)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", settings.connectionString)
+	if err != nil {
+		return nil, err
+	}
+	group := net.ParseIP(settings.multicastGroup)
+	if group == nil || !group.IsMulticast() {
+		return nil, errors.New(settings.multicastGroup + " isn't a multicast address")
+	}
+
+	// without an interface the system picks one
+	var iface *net.Interface
+	if settings.iface != "" {
+		iface, err = net.InterfaceByName(settings.iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return net.ListenMulticastUDP("udp", iface, &net.UDPAddr{IP: group, Port: addr.Port})
+}
+
+// packetServer reads UDP datagrams in its own goroutine, handing them back
+// to the block's Run loop in the same way as socketServer.
+type packetServer struct {
+	serverOutput
+	maxSize int
+	decode  socketDecoder
+
+	conn net.PacketConn
+	done chan bool
+}
+
+func listenPacket(settings udpSettings, decode socketDecoder, toOut blocks.MsgChan, toError chan error) (*packetServer, error) {
+	conn, err := listenUDP(settings)
+	if err != nil {
+		return nil, err
+	}
+	s := &packetServer{
+		serverOutput: serverOutput{
+			toOut:   toOut,
+			toError: toError,
+			stop:    make(chan bool),
+		},
+		maxSize: settings.maxSize,
+		decode:  decode,
+		conn:    conn,
+		done:    make(chan bool),
+	}
+	go s.read()
+	return s, nil
+}
+
+func (s *packetServer) close() {
+	close(s.stop)
+	s.conn.Close()
+	<-s.done
+}
+
+// failed says whether reading has stopped without the server being closed.
+func (s *packetServer) failed() bool {
+	select {
+	case <-s.done:
+		return !s.stopped()
+	default:
+		return false
+	}
+}
+
+// read hands on datagrams until the server is closed. An error that doesn't
+// pass means the socket is no use any more, so it's reported and reading
+// stops rather than failing over and over. Datagrams longer than maxSize
+// are reported and skipped.
+func (s *packetServer) read() {
+	defer close(s.done)
+	localAddr := s.conn.LocalAddr().String()
+	// a byte more than the largest datagram, so the system can't truncate
+	// one without us noticing
+	buffer := make([]byte, MAX_UDP_MESSAGE_SIZE+1)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			if s.stopped() {
+				return
+			}
+			if !s.sendError(err) {
+				return
+			}
+			if temporaryError(err) {
+				time.Sleep(time.Duration(100) * time.Millisecond)
+				continue
+			}
+			return
+		}
+		if n > s.maxSize {
+			if !s.sendError(errFrameTooLong) {
+				return
+			}
+			continue
+		}
+		frame := make([]byte, n)
+		copy(frame, buffer)
+		c := &socketConn{
+			id:         "udp:" + addr.String(),
+			localAddr:  localAddr,
+			remoteAddr: addr.String(),
+		}
+		if !s.send(s.decode(frame, c)) {
+			return
+		}
+	}
+}
+
+// how long to wait for a connection or a write before giving up
+const socketTimeout = time.Duration(10) * time.Second
+
+// socketClient is a connection the TCP and Unix socket blocks write to.
+// Nothing is expected back, so reading only tells us when the other end has
+// hung up, which a write wouldn't notice until it was too late.
+type socketClient struct {
+	conn net.Conn
+	gone chan bool
+}
+
+func dialSocket(network, address string) (*socketClient, error) {
+	conn, err := net.DialTimeout(network, address, socketTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &socketClient{
+		conn: conn,
+		gone: make(chan bool),
+	}
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(c.gone)
+	}()
+	return c, nil
+}
+
+func (c *socketClient) closed() bool {
+	select {
+	case <-c.gone:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *socketClient) write(framing string, data []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(socketTimeout))
+	return writeFrame(c.conn, framing, data)
+}
+
+func (c *socketClient) close() {
+	c.conn.Close()
+	<-c.gone
+}
@@ -0,0 +1,134 @@
+package library
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// sqlRule holds the connection rule shared by the toSQL and sqlQuery blocks.
+type sqlRule struct {
+	driver     string
+	dataSource string
+}
+
+// parseSQLRule reads which database to connect to. The driver is one of
+// those imported above, or in sql_sqlite3.go for builds with cgo.
+func parseSQLRule(ruleI interface{}) (*sqlRule, error) {
+	driver, err := util.ParseRequiredString(ruleI, "Driver")
+	if err != nil {
+		return nil, err
+	}
+	if driver != "postgres" && driver != "mysql" && driver != "sqlite3" {
+		return nil, errors.New("Driver must be one of postgres, mysql or sqlite3")
+	}
+	drivers := sql.Drivers()
+	if i := sort.SearchStrings(drivers, driver); i == len(drivers) || drivers[i] != driver {
+		return nil, errors.New("this build of streamtools doesn't include the " + driver + " driver")
+	}
+	dataSource, err := util.ParseRequiredString(ruleI, "DataSource")
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRule{
+		driver:     driver,
+		dataSource: dataSource,
+	}, nil
+}
+
+// open connects to the database. database/sql reconnects by itself, so a
+// database that's down is only reported, not fatal.
+func (r *sqlRule) open() (*sql.DB, error) {
+	db, err := sql.Open(r.driver, r.dataSource)
+	if err != nil {
+		return nil, err
+	}
+	return db, db.Ping()
+}
+
+// placeholder is the nth (from 1) parameter of a statement.
+func (r *sqlRule) placeholder(n int) string {
+	if r.driver == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// quote makes a table or column name safe to put in a statement. Names may
+// have a schema, as in public.events.
+func (r *sqlRule) quote(name string) (string, error) {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		if !sqlIdentifier.MatchString(part) {
+			return "", errors.New(name + " isn't a valid table or column name")
+		}
+		if r.driver == "mysql" {
+			parts[i] = "`" + part + "`"
+		} else {
+			parts[i] = `"` + part + `"`
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// sqlValue turns a value from a message into a statement parameter. Objects
+// and arrays are stored as JSON.
+func sqlValue(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, string, float64, bool:
+		return v, nil
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(j), nil
+}
+
+// sqlRows reads rows into objects keyed by column name.
+func sqlRows(rows *sql.Rows) ([]interface{}, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := []interface{}{}
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		err := rows.Scan(pointers...)
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{})
+		for i, column := range columns {
+			switch value := values[i].(type) {
+			case []byte:
+				row[column] = string(value)
+			case int64:
+				row[column] = float64(value)
+			case float32:
+				row[column] = float64(value)
+			case time.Time:
+				row[column] = value.UTC().Format(time.RFC3339Nano)
+			default:
+				row[column] = value
+			}
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,180 @@
+package library
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type SQLQuery struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewSQLQuery() blocks.BlockInterface {
+	return &SQLQuery{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *SQLQuery) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "runs a query for each message, adding the rows it returns to the message"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *SQLQuery) Run() {
+	var db *sql.DB
+	var stmt *sql.Stmt
+	var rule = &sqlRule{}
+	var query string
+	var arguments = []string{}
+	var argumentTrees []*jee.TokenTree
+
+	resultPath := ".rows"
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseSQLRule(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpQuery, err := util.ParseRequiredString(ruleI, "Query")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpArguments := []string{}
+			if util.KeyExists(ruleI, "Arguments") {
+				tmpArguments, err = util.ParseArrayString(ruleI, "Arguments")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpArgumentTrees := make([]*jee.TokenTree, len(tmpArguments))
+			for i, path := range tmpArguments {
+				tmpArgumentTrees[i], err = util.BuildTokenTree(path)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpResultPath := ".rows"
+			if util.KeyExists(ruleI, "ResultPath") {
+				tmpResultPath, err = util.ParseRequiredString(ruleI, "ResultPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			_, err = setPath(map[string]interface{}{}, tmpResultPath, nil)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			if db != nil {
+				db.Close()
+				db = nil
+				stmt = nil
+			}
+
+			rule = tmpRule
+			query = tmpQuery
+			arguments = tmpArguments
+			argumentTrees = tmpArgumentTrees
+			resultPath = tmpResultPath
+
+			db, err = rule.open()
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			// preparing now finds mistakes in the query straight away
+			stmt, err = db.Prepare(query)
+			if err != nil {
+				b.Error(err)
+			}
+		case msg := <-b.in:
+			if db == nil {
+				b.Error(errors.New("not connected to a database"))
+				continue
+			}
+			if stmt == nil {
+				// the database may have been down when the rule was set
+				var err error
+				stmt, err = db.Prepare(query)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			args := make([]interface{}, len(argumentTrees))
+			var err error
+			for i, tree := range argumentTrees {
+				var v interface{}
+				v, err = jee.Eval(tree, msg)
+				if err != nil {
+					break
+				}
+				args[i], err = sqlValue(v)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			rows, err := stmt.Query(args...)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			result, err := sqlRows(rows)
+			rows.Close()
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			out, err := setPath(msg, resultPath, result)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			b.out <- out
+		case <-b.quit:
+			if db != nil {
+				db.Close()
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Driver":     rule.driver,
+				"DataSource": rule.dataSource,
+				"Query":      query,
+				"Arguments":  arguments,
+				"ResultPath": resultPath,
+			}
+		}
+	}
+}
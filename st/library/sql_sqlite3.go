@@ -0,0 +1,10 @@
+//go:build cgo
+// +build cgo
+
+package library
+
+// the SQLite driver needs cgo, so builds without it can only use postgres and
+// mysql
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
@@ -0,0 +1,186 @@
+package library
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Switch struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       chan *blocks.Msg
+	quit      blocks.MsgChan
+}
+
+// switchRoutes are the out routes cases can send messages to.
+var switchRoutes = []string{"1", "2", "3", "4", "5", "6", "7", "8"}
+
+// a switchCase sends messages that match its filter to its route.
+type switchCase struct {
+	route  string
+	filter string
+	tree   *jee.TokenTree
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewSwitch() blocks.BlockInterface {
+	return &Switch{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Switch) Setup() {
+	b.Kind = "Core"
+	b.Desc = "sends each message out of the routes whose filters it matches"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.OutRoutes(switchRoutes...)
+}
+
+// checkSwitchRoute makes sure a route is one of the block's out routes.
+func checkSwitchRoute(route string) error {
+	for _, r := range switchRoutes {
+		if r == route {
+			return nil
+		}
+	}
+	return errors.New("Route must be one of " + strings.Join(switchRoutes, ", "))
+}
+
+// parseCases reads the ordered list of {"Route": ..., "Filter": ...} cases.
+func parseCases(ruleI interface{}) ([]switchCase, error) {
+	rule := ruleI.(map[string]interface{})
+	casesI, ok := rule["Cases"]
+	if !ok {
+		return nil, errors.New("Cases was not in rule")
+	}
+	list, ok := casesI.([]interface{})
+	if !ok {
+		return nil, errors.New("Cases must be an array")
+	}
+	cases := make([]switchCase, len(list))
+	for i, caseI := range list {
+		c, ok := caseI.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("each case must have a Route and a Filter")
+		}
+		route, err := util.ParseRequiredString(c, "Route")
+		if err != nil {
+			return nil, err
+		}
+		err = checkSwitchRoute(route)
+		if err != nil {
+			return nil, err
+		}
+		filter, err := util.ParseRequiredString(c, "Filter")
+		if err != nil {
+			return nil, err
+		}
+		tree, err := util.BuildTokenTree(filter)
+		if err != nil {
+			return nil, err
+		}
+		cases[i] = switchCase{
+			route:  route,
+			filter: filter,
+			tree:   tree,
+		}
+	}
+	return cases, nil
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Switch) Run() {
+	var cases []switchCase
+	var defaultRoute string
+	mode := "first"
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpCases, err := parseCases(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpMode, err := util.ParseString(ruleI, "Mode")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMode != "first" && tmpMode != "all" {
+				b.Error(errors.New("Mode must be either first or all"))
+				continue
+			}
+			tmpDefault, err := util.ParseString(ruleI, "Default")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpDefault != "" {
+				err = checkSwitchRoute(tmpDefault)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			cases = tmpCases
+			mode = tmpMode
+			defaultRoute = tmpDefault
+
+		case <-b.quit:
+			// quit the block
+			return
+		case msg := <-b.in:
+			matched := false
+			for _, c := range cases {
+				e, err := jee.Eval(c.tree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if eval, ok := e.(bool); !ok || !eval {
+					continue
+				}
+				matched = true
+				b.out <- &blocks.Msg{
+					Msg:   msg,
+					Route: c.route,
+				}
+				if mode == "first" {
+					break
+				}
+			}
+			// messages that match nothing are dropped unless there's a default
+			if !matched && defaultRoute != "" {
+				b.out <- &blocks.Msg{
+					Msg:   msg,
+					Route: defaultRoute,
+				}
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			casesOut := make([]interface{}, len(cases))
+			for i, sc := range cases {
+				casesOut[i] = map[string]interface{}{
+					"Route":  sc.route,
+					"Filter": sc.filter,
+				}
+			}
+			c <- map[string]interface{}{
+				"Cases":   casesOut,
+				"Mode":    mode,
+				"Default": defaultRoute,
+			}
+		}
+	}
+}
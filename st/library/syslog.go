@@ -0,0 +1,262 @@
+package library
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+var syslogSeverities = []string{
+	"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+}
+
+// parseSyslog turns a syslog message into an object. RFC 5424 messages are
+// recognised by their version number, and anything else is read as RFC 3164,
+// which is more of a description of what's out there than a format, so the
+// parts it can't find are left out. A message without a priority gets the
+// default of user.notice, with the whole thing as its message.
+func parseSyslog(data []byte, now time.Time) map[string]interface{} {
+	data = bytes.TrimRight(data, "\r\n\x00")
+
+	priority := 13
+	rest := string(data)
+	if p, r, ok := parseSyslogPriority(rest); ok {
+		priority = p
+		rest = r
+	}
+
+	msg := map[string]interface{}{
+		"Priority":     float64(priority),
+		"Facility":     float64(priority / 8),
+		"FacilityName": syslogFacilities[priority/8],
+		"Severity":     float64(priority % 8),
+		"SeverityName": syslogSeverities[priority%8],
+	}
+
+	err := parseRFC5424(rest, msg)
+	if err != nil {
+		// it may only have looked like RFC 5424
+		for _, key := range []string{"Version", "Timestamp", "Hostname", "AppName", "ProcID", "MsgID", "StructuredData"} {
+			delete(msg, key)
+		}
+		parseRFC3164(rest, now, msg)
+	}
+	return msg
+}
+
+// parseSyslogPriority reads the <PRI> from the start of a message.
+func parseSyslogPriority(s string) (int, string, bool) {
+	if len(s) < 3 || s[0] != '<' {
+		return 0, s, false
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return 0, s, false
+	}
+	p, err := strconv.Atoi(s[1:end])
+	if err != nil || p < 0 || p > 191 {
+		return 0, s, false
+	}
+	return p, s[end+1:], true
+}
+
+// nextSyslogField splits off the next field, up to a space. - means the
+// field has no value.
+func nextSyslogField(s string) (string, string, bool) {
+	i := strings.IndexByte(s, ' ')
+	if i < 1 {
+		return "", s, false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// parseRFC5424 reads a message like
+//
+//	1 2003-10-11T22:14:15.003Z mymachine evntslog - ID47 [exampleSDID@32473 iut="3"] An application event
+//
+// which is everything after the priority.
+func parseRFC5424(s string, msg map[string]interface{}) error {
+	version, s, ok := nextSyslogField(s)
+	if !ok {
+		return errors.New("no version")
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v < 1 || len(version) > 3 {
+		return errors.New("bad version")
+	}
+	msg["Version"] = float64(v)
+
+	timestamp, s, ok := nextSyslogField(s)
+	if !ok {
+		return errors.New("no timestamp")
+	}
+	if timestamp != "-" {
+		t, err := time.Parse(time.RFC3339Nano, timestamp)
+		if err != nil {
+			return err
+		}
+		msg["Timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	for _, key := range []string{"Hostname", "AppName", "ProcID", "MsgID"} {
+		var field string
+		field, s, ok = nextSyslogField(s)
+		if !ok {
+			return errors.New("no " + key)
+		}
+		if field != "-" {
+			msg[key] = field
+		}
+	}
+
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		sd, r, err := parseStructuredData(s)
+		if err != nil {
+			return err
+		}
+		msg["StructuredData"] = sd
+		s = r
+	}
+
+	if s != "" {
+		if s[0] != ' ' {
+			return errors.New("no space before the message")
+		}
+		s = s[1:]
+	}
+	// the message may start with a byte order mark to say it's UTF-8
+	msg["Message"] = strings.TrimPrefix(s, "\ufeff")
+	return nil
+}
+
+// parseStructuredData reads elements like [id name="value" ...], returning an
+// object of each id's parameters and whatever follows them.
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+	sd := make(map[string]interface{})
+	for strings.HasPrefix(s, "[") {
+		s = s[1:]
+		end := strings.IndexAny(s, " ]")
+		if end < 1 {
+			return nil, "", errors.New("bad structured data")
+		}
+		id := s[:end]
+		s = s[end:]
+		params, ok := sd[id].(map[string]interface{})
+		if !ok {
+			params = make(map[string]interface{})
+			sd[id] = params
+		}
+		for strings.HasPrefix(s, " ") {
+			s = s[1:]
+			eq := strings.Index(s, "=\"")
+			if eq < 1 {
+				return nil, "", errors.New("bad structured data")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+			// values escape ", \ and ] with a backslash
+			var value []byte
+			i := 0
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+					i++
+				}
+				value = append(value, s[i])
+			}
+			if i == len(s) {
+				return nil, "", errors.New("bad structured data")
+			}
+			params[name] = string(value)
+			s = s[i+1:]
+		}
+		if !strings.HasPrefix(s, "]") {
+			return nil, "", errors.New("bad structured data")
+		}
+		s = s[1:]
+	}
+	if len(sd) == 0 {
+		return nil, "", errors.New("bad structured data")
+	}
+	return sd, s, nil
+}
+
+// parseRFC3164 reads a message like
+//
+//	Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8
+//
+// which is everything after the priority. Some senders use an RFC 3339
+// timestamp instead, and some leave out the hostname.
+func parseRFC3164(s string, now time.Time, msg map[string]interface{}) {
+	t, r, ok := parseRFC3164Timestamp(s, now)
+	if !ok {
+		// without a header it's all message
+		msg["Message"] = s
+		return
+	}
+	msg["Timestamp"] = t.UTC().Format(time.RFC3339Nano)
+	s = r
+
+	// no hostname if the next field is already the tag
+	if field, r, ok := nextSyslogField(s); ok && !strings.HasSuffix(field, ":") && !strings.HasSuffix(field, "]") {
+		msg["Hostname"] = field
+		s = r
+	}
+
+	// the tag is the program's name, often with its process id
+	end := strings.IndexAny(s, ": ")
+	if end > 0 && end <= 48 {
+		tag := s[:end]
+		r := s[end:]
+		procID := ""
+		if open := strings.IndexByte(tag, '['); open > 0 && strings.HasSuffix(tag, "]") {
+			procID = tag[open+1 : len(tag)-1]
+			tag = tag[:open]
+		}
+		if strings.HasPrefix(r, ":") || procID != "" {
+			msg["AppName"] = tag
+			if procID != "" {
+				msg["ProcID"] = procID
+			}
+			s = strings.TrimPrefix(r, ":")
+			s = strings.TrimPrefix(s, " ")
+		}
+	}
+
+	msg["Message"] = s
+}
+
+// parseRFC3164Timestamp reads a timestamp like Oct 11 22:14:15, which has no
+// year or time zone, so it's taken to be the local time within the last
+// year. RFC 3339 timestamps are read too.
+func parseRFC3164Timestamp(s string, now time.Time) (time.Time, string, bool) {
+	if field, r, ok := nextSyslogField(s); ok {
+		t, err := time.Parse(time.RFC3339Nano, field)
+		if err == nil {
+			return t, r, true
+		}
+	}
+
+	if len(s) < len(time.Stamp)+1 || s[len(time.Stamp)] != ' ' {
+		return time.Time{}, s, false
+	}
+	t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], now.Location())
+	if err != nil {
+		return time.Time{}, s, false
+	}
+	t = time.Date(now.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, now.Location())
+	// December's messages arriving in January
+	if t.After(now.Add(time.Duration(24) * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t, s[len(time.Stamp)+1:], true
+}
@@ -0,0 +1,183 @@
+package library
+
+// T-DIGEST
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// a centroid summarises a cluster of nearby values by their mean and count.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+type centroids []centroid
+
+func (c centroids) Len() int           { return len(c) }
+func (c centroids) Less(i, j int) bool { return c[i].mean < c[j].mean }
+func (c centroids) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// A tDigest is a merging t-digest (Dunning & Ertl) which approximates the
+// distribution of a stream of numbers in bounded space. It is most accurate in
+// the tails, which is where quantiles like p99 live.
+type tDigest struct {
+	compression float64
+	centroids   centroids
+	buffer      centroids
+	count       float64
+	min         float64
+	max         float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add adds a single value to the digest.
+func (d *tDigest) Add(x float64) {
+	d.addCentroid(centroid{mean: x, weight: 1}, x, x)
+}
+
+// Merge adds every value summarised by another digest to this one.
+func (d *tDigest) Merge(o *tDigest) {
+	o.compress()
+	for _, c := range o.centroids {
+		d.addCentroid(c, o.min, o.max)
+	}
+}
+
+func (d *tDigest) addCentroid(c centroid, min, max float64) {
+	d.buffer = append(d.buffer, c)
+	d.count += c.weight
+	if min < d.min {
+		d.min = min
+	}
+	if max > d.max {
+		d.max = max
+	}
+	if float64(len(d.buffer)) > 5*d.compression {
+		d.compress()
+	}
+}
+
+// compress merges the buffered values into the centroids, keeping each
+// centroid small enough that the quantiles near it stay accurate.
+func (d *tDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	sort.Sort(all)
+
+	merged := centroids{all[0]}
+	soFar := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		q := (soFar + (last.weight+c.weight)/2) / d.count
+		limit := 4 * d.count * q * (1 - q) / d.compression
+		if last.weight+c.weight <= limit {
+			last.mean = (last.mean*last.weight + c.mean*c.weight) / (last.weight + c.weight)
+			last.weight += c.weight
+			continue
+		}
+		soFar += last.weight
+		merged = append(merged, c)
+	}
+
+	d.centroids = merged
+	d.buffer = nil
+}
+
+// Count returns the number of values added to the digest.
+func (d *tDigest) Count() float64 {
+	return d.count
+}
+
+// Quantile returns an estimate of the value below which the fraction q of the
+// values added to the digest fall.
+func (d *tDigest) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 {
+		return 0, errors.New("quantile must be between 0 and 1")
+	}
+	d.compress()
+	if len(d.centroids) == 0 {
+		return 0, errors.New("no values in digest")
+	}
+	if q == 0 {
+		return d.min, nil
+	}
+	if q == 1 {
+		return d.max, nil
+	}
+
+	target := q * d.count
+	first := d.centroids[0]
+	if target < first.weight/2 {
+		return d.min + (first.mean-d.min)*target/(first.weight/2), nil
+	}
+
+	cumulative := 0.0
+	for i := 0; i < len(d.centroids)-1; i++ {
+		c, next := d.centroids[i], d.centroids[i+1]
+		left := cumulative + c.weight/2
+		right := cumulative + c.weight + next.weight/2
+		if target <= right {
+			return c.mean + (next.mean-c.mean)*(target-left)/(right-left), nil
+		}
+		cumulative += c.weight
+	}
+
+	last := d.centroids[len(d.centroids)-1]
+	left := d.count - last.weight/2
+	return last.mean + (d.max-last.mean)*(target-left)/(last.weight/2), nil
+}
+
+// CDF returns an estimate of the fraction of values added to the digest that
+// are less than or equal to x.
+func (d *tDigest) CDF(x float64) (float64, error) {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return 0, errors.New("no values in digest")
+	}
+	if x < d.min {
+		return 0, nil
+	}
+	if x >= d.max {
+		return 1, nil
+	}
+
+	first := d.centroids[0]
+	if x < first.mean {
+		if first.mean == d.min {
+			return 0, nil
+		}
+		return (x - d.min) / (first.mean - d.min) * first.weight / 2 / d.count, nil
+	}
+
+	cumulative := 0.0
+	for i := 0; i < len(d.centroids)-1; i++ {
+		c, next := d.centroids[i], d.centroids[i+1]
+		if x < next.mean {
+			position := cumulative + c.weight/2
+			if next.mean > c.mean {
+				position += (x - c.mean) / (next.mean - c.mean) * (c.weight/2 + next.weight/2)
+			}
+			return position / d.count, nil
+		}
+		cumulative += c.weight
+	}
+
+	last := d.centroids[len(d.centroids)-1]
+	position := d.count - last.weight/2
+	if d.max > last.mean {
+		position += (x - last.mean) / (d.max - last.mean) * last.weight / 2
+	}
+	return position / d.count, nil
+}
@@ -0,0 +1,297 @@
+package library
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"   // util
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type Throttle struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	querytokens chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// a tokenBucket holds the tokens available to one key, along with any
+// messages waiting for a token when delaying.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	queue  *PriorityQueue
+}
+
+// refill adds the tokens that have accrued since we last looked at the bucket.
+func (t *tokenBucket) refill(now time.Time, rate, burst float64) {
+	t.tokens = math.Min(burst, t.tokens+rate*now.Sub(t.last).Seconds())
+	t.last = now
+}
+
+// newTokenBucket makes a full bucket with nothing waiting.
+func newTokenBucket(now time.Time, burst float64) *tokenBucket {
+	t := &tokenBucket{
+		tokens: burst,
+		last:   now,
+		queue:  &PriorityQueue{},
+	}
+	heap.Init(t.queue)
+	return t
+}
+
+// throttleKey finds the key a message is limited under, which is the same
+// for every message when there's no KeyPath.
+func throttleKey(keyTree *jee.TokenTree, msg interface{}) (string, error) {
+	if keyTree == nil {
+		return "", nil
+	}
+	k, err := jee.Eval(keyTree, msg)
+	if err != nil {
+		return "", err
+	}
+	return groupKey(k)
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewThrottle() blocks.BlockInterface {
+	return &Throttle{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *Throttle) Setup() {
+	b.Kind = "Core"
+	b.Desc = "limits the rate of messages with a token bucket, delaying, dropping or sampling those over the limit"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.querytokens = b.QueryRoute("tokens")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *Throttle) Run() {
+	var keyPath string
+	var keyTree *jee.TokenTree
+
+	rate := 1.0
+	burst := 1.0
+	mode := "delay"
+	sampleRate := 0.1
+	maxQueue := 1000
+	var queued, dropped float64
+
+	buckets := map[string]*tokenBucket{}
+	waitTimer := time.NewTimer(100 * time.Millisecond)
+
+	for {
+		tick := false
+		select {
+		case ruleI := <-b.inrule:
+			tmpRate, err := util.ParseFloat(ruleI, "Rate")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpBurst, err := util.ParseFloat(ruleI, "Burst")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpRate <= 0 || tmpBurst < 1 {
+				b.Error(errors.New("Rate must be positive and Burst must be at least 1"))
+				continue
+			}
+			tmpMode, err := util.ParseString(ruleI, "Mode")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpMode != "delay" && tmpMode != "drop" && tmpMode != "sample" {
+				b.Error(errors.New("Mode must be one of delay, drop or sample"))
+				continue
+			}
+			tmpKeyPath := ""
+			if util.KeyExists(ruleI, "KeyPath") {
+				tmpKeyPath, err = util.ParseString(ruleI, "KeyPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpKeyTree *jee.TokenTree
+			if tmpKeyPath != "" {
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpSampleRate := sampleRate
+			if util.KeyExists(ruleI, "SampleRate") {
+				tmpSampleRate, err = util.ParseFloat(ruleI, "SampleRate")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpSampleRate < 0 || tmpSampleRate > 1 {
+					b.Error(errors.New("SampleRate must be between 0 and 1"))
+					continue
+				}
+			}
+			tmpMaxQueue := maxQueue
+			if util.KeyExists(ruleI, "MaxQueue") {
+				tmpMaxQueue, err = util.ParseInt(ruleI, "MaxQueue")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			// messages already waiting carry on draining at the new rate,
+			// whatever the new mode, filed under their new keys if the
+			// KeyPath has changed
+			if tmpKeyPath != keyPath {
+				now := time.Now()
+				rekeyed := map[string]*tokenBucket{}
+				for _, bucket := range buckets {
+					for bucket.queue.Len() > 0 {
+						pqMsg := heap.Pop(bucket.queue).(*PQMessage)
+						key, err := throttleKey(tmpKeyTree, pqMsg.val)
+						if err != nil {
+							// it can't wait anywhere, so let it go
+							b.Error(err)
+							b.out <- pqMsg.val
+							queued--
+							continue
+						}
+						newBucket, ok := rekeyed[key]
+						if !ok {
+							newBucket = newTokenBucket(now, burst)
+							rekeyed[key] = newBucket
+						}
+						heap.Push(newBucket.queue, pqMsg)
+					}
+				}
+				buckets = rekeyed
+			}
+
+			rate = tmpRate
+			burst = tmpBurst
+			mode = tmpMode
+			keyPath, keyTree = tmpKeyPath, tmpKeyTree
+			sampleRate = tmpSampleRate
+			maxQueue = tmpMaxQueue
+
+		case <-b.quit:
+			// quit the block
+			return
+		case msg := <-b.in:
+			key, err := throttleKey(keyTree, msg)
+			if err != nil {
+				b.Error(err)
+				break
+			}
+
+			now := time.Now()
+			bucket, ok := buckets[key]
+			if !ok {
+				bucket = newTokenBucket(now, burst)
+				buckets[key] = bucket
+			}
+			bucket.refill(now, rate, burst)
+
+			// keep messages in order behind any that are already waiting
+			if bucket.tokens >= 1 && bucket.queue.Len() == 0 {
+				bucket.tokens--
+				b.out <- msg
+				break
+			}
+
+			switch mode {
+			case "delay":
+				if maxQueue > 0 && int(queued) >= maxQueue {
+					dropped++
+					break
+				}
+				heap.Push(bucket.queue, &PQMessage{
+					val: msg,
+					t:   now,
+				})
+				queued++
+			case "drop":
+				dropped++
+			case "sample":
+				if rand.Float64() < sampleRate {
+					b.out <- msg
+				} else {
+					dropped++
+				}
+			}
+		case c := <-b.querytokens:
+			now := time.Now()
+			tokens := map[string]interface{}{}
+			for key, bucket := range buckets {
+				bucket.refill(now, rate, burst)
+				tokens[key] = bucket.tokens
+			}
+			c <- map[string]interface{}{
+				"Tokens":  tokens,
+				"Queued":  queued,
+				"Dropped": dropped,
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Rate":       rate,
+				"Burst":      burst,
+				"Mode":       mode,
+				"KeyPath":    keyPath,
+				"SampleRate": sampleRate,
+				"MaxQueue":   float64(maxQueue),
+			}
+		case <-waitTimer.C:
+			tick = true
+		}
+
+		// idle buckets are only tidied up when the timer fires, so that we
+		// don't visit every key for every message
+		if queued == 0 && !tick {
+			continue
+		}
+
+		// release any delayed messages that now have a token, and work out
+		// when the next one will be ready
+		now := time.Now()
+		wait := time.Duration(500) * time.Millisecond
+		for key, bucket := range buckets {
+			bucket.refill(now, rate, burst)
+			for bucket.tokens >= 1 && bucket.queue.Len() > 0 {
+				bucket.tokens--
+				b.out <- heap.Pop(bucket.queue).(*PQMessage).val
+				queued--
+			}
+			if bucket.queue.Len() == 0 {
+				// a full bucket behaves the same as a new one
+				if bucket.tokens >= burst {
+					delete(buckets, key)
+				}
+				continue
+			}
+			next := time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+			if next < wait {
+				wait = next
+			}
+		}
+		waitTimer.Reset(wait)
+	}
+}
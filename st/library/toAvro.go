@@ -0,0 +1,272 @@
+package library
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToAvro struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	queryschema chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToAvro() blocks.BlockInterface {
+	return &ToAvro{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToAvro) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "writes messages to an Avro object container file, using the schema in the rule or one inferred from the first messages"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.queryschema = b.QueryRoute("schema")
+	b.quit = b.Quit()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToAvro) Run() {
+	var file *os.File
+	var buf *bufio.Writer
+	var writer *avroContainerWriter
+	var filename string
+	var schemaJSON []byte
+
+	// the schema as it was given in the rule
+	var schemaRule interface{} = ""
+	codec := "null"
+	inferFrom := 100
+	blockSize := 100
+	flushIntervalString := "0"
+
+	// messages waiting for us to infer a schema from them
+	var pending []interface{}
+
+	flushTicker := time.NewTicker(time.Duration(1) * time.Second)
+	flushTicker.Stop()
+
+	flush := func() {
+		if writer == nil {
+			return
+		}
+		if err := writer.Flush(); err != nil {
+			b.Error(err)
+		}
+		if err := buf.Flush(); err != nil {
+			b.Error(err)
+		}
+	}
+
+	startWriter := func(schemaBytes []byte, schema *avroSchema) error {
+		var err error
+		writer, err = newAvroContainerWriter(buf, schemaBytes, schema, codec)
+		if err != nil {
+			return err
+		}
+		schemaJSON = schemaBytes
+		for _, msg := range pending {
+			if err := writer.Append(msg); err != nil {
+				b.Error(err)
+			}
+		}
+		pending = nil
+		return nil
+	}
+
+	// inferAndStart works out a schema from the messages we've held on to.
+	inferAndStart := func() {
+		schemaBytes, schema, err := inferAvroSchema(pending)
+		if err != nil {
+			b.Error(err)
+			pending = nil
+			return
+		}
+		if err := startWriter(schemaBytes, schema); err != nil {
+			b.Error(err)
+		}
+	}
+
+	closeFile := func() {
+		if file == nil {
+			return
+		}
+		if writer == nil && len(pending) > 0 {
+			inferAndStart()
+		}
+		flush()
+		file.Close()
+		file, buf, writer = nil, nil, nil
+		pending = nil
+	}
+
+	for {
+		select {
+		case msgI := <-b.inrule:
+			tmpFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// an empty schema means we infer one
+			var tmpSchemaRule interface{} = ""
+			var tmpSchema *avroSchema
+			var tmpSchemaJSON []byte
+			if util.KeyExists(msgI, "Schema") {
+				tmpSchemaRule = msgI.(map[string]interface{})["Schema"]
+			}
+			schemaI := tmpSchemaRule
+			if s, ok := tmpSchemaRule.(string); ok && s != "" {
+				// the schema can be given as a string of JSON too
+				if err := json.Unmarshal([]byte(s), &schemaI); err != nil {
+					schemaI = s
+				}
+			}
+			if s, ok := schemaI.(string); !ok || s != "" {
+				tmpSchema, err = parseAvroSchema(schemaI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				tmpSchemaJSON, err = json.Marshal(schemaI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			tmpCodec := "null"
+			if util.KeyExists(msgI, "Codec") {
+				tmpCodec, err = util.ParseString(msgI, "Codec")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpCodec != "null" && tmpCodec != "deflate" {
+				b.Error(errors.New("Codec must be null or deflate"))
+				continue
+			}
+			tmpInferFrom := 100
+			if util.KeyExists(msgI, "InferFrom") {
+				tmpInferFrom, err = util.ParseInt(msgI, "InferFrom")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpInferFrom < 1 {
+				b.Error(errors.New("InferFrom must be at least 1"))
+				continue
+			}
+			tmpBlockSize := 100
+			if util.KeyExists(msgI, "BlockSize") {
+				tmpBlockSize, err = util.ParseInt(msgI, "BlockSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpBlockSize < 1 {
+				b.Error(errors.New("BlockSize must be at least 1"))
+				continue
+			}
+			tmpFlushIntervalString := "0"
+			if util.KeyExists(msgI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(msgI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			flushInterval, err := time.ParseDuration(tmpFlushIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			closeFile()
+			filename = tmpFilename
+			schemaRule = tmpSchemaRule
+			schemaJSON = nil
+			codec = tmpCodec
+			inferFrom = tmpInferFrom
+			blockSize = tmpBlockSize
+			flushIntervalString = tmpFlushIntervalString
+
+			flushTicker.Stop()
+			if flushInterval > 0 {
+				flushTicker = time.NewTicker(flushInterval)
+			}
+
+			file, err = os.Create(filename)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			buf = bufio.NewWriter(file)
+
+			if tmpSchema != nil {
+				if err := startWriter(tmpSchemaJSON, tmpSchema); err != nil {
+					b.Error(err)
+				}
+			}
+
+		case <-b.quit:
+			// quit the block
+			flushTicker.Stop()
+			closeFile()
+			return
+		case <-flushTicker.C:
+			flush()
+		case msg := <-b.in:
+			// deal with inbound data
+			if file == nil {
+				continue
+			}
+			if writer == nil {
+				pending = append(pending, msg)
+				if len(pending) >= inferFrom {
+					inferAndStart()
+				}
+				continue
+			}
+			if err := writer.Append(msg); err != nil {
+				b.Error(err)
+				continue
+			}
+			if writer.count >= blockSize {
+				flush()
+			}
+		case c := <-b.queryschema:
+			var schemaI interface{}
+			json.Unmarshal(schemaJSON, &schemaI)
+			c <- map[string]interface{}{
+				"Schema": schemaI,
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Filename":      filename,
+				"Schema":        schemaRule,
+				"Codec":         codec,
+				"InferFrom":     float64(inferFrom),
+				"BlockSize":     float64(blockSize),
+				"FlushInterval": flushIntervalString,
+			}
+		}
+	}
+}
@@ -1,7 +1,16 @@
 package library
 
 import (
-	elastigo "github.com/mattbaird/elastigo/lib"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 )
@@ -16,6 +25,32 @@ type ToElasticsearch struct {
 	quit      blocks.MsgChan
 }
 
+// bulkItem is a message waiting to be indexed.
+type bulkItem struct {
+	index    string
+	id       string
+	msg      interface{}
+	attempts int
+}
+
+// bulkFailure is a message Elasticsearch wouldn't index.
+type bulkFailure struct {
+	item   *bulkItem
+	status int
+	err    string
+}
+
+func (f *bulkFailure) event() map[string]interface{} {
+	return map[string]interface{}{
+		"Event":  "IndexFailed",
+		"Index":  f.item.index,
+		"ID":     f.item.id,
+		"Status": float64(f.status),
+		"Error":  f.err,
+		"Msg":    f.item.msg,
+	}
+}
+
 // a bit of boilerplate for streamtools
 func NewToElasticsearch() blocks.BlockInterface {
 	return &ToElasticsearch{}
@@ -23,23 +58,166 @@ func NewToElasticsearch() blocks.BlockInterface {
 
 func (b *ToElasticsearch) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "sends messages as JSON to a specified index and type in Elasticsearch"
+	b.Desc = "sends messages as JSON to a specified index and type in Elasticsearch, using the bulk API"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
 	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// retryableStatus says whether Elasticsearch might take an item if it's sent
+// again later.
+func retryableStatus(status int) bool {
+	return status == 429 || status >= 500
 }
 
-// connects to an NSQ topic and emits each message into streamtools.
+// bulkIndex sends items to the bulk API. It returns the items that are worth
+// trying again and those that failed for good. An error means the request as
+// a whole failed, in which case every item may be retried.
+func bulkIndex(client *http.Client, url, esType string, items []*bulkItem) ([]*bulkItem, []*bulkFailure, error) {
+	var body bytes.Buffer
+	for _, item := range items {
+		action := map[string]interface{}{
+			"_index": item.index,
+		}
+		if esType != "" {
+			action["_type"] = esType
+		}
+		if item.id != "" {
+			action["_id"] = item.id
+		}
+		actionLine, err := json.Marshal(map[string]interface{}{"index": action})
+		if err != nil {
+			return nil, nil, err
+		}
+		doc, err := json.Marshal(item.msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		body.Write(actionLine)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	resp, err := client.Post(url, "application/x-ndjson", &body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("bulk request returned " + resp.Status + ": " + string(respBody))
+	}
+
+	var result struct {
+		Errors bool
+		Items  []map[string]struct {
+			Status int
+			Error  interface{}
+		}
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !result.Errors {
+		return nil, nil, nil
+	}
+	if len(result.Items) != len(items) {
+		return nil, nil, errors.New("bulk response doesn't match the request")
+	}
+
+	var retry []*bulkItem
+	var failed []*bulkFailure
+	for i, r := range result.Items {
+		for _, outcome := range r {
+			if outcome.Status < 300 {
+				continue
+			}
+			if retryableStatus(outcome.Status) {
+				retry = append(retry, items[i])
+				continue
+			}
+			// errors are objects in newer versions and strings in older ones
+			reason, err := formatColumn(outcome.Error)
+			if err != nil {
+				reason = err.Error()
+			}
+			failed = append(failed, &bulkFailure{
+				item:   items[i],
+				status: outcome.Status,
+				err:    reason,
+			})
+		}
+	}
+	return retry, failed, nil
+}
+
+// Run batches up messages, sending them to Elasticsearch once there are
+// enough of them or enough time has passed.
 func (b *ToElasticsearch) Run() {
 	var err error
 	var esIndex string
 	var esType string
-
-	conn := elastigo.NewConn()
+	var indexTemplate string
+	var template *filenameTemplate
+	var idPath string
+	var idTree *jee.TokenTree
 
 	host := "localhost"
 	port := "9200"
+	batchSize := 100
+	flushInterval := time.Duration(1) * time.Second
+	retries := 3
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: dialTimeout,
+		},
+		Timeout: time.Duration(30) * time.Second,
+	}
+
+	var batch []*bulkItem
+
+	ticker := time.NewTicker(flushInterval)
+
+	// flush sends the batch. Items that can be retried go back in the batch
+	// for next time, until they've used up their retries. Failures are
+	// passed to failed.
+	flush := func(failed func(*bulkFailure)) {
+		if len(batch) == 0 {
+			return
+		}
+		items := batch
+		batch = nil
+		retry, failures, err := bulkIndex(client, "http://"+host+":"+port+"/_bulk", esType, items)
+		if err != nil {
+			b.Error(err)
+			retry = items
+		}
+		for _, item := range retry {
+			item.attempts++
+			if item.attempts > retries {
+				failed(&bulkFailure{
+					item: item,
+					err:  "gave up after " + strconv.Itoa(item.attempts) + " attempts",
+				})
+				continue
+			}
+			batch = append(batch, item)
+		}
+		for _, f := range failures {
+			failed(f)
+		}
+	}
+	emitFailure := func(f *bulkFailure) {
+		b.out <- f.event()
+	}
 
 	for {
 		select {
@@ -68,22 +246,152 @@ func (b *ToElasticsearch) Run() {
 				break
 			}
 
-			conn.Domain = host
-			conn.Port = port
-
-		case msg := <-b.in:
-			_, err := conn.Index(esIndex, esType, "", nil, msg)
+			// the remaining options are optional so that older rules still work
+			tmpIndexTemplate := ""
+			if util.KeyExists(ruleI, "IndexTemplate") {
+				tmpIndexTemplate, err = util.ParseString(ruleI, "IndexTemplate")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			var tmpTemplate *filenameTemplate
+			if tmpIndexTemplate != "" {
+				tmpTemplate, err = newFilenameTemplate(tmpIndexTemplate)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpIDPath := ""
+			if util.KeyExists(ruleI, "IDPath") {
+				tmpIDPath, err = util.ParseString(ruleI, "IDPath")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			var tmpIDTree *jee.TokenTree
+			if tmpIDPath != "" {
+				tmpIDTree, err = util.BuildTokenTree(tmpIDPath)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpBatchSize := 100
+			if util.KeyExists(ruleI, "BatchSize") {
+				tmpBatchSize, err = util.ParseInt(ruleI, "BatchSize")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if tmpBatchSize < 1 {
+				b.Error(errors.New("BatchSize must be at least 1"))
+				break
+			}
+			tmpFlushIntervalString := "1s"
+			if util.KeyExists(ruleI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(ruleI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
 			if err != nil {
 				b.Error(err)
+				break
+			}
+			if tmpFlushInterval <= 0 {
+				b.Error(errors.New("FlushInterval must be positive"))
+				break
+			}
+			tmpRetries := 3
+			if util.KeyExists(ruleI, "Retries") {
+				tmpRetries, err = util.ParseInt(ruleI, "Retries")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+
+			indexTemplate = tmpIndexTemplate
+			template = tmpTemplate
+			idPath = tmpIDPath
+			idTree = tmpIDTree
+			batchSize = tmpBatchSize
+			flushInterval = tmpFlushInterval
+			retries = tmpRetries
+			ticker.Stop()
+			ticker = time.NewTicker(flushInterval)
+
+		case msg := <-b.in:
+			index := esIndex
+			if template != nil {
+				index, err = template.Execute(msg, time.Now().UTC())
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				// Elasticsearch only allows lowercase index names
+				index = strings.ToLower(index)
+			}
+			if index == "" {
+				b.Error(errors.New("no index to send message to"))
+				break
 			}
+			id := ""
+			if idTree != nil {
+				idI, err := jee.Eval(idTree, msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				id, err = formatColumn(idI)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			batch = append(batch, &bulkItem{
+				index: index,
+				id:    id,
+				msg:   msg,
+			})
+			if len(batch) >= batchSize {
+				flush(emitFailure)
+			}
+		case <-ticker.C:
+			flush(emitFailure)
 		case <-b.quit:
+			// send what's left, reporting failures as errors as nothing
+			// is listening any more
+			ticker.Stop()
+			quitFailure := func(f *bulkFailure) {
+				b.Error(f.err)
+			}
+			flush(quitFailure)
+			// there's no next time for the items flush put back
+			for _, item := range batch {
+				quitFailure(&bulkFailure{
+					item: item,
+					err:  "gave up on a message for " + item.index + " as the block quit after " + strconv.Itoa(item.attempts) + " attempts",
+				})
+			}
 			return
 		case c := <-b.queryrule:
 			c <- map[string]interface{}{
-				"Host":  host,
-				"Port":  port,
-				"Index": esIndex,
-				"Type":  esType,
+				"Host":          host,
+				"Port":          port,
+				"Index":         esIndex,
+				"Type":          esType,
+				"IndexTemplate": indexTemplate,
+				"IDPath":        idPath,
+				"BatchSize":     float64(batchSize),
+				"FlushInterval": flushInterval.String(),
+				"Retries":       float64(retries),
 			}
 		}
 	}
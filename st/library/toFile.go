@@ -2,10 +2,18 @@ package library
 
 import (
 	"bufio"
+	"compress/gzip"
+	"encoding/csv"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 )
@@ -20,6 +28,238 @@ type ToFile struct {
 	quit      blocks.MsgChan
 }
 
+// fileSink is an open output file. Writes are buffered and, optionally,
+// gzipped on their way to disk.
+type fileSink struct {
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+	csv  *csv.Writer
+
+	name     string
+	opened   time.Time
+	used     time.Time
+	written  int64
+	messages int
+}
+
+// openFileSink opens filename for writing, either truncating it or appending
+// to it, creating any directories it's in. The returned bool is true if the
+// file is empty.
+func openFileSink(filename string, appendMode bool, compress bool, comma rune) (*fileSink, bool, error) {
+	// templated filenames often have a directory per value or per day
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, false, err
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendMode {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	file, err := os.OpenFile(filename, flag, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+
+	f := &fileSink{
+		file:   file,
+		name:   filename,
+		opened: time.Now(),
+		used:   time.Now(),
+	}
+	var w io.Writer = file
+	if compress {
+		// appending to a gzipped file adds a new gzip member, which readers
+		// treat as a continuation of the same stream
+		f.gz = gzip.NewWriter(file)
+		w = f.gz
+	}
+	f.buf = bufio.NewWriter(w)
+	f.csv = csv.NewWriter(f)
+	f.csv.Comma = comma
+	return f, info.Size() == 0, nil
+}
+
+// Write buffers p, counting the bytes written before any compression.
+func (f *fileSink) Write(p []byte) (int, error) {
+	n, err := f.buf.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+// Flush pushes everything written so far to the file, calling fsync as well
+// if sync is true.
+func (f *fileSink) Flush(sync bool) error {
+	f.csv.Flush()
+	if err := f.csv.Error(); err != nil {
+		return err
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if f.gz != nil {
+		if err := f.gz.Flush(); err != nil {
+			return err
+		}
+	}
+	if sync {
+		return f.file.Sync()
+	}
+	return nil
+}
+
+// Close flushes and closes the file.
+func (f *fileSink) Close() error {
+	err := f.Flush(false)
+	if f.gz != nil {
+		if gzErr := f.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// closedEvent describes a file the block has finished writing.
+func (f *fileSink) closedEvent() map[string]interface{} {
+	return map[string]interface{}{
+		"Event":    "FileClosed",
+		"Filename": f.name,
+		"Bytes":    float64(f.written),
+		"Messages": float64(f.messages),
+		"Opened":   float64(f.opened.UnixNano() / int64(time.Millisecond)),
+		"Closed":   float64(time.Now().UnixNano() / int64(time.Millisecond)),
+	}
+}
+
+// rotatedName gives the name of the nth file written for filename, putting
+// the number in front of the extension: out.ndjson, out.1.ndjson, ...
+func rotatedName(filename string, n int) string {
+	if n == 0 {
+		return filename
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + strconv.Itoa(n) + ext
+}
+
+// filenameTemplate builds filenames from messages. Each {{path}} is replaced
+// with the value found at that gojee path, each {{time "layout"}} with the
+// current time in that Go time layout, and everything else is copied as it
+// is.
+type filenameTemplate struct {
+	literals []string
+	fields   []templateField
+}
+
+// a templateField is either a gojee path or a time layout.
+type templateField struct {
+	tree   *jee.TokenTree
+	layout string
+}
+
+func newFilenameTemplate(template string) (*filenameTemplate, error) {
+	t := &filenameTemplate{}
+	for {
+		start := strings.Index(template, "{{")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(template[start:], "}}")
+		if end == -1 {
+			return nil, errors.New("unclosed {{ in template")
+		}
+		field, err := parseTemplateField(strings.TrimSpace(template[start+2 : start+end]))
+		if err != nil {
+			return nil, err
+		}
+		t.literals = append(t.literals, template[:start])
+		t.fields = append(t.fields, field)
+		template = template[start+end+2:]
+	}
+	t.literals = append(t.literals, template)
+	return t, nil
+}
+
+// parseTemplateField reads what's between a {{ and }}.
+func parseTemplateField(field string) (templateField, error) {
+	if strings.HasPrefix(field, "time ") {
+		layout, err := strconv.Unquote(strings.TrimSpace(strings.TrimPrefix(field, "time ")))
+		if err != nil {
+			return templateField{}, errors.New("time layouts must be quoted, as in {{time \"2006-01-02\"}}")
+		}
+		return templateField{layout: layout}, nil
+	}
+	tree, err := util.BuildTokenTree(field)
+	if err != nil {
+		return templateField{}, err
+	}
+	return templateField{tree: tree}, nil
+}
+
+// expand fills in the template, passing the values found in the message
+// through escape.
+func (t *filenameTemplate) expand(msg interface{}, now time.Time, escape func(string) string) (string, error) {
+	var out string
+	for i, literal := range t.literals {
+		out += literal
+		if i == len(t.fields) {
+			break
+		}
+		if t.fields[i].tree == nil {
+			out += now.Format(t.fields[i].layout)
+			continue
+		}
+		v, err := jee.Eval(t.fields[i].tree, msg)
+		if err != nil {
+			return "", err
+		}
+		value, err := formatColumn(v)
+		if err != nil {
+			return "", err
+		}
+		out += escape(value)
+	}
+	return out, nil
+}
+
+func (t *filenameTemplate) Execute(msg interface{}, now time.Time) (string, error) {
+	return t.expand(msg, now, func(value string) string {
+		// keep message values from walking around the filesystem, either
+		// into other directories or up out of the one they're put in
+		value = strings.Replace(value, string(os.PathSeparator), "_", -1)
+		if value == "." || value == ".." {
+			value = strings.Repeat("_", len(value))
+		}
+		return value
+	})
+}
+
+// formatColumn turns the value found at a column's path into a CSV field.
+func formatColumn(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(j), nil
+}
+
 // we need to build a simple factory so that streamtools can make new blocks of this kind
 func NewToFile() blocks.BlockInterface {
 	return &ToFile{}
@@ -28,7 +268,7 @@ func NewToFile() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *ToFile) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "writes messages, separated by newlines, to a file on the local filesystem"
+	b.Desc = "writes messages to a file on the local filesystem as newline delimited JSON, CSV, TSV or raw strings, optionally rotating files and emitting an event as each one is closed"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
@@ -38,44 +278,456 @@ func (b *ToFile) Setup() {
 
 // Run is the block's main loop. Here we listen on the different channels we set up.
 func (b *ToFile) Run() {
-	var err error
-	var file *os.File
 	var filename string
+	var template *filenameTemplate
+	var path string
+	var tree *jee.TokenTree
+	var columns []string
+	var columnTrees []*jee.TokenTree
+
+	format := "ndjson"
+	header := false
+	appendMode := false
+	compress := false
+	sync := false
+	useTemplate := false
+	flushIntervalString := "0"
+	rotateIntervalString := "0"
+	idleTimeoutString := "1m"
+	rotateSize := 0
+	maxFiles := 0
+	comma := ','
+
+	// open files, keyed by the filename they were opened for before rotation
+	sinks := make(map[string]*fileSink)
+	// how many times each filename has been rotated. Like the list of closed
+	// files, this outlives rule changes so that later files don't overwrite
+	// earlier ones.
+	rotations := make(map[string]int)
+	// files we've closed, oldest first, for removing once there are too many
+	var closed []string
+
+	// with no flush interval every message is flushed as it's written
+	flushTicker := time.NewTicker(time.Duration(1) * time.Second)
+	flushTicker.Stop()
+	flushInterval := time.Duration(0)
+
+	rotateTicker := time.NewTicker(time.Duration(1) * time.Second)
+	rotateTicker.Stop()
+	rotateInterval := time.Duration(0)
+
+	// templated files that stop being written to, such as yesterday's when
+	// the filename has the date in it, are closed after a while
+	idleTicker := time.NewTicker(time.Duration(1) * time.Second)
+	idleTicker.Stop()
+	idleTimeout := time.Duration(time.Minute)
+
+	openSink := func(key string) (*fileSink, error) {
+		sink, empty, err := openFileSink(rotatedName(key, rotations[key]), appendMode, compress, comma)
+		if err != nil {
+			return nil, err
+		}
+		// only write a header at the top of a file
+		if header && empty && (format == "csv" || format == "tsv") {
+			sink.csv.Write(columns)
+			sink.csv.Flush()
+		}
+		sinks[key] = sink
+		return sink, nil
+	}
+
+	// closeSink closes a file, announcing it unless the block is quitting, at
+	// which point nothing is listening.
+	closeSink := func(key string, announce bool) {
+		sink := sinks[key]
+		delete(sinks, key)
+		if err := sink.Close(); err != nil {
+			b.Error(err)
+		}
+		if !announce {
+			return
+		}
+		b.out <- sink.closedEvent()
+
+		closed = append(closed, sink.name)
+		for maxFiles > 0 && len(closed) > maxFiles {
+			if err := os.Remove(closed[0]); err != nil {
+				b.Error(err)
+			}
+			closed = closed[1:]
+		}
+	}
+
+	rotate := func(key string) {
+		closeSink(key, true)
+		rotations[key]++
+	}
 
 	for {
 		select {
 		case msgI := <-b.inrule:
-			filename, err = util.ParseString(msgI, "Filename")
+			tmpFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// everything but the filename is optional so that older rules still work
+			tmpFormat := "ndjson"
+			if util.KeyExists(msgI, "Format") {
+				tmpFormat, err = util.ParseString(msgI, "Format")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpFormat != "ndjson" && tmpFormat != "csv" && tmpFormat != "tsv" && tmpFormat != "raw" {
+				b.Error(errors.New("Format must be one of ndjson, csv, tsv or raw"))
+				continue
+			}
+
+			tmpColumns := []string{}
+			if util.KeyExists(msgI, "Columns") {
+				tmpColumns, err = util.ParseArrayString(msgI, "Columns")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if (tmpFormat == "csv" || tmpFormat == "tsv") && len(tmpColumns) == 0 {
+				b.Error(errors.New("csv and tsv output need a list of Columns"))
+				continue
+			}
+			tmpColumnTrees := make([]*jee.TokenTree, len(tmpColumns))
+			for i, column := range tmpColumns {
+				tmpColumnTrees[i], err = util.BuildTokenTree(column)
+				if err != nil {
+					break
+				}
+			}
 			if err != nil {
 				b.Error(err)
+				continue
+			}
+
+			tmpPath := ""
+			if util.KeyExists(msgI, "Path") {
+				tmpPath, err = util.ParseString(msgI, "Path")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpTree *jee.TokenTree
+			if tmpFormat == "raw" {
+				if tmpPath == "" {
+					b.Error(errors.New("raw output needs a Path"))
+					continue
+				}
+				tmpTree, err = util.BuildTokenTree(tmpPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
 			}
 
-			file, err = os.Create(filename)
+			tmpHeader := false
+			if util.KeyExists(msgI, "Header") {
+				tmpHeader, err = util.ParseBool(msgI, "Header")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpAppend := false
+			if util.KeyExists(msgI, "Append") {
+				tmpAppend, err = util.ParseBool(msgI, "Append")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCompress := false
+			if util.KeyExists(msgI, "Gzip") {
+				tmpCompress, err = util.ParseBool(msgI, "Gzip")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpSync := false
+			if util.KeyExists(msgI, "Sync") {
+				tmpSync, err = util.ParseBool(msgI, "Sync")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFlushIntervalString := "0"
+			if util.KeyExists(msgI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(msgI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
 			if err != nil {
 				b.Error(err)
+				continue
+			}
+
+			tmpUseTemplate := false
+			if util.KeyExists(msgI, "Template") {
+				tmpUseTemplate, err = util.ParseBool(msgI, "Template")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpTemplate *filenameTemplate
+			if tmpUseTemplate {
+				tmpTemplate, err = newFilenameTemplate(tmpFilename)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpRotateSize := 0
+			if util.KeyExists(msgI, "RotateSize") {
+				tmpRotateSize, err = util.ParseInt(msgI, "RotateSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpRotateIntervalString := "0"
+			if util.KeyExists(msgI, "RotateInterval") {
+				tmpRotateIntervalString, err = util.ParseString(msgI, "RotateInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpRotateInterval, err := time.ParseDuration(tmpRotateIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpMaxFiles := 0
+			if util.KeyExists(msgI, "MaxFiles") {
+				tmpMaxFiles, err = util.ParseInt(msgI, "MaxFiles")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpIdleTimeoutString := "1m"
+			if util.KeyExists(msgI, "IdleTimeout") {
+				tmpIdleTimeoutString, err = util.ParseString(msgI, "IdleTimeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpIdleTimeout, err := time.ParseDuration(tmpIdleTimeoutString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// unless the new rule appends, files opened under it start
+			// afresh rather than overwriting the ones closed here
+			for key := range sinks {
+				if tmpAppend {
+					closeSink(key, true)
+				} else {
+					rotate(key)
+				}
+			}
+
+			filename = tmpFilename
+			format = tmpFormat
+			columns, columnTrees = tmpColumns, tmpColumnTrees
+			path, tree = tmpPath, tmpTree
+			header = tmpHeader
+			appendMode = tmpAppend
+			compress = tmpCompress
+			sync = tmpSync
+			flushIntervalString, flushInterval = tmpFlushIntervalString, tmpFlushInterval
+			useTemplate, template = tmpUseTemplate, tmpTemplate
+			rotateSize = tmpRotateSize
+			rotateIntervalString, rotateInterval = tmpRotateIntervalString, tmpRotateInterval
+			maxFiles = tmpMaxFiles
+			idleTimeoutString, idleTimeout = tmpIdleTimeoutString, tmpIdleTimeout
+
+			comma = ','
+			if format == "tsv" {
+				comma = '\t'
+			}
+
+			flushTicker.Stop()
+			if flushInterval > 0 {
+				flushTicker = time.NewTicker(flushInterval)
+			}
+			rotateTicker.Stop()
+			if rotateInterval > 0 {
+				tick := time.Duration(1) * time.Second
+				if rotateInterval < tick {
+					tick = rotateInterval
+				}
+				rotateTicker = time.NewTicker(tick)
+			}
+			idleTicker.Stop()
+			if useTemplate && idleTimeout > 0 {
+				tick := time.Duration(1) * time.Second
+				if idleTimeout < tick {
+					tick = idleTimeout
+				}
+				idleTicker = time.NewTicker(tick)
+			}
+
+			// templated filenames depend on the messages, so those files are
+			// opened as messages arrive
+			if !useTemplate {
+				if _, err := openSink(filename); err != nil {
+					b.Error(err)
+				}
 			}
 
 		case <-b.quit:
 			// quit the block
-			if file != nil {
-				file.Close()
+			flushTicker.Stop()
+			rotateTicker.Stop()
+			idleTicker.Stop()
+			for key := range sinks {
+				closeSink(key, false)
 			}
 			return
+		case <-flushTicker.C:
+			for _, sink := range sinks {
+				if err := sink.Flush(sync); err != nil {
+					b.Error(err)
+				}
+			}
+		case now := <-rotateTicker.C:
+			for key, sink := range sinks {
+				if now.Sub(sink.opened) >= rotateInterval {
+					rotate(key)
+				}
+			}
+		case now := <-idleTicker.C:
+			for key, sink := range sinks {
+				if now.Sub(sink.used) < idleTimeout {
+					continue
+				}
+				// unless we're appending, the next message for it opens a
+				// new file rather than overwriting this one
+				if appendMode {
+					closeSink(key, true)
+				} else {
+					rotate(key)
+				}
+			}
 		case msg := <-b.in:
 			// deal with inbound data
-			writer := bufio.NewWriter(file)
-			msgStr, err := json.Marshal(msg)
-			if err != nil {
-				b.Error(err)
-				continue
+			key := filename
+			if useTemplate {
+				var err error
+				key, err = template.Execute(msg, time.Now())
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			sink, ok := sinks[key]
+			if !ok {
+				var err error
+				sink, err = openSink(key)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			switch format {
+			case "ndjson":
+				msgStr, err := json.Marshal(msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				sink.Write(append(msgStr, '\n'))
+			case "csv", "tsv":
+				record := make([]string, len(columnTrees))
+				var err error
+				for i, columnTree := range columnTrees {
+					var v interface{}
+					v, err = jee.Eval(columnTree, msg)
+					if err != nil {
+						break
+					}
+					record[i], err = formatColumn(v)
+					if err != nil {
+						break
+					}
+				}
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if err := sink.csv.Write(record); err != nil {
+					b.Error(err)
+					continue
+				}
+				// push the row through so that it's counted towards RotateSize
+				sink.csv.Flush()
+			case "raw":
+				v, err := jee.Eval(tree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				switch value := v.(type) {
+				case string:
+					sink.Write([]byte(value + "\n"))
+				case []byte:
+					sink.Write(value)
+					sink.Write([]byte{'\n'})
+				default:
+					b.Error(errors.New("raw output must be a string"))
+					continue
+				}
+			}
+			sink.messages++
+			sink.used = time.Now()
+
+			if flushInterval == 0 {
+				if err := sink.Flush(sync); err != nil {
+					b.Error(err)
+				}
+			}
+			if rotateSize > 0 && sink.written >= int64(rotateSize) {
+				rotate(key)
 			}
-			fmt.Fprintln(writer, string(msgStr))
-			writer.Flush()
 
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				"Filename": filename,
+				"Filename":       filename,
+				"Format":         format,
+				"Columns":        columns,
+				"Header":         header,
+				"Path":           path,
+				"Append":         appendMode,
+				"Gzip":           compress,
+				"Sync":           sync,
+				"FlushInterval":  flushIntervalString,
+				"Template":       useTemplate,
+				"RotateSize":     float64(rotateSize),
+				"RotateInterval": rotateIntervalString,
+				"MaxFiles":       float64(maxFiles),
+				"IdleTimeout":    idleTimeoutString,
 			}
 		}
 	}
@@ -0,0 +1,254 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/nytlabs/gojee"
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToKafka struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// hash sends messages with the same key to the same partition
+var kafkaPartitioners = map[string]sarama.PartitionerConstructor{
+	"hash":       sarama.NewHashPartitioner,
+	"random":     sarama.NewRandomPartitioner,
+	"roundrobin": sarama.NewRoundRobinPartitioner,
+}
+
+// how many replicas must have a message before Kafka acknowledges it
+var kafkaAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+// a bit of boilerplate for streamtools
+func NewToKafka() blocks.BlockInterface {
+	return &ToKafka{}
+}
+
+func (b *ToKafka) Setup() {
+	b.Kind = "Queue I/O"
+	b.Desc = "sends messages to a Kafka topic in batches, keyed by a value from each message"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+}
+
+// sends each message to a Kafka topic, letting the producer batch them up.
+func (b *ToKafka) Run() {
+	var producer sarama.AsyncProducer
+	var keyTree *jee.TokenTree
+	brokers := []string{"localhost:9092"}
+	var topic string
+	var keyPath string
+	partitioner := "hash"
+	batchSize := 100
+	flushInterval := time.Duration(1) * time.Second
+	acks := "leader"
+
+	// closeProducer sends anything still batched up, reporting the messages
+	// Kafka wouldn't take
+	closeProducer := func() {
+		if producer == nil {
+			return
+		}
+		err := producer.Close()
+		if errs, ok := err.(sarama.ProducerErrors); ok {
+			for _, perr := range errs {
+				b.Error(perr.Err)
+			}
+		} else if err != nil {
+			b.Error(err)
+		}
+		producer = nil
+	}
+
+	for {
+		// nobody else reads the producer's errors, and it stops taking
+		// messages if they back up
+		var producerErrors <-chan *sarama.ProducerError
+		if producer != nil {
+			producerErrors = producer.Errors()
+		}
+
+		select {
+		case perr := <-producerErrors:
+			b.Error(perr.Err)
+		case ruleI := <-b.inrule:
+			tmpTopic, err := util.ParseRequiredString(ruleI, "Topic")
+			if err != nil {
+				b.Error(err)
+				break
+			}
+			tmpBrokers := []string{"localhost:9092"}
+			if util.KeyExists(ruleI, "Brokers") {
+				tmpBrokers, err = util.ParseArrayString(ruleI, "Brokers")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpKeyPath := ""
+			if util.KeyExists(ruleI, "KeyPath") {
+				tmpKeyPath, err = util.ParseString(ruleI, "KeyPath")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			var tmpKeyTree *jee.TokenTree
+			if tmpKeyPath != "" {
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpPartitioner := "hash"
+			if util.KeyExists(ruleI, "Partitioner") {
+				tmpPartitioner, err = util.ParseString(ruleI, "Partitioner")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpBatchSize := 100
+			if util.KeyExists(ruleI, "BatchSize") {
+				tmpBatchSize, err = util.ParseInt(ruleI, "BatchSize")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			if tmpBatchSize < 1 {
+				b.Error(errors.New("BatchSize must be at least 1"))
+				break
+			}
+			tmpFlushIntervalString := "1s"
+			if util.KeyExists(ruleI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(ruleI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
+			if err != nil {
+				b.Error(err)
+				break
+			}
+			if tmpFlushInterval <= 0 {
+				b.Error(errors.New("FlushInterval must be positive"))
+				break
+			}
+			tmpAcks := "leader"
+			if util.KeyExists(ruleI, "Acks") {
+				tmpAcks, err = util.ParseString(ruleI, "Acks")
+				if err != nil {
+					b.Error(err)
+					break
+				}
+			}
+
+			tmpPartitionerConstructor, ok := kafkaPartitioners[tmpPartitioner]
+			if !ok {
+				b.Error(errors.New("Partitioner must be one of hash, random or roundrobin"))
+				break
+			}
+			tmpRequiredAcks, ok := kafkaAcks[tmpAcks]
+			if !ok {
+				b.Error(errors.New("Acks must be one of none, leader or all"))
+				break
+			}
+
+			conf := sarama.NewConfig()
+			conf.ClientID = "streamtools"
+			conf.Producer.Return.Errors = true
+			conf.Producer.Flush.Messages = tmpBatchSize
+			conf.Producer.Flush.Frequency = tmpFlushInterval
+			conf.Producer.Partitioner = tmpPartitionerConstructor
+			conf.Producer.RequiredAcks = tmpRequiredAcks
+
+			brokers = tmpBrokers
+			topic = tmpTopic
+			keyPath = tmpKeyPath
+			keyTree = tmpKeyTree
+			partitioner = tmpPartitioner
+			batchSize = tmpBatchSize
+			flushInterval = tmpFlushInterval
+			acks = tmpAcks
+
+			closeProducer()
+			producer, err = sarama.NewAsyncProducer(brokers, conf)
+			if err != nil {
+				b.Error(err)
+				break
+			}
+		case msg := <-b.in:
+			if producer == nil {
+				b.Error(errors.New("not connected to Kafka"))
+				break
+			}
+			msgByte, err := json.Marshal(msg)
+			if err != nil {
+				b.Error(err)
+				break
+			}
+			message := &sarama.ProducerMessage{
+				Topic: topic,
+				Value: sarama.ByteEncoder(msgByte),
+			}
+			if keyTree != nil {
+				keyI, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					break
+				}
+				// messages without a key are spread over the partitions
+				if keyI != nil {
+					key, err := formatColumn(keyI)
+					if err != nil {
+						b.Error(err)
+						break
+					}
+					message.Key = sarama.StringEncoder(key)
+				}
+			}
+			for sent := false; !sent; {
+				select {
+				case producer.Input() <- message:
+					sent = true
+				case perr := <-producer.Errors():
+					b.Error(perr.Err)
+				}
+			}
+		case <-b.quit:
+			closeProducer()
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Brokers":       brokers,
+				"Topic":         topic,
+				"KeyPath":       keyPath,
+				"Partitioner":   partitioner,
+				"BatchSize":     float64(batchSize),
+				"FlushInterval": flushInterval.String(),
+				"Acks":          acks,
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang" // mqtt
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToMQTT struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// a bit of boilerplate for streamtools
+func NewToMQTT() blocks.BlockInterface {
+	return &ToMQTT{}
+}
+
+func (b *ToMQTT) Setup() {
+	b.Kind = "Queue I/O"
+	b.Desc = "publishes messages to an MQTT broker, on a topic that can be built from each message"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+}
+
+// mqttTopic fills in a topic template like sensors/{{.device}}/temperature.
+// Slashes and wildcards in the values are replaced so that a message can't
+// publish outside of the levels the template gives it.
+func mqttTopic(t *filenameTemplate, msg interface{}) (string, error) {
+	return t.expand(msg, time.Now(), strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace)
+}
+
+// mqttPublish is a message the broker hasn't acknowledged yet.
+type mqttPublish struct {
+	token mqtt.Token
+	topic string
+	sent  time.Time
+}
+
+// mqttMaxInFlight is how many publishes can wait for the broker before the
+// block stops taking messages.
+const mqttMaxInFlight = 1000
+
+// publishes each message to an MQTT broker.
+func (b *ToMQTT) Run() {
+	var client mqtt.Client
+	var template *filenameTemplate
+	rule := &mqttRule{
+		broker:       "tcp://localhost:1883",
+		cleanSession: true,
+	}
+	var topic string
+	retained := false
+
+	toError := make(chan error)
+	stop := make(chan bool)
+
+	sendError := func(err error) {
+		select {
+		case toError <- err:
+		case <-stop:
+		}
+	}
+	connectionLost := func(client mqtt.Client, err error) {
+		sendError(errors.New("lost connection to MQTT broker, reconnecting: " + err.Error()))
+	}
+
+	// with QoS 1 or 2 the broker acknowledges each message. We check for
+	// the ones it didn't take here rather than waiting on each of them.
+	var inFlight []*mqttPublish
+	checkTicker := time.NewTicker(time.Duration(100) * time.Millisecond)
+	checkInFlight := func() {
+		waiting := inFlight[:0]
+		for _, p := range inFlight {
+			select {
+			case <-p.token.Done():
+				if p.token.Error() != nil {
+					b.Error(p.token.Error())
+				}
+			default:
+				if time.Since(p.sent) > time.Duration(30)*time.Second {
+					b.Error(errors.New("timed out publishing to " + p.topic))
+					continue
+				}
+				waiting = append(waiting, p)
+			}
+		}
+		inFlight = waiting
+	}
+
+	for {
+		// stop taking messages while too many are waiting for the broker
+		in := b.in
+		if len(inFlight) >= mqttMaxInFlight {
+			in = nil
+		}
+
+		select {
+		case <-checkTicker.C:
+			checkInFlight()
+		case err := <-toError:
+			b.Error(err)
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseMQTTRule(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTopic, err := util.ParseRequiredString(ruleI, "Topic")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTemplate, err := newFilenameTemplate(tmpTopic)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpRetained := false
+			if util.KeyExists(ruleI, "Retained") {
+				tmpRetained, err = util.ParseBool(ruleI, "Retained")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			rule = tmpRule
+			topic = tmpTopic
+			template = tmpTemplate
+			retained = tmpRetained
+
+			if client != nil {
+				client.Disconnect(250)
+			}
+			client = rule.connect(nil, connectionLost)
+		case msg := <-in:
+			if client == nil {
+				b.Error(errors.New("not connected to an MQTT broker"))
+				continue
+			}
+			msgTopic, err := mqttTopic(template, msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			payload, err := json.Marshal(msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			inFlight = append(inFlight, &mqttPublish{
+				token: client.Publish(msgTopic, byte(rule.qos), retained, payload),
+				topic: msgTopic,
+				sent:  time.Now(),
+			})
+		case <-b.quit:
+			checkTicker.Stop()
+			close(stop)
+			if client != nil {
+				// give messages in flight a moment to be sent
+				client.Disconnect(250)
+			}
+			return
+		case c := <-b.queryrule:
+			ruleMsg := rule.ruleMsg()
+			ruleMsg["Topic"] = topic
+			ruleMsg["Retained"] = retained
+			c <- ruleMsg
+		}
+	}
+}
@@ -2,7 +2,11 @@ package library
 
 import (
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/nytlabs/gojee"                 // jee
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
 	"github.com/nytlabs/streamtools/st/util"
 	"labix.org/v2/mgo"
@@ -14,9 +18,120 @@ type ToMongoDB struct {
 	queryrule chan blocks.MsgChan
 	inrule    blocks.MsgChan
 	in        blocks.MsgChan
+	out       blocks.MsgChan
 	quit      blocks.MsgChan
 }
 
+// updateTemplate builds a MongoDB update document, such as
+// {"$set": {"name": ".name"}, "$inc": {"count": 1}}, from each message.
+// Strings that start with a . are gojee paths into the message; everything
+// else is used as it is. A string that starts with .. is a literal with the
+// first dot dropped, so "..5" writes ".5".
+type updateTemplate struct {
+	template interface{}
+	trees    map[string]*jee.TokenTree
+}
+
+func newUpdateTemplate(template interface{}) (*updateTemplate, error) {
+	t := &updateTemplate{
+		template: template,
+		trees:    make(map[string]*jee.TokenTree),
+	}
+	var compile func(v interface{}) error
+	compile = func(v interface{}) error {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for _, child := range value {
+				if err := compile(child); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, child := range value {
+				if err := compile(child); err != nil {
+					return err
+				}
+			}
+		case string:
+			if strings.HasPrefix(value, ".") && !strings.HasPrefix(value, "..") {
+				tree, err := util.BuildTokenTree(value)
+				if err != nil {
+					return err
+				}
+				t.trees[value] = tree
+			}
+		}
+		return nil
+	}
+	err := compile(template)
+	return t, err
+}
+
+func (t *updateTemplate) Execute(msg interface{}) (interface{}, error) {
+	var execute func(v interface{}) (interface{}, error)
+	execute = func(v interface{}) (interface{}, error) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			out := make(map[string]interface{})
+			for k, child := range value {
+				r, err := execute(child)
+				if err != nil {
+					return nil, err
+				}
+				out[k] = r
+			}
+			return out, nil
+		case []interface{}:
+			out := make([]interface{}, len(value))
+			for i, child := range value {
+				r, err := execute(child)
+				if err != nil {
+					return nil, err
+				}
+				out[i] = r
+			}
+			return out, nil
+		case string:
+			if tree, ok := t.trees[value]; ok {
+				return jee.Eval(tree, msg)
+			}
+			if strings.HasPrefix(value, "..") {
+				return value[1:], nil
+			}
+		}
+		return v, nil
+	}
+	return execute(t.template)
+}
+
+// mongoWrite is a message waiting to be written. Inserts have no selector.
+type mongoWrite struct {
+	msg      interface{}
+	selector interface{}
+	update   interface{}
+}
+
+// parseWriteConcern turns the W, Journal and WTimeout rules into mgo's
+// safety settings. A W of 0 doesn't wait for the server at all.
+func parseWriteConcern(w string, journal bool, wtimeout time.Duration) (*mgo.Safe, error) {
+	safe := &mgo.Safe{
+		J:        journal,
+		WTimeout: int(wtimeout / time.Millisecond),
+	}
+	if n, err := strconv.Atoi(w); err == nil {
+		if n < 0 {
+			return nil, errors.New("W must be a number of servers or a tag set name such as majority")
+		}
+		if n == 0 && !journal {
+			return nil, nil
+		}
+		safe.W = n
+	} else {
+		safe.WMode = w
+	}
+	return safe, nil
+}
+
 // we need to build a simple factory so that streamtools can make new blocks of this kind
 func NewToMongoDB() blocks.BlockInterface {
 	return &ToMongoDB{}
@@ -25,11 +140,12 @@ func NewToMongoDB() blocks.BlockInterface {
 // Setup is called once before running the block. We build up the channels and specify what kind of block this is.
 func (b *ToMongoDB) Setup() {
 	b.Kind = "Data Stores"
-	b.Desc = "sends messages to MongoDB, optionally in batches"
+	b.Desc = "sends messages to MongoDB, optionally in batches, inserting them or updating a document per key"
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
 	b.quit = b.Quit()
+	b.out = b.Broadcast()
 }
 
 // Run is the block's main loop. Here we listen on the different channels we set up.
@@ -41,9 +157,61 @@ func (b *ToMongoDB) Run() {
 	var host = ""
 	var err error
 	var batch = 0
-	var count = 0
-	var maxindex = 0
-	var list []interface{}
+	var pending []*mongoWrite
+
+	flushInterval := time.Duration(1) * time.Second
+	mode := "insert"
+	var keyPath string
+	var keyTree *jee.TokenTree
+	keyField := "_id"
+	var updateRule interface{}
+	var update *updateTemplate
+	w := "1"
+	journal := false
+	var wtimeout time.Duration
+
+	ticker := time.NewTicker(flushInterval)
+
+	// flush writes everything pending, passing each document that couldn't
+	// be written to failed. mgo can't say which document of a failed batch
+	// insert was the problem, so the whole batch is reported, although the
+	// documents before the bad one will have been written.
+	flush := func(failed func(interface{}, error)) {
+		if len(pending) == 0 || collection == nil {
+			return
+		}
+		writes := pending
+		pending = nil
+
+		var inserts []interface{}
+		for _, write := range writes {
+			if write.selector == nil {
+				inserts = append(inserts, write.msg)
+				continue
+			}
+			_, err := collection.Upsert(write.selector, write.update)
+			if err != nil {
+				failed(write.msg, err)
+			}
+		}
+		if len(inserts) == 0 {
+			return
+		}
+		err := collection.Insert(inserts...)
+		if err != nil {
+			for _, msg := range inserts {
+				failed(msg, err)
+			}
+		}
+	}
+	emitFailure := func(msg interface{}, err error) {
+		b.out <- map[string]interface{}{
+			"Event": "WriteFailed",
+			"Error": err.Error(),
+			"Msg":   msg,
+		}
+	}
+
 	for {
 		select {
 		case msgI := <-b.inrule:
@@ -70,67 +238,211 @@ func (b *ToMongoDB) Run() {
 			if err != nil || batch < 0 {
 				b.Error(errors.New("Error parsing batch size....setting to 0"))
 				batch = 0
-			} else {
-				if batch > 1 {
-					list = make([]interface{}, batch, batch)
-					// set maxindex to 1 minus batch size
-					// use maxindex for looping everywhere for consistency
-					maxindex = batch - 1
+			}
+
+			// the remaining options are optional so that older rules still work
+			tmpFlushIntervalString := "1s"
+			if util.KeyExists(msgI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(msgI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpFlushInterval <= 0 {
+				b.Error(errors.New("FlushInterval must be positive"))
+				continue
+			}
+			tmpMode := "insert"
+			if util.KeyExists(msgI, "Mode") {
+				tmpMode, err = util.ParseString(msgI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMode != "insert" && tmpMode != "upsert" {
+				b.Error(errors.New("Mode must be either insert or upsert"))
+				continue
+			}
+			tmpKeyPath := ""
+			if util.KeyExists(msgI, "KeyPath") {
+				tmpKeyPath, err = util.ParseString(msgI, "KeyPath")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpKeyTree *jee.TokenTree
+			if tmpMode == "upsert" {
+				if tmpKeyPath == "" {
+					b.Error(errors.New("upsert needs a KeyPath"))
+					continue
+				}
+				tmpKeyTree, err = util.BuildTokenTree(tmpKeyPath)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpKeyField := "_id"
+			if util.KeyExists(msgI, "KeyField") {
+				tmpKeyField, err = util.ParseString(msgI, "KeyField")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			var tmpUpdateRule interface{}
+			var tmpUpdate *updateTemplate
+			if util.KeyExists(msgI, "Update") {
+				tmpUpdateRule = msgI.(map[string]interface{})["Update"]
+				if updateMap, ok := tmpUpdateRule.(map[string]interface{}); !ok {
+					b.Error(errors.New("Update must be an object such as {\"$inc\": {\"count\": 1}}"))
+					continue
+				} else if len(updateMap) == 0 {
+					tmpUpdateRule = nil
+				}
+			}
+			if tmpUpdateRule != nil {
+				tmpUpdate, err = newUpdateTemplate(tmpUpdateRule)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpW := "1"
+			if util.KeyExists(msgI, "W") {
+				tmpW, err = util.ParseString(msgI, "W")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpJournal := false
+			if util.KeyExists(msgI, "Journal") {
+				tmpJournal, err = util.ParseBool(msgI, "Journal")
+				if err != nil {
+					b.Error(err)
+					continue
 				}
 			}
+			tmpWTimeoutString := "0"
+			if util.KeyExists(msgI, "WTimeout") {
+				tmpWTimeoutString, err = util.ParseString(msgI, "WTimeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpWTimeout, err := time.ParseDuration(tmpWTimeoutString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			safe, err := parseWriteConcern(tmpW, tmpJournal, tmpWTimeout)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			flushInterval = tmpFlushInterval
+			mode = tmpMode
+			keyPath = tmpKeyPath
+			keyTree = tmpKeyTree
+			keyField = tmpKeyField
+			updateRule = tmpUpdateRule
+			update = tmpUpdate
+			w = tmpW
+			journal = tmpJournal
+			wtimeout = tmpWTimeout
+			ticker.Stop()
+			ticker = time.NewTicker(flushInterval)
+
+			// write out anything waiting for the old settings
+			flush(emitFailure)
+			if session != nil {
+				session.Close()
+			}
+
 			// create MongoDB connection
 			session, err = mgo.Dial(host)
 			if err != nil {
 				// swallowing a panic from mgo here - streamtools must not die
 				b.Error(errors.New("Could not initiate connection with MongoDB service"))
+				collection = nil
 				continue
 			}
+			session.SetSafe(safe)
 			// use the specified DB and collection
 			collection = session.DB(dbname).C(collectionname)
 		case <-b.quit:
-			// close connection to MongoDB and quit
+			// write what's left, then close connection to MongoDB and quit.
+			// nothing is listening for failures any more, so log them.
+			ticker.Stop()
+			flush(func(msg interface{}, err error) {
+				b.Error(err.Error())
+			})
 			if session != nil {
 				session.Close()
 			}
 			return
+		case <-ticker.C:
+			flush(emitFailure)
 		case msg := <-b.in:
 			// deal with inbound data
-			if session != nil {
-				// mgo is so cool - it will check if the message can be serialized to valid bson.
-				// So, no need to do a json.Marshal on the inbound. just append to the list and
-				// batch insert
-				if maxindex >= 1 {
-					if count <= maxindex {
-						list[count] = msg
-						count = count + 1
-					}
-					if count == maxindex {
-						// insert batch if count reaches batch size
-						err = collection.Insert(list...)
-						if err != nil {
-							b.Error(err.Error())
-						}
-						// reset list and count
-						list = make([]interface{}, batch, batch)
-						count = 0
-					}
-				} else {
-					// mgo coolness again. No need to do a json.Marshal on the inbound.
-					err = collection.Insert(msg)
+			if collection == nil {
+				b.Error(errors.New("MongoDB connection not initated or lost. Please check your MongoDB server or block settings."))
+				continue
+			}
+			// mgo is so cool - it will check if the message can be serialized to valid bson.
+			// So, no need to do a json.Marshal on the inbound.
+			write := &mongoWrite{msg: msg}
+			if mode == "upsert" {
+				key, err := jee.Eval(keyTree, msg)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if key == nil {
+					emitFailure(msg, errors.New("no key found at "+keyPath))
+					continue
+				}
+				write.selector = map[string]interface{}{keyField: key}
+				// without an update template the document is replaced
+				write.update = msg
+				if update != nil {
+					write.update, err = update.Execute(msg)
 					if err != nil {
-						b.Error(err.Error())
+						b.Error(err)
+						continue
 					}
 				}
-			} else {
-				b.Error(errors.New("MongoDB connection not initated or lost. Please check your MongoDB server or block settings."))
+			}
+			pending = append(pending, write)
+			if len(pending) >= batch {
+				flush(emitFailure)
 			}
 		case MsgChan := <-b.queryrule:
 			// deal with a query request
 			MsgChan <- map[string]interface{}{
-				"Collection": collectionname,
-				"Database":   dbname,
-				"Host":       host,
-				"BatchSize":  batch,
+				"Collection":    collectionname,
+				"Database":      dbname,
+				"Host":          host,
+				"BatchSize":     batch,
+				"FlushInterval": flushInterval.String(),
+				"Mode":          mode,
+				"KeyPath":       keyPath,
+				"KeyField":      keyField,
+				"Update":        updateRule,
+				"W":             w,
+				"Journal":       journal,
+				"WTimeout":      wtimeout.String(),
 			}
 		}
 	}
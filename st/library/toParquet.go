@@ -0,0 +1,250 @@
+package library
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToParquet struct {
+	blocks.Block
+	queryrule   chan blocks.MsgChan
+	queryschema chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	in          blocks.MsgChan
+	quit        blocks.MsgChan
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToParquet() blocks.BlockInterface {
+	return &ToParquet{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToParquet) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "writes messages to a Parquet file, using the schema in the rule or one inferred from the first messages"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.queryschema = b.QueryRoute("schema")
+	b.quit = b.Quit()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToParquet) Run() {
+	var file *os.File
+	var buf *bufio.Writer
+	var writer *parquetWriter
+	var filename string
+	var schemaJSON []byte
+
+	// the schema as it was given in the rule
+	var schemaRule interface{} = ""
+	codec := "snappy"
+	inferFrom := 100
+	rowGroupSize := 10000
+
+	// messages waiting for us to infer a schema from them
+	var pending []interface{}
+
+	startWriter := func(schemaBytes []byte, schema *avroSchema) error {
+		columns, err := parquetColumns(schema)
+		if err != nil {
+			return err
+		}
+		writer, err = newParquetWriter(buf, columns, codec)
+		if err != nil {
+			return err
+		}
+		schemaJSON = schemaBytes
+		for _, msg := range pending {
+			if err := writer.Append(msg); err != nil {
+				b.Error(err)
+			}
+		}
+		pending = nil
+		return nil
+	}
+
+	// inferAndStart works out a schema from the messages we've held on to.
+	inferAndStart := func() {
+		schemaBytes, schema, err := inferAvroSchema(pending)
+		if err != nil {
+			b.Error(err)
+			pending = nil
+			return
+		}
+		if err := startWriter(schemaBytes, schema); err != nil {
+			b.Error(err)
+			pending = nil
+		}
+	}
+
+	// closeFile writes the footer, without which the file can't be read.
+	closeFile := func() {
+		if file == nil {
+			return
+		}
+		if writer == nil && len(pending) > 0 {
+			inferAndStart()
+		}
+		if writer != nil {
+			if err := writer.Close(); err != nil {
+				b.Error(err)
+			}
+		}
+		if err := buf.Flush(); err != nil {
+			b.Error(err)
+		}
+		file.Close()
+		file, buf, writer = nil, nil, nil
+		pending = nil
+	}
+
+	for {
+		select {
+		case msgI := <-b.inrule:
+			tmpFilename, err := util.ParseRequiredString(msgI, "Filename")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// an empty schema means we infer one
+			var tmpSchemaRule interface{} = ""
+			var tmpSchema *avroSchema
+			var tmpSchemaJSON []byte
+			if util.KeyExists(msgI, "Schema") {
+				tmpSchemaRule = msgI.(map[string]interface{})["Schema"]
+			}
+			schemaI := tmpSchemaRule
+			if s, ok := tmpSchemaRule.(string); ok && s != "" {
+				// the schema can be given as a string of JSON too
+				if err := json.Unmarshal([]byte(s), &schemaI); err != nil {
+					schemaI = s
+				}
+			}
+			if s, ok := schemaI.(string); !ok || s != "" {
+				tmpSchema, err = parseAvroSchema(schemaI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if _, err = parquetColumns(tmpSchema); err != nil {
+					b.Error(err)
+					continue
+				}
+				tmpSchemaJSON, err = json.Marshal(schemaI)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			tmpCodec := "snappy"
+			if util.KeyExists(msgI, "Codec") {
+				tmpCodec, err = util.ParseString(msgI, "Codec")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if _, ok := parquetCodecs[tmpCodec]; !ok {
+				b.Error(errors.New("Codec must be none, snappy or gzip"))
+				continue
+			}
+			tmpInferFrom := 100
+			if util.KeyExists(msgI, "InferFrom") {
+				tmpInferFrom, err = util.ParseInt(msgI, "InferFrom")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpInferFrom < 1 {
+				b.Error(errors.New("InferFrom must be at least 1"))
+				continue
+			}
+			tmpRowGroupSize := 10000
+			if util.KeyExists(msgI, "RowGroupSize") {
+				tmpRowGroupSize, err = util.ParseInt(msgI, "RowGroupSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpRowGroupSize < 1 {
+				b.Error(errors.New("RowGroupSize must be at least 1"))
+				continue
+			}
+
+			closeFile()
+			filename = tmpFilename
+			schemaRule = tmpSchemaRule
+			schemaJSON = nil
+			codec = tmpCodec
+			inferFrom = tmpInferFrom
+			rowGroupSize = tmpRowGroupSize
+
+			file, err = os.Create(filename)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			buf = bufio.NewWriter(file)
+
+			if tmpSchema != nil {
+				if err := startWriter(tmpSchemaJSON, tmpSchema); err != nil {
+					b.Error(err)
+				}
+			}
+
+		case <-b.quit:
+			// quit the block
+			closeFile()
+			return
+		case msg := <-b.in:
+			// deal with inbound data
+			if file == nil {
+				continue
+			}
+			if writer == nil {
+				pending = append(pending, msg)
+				if len(pending) >= inferFrom {
+					inferAndStart()
+				}
+				continue
+			}
+			if err := writer.Append(msg); err != nil {
+				b.Error(err)
+				continue
+			}
+			if writer.count >= rowGroupSize {
+				if err := writer.Flush(); err != nil {
+					b.Error(err)
+				}
+			}
+		case c := <-b.queryschema:
+			var schemaI interface{}
+			json.Unmarshal(schemaJSON, &schemaI)
+			c <- map[string]interface{}{
+				"Schema": schemaI,
+			}
+		case c := <-b.queryrule:
+			// deal with a query request
+			c <- map[string]interface{}{
+				"Filename":     filename,
+				"Schema":       schemaRule,
+				"Codec":        codec,
+				"InferFrom":    float64(inferFrom),
+				"RowGroupSize": float64(rowGroupSize),
+			}
+		}
+	}
+}
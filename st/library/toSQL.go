@@ -0,0 +1,488 @@
+package library
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/gojee"                 // jee
+	"github.com/nytlabs/streamtools/st/blocks" // blocks
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToSQL struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	out       blocks.MsgChan
+	quit      blocks.MsgChan
+}
+
+// sqlPending is a message waiting to be written, along with its row.
+type sqlPending struct {
+	msg      interface{}
+	row      []interface{}
+	attempts int
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToSQL() blocks.BlockInterface {
+	return &ToSQL{}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToSQL) Setup() {
+	b.Kind = "Data Stores"
+	b.Desc = "writes messages as rows of a SQL table in batches, inserting them or updating the row with the same key"
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+	b.out = b.Broadcast()
+}
+
+// the most parameters SQLite takes in one statement
+const maxSQLParameters = 999
+
+// sqlInsert builds the statements that write rows to a table.
+type sqlInsert struct {
+	rule       *sqlRule
+	table      string
+	columns    []string
+	trees      []*jee.TokenTree
+	upsert     bool
+	keyColumns []string
+}
+
+func newSQLInsert(rule *sqlRule, table string, columnPaths map[string]string, upsert bool, keyColumns []string) (*sqlInsert, error) {
+	if len(columnPaths) == 0 {
+		return nil, errors.New("Columns must map at least one column to a path")
+	}
+	if len(columnPaths) > maxSQLParameters {
+		return nil, errors.New("Columns can't have more than " + strconv.Itoa(maxSQLParameters) + " columns")
+	}
+	s := &sqlInsert{
+		rule:       rule,
+		table:      table,
+		upsert:     upsert,
+		keyColumns: keyColumns,
+	}
+	for column := range columnPaths {
+		s.columns = append(s.columns, column)
+	}
+	// map order is random, so keep statements the same from one batch to the next
+	sort.Strings(s.columns)
+	for _, column := range s.columns {
+		tree, err := util.BuildTokenTree(columnPaths[column])
+		if err != nil {
+			return nil, err
+		}
+		s.trees = append(s.trees, tree)
+	}
+	if upsert {
+		if len(keyColumns) == 0 {
+			return nil, errors.New("upsert needs KeyColumns")
+		}
+		for _, key := range keyColumns {
+			if _, ok := columnPaths[key]; !ok {
+				return nil, errors.New("key column " + key + " isn't one of Columns")
+			}
+		}
+	}
+	// check the names now rather than on the first batch
+	_, err := s.statement(1)
+	return s, err
+}
+
+// row picks a message's values out for each column.
+func (s *sqlInsert) row(msg interface{}) ([]interface{}, error) {
+	row := make([]interface{}, len(s.trees))
+	for i, tree := range s.trees {
+		v, err := jee.Eval(tree, msg)
+		if err != nil {
+			return nil, err
+		}
+		row[i], err = sqlValue(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// statement writes n rows at once.
+func (s *sqlInsert) statement(n int) (string, error) {
+	table, err := s.rule.quote(s.table)
+	if err != nil {
+		return "", err
+	}
+	columns := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		columns[i], err = s.rule.quote(column)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	rows := make([]string, n)
+	p := 1
+	for i := range rows {
+		placeholders := make([]string, len(columns))
+		for j := range placeholders {
+			placeholders[j] = s.rule.placeholder(p)
+			p++
+		}
+		rows[i] = "(" + strings.Join(placeholders, ", ") + ")"
+	}
+	statement := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES " + strings.Join(rows, ", ")
+	if !s.upsert {
+		return statement, nil
+	}
+
+	isKey := make(map[string]bool)
+	keys := make([]string, len(s.keyColumns))
+	for i, key := range s.keyColumns {
+		isKey[key] = true
+		keys[i], err = s.rule.quote(key)
+		if err != nil {
+			return "", err
+		}
+	}
+	var updates []string
+	for i, column := range s.columns {
+		if isKey[column] {
+			continue
+		}
+		if s.rule.driver == "mysql" {
+			updates = append(updates, columns[i]+" = VALUES("+columns[i]+")")
+		} else {
+			updates = append(updates, columns[i]+" = excluded."+columns[i])
+		}
+	}
+	if s.rule.driver == "mysql" {
+		// MySQL finds the conflicting key itself
+		if len(updates) == 0 {
+			updates = []string{keys[0] + " = " + keys[0]}
+		}
+		return statement + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", "), nil
+	}
+	if len(updates) == 0 {
+		return statement + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO NOTHING", nil
+	}
+	return statement + " ON CONFLICT (" + strings.Join(keys, ", ") + ") DO UPDATE SET " + strings.Join(updates, ", "), nil
+}
+
+// dedupe keeps the last of the rows with the same key, as a statement can't
+// update the same row twice.
+func (s *sqlInsert) dedupe(rows [][]interface{}) ([][]interface{}, error) {
+	var keyIndexes []int
+	for _, key := range s.keyColumns {
+		keyIndexes = append(keyIndexes, sort.SearchStrings(s.columns, key))
+	}
+	seen := make(map[string]int)
+	var deduped [][]interface{}
+	for _, row := range rows {
+		key := make([]interface{}, len(keyIndexes))
+		for i, index := range keyIndexes {
+			key[i] = row[index]
+		}
+		k, err := formatColumn(key)
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := seen[k]; ok {
+			deduped[i] = row
+			continue
+		}
+		seen[k] = len(deduped)
+		deduped = append(deduped, row)
+	}
+	return deduped, nil
+}
+
+// write sends the rows in one transaction, so a batch is either all written
+// or not written at all.
+func (s *sqlInsert) write(db *sql.DB, rows [][]interface{}) error {
+	var err error
+	if s.upsert {
+		rows, err = s.dedupe(rows)
+		if err != nil {
+			return err
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	chunk := maxSQLParameters / len(s.columns)
+	for len(rows) > 0 {
+		n := chunk
+		if len(rows) < n {
+			n = len(rows)
+		}
+		statement, err := s.statement(n)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		var args []interface{}
+		for _, row := range rows[:n] {
+			args = append(args, row...)
+		}
+		_, err = tx.Exec(statement, args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		rows = rows[n:]
+	}
+	return tx.Commit()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToSQL) Run() {
+	var db *sql.DB
+	var insert *sqlInsert
+	var rule = &sqlRule{}
+	var table string
+	var columnPaths = map[string]string{}
+	var keyColumns = []string{}
+	var pending []*sqlPending
+
+	mode := "insert"
+	batchSize := 100
+	flushInterval := time.Duration(1) * time.Second
+	retries := 3
+
+	ticker := time.NewTicker(flushInterval)
+
+	// flush writes the pending rows. If the transaction fails the rows are
+	// tried one at a time, so that only those at fault are held back. They're
+	// kept for the next batch, until they've used up their retries, after
+	// which they're passed to failed.
+	flush := func(failed func(interface{}, string)) {
+		if len(pending) == 0 || db == nil {
+			return
+		}
+		items := pending
+		pending = nil
+		rows := make([][]interface{}, len(items))
+		for i, item := range items {
+			rows[i] = item.row
+		}
+		err := insert.write(db, rows)
+		if err == nil {
+			return
+		}
+		b.Error(err)
+		for _, item := range items {
+			if len(items) > 1 {
+				err = insert.write(db, [][]interface{}{item.row})
+				if err == nil {
+					continue
+				}
+			}
+			item.attempts++
+			if item.attempts > retries {
+				failed(item.msg, err.Error()+" (gave up after "+strconv.Itoa(item.attempts)+" attempts)")
+				continue
+			}
+			pending = append(pending, item)
+		}
+	}
+	// giveUp passes on the rows flush kept, for when there's no next batch
+	// for them to go in.
+	giveUp := func(failed func(interface{}, string), reason string) {
+		for _, item := range pending {
+			failed(item.msg, reason+" after "+strconv.Itoa(item.attempts)+" attempts")
+		}
+		pending = nil
+	}
+	emitFailure := func(msg interface{}, reason string) {
+		b.out <- map[string]interface{}{
+			"Event": "WriteFailed",
+			"Error": reason,
+			"Msg":   msg,
+		}
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpRule, err := parseSQLRule(ruleI)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpTable, err := util.ParseRequiredString(ruleI, "Table")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			columnsI, ok := ruleI.(map[string]interface{})["Columns"].(map[string]interface{})
+			if !ok {
+				b.Error(errors.New("Columns must be an object mapping each column to a path"))
+				continue
+			}
+			tmpColumnPaths := make(map[string]string)
+			for column, pathI := range columnsI {
+				path, ok := pathI.(string)
+				if !ok {
+					err = errors.New("the path for column " + column + " must be a string")
+					break
+				}
+				tmpColumnPaths[column] = path
+			}
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// the remaining options are optional
+			tmpMode := "insert"
+			if util.KeyExists(ruleI, "Mode") {
+				tmpMode, err = util.ParseString(ruleI, "Mode")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpMode != "insert" && tmpMode != "upsert" {
+				b.Error(errors.New("Mode must be either insert or upsert"))
+				continue
+			}
+			tmpKeyColumns := []string{}
+			if util.KeyExists(ruleI, "KeyColumns") {
+				tmpKeyColumns, err = util.ParseArrayString(ruleI, "KeyColumns")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpBatchSize := 100
+			if util.KeyExists(ruleI, "BatchSize") {
+				tmpBatchSize, err = util.ParseInt(ruleI, "BatchSize")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpBatchSize < 1 {
+				b.Error(errors.New("BatchSize must be at least 1"))
+				continue
+			}
+			tmpFlushIntervalString := "1s"
+			if util.KeyExists(ruleI, "FlushInterval") {
+				tmpFlushIntervalString, err = util.ParseString(ruleI, "FlushInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpFlushInterval, err := time.ParseDuration(tmpFlushIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			if tmpFlushInterval <= 0 {
+				b.Error(errors.New("FlushInterval must be positive"))
+				continue
+			}
+			tmpRetries := 3
+			if util.KeyExists(ruleI, "Retries") {
+				tmpRetries, err = util.ParseInt(ruleI, "Retries")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			if tmpRetries < 0 {
+				b.Error(errors.New("Retries can't be negative"))
+				continue
+			}
+			tmpInsert, err := newSQLInsert(tmpRule, tmpTable, tmpColumnPaths, tmpMode == "upsert", tmpKeyColumns)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			// write anything waiting with the old rule, which is the last
+			// chance for its rows
+			flush(emitFailure)
+			giveUp(emitFailure, "gave up on a row as the rule changed")
+			if db != nil {
+				db.Close()
+			}
+
+			rule = tmpRule
+			table = tmpTable
+			columnPaths = tmpColumnPaths
+			mode = tmpMode
+			keyColumns = tmpKeyColumns
+			batchSize = tmpBatchSize
+			flushInterval = tmpFlushInterval
+			retries = tmpRetries
+			insert = tmpInsert
+			ticker.Stop()
+			ticker = time.NewTicker(flushInterval)
+
+			db, err = rule.open()
+			if err != nil {
+				b.Error(err)
+			}
+		case <-ticker.C:
+			flush(emitFailure)
+		case msg := <-b.in:
+			if db == nil {
+				b.Error(errors.New("not connected to a database"))
+				continue
+			}
+			row, err := insert.row(msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			pending = append(pending, &sqlPending{
+				msg: msg,
+				row: row,
+			})
+			if len(pending) >= batchSize {
+				flush(emitFailure)
+			}
+		case <-b.quit:
+			// write what's left, reporting failures as errors as nothing is
+			// listening any more
+			ticker.Stop()
+			quitFailure := func(msg interface{}, reason string) {
+				b.Error(reason)
+			}
+			flush(quitFailure)
+			giveUp(quitFailure, "gave up on a row as the block quit")
+			if db != nil {
+				db.Close()
+			}
+			return
+		case c := <-b.queryrule:
+			columns := make(map[string]interface{})
+			for column, path := range columnPaths {
+				columns[column] = path
+			}
+			c <- map[string]interface{}{
+				"Driver":        rule.driver,
+				"DataSource":    rule.dataSource,
+				"Table":         table,
+				"Columns":       columns,
+				"Mode":          mode,
+				"KeyColumns":    keyColumns,
+				"BatchSize":     float64(batchSize),
+				"FlushInterval": flushInterval.String(),
+				"Retries":       float64(retries),
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package library
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/util"
+)
+
+// specify those channels we're going to use to communicate with streamtools
+type ToTCP struct {
+	blocks.Block
+	queryrule chan blocks.MsgChan
+	inrule    blocks.MsgChan
+	in        blocks.MsgChan
+	quit      blocks.MsgChan
+	network   string
+}
+
+// we need to build a simple factory so that streamtools can make new blocks of this kind
+func NewToTCP() blocks.BlockInterface {
+	return &ToTCP{network: "tcp"}
+}
+
+// toUnix is the same block writing to a Unix domain socket
+func NewToUnix() blocks.BlockInterface {
+	return &ToTCP{network: "unix"}
+}
+
+// Setup is called once before running the block. We build up the channels and specify what kind of block this is.
+func (b *ToTCP) Setup() {
+	b.Kind = "Network I/O"
+	if b.network == "unix" {
+		b.Desc = "sends messages as JSON over a Unix domain socket, reconnecting if the connection is lost"
+	} else {
+		b.Desc = "sends messages as JSON over a TCP connection, reconnecting if the connection is lost"
+	}
+	b.in = b.InRoute("in")
+	b.inrule = b.InRoute("rule")
+	b.queryrule = b.QueryRoute("rule")
+	b.quit = b.Quit()
+}
+
+// Run is the block's main loop. Here we listen on the different channels we set up.
+func (b *ToTCP) Run() {
+	var client *socketClient
+	var address string
+	var lastDial time.Time
+	framing := "newline"
+	reconnectInterval := time.Duration(1) * time.Second
+
+	// connect makes sure there's a connection, dialling at most once every
+	// reconnectInterval unless told to try now.
+	connect := func(now bool) error {
+		if client != nil && client.closed() {
+			client.close()
+			client = nil
+		}
+		if client != nil {
+			return nil
+		}
+		if address == "" {
+			return errors.New("no Address to connect to")
+		}
+		if !now && time.Since(lastDial) < reconnectInterval {
+			return errors.New("not connected to " + address)
+		}
+		lastDial = time.Now()
+		var err error
+		client, err = dialSocket(b.network, address)
+		return err
+	}
+
+	for {
+		select {
+		case ruleI := <-b.inrule:
+			tmpAddress, err := util.ParseRequiredString(ruleI, "Address")
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpFraming := "newline"
+			if util.KeyExists(ruleI, "Framing") {
+				tmpFraming, err = util.ParseString(ruleI, "Framing")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			err = checkFraming(tmpFraming)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpReconnectIntervalString := "1s"
+			if util.KeyExists(ruleI, "ReconnectInterval") {
+				tmpReconnectIntervalString, err = util.ParseString(ruleI, "ReconnectInterval")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpReconnectInterval, err := time.ParseDuration(tmpReconnectIntervalString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+
+			if client != nil {
+				client.close()
+				client = nil
+			}
+
+			address = tmpAddress
+			framing = tmpFraming
+			reconnectInterval = tmpReconnectInterval
+
+			// connect now so a bad address shows up straight away
+			err = connect(true)
+			if err != nil {
+				b.Error(err)
+			}
+		case msg := <-b.in:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			err = connect(false)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			err = client.write(framing, data)
+			if err != nil {
+				// the other end may just have restarted, so try again once on
+				// a new connection
+				client.close()
+				client = nil
+				err = connect(true)
+				if err == nil {
+					err = client.write(framing, data)
+				}
+			}
+			if err != nil {
+				b.Error(err)
+			}
+		case <-b.quit:
+			if client != nil {
+				client.close()
+			}
+			return
+		case c := <-b.queryrule:
+			c <- map[string]interface{}{
+				"Address":           address,
+				"Framing":           framing,
+				"ReconnectInterval": reconnectInterval.String(),
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/nytlabs/gojee"
 	"github.com/nytlabs/streamtools/st/blocks" // blocks
@@ -27,15 +29,123 @@ func parseHeaders(headerRule map[string]interface{}) (map[string]string, error)
 	return t, nil
 }
 
+// retryPolicy decides which requests are tried again, and how long to wait
+// before each attempt.
+type retryPolicy struct {
+	retries  int
+	backoff  time.Duration
+	statuses map[int]bool
+}
+
+// do makes a request, retrying network errors and the chosen status codes
+// with exponential backoff. The body is read and closed, and the number of
+// attempts made is returned alongside the last response.
+func (p *retryPolicy) do(client *http.Client, method, url string, body []byte, headers map[string]string) (*http.Response, []byte, int, error) {
+	var resp *http.Response
+	var respBody []byte
+	var err error
+	wait := p.backoff
+	attempt := 0
+	for {
+		attempt++
+		var req *http.Request
+		if body != nil {
+			req, err = http.NewRequest(method, url, bytes.NewReader(body))
+		} else {
+			req, err = http.NewRequest(method, url, nil)
+		}
+		if err != nil {
+			return nil, nil, attempt, err
+		}
+		for key, value := range headers {
+			if key == "Host" {
+				req.Host = value
+			} else {
+				req.Header.Set(key, value)
+			}
+		}
+
+		resp, err = client.Do(req)
+		if err == nil {
+			respBody, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if attempt > p.retries || (err == nil && !p.statuses[resp.StatusCode]) {
+			return resp, respBody, attempt, err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// circuitBreaker stops requests to a service that keeps failing. After
+// threshold failures in a row it opens, rejecting requests until cooldown has
+// passed. Then a single request is let through: if it succeeds the breaker
+// closes, otherwise it opens again.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	open      bool
+	trial     bool
+}
+
+// allow says whether a request may be made. A threshold of 0 turns the
+// breaker off.
+func (c *circuitBreaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.threshold <= 0 || !c.open {
+		return true
+	}
+	if c.trial || time.Since(c.openedAt) < c.cooldown {
+		return false
+	}
+	c.trial = true
+	return true
+}
+
+// record notes the outcome of a request that allow let through.
+func (c *circuitBreaker) record(success bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.trial = false
+	if success {
+		c.failures = 0
+		c.open = false
+		return
+	}
+	c.failures++
+	if c.threshold > 0 && (c.open || c.failures >= c.threshold) {
+		c.open = true
+		c.openedAt = time.Now()
+	}
+}
+
+func (c *circuitBreaker) state() string {
+	c.Lock()
+	defer c.Unlock()
+	switch {
+	case !c.open:
+		return "closed"
+	case c.trial || time.Since(c.openedAt) >= c.cooldown:
+		return "half-open"
+	}
+	return "open"
+}
+
 // specify those channels we're going to use to communicate with streamtools
 type WebRequest struct {
 	blocks.Block
-	queryrule chan blocks.MsgChan
-	inrule    blocks.MsgChan
-	inpoll    blocks.MsgChan
-	in        blocks.MsgChan
-	out       blocks.MsgChan
-	quit      blocks.MsgChan
+	queryrule   chan blocks.MsgChan
+	querystatus chan blocks.MsgChan
+	inrule      blocks.MsgChan
+	inpoll      blocks.MsgChan
+	in          blocks.MsgChan
+	out         blocks.MsgChan
+	quit        blocks.MsgChan
 }
 
 // we need to build a simple factory so that streamtools can make new blocks of this kind
@@ -50,6 +160,7 @@ func (b *WebRequest) Setup() {
 	b.in = b.InRoute("in")
 	b.inrule = b.InRoute("rule")
 	b.queryrule = b.QueryRoute("rule")
+	b.querystatus = b.QueryRoute("status")
 	b.out = b.Broadcast()
 	b.quit = b.Quit()
 }
@@ -89,86 +200,245 @@ func (b *WebRequest) Run() {
 		Transport: &transport,
 	}
 
+	var timeout time.Duration
+	policy := &retryPolicy{
+		backoff:  time.Duration(1) * time.Second,
+		statuses: map[int]bool{429: true, 502: true, 503: true, 504: true},
+	}
+	retryStatuses := []interface{}{float64(429), float64(502), float64(503), float64(504)}
+	breaker := &circuitBreaker{
+		cooldown: time.Duration(30) * time.Second,
+	}
+	pool := newRequestPool()
+
 	for {
+		// stop taking messages while the queue is full
+		in := b.in
+		if pool.full() {
+			in = nil
+		}
+
 		select {
 		case ruleI := <-b.inrule:
-			httpMethod, err = util.ParseString(ruleI, "Method")
+			tmpMethod, err := util.ParseString(ruleI, "Method")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			url, err = util.ParseString(ruleI, "Url")
+			tmpUrl, err := util.ParseString(ruleI, "Url")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			urlPath, err = util.ParseString(ruleI, "UrlPath")
+			tmpUrlPath, err := util.ParseString(ruleI, "UrlPath")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			if len(url) != 0 && len(urlPath) != 0 {
+			if len(tmpUrl) != 0 && len(tmpUrlPath) != 0 {
 				b.Error(errors.New("Specify either a url or a path to a url"))
 				continue
 			}
 
-			if len(urlPath) == 0 {
-				urlTree = nil
-			}
-
-			if len(url) == 0 {
-				token, err := jee.Lexer(urlPath)
+			var tmpUrlTree *jee.TokenTree
+			if len(tmpUrl) == 0 {
+				token, err := jee.Lexer(tmpUrlPath)
 				if err != nil {
 					b.Error(err)
 					continue
 				}
 
-				urlTree, err = jee.Parser(token)
+				tmpUrlTree, err = jee.Parser(token)
 				if err != nil {
 					b.Error(err)
 					continue
 				}
 			}
 
-			bodyPath, err = util.ParseString(ruleI, "BodyPath")
+			tmpBodyPath, err := util.ParseString(ruleI, "BodyPath")
 			if err != nil {
 				b.Error(err)
 				continue
 			}
-			token, err := jee.Lexer(bodyPath)
+			token, err := jee.Lexer(tmpBodyPath)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			bodyTree, err = jee.Parser(token)
+			tmpBodyTree, err := jee.Parser(token)
 			if err != nil {
 				b.Error(err)
 				continue
 			}
 
-			rule := ruleI.(map[string]interface{})
-			headerRuleI, ok := rule["Headers"]
-			if !ok {
+			// rules without headers keep the ones we have
+			tmpHeaderRule, tmpHeaders := headerRule, headers
+			if headerRuleI, ok := ruleI.(map[string]interface{})["Headers"]; ok {
+				tmpHeaderRule, ok = headerRuleI.(map[string]interface{})
+				if !ok {
+					b.Error(errors.New("Headers must be an object"))
+					continue
+				}
+				tmpHeaders, err = parseHeaders(tmpHeaderRule)
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			// the remaining options are optional so that older rules still work
+			tmpTimeoutString := timeout.String()
+			if util.KeyExists(ruleI, "Timeout") {
+				tmpTimeoutString, err = util.ParseString(ruleI, "Timeout")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpTimeout, err := time.ParseDuration(tmpTimeoutString)
+			if err != nil {
+				b.Error(err)
 				continue
 			}
-			headerRule = headerRuleI.(map[string]interface{})
-			p, err := parseHeaders(headerRule)
-			if err == nil {
-				headers = p
-			} else {
+			tmpRetries := policy.retries
+			if util.KeyExists(ruleI, "Retries") {
+				tmpRetries, err = util.ParseInt(ruleI, "Retries")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpBackoffString := policy.backoff.String()
+			if util.KeyExists(ruleI, "RetryBackoff") {
+				tmpBackoffString, err = util.ParseString(ruleI, "RetryBackoff")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpBackoff, err := time.ParseDuration(tmpBackoffString)
+			if err != nil {
+				b.Error(err)
+				continue
+			}
+			tmpRetryStatuses := retryStatuses
+			tmpStatuses := policy.statuses
+			if util.KeyExists(ruleI, "RetryStatuses") {
+				tmpRetryStatuses, ok = ruleI.(map[string]interface{})["RetryStatuses"].([]interface{})
+				if !ok {
+					b.Error(errors.New("RetryStatuses must be an array of status codes"))
+					continue
+				}
+				tmpStatuses = make(map[int]bool)
+				for _, statusI := range tmpRetryStatuses {
+					status, isNumber := statusI.(float64)
+					if !isNumber {
+						ok = false
+						break
+					}
+					tmpStatuses[int(status)] = true
+				}
+				if !ok {
+					b.Error(errors.New("RetryStatuses must be an array of status codes"))
+					continue
+				}
+			}
+			tmpThreshold := breaker.threshold
+			if util.KeyExists(ruleI, "BreakerThreshold") {
+				tmpThreshold, err = util.ParseInt(ruleI, "BreakerThreshold")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCooldownString := breaker.cooldown.String()
+			if util.KeyExists(ruleI, "BreakerCooldown") {
+				tmpCooldownString, err = util.ParseString(ruleI, "BreakerCooldown")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+			tmpCooldown, err := time.ParseDuration(tmpCooldownString)
+			if err != nil {
 				b.Error(err)
 				continue
 			}
+
+			tmpConcurrency := pool.size
+			if util.KeyExists(ruleI, "Concurrency") {
+				tmpConcurrency, err = util.ParseInt(ruleI, "Concurrency")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpConcurrency < 1 {
+					b.Error(errors.New("Concurrency must be at least 1"))
+					continue
+				}
+			}
+			tmpMaxQueued := pool.maxQueued
+			if util.KeyExists(ruleI, "MaxQueued") {
+				tmpMaxQueued, err = util.ParseInt(ruleI, "MaxQueued")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+				if tmpMaxQueued < 1 {
+					b.Error(errors.New("MaxQueued must be at least 1"))
+					continue
+				}
+			}
+			tmpOrdered := pool.ordered
+			if util.KeyExists(ruleI, "Ordered") {
+				tmpOrdered, err = util.ParseBool(ruleI, "Ordered")
+				if err != nil {
+					b.Error(err)
+					continue
+				}
+			}
+
+			httpMethod = tmpMethod
+			url = tmpUrl
+			urlPath = tmpUrlPath
+			urlTree = tmpUrlTree
+			bodyPath = tmpBodyPath
+			bodyTree = tmpBodyTree
+			headerRule = tmpHeaderRule
+			headers = tmpHeaders
+			timeout = tmpTimeout
+			client = &http.Client{
+				Transport: &transport,
+				Timeout:   timeout,
+			}
+			policy = &retryPolicy{
+				retries:  tmpRetries,
+				backoff:  tmpBackoff,
+				statuses: tmpStatuses,
+			}
+			retryStatuses = tmpRetryStatuses
+			// a new breaker would forget the failures the old one has seen
+			if tmpThreshold != breaker.threshold || tmpCooldown != breaker.cooldown {
+				breaker = &circuitBreaker{
+					threshold: tmpThreshold,
+					cooldown:  tmpCooldown,
+				}
+			}
+			pool.size = tmpConcurrency
+			pool.maxQueued = tmpMaxQueued
+			for _, outMsg := range pool.setOrdered(tmpOrdered) {
+				b.out <- outMsg
+			}
+			pool.dispatch()
 		case <-b.quit:
+			pool.close()
 			return
 
-		case msg := <-b.in:
-			var req *http.Request
-
+		case msg := <-in:
 			if urlTree != nil {
 				urlInterface, err := jee.Eval(urlTree, msg)
 				if err != nil {
@@ -188,75 +458,83 @@ func (b *WebRequest) Run() {
 				requestUrl = url
 			}
 
+			var requestBody []byte
 			if httpMethod == "POST" || httpMethod == "PUT" {
 				bodyInterface, err := jee.Eval(bodyTree, msg)
 				if err != nil {
 					b.Error(err)
 					continue
 				}
-				requestBody, err := json.Marshal(bodyInterface)
+				requestBody, err = json.Marshal(bodyInterface)
 				if err != nil {
 					b.Error(errors.New("couldn't marshal body"))
 					continue
 				}
+			}
 
-				req, err = http.NewRequest(httpMethod, requestUrl, bytes.NewReader(requestBody))
-				if err != nil {
-					b.Error(err)
-					break
+			// the rule can change while the request is queued, so take what
+			// it needs now
+			requestClient, requestPolicy, requestBreaker := client, policy, breaker
+			requestMethod, requestHeaders, target := httpMethod, headers, requestUrl
+			pool.add(func() interface{} {
+				if !requestBreaker.allow() {
+					b.Error(errors.New("circuit breaker is open, not requesting " + target))
+					return nil
 				}
 
-			} else {
-				req, err = http.NewRequest(httpMethod, requestUrl, nil)
+				start := time.Now()
+				resp, body, attempts, err := requestPolicy.do(requestClient, requestMethod, target, requestBody, requestHeaders)
+				latency := time.Since(start)
 				if err != nil {
+					requestBreaker.record(false)
 					b.Error(err)
-					break
+					return nil
 				}
-			}
+				requestBreaker.record(!requestPolicy.statuses[resp.StatusCode] && resp.StatusCode < 500)
 
-			for key, value := range headers {
-				if key == "Host" {
-					req.Host = value
-				} else {
-					req.Header.Set(key, value)
+				var responseBody interface{}
+				err = json.Unmarshal(body, &responseBody)
+				if err != nil {
+					responseBody = string(body)
 				}
-			}
-
-			resp, err := client.Do(req)
-			if err != nil {
-				b.Error(err)
-				break
-			}
-			defer resp.Body.Close()
-
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				b.Error(err)
-				break
-			}
 
-			var responseBody interface{}
-			err = json.Unmarshal(body, &responseBody)
-			if err != nil {
-				responseBody = string(body)
-			}
+				// always return body/headers/status even if it's nasty xml
+				return map[string]interface{}{
+					"body":       responseBody,
+					"headers":    resp.Header,
+					"status":     resp.Status,
+					"statusCode": float64(resp.StatusCode),
+					"latency":    float64(latency) / float64(time.Millisecond),
+					"attempts":   float64(attempts),
+				}
+			})
 
-			// always return body/headers/status even if it's nasty xml
-			outMsg := map[string]interface{}{
-				"body":    responseBody,
-				"headers": resp.Header,
-				"status":  resp.Status,
+		case j := <-pool.done:
+			for _, outMsg := range pool.finish(j) {
+				b.out <- outMsg
 			}
 
-			b.out <- outMsg
+		case resp := <-b.querystatus:
+			status := pool.status()
+			status["Breaker"] = breaker.state()
+			resp <- status
 
 		case resp := <-b.queryrule:
 			resp <- map[string]interface{}{
-				"Url":      url,
-				"UrlPath":  urlPath,
-				"BodyPath": bodyPath,
-				"Method":   httpMethod,
-				"Headers":  headerRule,
+				"Url":              url,
+				"UrlPath":          urlPath,
+				"BodyPath":         bodyPath,
+				"Method":           httpMethod,
+				"Headers":          headerRule,
+				"Timeout":          timeout.String(),
+				"Retries":          float64(policy.retries),
+				"RetryBackoff":     policy.backoff.String(),
+				"RetryStatuses":    retryStatuses,
+				"BreakerThreshold": float64(breaker.threshold),
+				"BreakerCooldown":  breaker.cooldown.String(),
+				"Concurrency":      float64(pool.size),
+				"MaxQueued":        float64(pool.maxQueued),
+				"Ordered":          pool.ordered,
 			}
 		}
 	}
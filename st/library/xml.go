@@ -0,0 +1,372 @@
+package library
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// xmlNode is an element of a parsed XML document. Names keep the namespace
+// prefix they were written with.
+type xmlNode struct {
+	prefix   string
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     string
+	parent   *xmlNode
+}
+
+// parseXMLDocument reads data into a tree of elements, returning a document
+// node whose only child is the root element.
+func parseXMLDocument(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		switch strings.ToLower(charset) {
+		case "iso-8859-1", "latin1", "us-ascii", "ascii":
+			return latin1Reader{input}, nil
+		}
+		return nil, errors.New("unsupported XML charset " + charset)
+	}
+
+	doc := &xmlNode{}
+	current := doc
+	var text bytes.Buffer
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := t.(type) {
+		case xml.StartElement:
+			if current == doc && len(doc.children) > 0 {
+				return nil, errors.New("XML document has more than one root element")
+			}
+			current.text += strings.TrimSpace(text.String())
+			text.Reset()
+			n := &xmlNode{
+				prefix: token.Name.Space,
+				name:   token.Name.Local,
+				attrs:  token.Attr,
+				parent: current,
+			}
+			current.children = append(current.children, n)
+			current = n
+		case xml.EndElement:
+			if current == doc || token.Name.Space != current.prefix || token.Name.Local != current.name {
+				return nil, errors.New("unexpected XML end element " + token.Name.Local)
+			}
+			current.text += strings.TrimSpace(text.String())
+			text.Reset()
+			current = current.parent
+		case xml.CharData:
+			if current != doc {
+				text.Write(token)
+			}
+		}
+	}
+	if current != doc {
+		return nil, errors.New("XML element " + current.name + " is not closed")
+	}
+	if len(doc.children) == 0 {
+		return nil, errors.New("XML document has no root element")
+	}
+	return doc, nil
+}
+
+// latin1Reader turns ISO-8859-1 into UTF-8. ASCII passes through untouched.
+type latin1Reader struct {
+	r io.Reader
+}
+
+func (l latin1Reader) Read(p []byte) (int, error) {
+	// every input byte becomes at most two output bytes
+	if len(p) < 2 {
+		return 0, io.ErrShortBuffer
+	}
+	buf := make([]byte, len(p)/2)
+	n, err := l.r.Read(buf)
+	out := p[:0]
+	for _, c := range buf[:n] {
+		if c < 0x80 {
+			out = append(out, c)
+		} else {
+			out = append(out, 0xc0|c>>6, 0x80|c&0x3f)
+		}
+	}
+	return len(out), err
+}
+
+func xmlName(prefix, name string, namespaces bool) string {
+	if namespaces && prefix != "" {
+		return prefix + ":" + name
+	}
+	return name
+}
+
+// xmlOptions controls how XML elements become messages.
+type xmlOptions struct {
+	// attributes is merge, to put attributes alongside child elements, prefix,
+	// to do the same with attrPrefix in front of their names, or nested, to
+	// collect them under #attributes.
+	attributes string
+	attrPrefix string
+	// namespaces keeps namespace prefixes on names, along with the xmlns
+	// declarations. Without it, names are reduced to their local part.
+	namespaces bool
+	// forceArray names elements that are always emitted as arrays, even when
+	// they only appear once.
+	forceArray map[string]bool
+}
+
+// message converts an element into a message keyed by its name.
+func (o *xmlOptions) message(n *xmlNode) map[string]interface{} {
+	return map[string]interface{}{
+		xmlName(n.prefix, n.name, o.namespaces): o.value(n),
+	}
+}
+
+// value converts an element. An element with only text becomes a string;
+// anything else becomes a map, with any text under #text and repeated
+// elements gathered into arrays.
+func (o *xmlOptions) value(n *xmlNode) interface{} {
+	m := make(map[string]interface{})
+
+	attrs := make(map[string]interface{})
+	for _, attr := range n.attrs {
+		isDeclaration := attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns")
+		if isDeclaration && !o.namespaces {
+			continue
+		}
+		name := xmlName(attr.Name.Space, attr.Name.Local, o.namespaces)
+		switch o.attributes {
+		case "prefix":
+			m[o.attrPrefix+name] = attr.Value
+		case "nested":
+			attrs[name] = attr.Value
+		default:
+			m[name] = attr.Value
+		}
+	}
+	if len(attrs) > 0 {
+		m["#attributes"] = attrs
+	}
+
+	for _, child := range n.children {
+		key := xmlName(child.prefix, child.name, o.namespaces)
+		v := o.value(child)
+		existing, ok := m[key]
+		switch {
+		case !ok && o.forceArray[key]:
+			m[key] = []interface{}{v}
+		case !ok:
+			m[key] = v
+		default:
+			if items, isArray := existing.([]interface{}); isArray {
+				m[key] = append(items, v)
+			} else {
+				m[key] = []interface{}{existing, v}
+			}
+		}
+	}
+
+	if len(m) == 0 {
+		return n.text
+	}
+	if n.text != "" {
+		m["#text"] = n.text
+	}
+	return m
+}
+
+// xpathStep is one step of a location path, such as item[@type='news'].
+type xpathStep struct {
+	// descendant is set when the step follows // rather than /
+	descendant bool
+	prefix     string
+	name       string
+	predicates []xpathPredicate
+}
+
+// xpathPredicate filters the nodes matched by a step: by position, by the
+// presence or value of an attribute, or by the text of a child element.
+type xpathPredicate struct {
+	position int
+	attr     bool
+	name     string
+	value    string
+	hasValue bool
+}
+
+// parseXPath reads the subset of XPath that selects elements: absolute and
+// descendant steps, * and prefix:name tests, and the predicates [n], [@a],
+// [@a='v'] and [child='v']. Paths are always evaluated from the document.
+func parseXPath(expr string) ([]xpathStep, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "" {
+		return nil, errors.New("empty XPath")
+	}
+	var steps []xpathStep
+	i := 0
+	for i < len(expr) {
+		step := xpathStep{}
+		if strings.HasPrefix(expr[i:], "//") {
+			step.descendant = true
+			i += 2
+		} else if expr[i] == '/' {
+			i++
+		} else if len(steps) > 0 {
+			return nil, errors.New("unexpected " + string(expr[i]) + " in XPath " + expr)
+		}
+
+		start := i
+		for i < len(expr) && expr[i] != '/' && expr[i] != '[' {
+			i++
+		}
+		name := expr[start:i]
+		if name == "" {
+			return nil, errors.New("missing element name in XPath " + expr)
+		}
+		if colon := strings.Index(name, ":"); colon >= 0 {
+			step.prefix, name = name[:colon], name[colon+1:]
+		}
+		step.name = name
+
+		for i < len(expr) && expr[i] == '[' {
+			end := strings.Index(expr[i:], "]")
+			if end < 0 {
+				return nil, errors.New("unclosed predicate in XPath " + expr)
+			}
+			p, err := parseXPathPredicate(expr[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			step.predicates = append(step.predicates, p)
+			i += end + 1
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func parseXPathPredicate(s string) (xpathPredicate, error) {
+	p := xpathPredicate{}
+	s = strings.TrimSpace(s)
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 1 {
+			return p, errors.New("XPath positions start at 1")
+		}
+		p.position = n
+		return p, nil
+	}
+	if strings.HasPrefix(s, "@") {
+		p.attr = true
+		s = s[1:]
+	}
+	if eq := strings.Index(s, "="); eq >= 0 {
+		value := strings.TrimSpace(s[eq+1:])
+		if len(value) < 2 || (value[0] != '\'' && value[0] != '"') || value[len(value)-1] != value[0] {
+			return p, errors.New("XPath predicate values must be quoted: " + s)
+		}
+		p.value = value[1 : len(value)-1]
+		p.hasValue = true
+		s = s[:eq]
+	}
+	p.name = strings.TrimSpace(s)
+	if p.name == "" {
+		return p, errors.New("missing name in XPath predicate")
+	}
+	return p, nil
+}
+
+// matches tests an element against the step's name. Steps without a prefix
+// match on the local name alone, so /rss/channel/item and //entry work
+// whether or not the document uses namespaces.
+func (s xpathStep) matches(n *xmlNode) bool {
+	if s.prefix != "" && s.prefix != n.prefix {
+		return false
+	}
+	return s.name == "*" || s.name == n.name
+}
+
+func (p xpathPredicate) matches(n *xmlNode) bool {
+	if p.attr {
+		for _, attr := range n.attrs {
+			if xmlName(attr.Name.Space, attr.Name.Local, true) == p.name || (!strings.Contains(p.name, ":") && attr.Name.Local == p.name) {
+				return !p.hasValue || attr.Value == p.value
+			}
+		}
+		return false
+	}
+	for _, child := range n.children {
+		if (child.name == p.name || xmlName(child.prefix, child.name, true) == p.name) && (!p.hasValue || child.text == p.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter applies the step's name test and predicates to the children of one
+// parent. Positions count among the nodes that survived earlier predicates.
+func (s xpathStep) filter(children []*xmlNode) []*xmlNode {
+	var matched []*xmlNode
+	for _, child := range children {
+		if s.matches(child) {
+			matched = append(matched, child)
+		}
+	}
+	for _, p := range s.predicates {
+		var kept []*xmlNode
+		for i, n := range matched {
+			if p.position > 0 {
+				if i+1 == p.position {
+					kept = append(kept, n)
+				}
+			} else if p.matches(n) {
+				kept = append(kept, n)
+			}
+		}
+		matched = kept
+	}
+	return matched
+}
+
+// descendantsOrSelf lists n and every element below it, in document order.
+func descendantsOrSelf(n *xmlNode) []*xmlNode {
+	nodes := []*xmlNode{n}
+	for _, child := range n.children {
+		nodes = append(nodes, descendantsOrSelf(child)...)
+	}
+	return nodes
+}
+
+// evalXPath returns the elements of doc selected by steps, in document order.
+func evalXPath(doc *xmlNode, steps []xpathStep) []*xmlNode {
+	context := []*xmlNode{doc}
+	for _, step := range steps {
+		var next []*xmlNode
+		seen := make(map[*xmlNode]bool)
+		for _, n := range context {
+			parents := []*xmlNode{n}
+			if step.descendant {
+				parents = descendantsOrSelf(n)
+			}
+			for _, parent := range parents {
+				for _, m := range step.filter(parent.children) {
+					if !seen[m] {
+						seen[m] = true
+						next = append(next, m)
+					}
+				}
+			}
+		}
+		context = next
+	}
+	return context
+}
@@ -20,11 +20,12 @@ type BlockInfo struct {
 }
 
 type ConnectionInfo struct {
-	Id      string
-	FromId  string
-	ToId    string
-	ToRoute string
-	chans   blocks.BlockChans
+	Id        string
+	FromId    string
+	FromRoute string
+	ToId      string
+	ToRoute   string
+	chans     blocks.BlockChans
 }
 
 type Coords struct {
@@ -261,6 +262,23 @@ func (b *BlockManager) Connect(connInfo *ConnectionInfo) (*ConnectionInfo, error
 		return nil, errors.New(fmt.Sprintf("Cannot create connection %s: ToId ID does not exist", connInfo.Id))
 	}
 
+	// connections made before blocks had more than one out route come from
+	// the broadcast route
+	if connInfo.FromRoute == "" {
+		connInfo.FromRoute = "out"
+	}
+	if from, ok := b.blockMap[connInfo.FromId]; ok {
+		found := false
+		for _, route := range library.BlockDefs[from.Type].OutRoutes {
+			if route == connInfo.FromRoute {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New(fmt.Sprintf("Cannot create connection %s: FromId block has no %s route", connInfo.Id, connInfo.FromRoute))
+		}
+	}
+
 	// create connection info for server
 	// and create connection routine
 	newConn := &blocks.Connection{
@@ -286,8 +304,9 @@ func (b *BlockManager) Connect(connInfo *ConnectionInfo) (*ConnectionInfo, error
 
 	// ask to connect the blocks together
 	b.blockMap[connInfo.FromId].chans.AddChan <- &blocks.AddChanMsg{
-		Route:   connInfo.Id,
-		Channel: connInfo.chans.InChan,
+		Route:     connInfo.Id,
+		Channel:   connInfo.chans.InChan,
+		FromRoute: connInfo.FromRoute,
 	}
 
 	b.connMap[connInfo.Id].chans.AddChan <- &blocks.AddChanMsg{
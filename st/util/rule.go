@@ -92,54 +92,48 @@ func ParseArrayString(ruleI interface{}, key string) ([]string, error) {
 	var val []string
 
 	rule := ruleI.(map[string]interface{})
-	var ok bool
 	foundRule, ok := rule[key]
 	if !ok {
 		return val, errors.New("Path was not in rule")
 	}
 
-	switch foundRule.(type) {
+	switch v := foundRule.(type) {
 	case []interface{}:
-		valI, ok := foundRule.([]interface{})
-		if !ok {
-			return val, errors.New("Supplied value was not an array of interfaces")
-		}
-		val = make([]string, len(valI))
-		for i, vi := range valI {
-			v, ok := vi.(string)
+		val = make([]string, len(v))
+		for i, vi := range v {
+			s, ok := vi.(string)
 			if !ok {
 				return val, errors.New("Failed asserting to []string")
 			}
-			val[i] = v
+			val[i] = s
 		}
 	case []string:
-		val, ok = foundRule.([]string)
-		if !ok {
-			return val, errors.New("Supplied value was not an array of strings")
-		}
+		val = v
 	}
 	return val, nil
 }
 
 func ParseArrayFloat(ruleI interface{}, key string) ([]float64, error) {
 	rule := ruleI.(map[string]interface{})
-	var ok bool
 	var val []float64
 	foundRule, ok := rule[key]
 	if !ok {
 		return val, errors.New("Path was not in rule")
 	}
-	valI, ok := foundRule.([]interface{})
-	if !ok {
-		return val, errors.New("Supplied value was not an array")
-	}
-	val = make([]float64, len(valI))
-	for i, vi := range valI {
-		v, ok := vi.(float64)
-		if !ok {
-			return val, errors.New("Supplied value was not an array of numbers")
+	switch v := foundRule.(type) {
+	case []interface{}:
+		val = make([]float64, len(v))
+		for i, vi := range v {
+			f, ok := vi.(float64)
+			if !ok {
+				return val, errors.New("Supplied value was not an array of numbers")
+			}
+			val[i] = f
 		}
-		val[i] = v
+	case []float64:
+		val = v
+	default:
+		return val, errors.New("Supplied value was not an array")
 	}
 	return val, nil
 }
@@ -0,0 +1,225 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type AnomalySuite struct{}
+
+var anomalySuite = Suite(&AnomalySuite{})
+
+func (s *AnomalySuite) TestAnomaly(c *C) {
+	loghub.Start()
+	log.Println("testing Anomaly")
+	b, ch := test_utils.NewBlock("testingAnomaly", "anomaly")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".value",
+		"KeyPath":    ".host",
+		"Method":     "ewma",
+		"Window":     "10s",
+		"Threshold":  3.0,
+		"MinSamples": 5.0,
+		"Alpha":      0.3,
+		"Beta":       0.1,
+		"Gamma":      0.1,
+		"Season":     24.0,
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 20; i++ {
+			v := 10.0
+			if i%2 == 0 {
+				v = 11.0
+			}
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "a", "value": v}, Route: "in"}
+		}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "a", "value": 100.0}, Route: "in"}
+		// a spike on a different host has no history and should not be flagged
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "b", "value": 100.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	flagged := 0
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			flagged++
+			c.Assert(message["Key"], Equals, "a")
+			c.Assert(message["Value"], Equals, 100.0)
+			c.Assert(message["Score"].(float64) > 3, Equals, true)
+			c.Assert(message["Upper"].(float64) < 100, Equals, true)
+
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(flagged, Equals, 1)
+				return
+			}
+		}
+	}
+}
+
+func (s *AnomalySuite) TestAnomalyMAD(c *C) {
+	loghub.Start()
+	log.Println("testing Anomaly: mad")
+	b, ch := test_utils.NewBlock("testingAnomalyMAD", "anomaly")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".value",
+		"KeyPath":    ".host",
+		"Method":     "mad",
+		"Window":     "1s",
+		"Threshold":  3.0,
+		"MinSamples": 5.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 20; i++ {
+			v := 10.0
+			if i%2 == 0 {
+				v = 11.0
+			}
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "a", "value": v}, Route: "in"}
+		}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "a", "value": 100.0}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"host": "b", "value": 5.0}, Route: "in"}
+	})
+
+	// once everything has left the window there's nothing left to score
+	// against, so the keys are forgotten
+	stateOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: stateOutChan, Route: "state"}
+	})
+
+	time.AfterFunc(time.Duration(4)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	flagged := 0
+	for {
+		select {
+		case messageI := <-stateOutChan:
+			c.Assert(messageI, DeepEquals, map[string]interface{}{
+				"State": map[string]interface{}{},
+			})
+
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			flagged++
+			c.Assert(message["Key"], Equals, "a")
+			c.Assert(message["Value"], Equals, 100.0)
+			c.Assert(message["Expected"], Equals, 10.5)
+			c.Assert(message["Score"].(float64) > 3, Equals, true)
+
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(flagged, Equals, 1)
+				return
+			}
+		}
+	}
+}
+
+func (s *AnomalySuite) TestAnomalyHoltWinters(c *C) {
+	loghub.Start()
+	log.Println("testing Anomaly: holtwinters")
+	b, ch := test_utils.NewBlock("testingAnomalyHoltWinters", "anomaly")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".value",
+		"Method":     "holtwinters",
+		"Window":     "0",
+		"Threshold":  4.0,
+		"MinSamples": 8.0,
+		"Alpha":      0.3,
+		"Beta":       0.1,
+		"Gamma":      0.3,
+		"Season":     4.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// a strongly seasonal series with a little noise: 30 is normal where we
+	// expect 30, but not where we expect 20
+	season := []float64{10, 20, 30, 20}
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 34; i++ {
+			v := season[i%4] + float64(i%3)*0.5
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"value": v}, Route: "in"}
+		}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"value": 30.0}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"value": 30.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	flagged := 0
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			flagged++
+			c.Assert(message["Key"], Equals, "")
+			c.Assert(message["Value"], Equals, 30.0)
+			expected := message["Expected"].(float64)
+			c.Assert(expected > 19 && expected < 22, Equals, true)
+
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(flagged, Equals, 1)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type AvroSuite struct{}
+
+var avroSuite = Suite(&AvroSuite{})
+
+func (s *AvroSuite) TestAvroRoundTrip(c *C) {
+	log.Println("testing toAvro and fromAvro")
+	f, err := ioutil.TempFile("", "streamtools_test_avro")
+	c.Assert(err, IsNil)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	messages := []interface{}{
+		map[string]interface{}{"name": "Jacqui Maher", "visits": 3.0, "tags": []interface{}{"a", "b"}},
+		map[string]interface{}{"name": "Mike Dewar", "visits": 1.5, "user": map[string]interface{}{"admin": true}},
+		map[string]interface{}{"name": "Nik Hanselmann", "visits": 2.0, "tags": []interface{}{}},
+	}
+
+	b, ch := test_utils.NewBlock("testingToAvro", "toavro")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{"Filename": f.Name(), "InferFrom": 2.0, "BlockSize": 2.0, "Codec": "deflate"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for _, msg := range messages {
+			ch.InChan <- &blocks.Msg{Msg: msg, Route: "in"}
+		}
+	})
+
+	schemaChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: schemaChan, Route: "schema"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	func() {
+		for {
+			select {
+			case messageI := <-schemaChan:
+				schema := messageI.(map[string]interface{})["Schema"].(map[string]interface{})
+				c.Assert(schema["type"], Equals, "record")
+				c.Assert(schema["name"], Equals, "Message")
+				c.Assert(len(schema["fields"].([]interface{})), Equals, 4)
+			case err := <-ch.ErrChan:
+				if err != nil {
+					c.Errorf(err.Error())
+					continue
+				}
+				return
+			}
+		}
+	}()
+	// the block finishes writing its file as it quits
+	time.Sleep(time.Duration(100) * time.Millisecond)
+
+	b, ch = test_utils.NewBlock("testingFromAvro", "fromavro")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Filename": f.Name()}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	// fields missing from a message come back as null
+	expected := []interface{}{
+		map[string]interface{}{"name": "Jacqui Maher", "visits": 3.0, "tags": []interface{}{"a", "b"}, "user": nil},
+		map[string]interface{}{"name": "Mike Dewar", "visits": 1.5, "tags": nil, "user": map[string]interface{}{"admin": true}},
+		map[string]interface{}{"name": "Nik Hanselmann", "visits": 2.0, "tags": []interface{}{}, "user": nil},
+	}
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(received, DeepEquals, expected)
+			return
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package tests
+
+import (
+	"encoding/base64"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type CodecSuite struct{}
+
+var codecSuite = Suite(&CodecSuite{})
+
+func (s *CodecSuite) TestDecodeMsgpack(c *C) {
+	log.Println("testing Decode: msgpack")
+	b, ch := test_utils.NewBlock("testingDecodeMsgpack", "decode")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Format":      "msgpack",
+		"Path":        ".data",
+		"Encoding":    "raw",
+		"Descriptors": "",
+		"Message":     "",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	// {"a": 1, "b": [true, nil], "c": "hi", "d": -1.5}
+	packed := []byte{
+		0x84,
+		0xa1, 'a', 0x01,
+		0xa1, 'b', 0x92, 0xc3, 0xc0,
+		0xa1, 'c', 0xa2, 'h', 'i',
+		0xa1, 'd', 0xcb, 0xbf, 0xf8, 0, 0, 0, 0, 0, 0,
+	}
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"data": string(packed)}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	decoded := 0
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			c.Assert(messageI.Msg, DeepEquals, map[string]interface{}{
+				"a": 1.0,
+				"b": []interface{}{true, nil},
+				"c": "hi",
+				"d": -1.5,
+			})
+			decoded++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(decoded, Equals, 1)
+				return
+			}
+		}
+	}
+}
+
+// protobuf wire format helpers for building a descriptor set by hand
+func pbVarint(v uint64) []byte {
+	var b []byte
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func pbField(num uint64, v uint64) []byte {
+	return append(pbVarint(num<<3), pbVarint(v)...)
+}
+
+func pbBytes(num uint64, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	b := append(pbVarint(num<<3|2), pbVarint(uint64(len(body)))...)
+	return append(b, body...)
+}
+
+func pbString(num uint64, s string) []byte {
+	return pbBytes(num, []byte(s))
+}
+
+func (s *CodecSuite) TestProtobufRoundTrip(c *C) {
+	log.Println("testing Encode and Decode: protobuf")
+
+	// syntax = "proto3";
+	// package test;
+	// message Event {
+	//   enum Kind { UNKNOWN = 0; CLICK = 1; }
+	//   string name = 1;
+	//   int64 count = 2;
+	//   repeated int32 ids = 3;
+	//   Kind kind = 4;
+	//   map<string, int32> tags = 5;
+	//   Inner inner = 6;
+	// }
+	// message Inner { bool ok = 1; }
+	field := func(name string, number, label, typ uint64, typeName string) []byte {
+		f := [][]byte{pbString(1, name), pbField(3, number), pbField(4, label), pbField(5, typ)}
+		if typeName != "" {
+			f = append(f, pbString(6, typeName))
+		}
+		return pbBytes(2, f...)
+	}
+	file := pbBytes(1,
+		pbString(1, "test.proto"),
+		pbString(2, "test"),
+		pbBytes(4,
+			pbString(1, "Event"),
+			field("name", 1, 1, 9, ""),
+			field("count", 2, 1, 3, ""),
+			field("ids", 3, 3, 5, ""),
+			field("kind", 4, 1, 14, ".test.Event.Kind"),
+			field("tags", 5, 3, 11, ".test.Event.TagsEntry"),
+			field("inner", 6, 1, 11, ".test.Inner"),
+			pbBytes(3,
+				pbString(1, "TagsEntry"),
+				field("key", 1, 1, 9, ""),
+				field("value", 2, 1, 5, ""),
+				pbBytes(7, pbField(7, 1)),
+			),
+			pbBytes(4,
+				pbString(1, "Kind"),
+				pbBytes(2, pbString(1, "UNKNOWN"), pbField(2, 0)),
+				pbBytes(2, pbString(1, "CLICK"), pbField(2, 1)),
+			),
+		),
+		pbBytes(4,
+			pbString(1, "Inner"),
+			field("ok", 1, 1, 8, ""),
+		),
+		pbString(12, "proto3"),
+	)
+	descriptors := base64.StdEncoding.EncodeToString(file)
+
+	encoder, encCh := test_utils.NewBlock("testingEncodeProtobuf", "encode")
+	go blocks.BlockRoutine(encoder)
+	encOut := make(chan *blocks.Msg)
+	encCh.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: encOut}
+	encCh.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Format":      "protobuf",
+		"Descriptors": descriptors,
+		"Message":     "test.Event",
+	}, Route: "rule"}
+
+	decoder, decCh := test_utils.NewBlock("testingDecodeProtobuf", "decode")
+	go blocks.BlockRoutine(decoder)
+	decOut := make(chan *blocks.Msg)
+	decCh.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: decOut}
+	decCh.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Format":      "protobuf",
+		"Encoding":    "base64",
+		"Descriptors": descriptors,
+		"Message":     ".test.Event",
+	}, Route: "rule"}
+
+	event := map[string]interface{}{
+		"name":  "signup",
+		"count": -3.0,
+		"ids":   []interface{}{1.0, 300.0, -2.0},
+		"kind":  "CLICK",
+		"tags":  map[string]interface{}{"x": 2.0, "y": 0.0},
+		"inner": map[string]interface{}{"ok": true},
+	}
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		encCh.InChan <- &blocks.Msg{Msg: event, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		encCh.QuitChan <- true
+		decCh.QuitChan <- true
+	})
+
+	decoded := 0
+	// stop listening to each block once it has quit
+	encErr, decErr := encCh.ErrChan, decCh.ErrChan
+	for encErr != nil || decErr != nil {
+		select {
+		case messageI := <-encOut:
+			decCh.InChan <- &blocks.Msg{Msg: messageI.Msg, Route: "in"}
+		case messageI := <-decOut:
+			c.Assert(messageI.Msg, DeepEquals, event)
+			decoded++
+		case err := <-encErr:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				encErr = nil
+			}
+		case err := <-decErr:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				decErr = nil
+			}
+		}
+	}
+	c.Assert(decoded, Equals, 1)
+}
@@ -0,0 +1,282 @@
+package tests
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type FromFeedSuite struct{}
+
+var fromFeedSuite = Suite(&FromFeedSuite{})
+
+func (s *FromFeedSuite) TestFromFeed(c *C) {
+	log.Println("testing FromFeed")
+	b, ch := test_utils.NewBlock("testingFromFeed", "fromfeed")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	item := `<item><guid>%d</guid><title>Item %d</title><link>http://example.com/%d</link><pubDate>Thu, 0%d May 2014 10:00:00 -0400</pubDate></item>`
+	var lock sync.Mutex
+	version := 1
+	notModified := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		etag := fmt.Sprintf(`"v%d"`, version)
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>Test</title><link>http://example.com/</link>`)
+		// newest first, as feeds usually are
+		for i := version + 1; i > 0; i-- {
+			fmt.Fprintf(w, item, i, i, i, i)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"URL": ts.URL, "Interval": "1s", "MaxSeen": float64(10), "Timeout": "5s"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	// publish a new item after the feed has been fetched and checked once
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		lock.Lock()
+		version = 2
+		lock.Unlock()
+	})
+
+	time.AfterFunc(time.Duration(3500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	var titles []string
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(titles, DeepEquals, []string{"Item 1", "Item 2", "Item 3"})
+				lock.Lock()
+				c.Assert(notModified > 0, Equals, true)
+				lock.Unlock()
+				return
+			}
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			titles = append(titles, message["Title"].(string))
+			if message["Title"] == "Item 1" {
+				c.Assert(message["ID"], Equals, "1")
+				c.Assert(message["Link"], Equals, "http://example.com/1")
+				c.Assert(message["Published"], Equals, "2014-05-01T14:00:00Z")
+				c.Assert(message["Feed"].(map[string]interface{})["Title"], Equals, "Test")
+			}
+		}
+	}
+}
+
+func (s *FromFeedSuite) TestFromFeedTimeout(c *C) {
+	log.Println("testing FromFeed with a server that doesn't answer")
+	b, ch := test_utils.NewBlock("testingFromFeedTimeout", "fromfeed")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		n := requests
+		lock.Unlock()
+		w.Header().Set("ETag", `"v1"`)
+		switch n {
+		case 1:
+			// hangs for longer than the timeout
+			time.Sleep(time.Duration(2) * time.Second)
+		case 2:
+			// cut short, so it can't be parsed
+			fmt.Fprint(w, `<rss version="2.0"><channel><title>Test</title>`)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, `<rss version="2.0"><channel><title>Test</title><item><guid>1</guid><title>Item 1</title></item></channel></rss>`)
+	}))
+	defer ts.Close()
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"URL": ts.URL, "Interval": "200ms", "Timeout": "500ms"}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	// neither the hung request nor the bad response keep the block from
+	// fetching the feed in full
+	var titles []string
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(titles, DeepEquals, []string{"Item 1"})
+			return
+		case messageI := <-outChan:
+			titles = append(titles, messageI.Msg.(map[string]interface{})["Title"].(string))
+		}
+	}
+}
+
+// fetchFeed serves body to a fromFeed block and returns the items it emits
+// from its first fetch.
+func fetchFeed(c *C, body string) []map[string]interface{} {
+	b, ch := test_utils.NewBlock("testingFromFeed", "fromfeed")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer ts.Close()
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"URL": ts.URL, "Interval": "1m"}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var items []map[string]interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			return items
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg.(map[string]interface{}))
+		}
+	}
+}
+
+func (s *FromFeedSuite) TestFromFeedAtomLinkInRSS(c *C) {
+	log.Println("testing FromFeed with an atom:link in RSS")
+	items := fetchFeed(c, `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+		<atom:link href="http://example.com/feed.xml" rel="self" type="application/rss+xml"/>
+		<title>Test</title><link>http://example.com/</link>
+		<item><atom:link href="http://example.com/1.xml" rel="self"/><title>Item 1</title><link>http://example.com/1</link></item>
+	</channel></rss>`)
+	c.Assert(len(items), Equals, 1)
+	c.Assert(items[0]["Link"], Equals, "http://example.com/1")
+	c.Assert(items[0]["Feed"].(map[string]interface{})["Link"], Equals, "http://example.com/")
+}
+
+func (s *FromFeedSuite) TestFromFeedAtom(c *C) {
+	log.Println("testing FromFeed with Atom")
+	items := fetchFeed(c, `<?xml version="1.0" encoding="utf-8"?>
+	<feed xmlns="http://www.w3.org/2005/Atom">
+		<title>Test</title>
+		<link href="http://example.com/feed.atom" rel="self"/>
+		<link href="http://example.com/"/>
+		<entry>
+			<id>tag:example.com,2014:2</id>
+			<title>Item 2</title>
+			<link href="http://example.com/2/comments" rel="replies"/>
+			<link href="http://example.com/2" rel="alternate"/>
+			<updated>2014-05-02T10:00:00-04:00</updated>
+			<author><name>Mike Dewar</name></author>
+			<summary>The second item</summary>
+			<content type="html">&lt;p&gt;Two&lt;/p&gt;</content>
+			<category term="news"/>
+			<category term="tests"/>
+		</entry>
+		<entry>
+			<id>tag:example.com,2014:1</id>
+			<title>Item 1</title>
+			<link href="http://example.com/1"/>
+			<published>2014-05-01T10:00:00-04:00</published>
+			<updated>2014-05-01T12:00:00-04:00</updated>
+		</entry>
+	</feed>`)
+	c.Assert(len(items), Equals, 2)
+	c.Assert(items[0]["ID"], Equals, "tag:example.com,2014:1")
+	c.Assert(items[0]["Published"], Equals, "2014-05-01T14:00:00Z")
+	c.Assert(items[0]["Updated"], Equals, "2014-05-01T16:00:00Z")
+
+	// entries without a published date use their updated one
+	item := items[1]
+	c.Assert(item["Title"], Equals, "Item 2")
+	c.Assert(item["Link"], Equals, "http://example.com/2")
+	c.Assert(item["Author"], Equals, "Mike Dewar")
+	c.Assert(item["Summary"], Equals, "The second item")
+	c.Assert(item["Content"], Equals, "<p>Two</p>")
+	c.Assert(item["Published"], Equals, "2014-05-02T14:00:00Z")
+	c.Assert(item["Categories"], DeepEquals, []interface{}{"news", "tests"})
+	c.Assert(item["Feed"].(map[string]interface{})["Link"], Equals, "http://example.com/")
+}
+
+func (s *FromFeedSuite) TestFromFeedJSON(c *C) {
+	log.Println("testing FromFeed with JSON Feed")
+	items := fetchFeed(c, `{
+		"version": "https://jsonfeed.org/version/1",
+		"title": "Test",
+		"home_page_url": "http://example.com/",
+		"items": [
+			{"id": 2, "url": "http://example.com/2", "title": "Item 2", "content_text": "Two",
+			 "date_published": "2014-05-02T10:00:00-04:00", "authors": [{"name": "Jacqui Maher"}], "tags": ["news"]},
+			{"id": "1", "url": "http://example.com/1", "title": "Item 1", "content_html": "<p>One</p>",
+			 "summary": "The first item", "date_published": "2014-05-01T10:00:00-04:00", "author": {"name": "Mike Dewar"}}
+		]
+	}`)
+	c.Assert(len(items), Equals, 2)
+	c.Assert(items[0]["ID"], Equals, "1")
+	c.Assert(items[0]["Content"], Equals, "<p>One</p>")
+	c.Assert(items[0]["Summary"], Equals, "The first item")
+	c.Assert(items[0]["Author"], Equals, "Mike Dewar")
+	c.Assert(items[0]["Published"], Equals, "2014-05-01T14:00:00Z")
+
+	// numeric ids are kept as strings
+	c.Assert(items[1]["ID"], Equals, "2")
+	c.Assert(items[1]["Content"], Equals, "Two")
+	c.Assert(items[1]["Author"], Equals, "Jacqui Maher")
+	c.Assert(items[1]["Categories"], DeepEquals, []interface{}{"news"})
+	c.Assert(items[1]["Feed"].(map[string]interface{})["Title"], Equals, "Test")
+}
@@ -1,8 +1,11 @@
 package tests
 
 import (
+	"compress/gzip"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"syscall"
 	//	"syscall"
 	"time"
@@ -92,3 +95,122 @@ func (s *FromFileSuite) TestFromFile(c *C) {
 		}
 	}
 }
+
+func (s *FromFileSuite) TestFromFileRead(c *C) {
+	log.Println("testing FromFile: read")
+	b, ch := test_utils.NewBlock("testingFileRead", "fromfile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	dir, err := ioutil.TempDir("", "streamtools_test_from_file")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a.log"), []byte("{\"Name\": \"Jacqui Maher\"}\nnot json\n"), 0644)
+	c.Assert(err, IsNil)
+
+	f, err := os.Create(filepath.Join(dir, "b.log"))
+	c.Assert(err, IsNil)
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("{\"Name\": \"Mike Dewar\"}\n{\"Name\": \"Nik Hanselmann\"}"))
+	gz.Close()
+	f.Close()
+
+	ruleMsg := map[string]interface{}{"Filename": filepath.Join(dir, "*.log"), "Mode": "read"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{"Name": "Jacqui Maher"},
+				map[string]interface{}{"data": "not json"},
+				map[string]interface{}{"Name": "Mike Dewar"},
+				map[string]interface{}{"Name": "Nik Hanselmann"},
+			})
+			return
+		}
+	}
+}
+
+func (s *FromFileSuite) TestFromFileFollow(c *C) {
+	log.Println("testing FromFile: follow")
+	b, ch := test_utils.NewBlock("testingFileFollow", "fromfile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	dir, err := ioutil.TempDir("", "streamtools_test_from_file")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "follow.log")
+
+	err = ioutil.WriteFile(name, []byte("skipped\n"), 0644)
+	c.Assert(err, IsNil)
+
+	ruleMsg := map[string]interface{}{
+		"Filename":     name,
+		"Mode":         "follow",
+		"PollInterval": "100ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	appendLine := func(line string) {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+		c.Assert(err, IsNil)
+		f.Write([]byte(line))
+		f.Close()
+	}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		appendLine("one\ntw")
+	})
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		// finish the line, then rotate the file
+		appendLine("o\n")
+		os.Rename(name, name+".1")
+		ioutil.WriteFile(name, []byte("three\nfour\n"), 0644)
+	})
+	time.AfterFunc(time.Duration(2000)*time.Millisecond, func() {
+		// truncate the file
+		ioutil.WriteFile(name, []byte("five\n"), 0644)
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []string
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			received = append(received, message["data"].(string))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(received, DeepEquals, []string{"one", "two", "three", "four", "five"})
+			return
+		}
+	}
+}
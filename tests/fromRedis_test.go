@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type FromRedisSuite struct{}
+
+var fromRedisSuite = Suite(&FromRedisSuite{})
+
+func (s *FromRedisSuite) TestFromRedisList(c *C) {
+	loghub.Start()
+	log.Println("testing FromRedis: list")
+
+	b, ch := test_utils.NewBlock("testingFromRedisList", "fromredis")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Server":   "localhost:6379",
+		"Password": "",
+		"Mode":     "list",
+		"Channels": []string{},
+		"Keys":     []string{"streamtools:test:list"},
+		"Stream":   "",
+		"Group":    "streamtools",
+		"Consumer": "testingFromRedisList",
+		"Count":    float64(10),
+		"Timeout":  "1s",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := redis.Dial("tcp", "localhost:6379")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Do("RPUSH", "streamtools:test:list", `{"a":1}`, "not json")
+	})
+
+	time.AfterFunc(time.Duration(5)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				expected := []interface{}{
+					map[string]interface{}{"a": float64(1)},
+					map[string]interface{}{"data": "not json"},
+				}
+				c.Assert(received, DeepEquals, expected)
+				return
+			}
+		}
+	}
+}
+
+func (s *FromRedisSuite) TestFromRedisSubscribe(c *C) {
+	loghub.Start()
+	log.Println("testing FromRedis: psubscribe")
+
+	b, ch := test_utils.NewBlock("testingFromRedisSubscribe", "fromredis")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Mode":     "psubscribe",
+		"Channels": []string{"streamtools:test:*"},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := redis.Dial("tcp", "localhost:6379")
+		if err != nil {
+			c.Error(err)
+			return
+		}
+		defer conn.Close()
+		conn.Do("PUBLISH", "streamtools:test:news", `{"headline":"hello"}`)
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				expected := []interface{}{
+					map[string]interface{}{"headline": "hello"},
+				}
+				c.Assert(received, DeepEquals, expected)
+				return
+			}
+		}
+	}
+}
+
+func (s *FromRedisSuite) TestFromRedisStream(c *C) {
+	loghub.Start()
+	log.Println("testing FromRedis: stream")
+
+	conn, err := redis.Dial("tcp", "localhost:6379")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	conn.Do("DEL", "streamtools:test:stream")
+
+	b, ch := test_utils.NewBlock("testingFromRedisStream", "fromredis")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Mode":   "stream",
+		"Stream": "streamtools:test:stream",
+		"Group":  "testers",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn.Do("XADD", "streamtools:test:stream", "*", "user", "ann", "event", `{"type":"click"}`)
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				expected := []interface{}{
+					map[string]interface{}{
+						"user":  "ann",
+						"event": map[string]interface{}{"type": "click"},
+					},
+				}
+				c.Assert(received, DeepEquals, expected)
+				// everything read has been acknowledged
+				pending, err := redis.Values(conn.Do("XPENDING", "streamtools:test:stream", "testers"))
+				c.Assert(err, IsNil)
+				c.Assert(pending[0], Equals, int64(0))
+				return
+			}
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package tests
 
 import (
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"time"
 
@@ -24,7 +27,7 @@ func (s *GetHTTPSuite) TestGetHTTP(c *C) {
 		Channel: outChan,
 	}
 
-	ruleMsg := map[string]interface{}{"Path": ".url"}
+	ruleMsg := map[string]interface{}{"Path": ".url", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -71,7 +74,7 @@ func (s *GetHTTPSuite) TestGetHTTPXML(c *C) {
 		Channel: outChan,
 	}
 
-	ruleMsg := map[string]interface{}{"Path": ".url"}
+	ruleMsg := map[string]interface{}{"Path": ".url", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -116,3 +119,105 @@ func (s *GetHTTPSuite) TestGetHTTPXML(c *C) {
 		}
 	}
 }
+
+func (s *GetHTTPSuite) TestGetHTTPUnordered(c *C) {
+	log.Println("testing GetHTTP with unordered concurrent requests")
+	b, ch := test_utils.NewBlock("testingGetHTTPUnordered", "gethttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	// each request takes as long as it asks for
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("d"))
+		time.Sleep(d)
+		fmt.Fprintf(w, `{"d": "%s"}`, d)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"Path": ".url", "Concurrency": float64(2), "MaxQueued": float64(100), "Ordered": false}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for _, d := range []string{"500ms", "100ms", "100ms"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"url": ts.URL + "/?d=" + d}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	var order []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				// the slow request doesn't hold up the two behind it
+				c.Assert(order, DeepEquals, []interface{}{"100ms", "100ms", "500ms"})
+				return
+			}
+		case messageI := <-outChan:
+			order = append(order, messageI.Msg.(map[string]interface{})["d"])
+		}
+	}
+}
+
+func (s *GetHTTPSuite) TestGetHTTPMaxQueued(c *C) {
+	log.Println("testing GetHTTP: MaxQueued")
+	b, ch := test_utils.NewBlock("testingGetHTTPMaxQueued", "gethttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Duration(500) * time.Millisecond)
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"Path": ".url", "Concurrency": float64(1), "MaxQueued": float64(1)}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		for i := 0; i < 4; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"url": ts.URL}, Route: "in"}
+		}
+	})
+
+	// the rest wait to be read rather than in the queue
+	statusChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(700)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: statusChan, Route: "status"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	responses := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				// nothing is lost while the block waits
+				c.Assert(responses, Equals, 4)
+				return
+			}
+		case messageI := <-statusChan:
+			status := messageI.(map[string]interface{})
+			c.Assert(status["InFlight"], Equals, float64(1))
+			c.Assert(status["Queued"], Equals, float64(1))
+		case <-outChan:
+			responses++
+		}
+	}
+}
@@ -2,6 +2,8 @@ package tests
 
 import (
 	"log"
+	"math"
+	"net/url"
 	"reflect"
 	"time"
 
@@ -24,7 +26,14 @@ func (s *HistogramSuite) TestHistogram(c *C) {
 		Channel: outChan,
 	}
 
-	ruleMsg := map[string]interface{}{"Window": "10s", "Path": ".data"}
+	ruleMsg := map[string]interface{}{
+		"Window":      "10s",
+		"Path":        ".data",
+		"Mode":        "discrete",
+		"Compression": 100.0,
+		"Buckets":     []float64{},
+		"Quantiles":   []float64{0.5, 0.9, 0.99},
+	}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -53,3 +62,84 @@ func (s *HistogramSuite) TestHistogram(c *C) {
 		}
 	}
 }
+
+func (s *HistogramSuite) TestHistogramNumeric(c *C) {
+	log.Println("testing Histogram: numeric")
+	b, ch := test_utils.NewBlock("testingHistogramNumeric", "histogram")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Window":      "10s",
+		"Path":        ".latency",
+		"Mode":        "numeric",
+		"Compression": 100.0,
+		"Buckets":     []float64{100, 500},
+		"Quantiles":   []float64{0.5},
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	// the rule and the values arrive on different routes, so give the rule
+	// a head start
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		for i := 1; i <= 1000; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"latency": float64(i)}, Route: "in"}
+		}
+	})
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	quantileChan := make(chan interface{})
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QueryParamChan <- &blocks.QueryParamMsg{
+			Route:    "quantile",
+			RespChan: quantileChan,
+			Params:   url.Values{"q": []string{"0.99"}},
+		}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "poll"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-quantileChan:
+			message := messageI.(map[string]interface{})
+			quantiles := message["Quantiles"].([]interface{})
+			c.Assert(quantiles, HasLen, 1)
+			p99 := quantiles[0].(map[string]interface{})["Value"].(float64)
+			c.Assert(math.Abs(p99-990) < 10, Equals, true)
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["Count"], Equals, 1000.0)
+			buckets := message["Histogram"].([]interface{})
+			c.Assert(buckets, HasLen, 3)
+			last := buckets[2].(map[string]interface{})
+			c.Assert(last["Label"], Equals, ">500")
+			c.Assert(math.Abs(last["Count"].(float64)-500) < 10, Equals, true)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type KafkaSuite struct{}
+
+var kafkaSuite = Suite(&KafkaSuite{})
+
+func (s *KafkaSuite) TestKafkaRoundTrip(c *C) {
+	log.Println("testing toKafka and fromKafka")
+
+	// a new group starts from the oldest offset, so it needs to know which
+	// messages are from this run
+	run := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	toB, toC := test_utils.NewBlock("testingToKafka", "tokafka")
+	go blocks.BlockRoutine(toB)
+	fromB, fromC := test_utils.NewBlock("testingFromKafka", "fromkafka")
+	go blocks.BlockRoutine(fromB)
+
+	toRule := map[string]interface{}{
+		"Brokers":       []string{"localhost:9092"},
+		"Topic":         "librarytest",
+		"KeyPath":       ".user",
+		"Partitioner":   "hash",
+		"BatchSize":     float64(10),
+		"FlushInterval": "100ms",
+		"Acks":          "all",
+	}
+	toC.InChan <- &blocks.Msg{Msg: toRule, Route: "rule"}
+
+	fromRule := map[string]interface{}{
+		"Brokers":        []string{"localhost:9092"},
+		"Topics":         []string{"librarytest"},
+		"Group":          "librarytest-" + run,
+		"StartOffset":    "oldest",
+		"CommitInterval": "1s",
+	}
+	fromC.InChan <- &blocks.Msg{Msg: fromRule, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	fromC.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	toQueryChan := make(blocks.MsgChan)
+	fromQueryChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		toC.QueryChan <- &blocks.QueryMsg{MsgChan: toQueryChan, Route: "rule"}
+		fromC.QueryChan <- &blocks.QueryMsg{MsgChan: fromQueryChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		for i := 0; i < 3; i++ {
+			kafkaMsg := map[string]interface{}{"user": "ann", "run": run, "i": float64(i)}
+			toC.InChan <- &blocks.Msg{Msg: kafkaMsg, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(8)*time.Second, func() {
+		toC.QuitChan <- true
+		fromC.QuitChan <- true
+	})
+
+	var received []float64
+	quit := 0
+	for {
+		select {
+		case messageI := <-toQueryChan:
+			c.Assert(messageI, DeepEquals, toRule)
+		case messageI := <-fromQueryChan:
+			c.Assert(messageI, DeepEquals, fromRule)
+		case message := <-outChan:
+			msg, ok := message.Msg.(map[string]interface{})
+			if ok && msg["run"] == run {
+				received = append(received, msg["i"].(float64))
+			}
+		case err := <-toC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		case err := <-fromC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		}
+		if quit == 2 {
+			// they share a key, so they're on one partition and stay in order
+			c.Assert(received, DeepEquals, []float64{0, 1, 2})
+			return
+		}
+	}
+}
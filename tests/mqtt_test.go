@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type MQTTSuite struct{}
+
+var mqttSuite = Suite(&MQTTSuite{})
+
+func (s *MQTTSuite) TestMQTTRoundTrip(c *C) {
+	log.Println("testing toMQTT and fromMQTT")
+
+	// topics of this run, so retained messages from earlier runs don't count
+	run := strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	fromB, fromC := test_utils.NewBlock("testingFromMQTT", "frommqtt")
+	go blocks.BlockRoutine(fromB)
+	toB, toC := test_utils.NewBlock("testingToMQTT", "tomqtt")
+	go blocks.BlockRoutine(toB)
+
+	fromRule := map[string]interface{}{
+		"Broker":       "tcp://localhost:1883",
+		"ClientID":     "",
+		"Username":     "",
+		"Password":     "",
+		"QoS":          float64(1),
+		"CleanSession": true,
+		"Topics":       []string{"streamtools/" + run + "/+/temperature"},
+		"IncludeTopic": true,
+	}
+	fromC.InChan <- &blocks.Msg{Msg: fromRule, Route: "rule"}
+
+	toRule := map[string]interface{}{
+		"Broker":       "tcp://localhost:1883",
+		"ClientID":     "",
+		"Username":     "",
+		"Password":     "",
+		"QoS":          float64(1),
+		"CleanSession": true,
+		"Topic":        "streamtools/" + run + "/{{.device}}/temperature",
+		"Retained":     false,
+	}
+	toC.InChan <- &blocks.Msg{Msg: toRule, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	fromC.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	fromQueryChan := make(blocks.MsgChan)
+	toQueryChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		fromC.QueryChan <- &blocks.QueryMsg{MsgChan: fromQueryChan, Route: "rule"}
+		toC.QueryChan <- &blocks.QueryMsg{MsgChan: toQueryChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		toC.InChan <- &blocks.Msg{Msg: map[string]interface{}{"device": "kitchen", "value": 21.5}, Route: "in"}
+		// a slash in a value can't add a level to the topic
+		toC.InChan <- &blocks.Msg{Msg: map[string]interface{}{"device": "garden/shed", "value": 9.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(4)*time.Second, func() {
+		fromC.QuitChan <- true
+		toC.QuitChan <- true
+	})
+
+	var received []interface{}
+	quit := 0
+	for {
+		select {
+		case messageI := <-fromQueryChan:
+			c.Assert(messageI, DeepEquals, fromRule)
+		case messageI := <-toQueryChan:
+			c.Assert(messageI, DeepEquals, toRule)
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-fromC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		case err := <-toC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		}
+		if quit == 2 {
+			expected := []interface{}{
+				map[string]interface{}{
+					"Topic":    "streamtools/" + run + "/kitchen/temperature",
+					"Retained": false,
+					"Msg":      map[string]interface{}{"device": "kitchen", "value": 21.5},
+				},
+				map[string]interface{}{
+					"Topic":    "streamtools/" + run + "/garden_shed/temperature",
+					"Retained": false,
+					"Msg":      map[string]interface{}{"device": "garden/shed", "value": 9.0},
+				},
+			}
+			c.Assert(received, DeepEquals, expected)
+			return
+		}
+	}
+}
@@ -26,7 +26,18 @@ func (s *ParseCSVSuite) TestParseCSV(c *C) {
 
 	// where to find the xml in input
 	headers := []string{"name", "email", "phone"}
-	ruleMsg := map[string]interface{}{"Path": ".data", "Headers": headers}
+	ruleMsg := map[string]interface{}{
+		"Path":       ".data",
+		"Headers":    headers,
+		"Mode":       "poll",
+		"HeaderRow":  false,
+		"Summary":    false,
+		"Delimiter":  ",",
+		"Quote":      "\"",
+		"Comment":    "",
+		"Types":      map[string]interface{}{},
+		"TimeFormat": time.RFC3339,
+	}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -92,3 +103,119 @@ func (s *ParseCSVSuite) TestParseCSV(c *C) {
 		}
 	}
 }
+
+func (s *ParseCSVSuite) TestParseCSVStream(c *C) {
+	log.Println("testing ParseCSV: stream")
+	b, ch := test_utils.NewBlock("testingParseCSVStream", "parsecsv")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".data",
+		"Headers":    []string{},
+		"Mode":       "stream",
+		"HeaderRow":  true,
+		"Summary":    true,
+		"Delimiter":  ";",
+		"Quote":      "'",
+		"Comment":    "#",
+		"Types":      map[string]interface{}{"age": "number", "admin": "bool", "joined": "timestamp"},
+		"TimeFormat": "2006-01-02",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	var csvInput = `name;age;admin;joined
+# a comment
+'Maher; Jacqui';34;true;2014-01-02
+'Dewar, ''Mike''';thirty;false;2014-01-03
+`
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"data": csvInput}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var rows []map[string]interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			summaryI, ok := message["Summary"]
+			if !ok {
+				rows = append(rows, message)
+				continue
+			}
+			// the summary comes after every row of the input
+			summary := summaryI.(map[string]interface{})
+			c.Assert(len(rows), Equals, 2)
+			c.Assert(summary["Rows"], Equals, 2.0)
+			c.Assert(summary["Errors"], Equals, 1.0)
+			c.Assert(rows[0]["name"], Equals, "Maher; Jacqui")
+			c.Assert(rows[0]["age"], Equals, 34.0)
+			c.Assert(rows[0]["admin"], Equals, true)
+			c.Assert(rows[0]["joined"], Equals, 1388620800000.0)
+			c.Assert(rows[1]["name"], Equals, "Dewar, 'Mike'")
+			// fields that can't be coerced are left as strings
+			c.Assert(rows[1]["age"], Equals, "thirty")
+			c.Assert(rows[1]["admin"], Equals, false)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(len(rows), Equals, 2)
+				return
+			}
+		}
+	}
+}
+
+func (s *ParseCSVSuite) TestParseCSVBadRule(c *C) {
+	log.Println("testing ParseCSV: a bad rule changes nothing")
+	b, ch := test_utils.NewBlock("testingParseCSVBadRule", "parsecsv")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{"Path": ".data", "Headers": []string{"a", "b"}, "Mode": "poll", "Delimiter": ","}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// everything is fine but the types
+	badRuleMsg := map[string]interface{}{"Path": ".csv", "Headers": []string{"c"}, "Mode": "stream", "Delimiter": ";", "Types": map[string]interface{}{"c": "date"}}
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: badRuleMsg, Route: "rule"}
+	})
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	queried := false
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(queried, Equals, true)
+			return
+		case messageI := <-queryOutChan:
+			queried = true
+			rule := messageI.(map[string]interface{})
+			c.Assert(rule["Path"], Equals, ".data")
+			c.Assert(rule["Headers"], DeepEquals, []string{"a", "b"})
+			c.Assert(rule["Mode"], Equals, "poll")
+			c.Assert(rule["Delimiter"], Equals, ",")
+		}
+	}
+}
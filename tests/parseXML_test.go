@@ -25,7 +25,14 @@ func (s *ParseXMLSuite) TestParseXML(c *C) {
 	}
 
 	// where to find the xml in input
-	ruleMsg := map[string]interface{}{"Path": ".data"}
+	ruleMsg := map[string]interface{}{
+		"Path":       ".data",
+		"Attributes": "merge",
+		"AttrPrefix": "-",
+		"Namespaces": false,
+		"ForceArray": []string{},
+		"XPath":      "",
+	}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -74,3 +81,83 @@ func (s *ParseXMLSuite) TestParseXML(c *C) {
 		}
 	}
 }
+
+func (s *ParseXMLSuite) TestParseXMLXPath(c *C) {
+	log.Println("testing ParseXML with XPath")
+	b, ch := test_utils.NewBlock("testingParseXMLXPath", "parsexml")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Path":       ".data",
+		"Attributes": "nested",
+		"Namespaces": true,
+		"ForceArray": []interface{}{"category"},
+		"XPath":      "/rss/channel/item[@type='news']",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	var xmldata = `<?xml version="1.0" encoding="utf-8"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <channel>
+    <title>Example</title>
+    <item type="news">
+      <title>First</title>
+      <dc:creator>Ada</dc:creator>
+      <category>science</category>
+    </item>
+    <item type="ad">
+      <title>Skip me</title>
+    </item>
+    <item type="news">
+      <title>Second</title>
+      <category>arts</category>
+      <category>books</category>
+    </item>
+  </channel>
+</rss>`
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"data": xmldata}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := []interface{}{
+		map[string]interface{}{
+			"item": map[string]interface{}{
+				"#attributes": map[string]interface{}{"type": "news"},
+				"title":       "First",
+				"dc:creator":  "Ada",
+				"category":    []interface{}{"science"},
+			},
+		},
+		map[string]interface{}{
+			"item": map[string]interface{}{
+				"#attributes": map[string]interface{}{"type": "news"},
+				"title":       "Second",
+				"category":    []interface{}{"arts", "books"},
+			},
+		},
+	}
+	var items []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(items, DeepEquals, expected)
+				return
+			}
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg)
+		}
+	}
+}
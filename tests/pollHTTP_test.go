@@ -0,0 +1,297 @@
+package tests
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type PollHTTPSuite struct{}
+
+var pollHTTPSuite = Suite(&PollHTTPSuite{})
+
+func (s *PollHTTPSuite) TestPollHTTPCursor(c *C) {
+	log.Println("testing PollHTTP with cursor pagination")
+	b, ch := test_utils.NewBlock("testingPollHTTPCursor", "pollhttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	var lock sync.Mutex
+	requests := 0
+	notModified := 0
+	var throttledAt, retriedAt time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		// the first request is throttled
+		if requests == 1 {
+			throttledAt = time.Now()
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(429)
+			return
+		}
+		if r.Header.Get("X-Token") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if requests == 2 {
+			retriedAt = time.Now()
+		}
+		switch r.URL.Query().Get("page") {
+		case "":
+			if r.Header.Get("If-None-Match") == `"1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"1"`)
+			fmt.Fprint(w, `{"results": {"items": [{"n": 1}, {"n": 2}]}, "next": "two"}`)
+		case "two":
+			fmt.Fprint(w, `{"results": {"items": [{"n": 3}]}, "next": null}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{
+		"URL":         ts.URL,
+		"Interval":    "500ms",
+		"Headers":     map[string]interface{}{"X-Token": "secret"},
+		"ItemsPath":   ".results.items",
+		"Pagination":  "cursor",
+		"CursorPath":  ".next",
+		"CursorParam": "page",
+		"MaxPages":    float64(5),
+		"MaxBackoff":  "1m0s",
+		"Timeout":     "5s",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var items []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(items, DeepEquals, []interface{}{float64(1), float64(2), float64(3)})
+				lock.Lock()
+				// the retry waits out the doubled interval
+				c.Assert(retriedAt.Sub(throttledAt) >= 900*time.Millisecond, Equals, true)
+				c.Assert(notModified > 0, Equals, true)
+				lock.Unlock()
+				return
+			}
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg.(map[string]interface{})["n"])
+		}
+	}
+}
+
+func (s *PollHTTPSuite) TestPollHTTPLink(c *C) {
+	log.Println("testing PollHTTP with Link header pagination")
+	b, ch := test_utils.NewBlock("testingPollHTTPLink", "pollhttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Link", `</page/2>; rel="next", </page/2>; rel="last"`)
+			fmt.Fprint(w, `[{"n": 1}]`)
+		case "/page/2":
+			fmt.Fprint(w, `[{"n": 2}]`)
+		}
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{
+		"URL":        ts.URL + "/",
+		"Interval":   "1h",
+		"ItemsPath":  ".",
+		"Pagination": "link",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var items []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(items, DeepEquals, []interface{}{float64(1), float64(2)})
+				return
+			}
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg.(map[string]interface{})["n"])
+		}
+	}
+}
+
+func (s *PollHTTPSuite) TestPollHTTPFailedPage(c *C) {
+	log.Println("testing PollHTTP when a later page fails")
+	b, ch := test_utils.NewBlock("testingPollHTTPFailedPage", "pollhttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	var lock sync.Mutex
+	pageTwo := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Query().Get("page") {
+		case "":
+			if r.Header.Get("If-None-Match") == `"1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"1"`)
+			fmt.Fprint(w, `{"items": [{"n": 1}], "next": "two"}`)
+		case "two":
+			// the second page isn't there the first time
+			pageTwo++
+			if pageTwo == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, `{"items": [{"n": 2}], "next": null}`)
+		}
+	}))
+	defer ts.Close()
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"URL":         ts.URL,
+		"Interval":    "200ms",
+		"ItemsPath":   ".items",
+		"Pagination":  "cursor",
+		"CursorPath":  ".next",
+		"CursorParam": "page",
+	}, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	// the ETag isn't kept until the whole poll has worked, so the first page
+	// is fetched again rather than skipped as not modified
+	var items []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(items, DeepEquals, []interface{}{float64(1), float64(1), float64(2)})
+				return
+			}
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg.(map[string]interface{})["n"])
+		}
+	}
+}
+
+func (s *PollHTTPSuite) TestPollHTTPTimeout(c *C) {
+	log.Println("testing PollHTTP with a server that doesn't answer")
+	b, ch := test_utils.NewBlock("testingPollHTTPTimeout", "pollhttp")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests++
+		first := requests == 1
+		lock.Unlock()
+		// the first request hangs for longer than the timeout
+		if first {
+			time.Sleep(time.Duration(2) * time.Second)
+		}
+		fmt.Fprint(w, `{"n": 1}`)
+	}))
+	defer ts.Close()
+
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"URL":      ts.URL,
+		"Interval": "100ms",
+		"Timeout":  "500ms",
+	}, Route: "rule"}
+
+	// the block still answers while the request hangs
+	queryOutChan := make(blocks.MsgChan)
+	var queried time.Time
+	time.AfterFunc(time.Duration(200)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	start := time.Now()
+	var items []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(queried.Sub(start) < 500*time.Millisecond, Equals, true)
+				// the hung request is given up on and the next poll works
+				c.Assert(len(items) > 0, Equals, true)
+				c.Assert(items[0], DeepEquals, map[string]interface{}{"n": float64(1)})
+				return
+			}
+		case messageI := <-queryOutChan:
+			queried = time.Now()
+			c.Assert(messageI.(map[string]interface{})["Timeout"], Equals, "500ms")
+		case messageI := <-outChan:
+			items = append(items, messageI.Msg)
+		}
+	}
+}
@@ -23,7 +23,7 @@ func (s *RedisSuite) TestRedisSADD(c *C) {
 	go blocks.BlockRoutine(b)
 
 	m := []string{"'foobar'", "'baz'"}
-	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "SADD", "Arguments": m}
+	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "SADD", "Arguments": m, "Commands": []interface{}{}, "BatchSize": float64(1), "FlushInterval": "1s", "ReplyPath": ""}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -69,7 +69,7 @@ func (s *RedisSuite) TestRedisSMEMBERS(c *C) {
 	go blocks.BlockRoutine(b)
 
 	m := []string{"'foobar'"}
-	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "SMEMBERS", "Arguments": m}
+	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "SMEMBERS", "Arguments": m, "Commands": []interface{}{}, "BatchSize": float64(1), "FlushInterval": "1s", "ReplyPath": ""}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -116,7 +116,7 @@ func (s *RedisSuite) TestRedisDBSIZE(c *C) {
 	go blocks.BlockRoutine(b)
 
 	var args = make([]string, 0, 10)
-	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "DBSIZE", "Arguments": args}
+	ruleMsg := map[string]interface{}{"Server": "localhost:6379", "Password": "", "Command": "DBSIZE", "Arguments": args, "Commands": []interface{}{}, "BatchSize": float64(1), "FlushInterval": "1s", "ReplyPath": ""}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -153,3 +153,62 @@ func (s *RedisSuite) TestRedisDBSIZE(c *C) {
 		}
 	}
 }
+
+func (s *RedisSuite) TestRedisPipeline(c *C) {
+	loghub.Start()
+	log.Println("testing Redis: pipelined INCR and EXPIRE")
+
+	b, ch := test_utils.NewBlock("testingRedisPipeline", "redis")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Server":   "localhost:6379",
+		"Password": "",
+		"Commands": []interface{}{
+			map[string]interface{}{"Command": "INCR", "Arguments": []interface{}{".key"}},
+			map[string]interface{}{"Command": "EXPIRE", "Arguments": []interface{}{".key", "60"}},
+		},
+		"BatchSize": float64(2),
+		"ReplyPath": ".counter.reply",
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 2; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"key": "streamtools:test:pipeline", "i": float64(i)}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []map[string]interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			received = append(received, messageI.Msg.(map[string]interface{}))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(received, HasLen, 2)
+				for i, message := range received {
+					c.Assert(message["i"], Equals, float64(i))
+					reply := message["counter"].(map[string]interface{})["reply"].([]interface{})
+					c.Assert(reply, HasLen, 2)
+					c.Assert(reply[0], FitsTypeOf, float64(0))
+					c.Assert(reply[1], Equals, float64(1))
+				}
+				// the replies are in the order the messages came in
+				c.Assert(received[1]["counter"].(map[string]interface{})["reply"].([]interface{})[0], Equals,
+					received[0]["counter"].(map[string]interface{})["reply"].([]interface{})[0].(float64)+1)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SampleSuite struct{}
+
+var sampleSuite = Suite(&SampleSuite{})
+
+func (s *SampleSuite) TestSampleHash(c *C) {
+	loghub.Start()
+	log.Println("testing Sample: hash")
+	b, ch := test_utils.NewBlock("testingSampleHash", "sample")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Mode":        "hash",
+		"Probability": 0.5,
+		"KeyPath":     ".user",
+		"Size":        100.0,
+		"Window":      "0",
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	users := []string{"ann", "bob", "cat", "dan", "eve", "fay", "gus", "hal"}
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 3; i++ {
+			for _, user := range users {
+				ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"user": user}, Route: "in"}
+			}
+		}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	kept := map[string]int{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			kept[message["user"].(string)]++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				// every event for a user is either kept or dropped
+				for _, n := range kept {
+					c.Assert(n, Equals, 3)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (s *SampleSuite) TestSampleReservoir(c *C) {
+	log.Println("testing Sample: reservoir")
+	b, ch := test_utils.NewBlock("testingSampleReservoir", "sample")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Mode":        "reservoir",
+		"Probability": 0.1,
+		"KeyPath":     "",
+		"Size":        5.0,
+		"Window":      "0",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 50; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": float64(i)}, Route: "in"}
+		}
+	})
+
+	sampleChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: sampleChan, Route: "sample"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case messageI := <-sampleChan:
+			message := messageI.(map[string]interface{})
+			c.Assert(message["Sample"], HasLen, 5)
+			c.Assert(message["Seen"], Equals, 50.0)
+		case <-outChan:
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				return
+			}
+		}
+	}
+}
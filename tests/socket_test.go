@@ -0,0 +1,241 @@
+package tests
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SocketSuite struct{}
+
+var socketSuite = Suite(&SocketSuite{})
+
+func (s *SocketSuite) TestTCPRoundTrip(c *C) {
+	log.Println("testing toTCP and fromTCP")
+
+	fromB, fromC := test_utils.NewBlock("testingFromTCP", "fromtcp")
+	go blocks.BlockRoutine(fromB)
+	toB, toC := test_utils.NewBlock("testingToTCP", "totcp")
+	go blocks.BlockRoutine(toB)
+
+	fromRule := map[string]interface{}{
+		"Address":           "127.0.0.1:27016",
+		"Framing":           "length",
+		"MaxSize":           float64(1024),
+		"IncludeConnection": false,
+	}
+	fromC.InChan <- &blocks.Msg{Msg: fromRule, Route: "rule"}
+
+	toRule := map[string]interface{}{
+		"Address":           "127.0.0.1:27016",
+		"Framing":           "length",
+		"ReconnectInterval": "100ms",
+	}
+	toC.InChan <- &blocks.Msg{Msg: toRule, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	fromC.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	fromQueryChan := make(blocks.MsgChan)
+	toQueryChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		fromC.QueryChan <- &blocks.QueryMsg{MsgChan: fromQueryChan, Route: "rule"}
+		toC.QueryChan <- &blocks.QueryMsg{MsgChan: toQueryChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		toC.InChan <- &blocks.Msg{Msg: map[string]interface{}{"line": "one\ntwo"}, Route: "in"}
+	})
+	// restarting fromTCP drops the connection, which toTCP should notice
+	// and make again
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		fromC.InChan <- &blocks.Msg{Msg: fromRule, Route: "rule"}
+	})
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		toC.InChan <- &blocks.Msg{Msg: map[string]interface{}{"line": "three"}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(4)*time.Second, func() {
+		fromC.QuitChan <- true
+		toC.QuitChan <- true
+	})
+
+	var received []interface{}
+	quit := 0
+	for {
+		select {
+		case messageI := <-fromQueryChan:
+			c.Assert(messageI, DeepEquals, fromRule)
+		case messageI := <-toQueryChan:
+			c.Assert(messageI, DeepEquals, toRule)
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-fromC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		case err := <-toC.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			quit++
+		}
+		if quit == 2 {
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{"line": "one\ntwo"},
+				map[string]interface{}{"line": "three"},
+			})
+			return
+		}
+	}
+}
+
+func (s *SocketSuite) TestFromUnix(c *C) {
+	log.Println("testing fromUnix")
+
+	dir, err := ioutil.TempDir("", "streamtools_test_from_unix")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	address := filepath.Join(dir, "test.sock")
+
+	b, ch := test_utils.NewBlock("testingFromUnix", "fromunix")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Address":           address,
+		"Framing":           "newline",
+		"MaxSize":           float64(64),
+		"IncludeConnection": true,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := net.Dial("unix", address)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("{\"a\":1}\r\n\n" + strings.Repeat("x", 100) + "\nnot json"))
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// the line longer than MaxSize is skipped
+			connection := map[string]interface{}{
+				"ID":         "unix:1",
+				"LocalAddr":  address,
+				"RemoteAddr": "",
+			}
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"Connection": connection,
+					"Msg":        map[string]interface{}{"a": 1.0},
+				},
+				map[string]interface{}{
+					"Connection": connection,
+					"Msg":        map[string]interface{}{"data": "not json"},
+				},
+			})
+			// the socket file is cleaned up once the block has shut down
+			deadline := time.Now().Add(time.Duration(1) * time.Second)
+			for {
+				_, err = os.Stat(address)
+				if os.IsNotExist(err) || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(time.Duration(10) * time.Millisecond)
+			}
+			c.Assert(os.IsNotExist(err), Equals, true)
+			return
+		}
+	}
+}
+
+func (s *SocketSuite) TestFromUDPMaxSize(c *C) {
+	log.Println("testing fromUDP: MaxSize")
+
+	b, ch := test_utils.NewBlock("testingFromUDP", "fromudp")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"ConnectionString": "127.0.0.1:27017",
+		"MaxSize":          float64(4096),
+		"MulticastGroup":   "",
+		"Interface":        "",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	// longer than the old limit of 1024 bytes
+	long := strings.Repeat("x", 2000)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := net.Dial("udp", "127.0.0.1:27017")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(long))
+		// longer than MaxSize, so it's skipped rather than cut short
+		conn.Write([]byte(strings.Repeat("y", 5000)))
+		conn.Write([]byte("short"))
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			c.Assert(messageI, DeepEquals, ruleMsg)
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{"data": long},
+				map[string]interface{}{"data": "short"},
+			})
+			return
+		}
+	}
+}
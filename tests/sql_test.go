@@ -0,0 +1,299 @@
+package tests
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SQLSuite struct{}
+
+var sqlSuite = Suite(&SQLSuite{})
+
+func (s *SQLSuite) TestToSQLUpsert(c *C) {
+	log.Println("testing toSQL: upsert")
+
+	dir, err := ioutil.TempDir("", "streamtools_test_to_sql")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	dataSource := filepath.Join(dir, "test.db")
+
+	db, err := sql.Open("sqlite3", dataSource)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE counts (name TEXT PRIMARY KEY, count REAL, tags TEXT)")
+	c.Assert(err, IsNil)
+
+	b, ch := test_utils.NewBlock("testingToSQL", "tosql")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Driver":     "sqlite3",
+		"DataSource": dataSource,
+		"Table":      "counts",
+		"Columns": map[string]interface{}{
+			"name":  ".name",
+			"count": ".count",
+			"tags":  ".tags",
+		},
+		"Mode":          "upsert",
+		"KeyColumns":    []string{"name"},
+		"BatchSize":     float64(10),
+		"FlushInterval": "100ms",
+		"Retries":       float64(3),
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "a", "count": 1.0, "tags": []interface{}{"x"}}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "b", "count": 2.0}, Route: "in"}
+		// likely in the same batch as the first row for a, which it replaces
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "a", "count": 3.0}, Route: "in"}
+	})
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		// a later batch updates a again
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "a", "count": 4.0, "tags": []interface{}{"y", "z"}}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			c.Assert(messageI, DeepEquals, ruleMsg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			rows, err := db.Query("SELECT name, count, tags FROM counts ORDER BY name")
+			c.Assert(err, IsNil)
+			defer rows.Close()
+			type count struct {
+				name  string
+				count float64
+				tags  sql.NullString
+			}
+			var counts []count
+			for rows.Next() {
+				var row count
+				c.Assert(rows.Scan(&row.name, &row.count, &row.tags), IsNil)
+				counts = append(counts, row)
+			}
+			c.Assert(counts, DeepEquals, []count{
+				{"a", 4, sql.NullString{String: `["y","z"]`, Valid: true}},
+				{"b", 2, sql.NullString{}},
+			})
+			return
+		}
+	}
+}
+
+func (s *SQLSuite) TestToSQLWriteFailed(c *C) {
+	log.Println("testing toSQL: rows that can't be written")
+
+	dir, err := ioutil.TempDir("", "streamtools_test_to_sql")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	dataSource := filepath.Join(dir, "test.db")
+
+	db, err := sql.Open("sqlite3", dataSource)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	// rows without a name can't be written
+	_, err = db.Exec("CREATE TABLE counts (name TEXT NOT NULL, count REAL)")
+	c.Assert(err, IsNil)
+
+	b, ch := test_utils.NewBlock("testingToSQLWriteFailed", "tosql")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Driver":     "sqlite3",
+		"DataSource": dataSource,
+		"Table":      "counts",
+		"Columns": map[string]interface{}{
+			"name":  ".name",
+			"count": ".count",
+		},
+		"BatchSize":     float64(2),
+		"FlushInterval": "100ms",
+		"Retries":       float64(2),
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// the bad row fails the batch, but shouldn't stop the good one in it
+	// being written
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"count": 1.0}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "a", "count": 2.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var failed []map[string]interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			failed = append(failed, messageI.Msg.(map[string]interface{}))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// the row is tried three times before it's given up on
+			c.Assert(len(failed), Equals, 1)
+			c.Assert(failed[0]["Event"], Equals, "WriteFailed")
+			c.Assert(failed[0]["Msg"], DeepEquals, map[string]interface{}{"count": 1.0})
+			c.Assert(strings.HasSuffix(failed[0]["Error"].(string), "(gave up after 3 attempts)"), Equals, true)
+			var name string
+			c.Assert(db.QueryRow("SELECT name FROM counts").Scan(&name), IsNil)
+			c.Assert(name, Equals, "a")
+			return
+		}
+	}
+}
+
+func (s *SQLSuite) TestToSQLTooManyColumns(c *C) {
+	log.Println("testing toSQL: more columns than a statement can take")
+	b, ch := test_utils.NewBlock("testingToSQLTooManyColumns", "tosql")
+	go blocks.BlockRoutine(b)
+
+	columns := make(map[string]interface{})
+	for i := 0; i < 1000; i++ {
+		columns["c"+strconv.Itoa(i)] = ".c"
+	}
+	ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{
+		"Driver":     "sqlite3",
+		"DataSource": ":memory:",
+		"Table":      "wide",
+		"Columns":    columns,
+	}, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			// the rule is rejected, rather than hanging the first batch
+			rule := messageI.(map[string]interface{})
+			c.Assert(rule["Table"], Equals, "")
+			c.Assert(rule["Columns"], DeepEquals, map[string]interface{}{})
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			return
+		}
+	}
+}
+
+func (s *SQLSuite) TestSQLQuery(c *C) {
+	log.Println("testing sqlQuery")
+
+	dir, err := ioutil.TempDir("", "streamtools_test_sql_query")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	dataSource := filepath.Join(dir, "test.db")
+
+	db, err := sql.Open("sqlite3", dataSource)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	_, err = db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, team TEXT)")
+	c.Assert(err, IsNil)
+	_, err = db.Exec("INSERT INTO users (id, name, team) VALUES (1, 'ann', 'red'), (2, 'bob', 'blue'), (3, 'cat', 'red')")
+	c.Assert(err, IsNil)
+
+	b, ch := test_utils.NewBlock("testingSQLQuery", "sqlquery")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Driver":     "sqlite3",
+		"DataSource": dataSource,
+		"Query":      "SELECT id, name FROM users WHERE team = ? ORDER BY id",
+		"Arguments":  []string{".team"},
+		"ResultPath": ".lookup.users",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"team": "red"}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"team": "green"}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			c.Assert(messageI, DeepEquals, ruleMsg)
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"team": "red",
+					"lookup": map[string]interface{}{
+						"users": []interface{}{
+							map[string]interface{}{"id": float64(1), "name": "ann"},
+							map[string]interface{}{"id": float64(3), "name": "cat"},
+						},
+					},
+				},
+				map[string]interface{}{
+					"team": "green",
+					"lookup": map[string]interface{}{
+						"users": []interface{}{},
+					},
+				},
+			})
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SwitchSuite struct{}
+
+var switchSuite = Suite(&SwitchSuite{})
+
+func (s *SwitchSuite) TestSwitch(c *C) {
+	loghub.Start()
+	log.Println("testing Switch")
+	b, ch := test_utils.NewBlock("testingSwitch", "switch")
+	go blocks.BlockRoutine(b)
+	// each route gets its own connection
+	outChans := map[string]chan *blocks.Msg{}
+	for _, route := range []string{"1", "2", "3"} {
+		outChans[route] = make(chan *blocks.Msg)
+		ch.AddChan <- &blocks.AddChanMsg{
+			Route:     "out" + route,
+			Channel:   outChans[route],
+			FromRoute: route,
+		}
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Cases": []interface{}{
+			map[string]interface{}{"Route": "1", "Filter": ".error"},
+			map[string]interface{}{"Route": "2", "Filter": ".slow"},
+		},
+		"Mode":    "first",
+		"Default": "3",
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"error": true, "slow": true}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"error": false, "slow": true}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"error": false, "slow": false}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	received := map[string][]interface{}{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case message := <-outChans["1"]:
+			received["1"] = append(received["1"], message.Msg)
+		case message := <-outChans["2"]:
+			received["2"] = append(received["2"], message.Msg)
+		case message := <-outChans["3"]:
+			received["3"] = append(received["3"], message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(received, DeepEquals, map[string][]interface{}{
+					"1": {map[string]interface{}{"error": true, "slow": true}},
+					"2": {map[string]interface{}{"error": false, "slow": true}},
+					"3": {map[string]interface{}{"error": false, "slow": false}},
+				})
+				return
+			}
+		}
+	}
+}
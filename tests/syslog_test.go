@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type SyslogSuite struct{}
+
+var syslogSuite = Suite(&SyslogSuite{})
+
+func (s *SyslogSuite) TestFromSyslogUDP(c *C) {
+	log.Println("testing fromSyslog: UDP")
+
+	b, ch := test_utils.NewBlock("testingFromSyslogUDP", "fromsyslog")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Address":  "127.0.0.1:27514",
+		"Protocol": "udp",
+		"MaxSize":  float64(2048),
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	localAddr := make(chan string, 1)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := net.Dial("udp", "127.0.0.1:27514")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close()
+		localAddr <- conn.LocalAddr().String()
+		conn.Write([]byte(`<165>1 2003-10-11T22:14:15.003-07:00 mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"][examplePriority@32473 class="high \"x\"\]"] ` + "\xef\xbb\xbfAn application event log entry"))
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			c.Assert(messageI, DeepEquals, ruleMsg)
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			remoteAddr := <-localAddr
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"Priority":     float64(165),
+					"Facility":     float64(20),
+					"FacilityName": "local4",
+					"Severity":     float64(5),
+					"SeverityName": "notice",
+					"Version":      float64(1),
+					"Timestamp":    "2003-10-12T05:14:15.003Z",
+					"Hostname":     "mymachine.example.com",
+					"AppName":      "evntslog",
+					"MsgID":        "ID47",
+					"StructuredData": map[string]interface{}{
+						"exampleSDID@32473": map[string]interface{}{
+							"iut":         "3",
+							"eventSource": "Application",
+						},
+						"examplePriority@32473": map[string]interface{}{
+							"class": `high "x"]`,
+						},
+					},
+					"Message":    "An application event log entry",
+					"RemoteAddr": remoteAddr,
+				},
+			})
+			return
+		}
+	}
+}
+
+func (s *SyslogSuite) TestFromSyslogTCP(c *C) {
+	log.Println("testing fromSyslog: TCP")
+
+	b, ch := test_utils.NewBlock("testingFromSyslogTCP", "fromsyslog")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Address":  "127.0.0.1:27515",
+		"Protocol": "tcp",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "1", Channel: outChan}
+
+	// RFC 3164 timestamps have no year or time zone
+	stamp := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	localAddr := make(chan string, 1)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:27515")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer conn.Close()
+		localAddr <- conn.LocalAddr().String()
+		first := "<34>" + stamp.Format(time.Stamp) + " mymachine su[123]: 'su root' failed\non /dev/pts/8"
+		// octet counted, then newline framed
+		conn.Write([]byte(strconv.Itoa(len(first)) + " " + first + "<13>no header here\n"))
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var received []interface{}
+	for {
+		select {
+		case message := <-outChan:
+			received = append(received, message.Msg)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			remoteAddr := <-localAddr
+			c.Assert(received, DeepEquals, []interface{}{
+				map[string]interface{}{
+					"Priority":     float64(34),
+					"Facility":     float64(4),
+					"FacilityName": "auth",
+					"Severity":     float64(2),
+					"SeverityName": "crit",
+					"Timestamp":    stamp.UTC().Format(time.RFC3339Nano),
+					"Hostname":     "mymachine",
+					"AppName":      "su",
+					"ProcID":       "123",
+					"Message":      "'su root' failed\non /dev/pts/8",
+					"RemoteAddr":   remoteAddr,
+				},
+				map[string]interface{}{
+					"Priority":     float64(13),
+					"Facility":     float64(1),
+					"FacilityName": "user",
+					"Severity":     float64(5),
+					"SeverityName": "notice",
+					"Message":      "no header here",
+					"RemoteAddr":   remoteAddr,
+				},
+			})
+			return
+		}
+	}
+}
@@ -0,0 +1,145 @@
+//go:build ignore
+
+// reference writes the Parquet files the tests read with the Apache Arrow Go
+// implementation, and checks that files the toParquet block writes can be
+// read by it. It has its own dependencies, so run it from a module of its
+// own:
+//
+//	go mod init reference && go get github.com/apache/arrow-go/v18@v18.8.0
+//	go run reference.go write
+//	go run reference.go check toparquet.parquet
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+	"github.com/apache/arrow-go/v18/parquet"
+	"github.com/apache/arrow-go/v18/parquet/compress"
+	"github.com/apache/arrow-go/v18/parquet/pqarrow"
+)
+
+// rows builds the ten rows every reference file holds.
+func rows() arrow.RecordBatch {
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "sensor", Type: arrow.BinaryTypes.String},
+		{Name: "count", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "total", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+		{Name: "ratio", Type: arrow.PrimitiveTypes.Float32},
+		{Name: "score", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "ok", Type: arrow.FixedWidthTypes.Boolean},
+		{Name: "note", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer b.Release()
+	for i := 0; i < 10; i++ {
+		b.Field(0).(*array.StringBuilder).Append([]string{"a", "b", "c"}[i%3])
+		b.Field(1).(*array.Int32Builder).Append(int32(i))
+		if i%4 == 3 {
+			b.Field(2).AppendNull()
+		} else {
+			b.Field(2).(*array.Int64Builder).Append(int64(i) * 1000000000)
+		}
+		b.Field(3).(*array.Float32Builder).Append(float32(i) / 4)
+		if i%3 == 1 {
+			b.Field(4).AppendNull()
+		} else {
+			b.Field(4).(*array.Float64Builder).Append(float64(i) * 1.5)
+		}
+		b.Field(5).(*array.BooleanBuilder).Append(i%3 == 0)
+		if i == 9 {
+			b.Field(6).(*array.StringBuilder).Append("last")
+		} else {
+			b.Field(6).AppendNull()
+		}
+	}
+	return b.NewRecordBatch()
+}
+
+func write(filename string, props ...parquet.WriterProperty) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rec := rows()
+	defer rec.Release()
+	w, err := pqarrow.NewFileWriter(rec.Schema(), f, parquet.NewWriterProperties(props...), pqarrow.DefaultWriterProps())
+	if err != nil {
+		return err
+	}
+	if err := w.Write(rec); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// check reads filename and compares its rows with the reference rows.
+func check(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	table, err := pqarrow.ReadTable(context.Background(), f, parquet.NewReaderProperties(memory.DefaultAllocator), pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+	if err != nil {
+		return err
+	}
+	defer table.Release()
+	var got bytes.Buffer
+	r := array.NewTableReader(table, 0)
+	defer r.Release()
+	for r.Next() {
+		if err := array.RecordToJSON(r.RecordBatch(), &got); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	rec := rows()
+	defer rec.Release()
+	var want bytes.Buffer
+	if err := array.RecordToJSON(rec, &want); err != nil {
+		return err
+	}
+	if got.String() != want.String() {
+		return fmt.Errorf("%s has the wrong rows:\n%s", filename, got.String())
+	}
+	fmt.Println(filename, "ok")
+	return nil
+}
+
+func main() {
+	var err error
+	switch {
+	case len(os.Args) == 2 && os.Args[1] == "write":
+		// dictionary encoding and several row groups, as most writers do
+		err = write("arrow_v1_snappy.parquet",
+			parquet.WithCompression(compress.Codecs.Snappy),
+			parquet.WithDataPageVersion(parquet.DataPageV1),
+			parquet.WithMaxRowGroupLength(4))
+		if err == nil {
+			err = write("arrow_v2_gzip.parquet",
+				parquet.WithCompression(compress.Codecs.Gzip),
+				parquet.WithDataPageVersion(parquet.DataPageV2))
+		}
+		if err == nil {
+			err = write("arrow_plain.parquet",
+				parquet.WithDictionaryDefault(false))
+		}
+	case len(os.Args) == 3 && os.Args[1] == "check":
+		err = check(os.Args[2])
+	default:
+		err = fmt.Errorf("usage: reference write | reference check <file>")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
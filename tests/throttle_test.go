@@ -0,0 +1,176 @@
+package tests
+
+import (
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ThrottleSuite struct{}
+
+var throttleSuite = Suite(&ThrottleSuite{})
+
+func (s *ThrottleSuite) TestThrottleDrop(c *C) {
+	loghub.Start()
+	log.Println("testing Throttle: drop")
+	b, ch := test_utils.NewBlock("testingThrottleDrop", "throttle")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Rate":       0.1,
+		"Burst":      2.0,
+		"Mode":       "drop",
+		"KeyPath":    "",
+		"SampleRate": 0.1,
+		"MaxQueue":   1000.0,
+	}
+	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+	ch.InChan <- toRule
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 5; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": float64(i)}, Route: "in"}
+		}
+	})
+
+	tokensChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: tokensChan, Route: "tokens"}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	emitted := 0
+	for {
+		select {
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-tokensChan:
+			message := messageI.(map[string]interface{})
+			c.Assert(message["Dropped"], Equals, 3.0)
+			c.Assert(message["Queued"], Equals, 0.0)
+		case <-outChan:
+			emitted++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(emitted, Equals, 2)
+				return
+			}
+		}
+	}
+}
+
+func (s *ThrottleSuite) TestThrottleDelay(c *C) {
+	log.Println("testing Throttle: delay")
+	b, ch := test_utils.NewBlock("testingThrottleDelay", "throttle")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{"Rate": 10.0, "Burst": 1.0, "Mode": "delay", "KeyPath": ".user"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 5; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"user": "a", "i": float64(i)}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(3)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := 0.0
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			// delayed messages keep their order
+			c.Assert(message["i"], Equals, expected)
+			expected++
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(expected, Equals, 5.0)
+				return
+			}
+		}
+	}
+}
+
+func (s *ThrottleSuite) TestThrottleRuleChange(c *C) {
+	log.Println("testing Throttle: rule change while delaying")
+	b, ch := test_utils.NewBlock("testingThrottleRuleChange", "throttle")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	// KeyPath can be left out
+	ruleMsg := map[string]interface{}{"Rate": 2.0, "Burst": 1.0, "Mode": "delay"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 5; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": float64(i)}, Route: "in"}
+		}
+	})
+	// the messages still waiting are released at the rate rather than all
+	// at once
+	time.AfterFunc(time.Duration(1200)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"Rate": 2.0, "Burst": 1.0, "Mode": "drop"}, Route: "rule"}
+	})
+
+	var received []time.Time
+	time.AfterFunc(time.Duration(4)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	expected := 0.0
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["i"], Equals, expected)
+			expected++
+			received = append(received, time.Now())
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(expected, Equals, 5.0)
+				// four waits of half a second after the first
+				c.Assert(received[4].Sub(received[0]) > time.Duration(1500)*time.Millisecond, Equals, true)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/test_utils"
+	. "launchpad.net/gocheck"
+)
+
+type ToElasticsearchSuite struct{}
+
+var toElasticsearchSuite = Suite(&ToElasticsearchSuite{})
+
+func (s *ToElasticsearchSuite) TestToElasticsearchBulk(c *C) {
+	log.Println("testing ToElasticsearch bulk indexing")
+	b, ch := test_utils.NewBlock("testingToElasticsearchBulk", "toelasticsearch")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	// a stand in for Elasticsearch's bulk API. It throttles "retry" the
+	// first time it sees it and rejects "bad" every time.
+	var lock sync.Mutex
+	indexed := make(map[string]string)
+	throttled := false
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if r.URL.Path != "/_bulk" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests++
+		var items []interface{}
+		errors := false
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			index := action["index"]["_index"].(string)
+			id := action["index"]["_id"].(string)
+			status := 201
+			var reason interface{}
+			switch {
+			case id == "retry" && !throttled:
+				throttled = true
+				status = 429
+			case id == "bad":
+				status = 400
+				reason = map[string]interface{}{"type": "mapper_parsing_exception"}
+			default:
+				indexed[id] = index
+			}
+			if status >= 300 {
+				errors = true
+			}
+			items = append(items, map[string]interface{}{
+				"index": map[string]interface{}{"_index": index, "_id": id, "status": status, "error": reason},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": errors, "items": items})
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	hostPort := strings.Split(u.Host, ":")
+
+	ruleMsg := map[string]interface{}{
+		"Host":          hostPort[0],
+		"Port":          hostPort[1],
+		"Index":         "",
+		"Type":          "event",
+		"IndexTemplate": `events-{{.kind}}-{{time "2006.01.02"}}`,
+		"IDPath":        ".id",
+		"BatchSize":     float64(3),
+		"FlushInterval": "200ms",
+		"Retries":       float64(2),
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+		for _, id := range []string{"a", "retry", "bad"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"id": id, "kind": "Click"}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	index := "events-click-" + time.Now().UTC().Format("2006.01.02")
+	failures := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(failures, Equals, 1)
+				lock.Lock()
+				c.Assert(indexed, DeepEquals, map[string]string{"a": index, "retry": index})
+				c.Assert(requests, Equals, 2)
+				lock.Unlock()
+				return
+			}
+		case messageI := <-queryOutChan:
+			if !reflect.DeepEqual(messageI, ruleMsg) {
+				log.Println("Rule mismatch:", messageI, ruleMsg)
+				c.Fail()
+			}
+		case messageI := <-outChan:
+			failures++
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["Event"], Equals, "IndexFailed")
+			c.Assert(message["ID"], Equals, "bad")
+			c.Assert(message["Index"], Equals, index)
+			c.Assert(message["Status"], Equals, float64(400))
+			c.Assert(message["Error"], Equals, `{"type":"mapper_parsing_exception"}`)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"log"
+	"time"
+
+	"github.com/nytlabs/streamtools/st/blocks"
+	"github.com/nytlabs/streamtools/st/loghub"
+	"github.com/nytlabs/streamtools/test_utils"
+	"labix.org/v2/mgo"
+	. "launchpad.net/gocheck"
+)
+
+// these tests need a mongod listening on localhost:27017
+
+type ToMongoDBSuite struct{}
+
+var toMongoDBSuite = Suite(&ToMongoDBSuite{})
+
+// mongoTestCollection empties and returns a collection for a test.
+func mongoTestCollection(c *C, name string) (*mgo.Session, *mgo.Collection) {
+	session, err := mgo.Dial("localhost:27017")
+	c.Assert(err, IsNil)
+	collection := session.DB("streamtools_test").C(name)
+	collection.DropCollection()
+	return session, collection
+}
+
+func (s *ToMongoDBSuite) TestToMongoDBUpsert(c *C) {
+	loghub.Start()
+	log.Println("testing toMongoDB: upsert")
+	session, collection := mongoTestCollection(c, "upsert")
+	defer session.Close()
+
+	b, ch := test_utils.NewBlock("testingToMongoDBUpsert", "tomongodb")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Host":       "localhost:27017",
+		"Database":   "streamtools_test",
+		"Collection": "upsert",
+		"BatchSize":  float64(1),
+		"Mode":       "upsert",
+		"KeyPath":    ".user",
+		"Update": map[string]interface{}{
+			"$inc": map[string]interface{}{"count": float64(1)},
+			"$set": map[string]interface{}{"name": ".name", "version": "..5"},
+		},
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		for _, name := range []string{"Jacqui", "Mike", "Mike", "Mike"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"user": name[:1], "name": name}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			var doc map[string]interface{}
+			c.Assert(collection.FindId("M").One(&doc), IsNil)
+			c.Assert(doc["count"], Equals, float64(3))
+			c.Assert(doc["name"], Equals, "Mike")
+			// a string starting with .. isn't a path
+			c.Assert(doc["version"], Equals, ".5")
+			n, err := collection.Count()
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, 2)
+			return
+		}
+	}
+}
+
+func (s *ToMongoDBSuite) TestToMongoDBFlushInterval(c *C) {
+	loghub.Start()
+	log.Println("testing toMongoDB: flushing a partial batch")
+	session, collection := mongoTestCollection(c, "flush")
+	defer session.Close()
+
+	b, ch := test_utils.NewBlock("testingToMongoDBFlush", "tomongodb")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{
+		"Host":          "localhost:27017",
+		"Database":      "streamtools_test",
+		"Collection":    "flush",
+		"BatchSize":     float64(100),
+		"FlushInterval": "1s",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(100)*time.Millisecond, func() {
+		for i := 0; i < 3; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": float64(i)}, Route: "in"}
+		}
+	})
+
+	// nothing is written until the batch fills or the interval passes
+	counts := make(chan int)
+	for _, at := range []int{500, 1500} {
+		time.AfterFunc(time.Duration(at)*time.Millisecond, func() {
+			n, err := collection.Count()
+			if err != nil {
+				c.Errorf(err.Error())
+			}
+			counts <- n
+		})
+	}
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var seen []int
+	for {
+		select {
+		case n := <-counts:
+			seen = append(seen, n)
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(seen, DeepEquals, []int{0, 3})
+			return
+		}
+	}
+}
+
+func (s *ToMongoDBSuite) TestToMongoDBWriteFailed(c *C) {
+	loghub.Start()
+	log.Println("testing toMongoDB: WriteFailed")
+	session, _ := mongoTestCollection(c, "failed")
+	defer session.Close()
+
+	b, ch := test_utils.NewBlock("testingToMongoDBFailed", "tomongodb")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	ruleMsg := map[string]interface{}{
+		"Host":       "localhost:27017",
+		"Database":   "streamtools_test",
+		"Collection": "failed",
+		"BatchSize":  float64(1),
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// the second insert has a duplicate _id
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"_id": "a", "n": float64(1)}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"_id": "a", "n": float64(2)}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	var failures []map[string]interface{}
+	for {
+		select {
+		case messageI := <-outChan:
+			failures = append(failures, messageI.Msg.(map[string]interface{}))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(len(failures), Equals, 1)
+			c.Assert(failures[0]["Event"], Equals, "WriteFailed")
+			c.Assert(failures[0]["Msg"], DeepEquals, map[string]interface{}{"_id": "a", "n": float64(2)})
+			c.Assert(failures[0]["Error"], Not(Equals), "")
+			return
+		}
+	}
+}
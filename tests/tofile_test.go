@@ -1,6 +1,8 @@
 package tests
 
 import (
+	"compress/gzip"
+	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
@@ -22,7 +24,22 @@ func (s *ToFileSuite) TestToFile(c *C) {
 	b, ch := test_utils.NewBlock("testingToFile", "tofile")
 	go blocks.BlockRoutine(b)
 
-	ruleMsg := map[string]interface{}{"Filename": "foobar.log"}
+	ruleMsg := map[string]interface{}{
+		"Filename":       "foobar.log",
+		"Format":         "ndjson",
+		"Columns":        []string{},
+		"Header":         false,
+		"Path":           "",
+		"Append":         false,
+		"Gzip":           false,
+		"Sync":           false,
+		"FlushInterval":  "0",
+		"Template":       false,
+		"RotateSize":     0.0,
+		"RotateInterval": "0",
+		"MaxFiles":       0.0,
+		"IdleTimeout":    "1m",
+	}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -59,3 +76,272 @@ func (s *ToFileSuite) TestToFile(c *C) {
 		}
 	}
 }
+
+func (s *ToFileSuite) TestToFileCSV(c *C) {
+	log.Println("testing toFile: gzipped csv")
+	b, ch := test_utils.NewBlock("testingToFileCSV", "tofile")
+	go blocks.BlockRoutine(b)
+
+	f, err := ioutil.TempFile("", "streamtools_test_to_file.csv.gz")
+	if err != nil {
+		c.Errorf(err.Error())
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ruleMsg := map[string]interface{}{
+		"Filename":      f.Name(),
+		"Format":        "csv",
+		"Columns":       []string{".name", ".visits", ".user.admin"},
+		"Header":        true,
+		"Gzip":          true,
+		"FlushInterval": "100ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "Mike Dewar", "visits": 3.0, "user": map[string]interface{}{"admin": true}}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"name": "Dewar, Mike", "visits": 1.5}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			// the block closes its file as it quits, which can finish after
+			// the block has reported quitting
+			time.Sleep(time.Duration(100) * time.Millisecond)
+			file, err := os.Open(f.Name())
+			c.Assert(err, IsNil)
+			defer file.Close()
+			gz, err := gzip.NewReader(file)
+			c.Assert(err, IsNil)
+			contents, err := ioutil.ReadAll(gz)
+			c.Assert(err, IsNil)
+			c.Assert(string(contents), Equals, ".name,.visits,.user.admin\nMike Dewar,3,true\n\"Dewar, Mike\",1.5,\n")
+			return
+		}
+	}
+}
+
+func (s *ToFileSuite) TestToFileRotate(c *C) {
+	log.Println("testing toFile: rotation")
+	b, ch := test_utils.NewBlock("testingToFileRotate", "tofile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	dir := "tofile_rotate"
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	defer os.RemoveAll(dir)
+
+	ruleMsg := map[string]interface{}{
+		"Filename":   dir + "/{{.source}}.ndjson",
+		"Template":   true,
+		"RotateSize": 40.0,
+		"MaxFiles":   2.0,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		// each message is 21 bytes, so every file holds two
+		for i := 0; i < 6; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "a", "i": float64(i)}, Route: "in"}
+		}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "b", "i": 0.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var closedFiles []string
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["Event"], Equals, "FileClosed")
+			c.Assert(message["Messages"], Equals, 2.0)
+			c.Assert(message["Bytes"], Equals, 42.0)
+			closedFiles = append(closedFiles, message["Filename"].(string))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(closedFiles, DeepEquals, []string{
+				dir + "/a.ndjson",
+				dir + "/a.1.ndjson",
+				dir + "/a.2.ndjson",
+			})
+			// only the last two closed files are kept
+			_, err = os.Stat(dir + "/a.ndjson")
+			c.Assert(os.IsNotExist(err), Equals, true)
+			for _, name := range []string{"a.1.ndjson", "a.2.ndjson", "b.ndjson"} {
+				_, err = os.Stat(dir + "/" + name)
+				c.Assert(err, IsNil)
+			}
+			return
+		}
+	}
+}
+
+func (s *ToFileSuite) TestToFileTemplate(c *C) {
+	log.Println("testing toFile: templates")
+	b, ch := test_utils.NewBlock("testingToFileTemplate", "tofile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	// text outside of {{ }} is left alone, even where it looks like part of
+	// a time layout
+	dir := "tofile_template-v2"
+	c.Assert(os.MkdirAll(dir, 0755), IsNil)
+	defer os.RemoveAll(dir)
+
+	ruleMsg := map[string]interface{}{
+		"Filename":    dir + `/{{.source}}-{{time "2006"}}.ndjson`,
+		"Template":    true,
+		"IdleTimeout": "500ms",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	year := time.Now().Format("2006")
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "a"}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "b"}, Route: "in"}
+	})
+	// a keeps being written to, so only b is idle long enough to be closed
+	for _, d := range []int{1300, 1600, 1900} {
+		time.AfterFunc(time.Duration(d)*time.Millisecond, func() {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "a"}, Route: "in"}
+		})
+	}
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var closedFiles []string
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["Event"], Equals, "FileClosed")
+			c.Assert(message["Messages"], Equals, 1.0)
+			closedFiles = append(closedFiles, message["Filename"].(string))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(closedFiles, DeepEquals, []string{dir + "/b-" + year + ".ndjson"})
+			for _, name := range []string{"a-" + year + ".ndjson", "b-" + year + ".ndjson"} {
+				_, err = os.Stat(dir + "/" + name)
+				c.Assert(err, IsNil)
+			}
+			return
+		}
+	}
+}
+
+func (s *ToFileSuite) TestToFileTemplateDirectories(c *C) {
+	log.Println("testing toFile: templated directories")
+	b, ch := test_utils.NewBlock("testingToFileTemplateDirectories", "tofile")
+	go blocks.BlockRoutine(b)
+
+	// the block makes the directories it needs, this one included
+	dir := "tofile_directories"
+	defer os.RemoveAll(dir)
+
+	ruleMsg := map[string]interface{}{
+		"Filename": dir + "/{{.source}}/{{.name}}.ndjson",
+		"Template": true,
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "a", "name": "b"}, Route: "in"}
+		// values can't climb out of the directory they're put in
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "..", "name": "c"}, Route: "in"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"source": "a", "name": "."}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			for _, name := range []string{"a/b.ndjson", "__/c.ndjson", "a/_.ndjson"} {
+				_, err = os.Stat(dir + "/" + name)
+				c.Assert(err, IsNil)
+			}
+			_, err = os.Stat("c.ndjson")
+			c.Assert(os.IsNotExist(err), Equals, true)
+			return
+		}
+	}
+}
+
+func (s *ToFileSuite) TestToFileRuleChange(c *C) {
+	log.Println("testing toFile: changing the rule")
+	b, ch := test_utils.NewBlock("testingToFileRuleChange", "tofile")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{Route: "out", Channel: outChan}
+
+	dir := "tofile_rule_change"
+	defer os.RemoveAll(dir)
+
+	ruleMsg := map[string]interface{}{
+		"Filename": dir + "/out.ndjson",
+	}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": 1.0}, Route: "in"}
+		// the file closed here isn't overwritten by the one opened for the
+		// new rule
+		ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"i": 2.0}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+
+	var closedFiles []string
+	for {
+		select {
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			closedFiles = append(closedFiles, message["Filename"].(string))
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(closedFiles, DeepEquals, []string{dir + "/out.ndjson"})
+			first, err := ioutil.ReadFile(dir + "/out.ndjson")
+			c.Assert(err, IsNil)
+			c.Assert(string(first), Equals, "{\"i\":1}\n")
+			second, err := ioutil.ReadFile(dir + "/out.1.ndjson")
+			c.Assert(err, IsNil)
+			c.Assert(string(second), Equals, "{\"i\":2}\n")
+			return
+		}
+	}
+}
@@ -45,7 +45,7 @@ func (s *WebRequestSuite) TestWebRequestPost(c *C) {
 	defer ts.Close()
 
 	headers := map[string]interface{}{"Content-Type": "application/json"}
-	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "POST", "Headers": headers}
+	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "POST", "Headers": headers, "Timeout": "0s", "Retries": float64(0), "RetryBackoff": "1s", "RetryStatuses": []interface{}{float64(429), float64(502), float64(503), float64(504)}, "BreakerThreshold": float64(0), "BreakerCooldown": "30s", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -112,7 +112,7 @@ func (s *WebRequestSuite) TestWebRequestGet(c *C) {
 	defer ts.Close()
 
 	headers := map[string]interface{}{"Content-Type": "application/json"}
-	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "Headers": headers}
+	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "Headers": headers, "Timeout": "0s", "Retries": float64(0), "RetryBackoff": "1s", "RetryStatuses": []interface{}{float64(429), float64(502), float64(503), float64(504)}, "BreakerThreshold": float64(0), "BreakerCooldown": "30s", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -180,7 +180,7 @@ func (s *WebRequestSuite) TestWebRequestGetXML(c *C) {
 	defer ts.Close()
 
 	headers := map[string]interface{}{"Content-Type": "application/xml"}
-	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "Headers": headers}
+	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "Headers": headers, "Timeout": "0s", "Retries": float64(0), "RetryBackoff": "1s", "RetryStatuses": []interface{}{float64(429), float64(502), float64(503), float64(504)}, "BreakerThreshold": float64(0), "BreakerCooldown": "30s", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -247,7 +247,7 @@ func (s *WebRequestSuite) TestWebRequestGetUrlPath(c *C) {
 	defer ts.Close()
 
 	headers := map[string]interface{}{"Content-Type": "application/json"}
-	ruleMsg := map[string]interface{}{"Url": "", "UrlPath": ".url", "BodyPath": ".", "Method": "GET", "Headers": headers}
+	ruleMsg := map[string]interface{}{"Url": "", "UrlPath": ".url", "BodyPath": ".", "Method": "GET", "Headers": headers, "Timeout": "0s", "Retries": float64(0), "RetryBackoff": "1s", "RetryStatuses": []interface{}{float64(429), float64(502), float64(503), float64(504)}, "BreakerThreshold": float64(0), "BreakerCooldown": "30s", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -315,7 +315,7 @@ func (s *WebRequestSuite) TestWebRequestPostUrlPath(c *C) {
 	defer ts.Close()
 
 	headers := map[string]interface{}{"Content-Type": "application/json"}
-	ruleMsg := map[string]interface{}{"Url": "", "UrlPath": ".url", "BodyPath": ".foo", "Method": "POST", "Headers": headers}
+	ruleMsg := map[string]interface{}{"Url": "", "UrlPath": ".url", "BodyPath": ".foo", "Method": "POST", "Headers": headers, "Timeout": "0s", "Retries": float64(0), "RetryBackoff": "1s", "RetryStatuses": []interface{}{float64(429), float64(502), float64(503), float64(504)}, "BreakerThreshold": float64(0), "BreakerCooldown": "30s", "Concurrency": float64(1), "MaxQueued": float64(100), "Ordered": true}
 	toRule := &blocks.Msg{Msg: ruleMsg, Route: "rule"}
 	ch.InChan <- toRule
 
@@ -356,3 +356,206 @@ func (s *WebRequestSuite) TestWebRequestPostUrlPath(c *C) {
 		}
 	}
 }
+
+func (s *WebRequestSuite) TestWebRequestRetry(c *C) {
+	log.Println("testing WebRequest: retries")
+	b, ch := test_utils.NewBlock("testingWebRequestRetry", "webRequest")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"Status": "OK"}`)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "Timeout": "5s", "Retries": float64(2), "RetryBackoff": "10ms"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "in"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	responses := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				c.Assert(responses, Equals, 1)
+				return
+			}
+		case messageI := <-outChan:
+			responses++
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["statusCode"], Equals, float64(200))
+			c.Assert(message["attempts"], Equals, float64(3))
+			c.Assert(message["latency"].(float64) >= 30, Equals, true)
+		}
+	}
+}
+
+func (s *WebRequestSuite) TestWebRequestCircuitBreaker(c *C) {
+	log.Println("testing WebRequest: circuit breaker")
+	b, ch := test_utils.NewBlock("testingWebRequestCircuitBreaker", "webRequest")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"Url": ts.URL, "UrlPath": "", "BodyPath": ".", "Method": "GET", "BreakerThreshold": float64(2), "BreakerCooldown": "1h"}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for i := 0; i < 4; i++ {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{}, Route: "in"}
+		}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	responses := 0
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				// once open, the breaker stops the last two requests
+				c.Assert(responses, Equals, 2)
+				c.Assert(requests, Equals, 2)
+				return
+			}
+		case messageI := <-outChan:
+			responses++
+			message := messageI.Msg.(map[string]interface{})
+			c.Assert(message["statusCode"], Equals, float64(500))
+		}
+	}
+}
+
+func (s *WebRequestSuite) TestWebRequestConcurrency(c *C) {
+	log.Println("testing WebRequest: concurrency")
+	b, ch := test_utils.NewBlock("testingWebRequestConcurrency", "webRequest")
+	go blocks.BlockRoutine(b)
+	outChan := make(chan *blocks.Msg)
+	ch.AddChan <- &blocks.AddChanMsg{
+		Route:   "out",
+		Channel: outChan,
+	}
+
+	// each request takes as long as it asks for
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d, _ := time.ParseDuration(r.URL.Query().Get("d"))
+		time.Sleep(d)
+		fmt.Fprintf(w, `{"d": "%s"}`, d)
+	}))
+	defer ts.Close()
+
+	ruleMsg := map[string]interface{}{"Url": "", "UrlPath": ".url", "BodyPath": ".", "Method": "GET", "Concurrency": float64(3), "Ordered": true}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		for _, d := range []string{"600ms", "200ms", "400ms", "100ms"} {
+			ch.InChan <- &blocks.Msg{Msg: map[string]interface{}{"url": ts.URL + "/?d=" + d}, Route: "in"}
+		}
+	})
+
+	statusChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1100)*time.Millisecond, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: statusChan, Route: "status"}
+	})
+
+	time.AfterFunc(time.Duration(2)*time.Second, func() {
+		ch.QuitChan <- true
+	})
+	var order []interface{}
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+			} else {
+				// the four requests take 1.3s one after another, but finish
+				// well within a second three at a time, in the order they came in
+				c.Assert(order, DeepEquals, []interface{}{"600ms", "200ms", "400ms", "100ms"})
+				return
+			}
+		case messageI := <-statusChan:
+			status := messageI.(map[string]interface{})
+			c.Assert(status["InFlight"], Equals, float64(3))
+			c.Assert(status["Queued"], Equals, float64(1))
+			c.Assert(status["Breaker"], Equals, "closed")
+		case messageI := <-outChan:
+			message := messageI.Msg.(map[string]interface{})
+			order = append(order, message["body"].(map[string]interface{})["d"])
+		}
+	}
+}
+
+func (s *WebRequestSuite) TestWebRequestBadRule(c *C) {
+	log.Println("testing WebRequest: a bad rule changes nothing")
+	b, ch := test_utils.NewBlock("testingWebRequestBadRule", "webRequest")
+	go blocks.BlockRoutine(b)
+
+	ruleMsg := map[string]interface{}{"Url": "http://example.com/", "UrlPath": "", "BodyPath": ".", "Method": "GET", "Timeout": "5s", "Concurrency": float64(2)}
+	ch.InChan <- &blocks.Msg{Msg: ruleMsg, Route: "rule"}
+
+	// everything is fine but the concurrency
+	badRuleMsg := map[string]interface{}{"Url": "http://example.org/", "UrlPath": "", "BodyPath": ".", "Method": "POST", "Timeout": "1s", "Concurrency": float64(0)}
+	time.AfterFunc(time.Duration(500)*time.Millisecond, func() {
+		ch.InChan <- &blocks.Msg{Msg: badRuleMsg, Route: "rule"}
+	})
+
+	queryOutChan := make(blocks.MsgChan)
+	time.AfterFunc(time.Duration(1)*time.Second, func() {
+		ch.QueryChan <- &blocks.QueryMsg{MsgChan: queryOutChan, Route: "rule"}
+	})
+
+	time.AfterFunc(time.Duration(1500)*time.Millisecond, func() {
+		ch.QuitChan <- true
+	})
+
+	queried := false
+	for {
+		select {
+		case err := <-ch.ErrChan:
+			if err != nil {
+				c.Errorf(err.Error())
+				continue
+			}
+			c.Assert(queried, Equals, true)
+			return
+		case messageI := <-queryOutChan:
+			queried = true
+			rule := messageI.(map[string]interface{})
+			c.Assert(rule["Url"], Equals, "http://example.com/")
+			c.Assert(rule["Method"], Equals, "GET")
+			c.Assert(rule["Timeout"], Equals, "5s")
+			c.Assert(rule["Concurrency"], Equals, float64(2))
+		}
+	}
+}